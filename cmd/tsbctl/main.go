@@ -0,0 +1,256 @@
+// tsbctl rolls template upgrades out to the instances of a template service broker through its admin API, e.g.
+//
+//	tsbctl --url http://template-service-broker:8081 plan --template redis
+//	tsbctl start --template redis --batch-size 3
+//	tsbctl status template-service-broker-rollout-x7k2p
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/apis"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
+)
+
+const usage = `Usage: tsbctl [flags] COMMAND [ARGS]
+
+Commands:
+  outdated  [--template T] [--namespace N]                  list the instances behind the revision of their template
+  plan      --template T [--namespace N] [--batch-size B]   show the upgrades a rollout would make, without starting it
+  start     --template T [--namespace N] [--batch-size B]   start a rollout of the outdated instances of a template
+  list      [--template T]                                  list the rollouts, newest first
+  status    ROLLOUT                                         show a rollout and its instances
+  pause     ROLLOUT                                         stop a rollout from starting further batches
+  resume    ROLLOUT                                         continue a paused rollout
+  rollback  ROLLOUT                                         roll the instances a rollout upgraded back
+
+Flags:
+`
+
+// adminClient calls the admin API of the broker
+type adminClient struct {
+	url      string
+	username string
+	password string
+	client   *http.Client
+}
+
+func main() {
+	fs := flag.NewFlagSet("tsbctl", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	c := &adminClient{client: &http.Client{Timeout: time.Minute}}
+	fs.StringVar(&c.url, "url", envOr("TSB_URL", "http://localhost:8081"), "URL of the broker, also set by TSB_URL")
+	fs.StringVar(&c.username, "username", os.Getenv("TSB_USERNAME"), "basic auth username of the broker, also set by TSB_USERNAME")
+	fs.StringVar(&c.password, "password", os.Getenv("TSB_PASSWORD"), "basic auth password of the broker, also set by TSB_PASSWORD")
+	output := fs.String("output", "table", "output format: table or json")
+	fs.Parse(os.Args[1:])
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := run(c, fs.Arg(0), fs.Args()[1:], *output); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(c *adminClient, command string, args []string, output string) error {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	template := fs.String("template", "", "name of the template or cluster template")
+	namespace := fs.String("namespace", "", "namespace of the instances, all served namespaces if empty")
+	batchSize := fs.Int("batch-size", 0, "instances upgraded at once, rollout.batchSize of the broker if 0")
+	fs.Parse(args)
+
+	rolloutPath := func() (string, error) {
+		if fs.NArg() != 1 {
+			return "", fmt.Errorf("%s takes the id of a rollout", command)
+		}
+		return "/admin/rollouts/" + url.PathEscape(fs.Arg(0)), nil
+	}
+	request := apis.RolloutRequest{Template: *template, Namespace: *namespace, BatchSize: *batchSize}
+
+	switch command {
+	case "outdated":
+		report := &apis.OutdatedReport{}
+		query := url.Values{"template": {*template}, "namespace": {*namespace}}
+		if err := c.do("GET", "/admin/instances/outdated?"+query.Encode(), nil, report); err != nil {
+			return err
+		}
+		return printOutput(output, report, func(w io.Writer) {
+			fmt.Fprintln(w, "NAMESPACE\tNAME\tINSTANCE\tTEMPLATE\tPLAN\tREVISION\tCURRENT")
+			for _, i := range report.Outdated {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", i.Namespace, i.Name, i.InstanceId, i.Template, i.Plan,
+					orNone(i.Revision.Revision), i.CurrentRevision.Revision)
+			}
+		})
+
+	case "plan":
+		request.DryRun = true
+		plan := &apis.RolloutPlan{}
+		if err := c.do("POST", "/admin/rollouts", request, plan); err != nil {
+			return err
+		}
+		return printOutput(output, plan, func(w io.Writer) {
+			fmt.Fprintf(w, "%d instances of template %s in %d batches of %d\n\n", len(plan.Instances), plan.Template, plan.Batches, plan.BatchSize)
+			for _, i := range plan.Instances {
+				fmt.Fprintf(w, "%s/%s\t%s -> %s\n", i.Namespace, i.Name, orNone(i.Revision.Revision), i.CurrentRevision.Revision)
+				if len(i.Error) != 0 {
+					fmt.Fprintf(w, "\twould fail: %s\n", i.Error)
+				}
+				for _, change := range i.Changes {
+					fmt.Fprintf(w, "\t%s %s\t%s\n", change.Change, change.Name, changeValues(change))
+				}
+				for _, change := range i.TemplateChanges {
+					fmt.Fprintf(w, "\t%s %s/%s\n", change.Change, change.Kind, change.Name)
+				}
+			}
+		})
+
+	case "start":
+		rollout := &internal.Rollout{}
+		if err := c.do("POST", "/admin/rollouts", request, rollout); err != nil {
+			return err
+		}
+		return printRollout(output, rollout)
+
+	case "list":
+		var rollouts []internal.Rollout
+		query := url.Values{"template": {*template}}
+		if err := c.do("GET", "/admin/rollouts?"+query.Encode(), nil, &rollouts); err != nil {
+			return err
+		}
+		return printOutput(output, rollouts, func(w io.Writer) {
+			fmt.Fprintln(w, "ID\tTEMPLATE\tNAMESPACE\tSTATE\tUPGRADED\tINSTANCES\tCREATED")
+			for _, r := range rollouts {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n", r.Id, r.Template, orNone(r.Namespace), r.State,
+					r.Count(internal.RolloutInstanceUpgraded), len(r.Instances), r.Created.UTC().Format(time.RFC3339))
+			}
+		})
+
+	case "status", "pause", "resume", "rollback":
+		path, err := rolloutPath()
+		if err != nil {
+			return err
+		}
+		method := "GET"
+		if command != "status" {
+			method, path = "POST", path+"/"+command
+		}
+		rollout := &internal.Rollout{}
+		if err := c.do(method, path, nil, rollout); err != nil {
+			return err
+		}
+		return printRollout(output, rollout)
+	}
+	return fmt.Errorf("unknown command %q, see tsbctl --help", command)
+}
+
+// do sends the request and decodes the response into out. Error responses are returned as errors.
+func (c *adminClient) do(method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.url, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(c.username) != 0 {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		e := &schemas.Error{}
+		if err := json.Unmarshal(data, e); err != nil || len(e.Error) == 0 {
+			return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return fmt.Errorf("%s: %s", e.Error, e.Description)
+	}
+	return json.Unmarshal(data, out)
+}
+
+func printRollout(output string, rollout *internal.Rollout) error {
+	return printOutput(output, rollout, func(w io.Writer) {
+		fmt.Fprintf(w, "Rollout:\t%s\nTemplate:\t%s\n", rollout.Id, rollout.Template)
+		if len(rollout.Namespace) != 0 {
+			fmt.Fprintf(w, "Namespace:\t%s\n", rollout.Namespace)
+		}
+		fmt.Fprintf(w, "State:\t%s\n", rollout.State)
+		if len(rollout.Message) != 0 {
+			fmt.Fprintf(w, "Message:\t%s\n", rollout.Message)
+		}
+		fmt.Fprintf(w, "Batch size:\t%d\n\n", rollout.BatchSize)
+
+		fmt.Fprintln(w, "NAMESPACE\tNAME\tINSTANCE\tFROM\tTO\tSTATE\tMESSAGE")
+		for _, i := range rollout.Instances {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", i.Namespace, i.Name, i.InstanceId, orNone(i.From.Revision),
+				i.To.Revision, i.State, i.Message)
+		}
+	})
+}
+
+// printOutput writes v as JSON, or as the table written by table
+func printOutput(output string, v interface{}, table func(w io.Writer)) error {
+	if output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	table(w)
+	return w.Flush()
+}
+
+func changeValues(change apis.ParameterChange) string {
+	switch change.Change {
+	case "added":
+		return change.To
+	case "removed":
+		return change.From
+	}
+	return change.From + " -> " + change.To
+}
+
+func orNone(s string) string {
+	if len(s) == 0 {
+		return "<none>"
+	}
+	return s
+}
+
+func envOr(key string, def string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+	return def
+}
@@ -1,14 +1,22 @@
 module github.com/tmax-cloud/template-service-broker-go
 
-go 1.13
+go 1.15
 
 require (
 	github.com/go-logr/logr v0.1.0
 	github.com/gorilla/mux v1.8.0
 	github.com/kubernetes-sigs/service-catalog v0.3.1
+	github.com/prometheus/client_golang v1.0.0
 	github.com/tmax-cloud/template-operator v0.0.0-20211117102250-3e3c24f39d47
+	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.25.0
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
 	k8s.io/api v0.18.6
 	k8s.io/apimachinery v0.18.6
 	k8s.io/client-go v0.18.6
 	sigs.k8s.io/controller-runtime v0.6.2
+	sigs.k8s.io/yaml v1.2.0
 )
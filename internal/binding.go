@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// BindingAnnotation holds the binding configuration of a (cluster)template as JSON, e.g.
+	// {"bindable": true, "parameters": [...], "plans": {"small": {"bindable": false}}}
+	BindingAnnotation = "tsb.tmax.io/binding"
+	// BindAnnotation set to "false" on a template object excludes it from binding credentials
+	BindAnnotation = "tsb.tmax.io/bind"
+	// BindIfAnnotation on a template object limits it to bindings whose parameters match, e.g. "role=read-write"
+	BindIfAnnotation = "tsb.tmax.io/bind-if"
+)
+
+type BindingConfig struct {
+	Bindable    *bool                        `json:"bindable,omitempty"`
+	RequiresApp bool                         `json:"requiresApp,omitempty"` // reject bindings without bind_resource.app_guid
+	Parameters  []BindingParamSpec           `json:"parameters,omitempty"`
+	Plans       map[string]PlanBindingConfig `json:"plans,omitempty"`
+}
+
+type PlanBindingConfig struct {
+	Bindable   *bool              `json:"bindable,omitempty"`
+	Parameters []BindingParamSpec `json:"parameters,omitempty"`
+}
+
+type BindingParamSpec struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Required    bool     `json:"required,omitempty"`
+	Default     string   `json:"default,omitempty"`
+	Enum        []string `json:"enum,omitempty"`
+}
+
+func ParseBindingConfig(annotations map[string]string) (*BindingConfig, error) {
+	config := &BindingConfig{}
+	raw, ok := annotations[BindingAnnotation]
+	if !ok || len(strings.TrimSpace(raw)) == 0 {
+		return config, nil
+	}
+	if err := json.Unmarshal([]byte(raw), config); err != nil {
+		return nil, fmt.Errorf("annotation %s is not valid: %s", BindingAnnotation, err.Error())
+	}
+	return config, nil
+}
+
+// PlanBindable returns the explicit bindability of a plan, or nil if the plan inherits it from the service
+func (b *BindingConfig) PlanBindable(planName string) *bool {
+	if plan, ok := b.Plans[planName]; ok {
+		return plan.Bindable
+	}
+	return nil
+}
+
+// PlanParameters returns the binding parameters of a plan. Plan-level specs override service-level specs of the same name.
+func (b *BindingConfig) PlanParameters(planName string) []BindingParamSpec {
+	specs := make(map[string]BindingParamSpec)
+	for _, spec := range b.Parameters {
+		specs[spec.Name] = spec
+	}
+	if plan, ok := b.Plans[planName]; ok {
+		for _, spec := range plan.Parameters {
+			specs[spec.Name] = spec
+		}
+	}
+
+	var names []string
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parameters []BindingParamSpec
+	for _, name := range names {
+		parameters = append(parameters, specs[name])
+	}
+	return parameters
+}
+
+// ValidateBindingParameters checks the given binding parameters against the specs and fills in defaults
+func ValidateBindingParameters(specs []BindingParamSpec, given map[string]string) (map[string]string, error) {
+	parameters := make(map[string]string)
+	known := make(map[string]bool)
+	for _, spec := range specs {
+		known[spec.Name] = true
+		val, ok := given[spec.Name]
+		if !ok || len(val) == 0 {
+			if spec.Required {
+				return nil, parameterErrorf(spec.Name, "binding parameter %s must be included", spec.Name)
+			}
+			if len(spec.Default) == 0 {
+				continue
+			}
+			val = spec.Default
+		}
+		if len(spec.Enum) != 0 && !containsString(spec.Enum, val) {
+			return nil, parameterErrorf(spec.Name, "binding parameter %s must be one of %s, got %q", spec.Name, strings.Join(spec.Enum, ", "), val)
+		}
+		parameters[spec.Name] = val
+	}
+
+	for name := range given {
+		if !known[name] {
+			return nil, parameterErrorf(name, "binding parameter %s is not supported by the plan", name)
+		}
+	}
+	return parameters, nil
+}
+
+// MatchBindCondition evaluates a bind-if condition such as "role=read-write,tls=true" against binding parameters
+func MatchBindCondition(condition string, parameters map[string]string) bool {
+	for _, term := range strings.Split(condition, ",") {
+		term = strings.TrimSpace(term)
+		if len(term) == 0 {
+			continue
+		}
+		kv := strings.SplitN(term, "=", 2)
+		if len(kv) != 2 || parameters[strings.TrimSpace(kv[0])] != strings.TrimSpace(kv[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBindingConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		annotation string
+		bindable   *bool
+		parameters int
+		err        bool
+	}{
+		{name: "none"},
+		{name: "bindable", annotation: `{"bindable": true}`, bindable: boolPtr(true)},
+		{name: "parameters", annotation: `{"parameters": [{"name": "role"}, {"name": "tls"}]}`, parameters: 2},
+		{name: "invalid", annotation: `{"bindable": "yes"}`, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			annotations := map[string]string{}
+			if len(test.annotation) != 0 {
+				annotations[BindingAnnotation] = test.annotation
+			}
+			config, err := ParseBindingConfig(annotations)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(config.Bindable, test.bindable) {
+				t.Errorf("bindable %v, want %v", config.Bindable, test.bindable)
+			}
+			if len(config.Parameters) != test.parameters {
+				t.Errorf("%d parameters, want %d", len(config.Parameters), test.parameters)
+			}
+		})
+	}
+}
+
+func TestPlanBindingConfig(t *testing.T) {
+	config := &BindingConfig{
+		Parameters: []BindingParamSpec{{Name: "role", Default: "read-only"}, {Name: "tls"}},
+		Plans: map[string]PlanBindingConfig{
+			"small": {Bindable: boolPtr(false)},
+			"large": {Parameters: []BindingParamSpec{{Name: "role", Default: "read-write"}, {Name: "replica"}}},
+		},
+	}
+
+	tests := []struct {
+		plan       string
+		bindable   *bool
+		parameters []BindingParamSpec
+	}{
+		{
+			plan:       "small",
+			bindable:   boolPtr(false),
+			parameters: []BindingParamSpec{{Name: "role", Default: "read-only"}, {Name: "tls"}},
+		},
+		{
+			plan:       "large",
+			parameters: []BindingParamSpec{{Name: "replica"}, {Name: "role", Default: "read-write"}, {Name: "tls"}},
+		},
+		{
+			plan:       "unknown",
+			parameters: []BindingParamSpec{{Name: "role", Default: "read-only"}, {Name: "tls"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.plan, func(t *testing.T) {
+			if bindable := config.PlanBindable(test.plan); !reflect.DeepEqual(bindable, test.bindable) {
+				t.Errorf("bindable %v, want %v", bindable, test.bindable)
+			}
+			if parameters := config.PlanParameters(test.plan); !reflect.DeepEqual(parameters, test.parameters) {
+				t.Errorf("parameters %+v, want %+v", parameters, test.parameters)
+			}
+		})
+	}
+}
+
+func TestValidateBindingParameters(t *testing.T) {
+	specs := []BindingParamSpec{
+		{Name: "role", Default: "read-only", Enum: []string{"read-only", "read-write"}},
+		{Name: "user", Required: true},
+		{Name: "tls"},
+	}
+	tests := []struct {
+		name  string
+		given map[string]string
+		want  map[string]string
+		err   bool
+	}{
+		{
+			name:  "defaults",
+			given: map[string]string{"user": "app"},
+			want:  map[string]string{"user": "app", "role": "read-only"},
+		},
+		{
+			name:  "given",
+			given: map[string]string{"user": "app", "role": "read-write", "tls": "true"},
+			want:  map[string]string{"user": "app", "role": "read-write", "tls": "true"},
+		},
+		{name: "missing required", given: map[string]string{"role": "read-write"}, err: true},
+		{name: "empty required", given: map[string]string{"user": ""}, err: true},
+		{name: "not in enum", given: map[string]string{"user": "app", "role": "admin"}, err: true},
+		{name: "unknown", given: map[string]string{"user": "app", "port": "5432"}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parameters, err := ValidateBindingParameters(specs, test.given)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", parameters)
+				}
+				if _, ok := err.(*ParameterError); !ok {
+					t.Errorf("expected a parameter error, got %T", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !reflect.DeepEqual(parameters, test.want) {
+				t.Errorf("got %v, want %v", parameters, test.want)
+			}
+		})
+	}
+}
+
+func TestMatchBindCondition(t *testing.T) {
+	parameters := map[string]string{"role": "read-write", "tls": "true"}
+	tests := []struct {
+		condition string
+		want      bool
+	}{
+		{condition: "", want: true},
+		{condition: "role=read-write", want: true},
+		{condition: " role = read-write , tls=true ", want: true},
+		{condition: "role=read-only", want: false},
+		{condition: "role=read-write,replica=1", want: false},
+		{condition: "role", want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.condition, func(t *testing.T) {
+			if got := MatchBindCondition(test.condition, parameters); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
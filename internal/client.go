@@ -5,6 +5,7 @@ import (
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 )
@@ -20,7 +21,16 @@ func Client(options client.Options) (client.Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return c, nil
+	return TracedClient(c), nil
+}
+
+// Clientset returns a typed clientset for the APIs the controller-runtime client does not cover, e.g. events and leases
+func Clientset() (kubernetes.Interface, error) {
+	cfg, err := config.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(cfg)
 }
 
 func AddKnownTypes(scheme *runtime.Scheme) error {
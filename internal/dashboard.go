@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DashboardAnnotation declares the dashboard URL of the instances of a (cluster)template. ${PARAM} is replaced by the value
+// of a parameter and ${ingress:NAME} by the host of an Ingress of the instance, e.g.
+// tsb.tmax.io/dashboard-url: "https://${ingress:${APP_NAME}-ingress}/jenkins"
+const DashboardAnnotation = "tsb.tmax.io/dashboard-url"
+
+var (
+	dashboardParameter = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_.-]*)\}`)
+	dashboardIngress   = regexp.MustCompile(`\$\{ingress:([a-z0-9.-]+)\}`)
+)
+
+// DashboardURL resolves the dashboard URL declared for the template instance. It is empty if none is declared or an Ingress
+// it refers to has no host yet, as is usual right after provisioning.
+func DashboardURL(ctx context.Context, c client.Client, templateInstance *tmaxv1.TemplateInstance) (string, error) {
+	pattern := templateInstance.Annotations[DashboardAnnotation]
+	if len(pattern) == 0 {
+		return "", nil
+	}
+
+	// sensitive values must not end up in a URL the platform shows to everyone who can see the instance
+	redactor := InstanceRedactor(templateInstance, templateInstance)
+	generated := generatedParameterNames(templateInstance)
+	values := InstanceParameters(templateInstance)
+	for _, match := range dashboardParameter.FindAllStringSubmatch(pattern, -1) {
+		name := match[1]
+		if redactor.IsSensitive(name) || generated[name] {
+			return "", fmt.Errorf("dashboard url of templateinstance %s refers to sensitive parameter %s", templateInstance.Name, name)
+		}
+		if _, ok := values[name]; !ok {
+			return "", fmt.Errorf("dashboard url of templateinstance %s refers to unknown parameter %s", templateInstance.Name, name)
+		}
+	}
+	resolved := dashboardParameter.ReplaceAllStringFunc(pattern, func(ref string) string {
+		return values[dashboardParameter.FindStringSubmatch(ref)[1]]
+	})
+
+	for _, match := range dashboardIngress.FindAllStringSubmatch(resolved, -1) {
+		host, err := ingressHost(ctx, c, types.NamespacedName{Namespace: templateInstance.Namespace, Name: match[1]})
+		if err != nil || len(host) == 0 {
+			return "", err
+		}
+		resolved = strings.Replace(resolved, match[0], host, 1)
+	}
+
+	dashboard, err := url.Parse(resolved)
+	if err != nil || (dashboard.Scheme != "http" && dashboard.Scheme != "https") || len(dashboard.Host) == 0 {
+		return "", fmt.Errorf("dashboard url of templateinstance %s is not an absolute http(s) url: %q", templateInstance.Name, resolved)
+	}
+	return dashboard.String(), nil
+}
+
+// ingressHost returns the host of the first rule of the Ingress, or its load balancer address if the rule has none.
+// A missing Ingress has no host yet.
+func ingressHost(ctx context.Context, c client.Client, name types.NamespacedName) (string, error) {
+	ingress := &networkingv1beta1.Ingress{}
+	if err := c.Get(ctx, name, ingress); err != nil {
+		if kerrors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	for _, rule := range ingress.Spec.Rules {
+		if len(rule.Host) != 0 {
+			return rule.Host, nil
+		}
+	}
+	for _, lb := range ingress.Status.LoadBalancer.Ingress {
+		if len(lb.Hostname) != 0 {
+			return lb.Hostname, nil
+		}
+		if len(lb.IP) != 0 {
+			return lb.IP, nil
+		}
+	}
+	return "", nil
+}
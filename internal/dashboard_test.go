@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestDashboardURL(t *testing.T) {
+	ingress := func(name string, host string, lb corev1.LoadBalancerIngress) *networkingv1beta1.Ingress {
+		ingress := &networkingv1beta1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name}}
+		ingress.Spec.Rules = []networkingv1beta1.IngressRule{{Host: host}}
+		ingress.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{lb}
+		return ingress
+	}
+	c := newFakeClient(t,
+		ingress("jenkins-ingress", "jenkins.example.com", corev1.LoadBalancerIngress{}),
+		ingress("lb-hostname", "", corev1.LoadBalancerIngress{Hostname: "lb.example.com"}),
+		ingress("lb-ip", "", corev1.LoadBalancerIngress{IP: "10.0.0.1"}),
+		ingress("pending", "", corev1.LoadBalancerIngress{}),
+	)
+
+	tests := []struct {
+		name    string
+		pattern string
+		want    string
+		err     bool
+	}{
+		{name: "none"},
+		{name: "static", pattern: "https://console.example.com/db", want: "https://console.example.com/db"},
+		{name: "parameter", pattern: "https://${APP_NAME}.example.com/", want: "https://jenkins.example.com/"},
+		{name: "ingress", pattern: "https://${ingress:jenkins-ingress}/jenkins", want: "https://jenkins.example.com/jenkins"},
+		{name: "ingress named by a parameter", pattern: "https://${ingress:${APP_NAME}-ingress}/", want: "https://jenkins.example.com/"},
+		{name: "load balancer hostname", pattern: "http://${ingress:lb-hostname}", want: "http://lb.example.com"},
+		{name: "load balancer ip", pattern: "http://${ingress:lb-ip}:8080", want: "http://10.0.0.1:8080"},
+		{name: "ingress without host yet", pattern: "https://${ingress:pending}/"},
+		{name: "missing ingress", pattern: "https://${ingress:missing}/"},
+		{name: "declared sensitive parameter", pattern: "https://example.com/?license=${LICENSE}", err: true},
+		{name: "sensitive parameter by name", pattern: "https://example.com/?p=${ADMIN_PASSWORD}", err: true},
+		{name: "generated parameter", pattern: "https://${SUFFIX}.example.com", err: true},
+		{name: "unknown parameter", pattern: "https://${UNKNOWN}.example.com", err: true},
+		{name: "relative", pattern: "/jenkins", err: true},
+		{name: "other scheme", pattern: "ftp://${APP_NAME}.example.com", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			templateInstance := &tmaxv1.TemplateInstance{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "ns",
+				Name:      "jenkins",
+				Annotations: map[string]string{
+					SensitiveAnnotation:           "LICENSE",
+					GeneratedParametersAnnotation: "SUFFIX",
+				},
+			}}
+			if len(test.pattern) != 0 {
+				templateInstance.Annotations[DashboardAnnotation] = test.pattern
+			}
+			templateInstance.Spec.Template = &tmaxv1.ObjectInfo{Parameters: []tmaxv1.ParamSpec{
+				{Name: "APP_NAME", Value: intstr.FromString("jenkins")},
+				{Name: "LICENSE", Value: intstr.FromString("lic-1234")},
+				{Name: "ADMIN_PASSWORD", Value: intstr.FromString("hunter22")},
+				{Name: "SUFFIX", Value: intstr.FromString("x7k2q")},
+			}}
+
+			url, err := DashboardURL(context.Background(), c, templateInstance)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			}
+			if url != test.want {
+				t.Errorf("got %q, want %q", url, test.want)
+			}
+		})
+	}
+}
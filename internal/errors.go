@@ -0,0 +1,17 @@
+package internal
+
+import "fmt"
+
+// ParameterError reports a missing or invalid parameter of a request
+type ParameterError struct {
+	Name    string
+	Message string
+}
+
+func (e *ParameterError) Error() string {
+	return e.Message
+}
+
+func parameterErrorf(name string, format string, args ...interface{}) *ParameterError {
+	return &ParameterError{Name: name, Message: fmt.Sprintf(format, args...)}
+}
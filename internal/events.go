@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// EventComponent is the source component of the events emitted by the broker
+const EventComponent = "template-service-broker"
+
+// Event reasons of broker operations
+const (
+	ReasonProvisioned         = "Provisioned"
+	ReasonProvisionFailed     = "ProvisionFailed"
+	ReasonUpdated             = "Updated"
+	ReasonUpdateFailed        = "UpdateFailed"
+	ReasonUpgraded            = "Upgraded"
+	ReasonUpgradeFailed       = "UpgradeFailed"
+	ReasonRolledBack          = "RolledBack"
+	ReasonDeprovisioned       = "Deprovisioned"
+	ReasonDeprovisionFailed   = "DeprovisionFailed"
+	ReasonBound               = "Bound"
+	ReasonBindFailed          = "BindFailed"
+	ReasonUnbound             = "Unbound"
+	ReasonUnbindFailed        = "UnbindFailed"
+	ReasonInvalidParameters   = "InvalidParameters"
+	ReasonProvisionConflicted = "ProvisionConflicted"
+	ReasonQuotaExceeded       = "QuotaExceeded"
+	ReasonOrphaned            = "Orphaned"
+	ReasonOrphanDeleted       = "OrphanDeleted"
+)
+
+// EventRecorder returns a recorder writing events to the API server through a typed clientset
+func EventRecorder(scheme *runtime.Scheme) (record.EventRecorder, error) {
+	clientset, err := Clientset()
+	if err != nil {
+		return nil, err
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme, corev1.EventSource{Component: EventComponent}), nil
+}
+
+// RecordEvent emits the event on each of the objects, skipping the ones that could not be resolved
+func RecordEvent(recorder record.EventRecorder, eventType, reason, message string, objects ...runtime.Object) {
+	if recorder == nil {
+		return
+	}
+	for _, object := range objects {
+		if object == nil || reflect.ValueOf(object).IsNil() {
+			continue
+		}
+		recorder.Event(object, eventType, reason, message)
+	}
+}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"testing"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestRecordEvent(t *testing.T) {
+	var noTemplateInstance *tmaxv1.TemplateInstance
+	template := &tmaxv1.Template{ObjectMeta: metav1.ObjectMeta{Name: "mysql"}}
+	templateInstance := &tmaxv1.TemplateInstance{ObjectMeta: metav1.ObjectMeta{Name: "db"}}
+
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		events  int
+	}{
+		{name: "none"},
+		{name: "one", objects: []runtime.Object{templateInstance}, events: 1},
+		{name: "each", objects: []runtime.Object{template, templateInstance}, events: 2},
+		{name: "unresolved are skipped", objects: []runtime.Object{nil, noTemplateInstance, template}, events: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			RecordEvent(recorder, corev1.EventTypeNormal, ReasonProvisioned, "instance i-1 is provisioned", test.objects...)
+			if len(recorder.Events) != test.events {
+				t.Fatalf("got %d events, want %d", len(recorder.Events), test.events)
+			}
+			for i := 0; i < test.events; i++ {
+				if event := <-recorder.Events; event != "Normal Provisioned instance i-1 is provisioned" {
+					t.Errorf("unexpected event %q", event)
+				}
+			}
+		})
+	}
+
+	// no recorder is configured
+	RecordEvent(nil, corev1.EventTypeNormal, ReasonProvisioned, "instance i-1 is provisioned", templateInstance)
+}
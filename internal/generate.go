@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+const (
+	// GenerateAnnotation holds a JSON map of parameter name to generator expression,
+	// e.g. {"MYSQL_ROOT_PASSWORD": "password:length=20,charset=alphanumeric"}
+	GenerateAnnotation = "tsb.tmax.io/generate"
+	// GeneratedParametersAnnotation records which parameters of a template instance were generated by the broker
+	GeneratedParametersAnnotation = "tsb.tmax.io/generated-parameters"
+)
+
+const (
+	GeneratorPassword   = "password"
+	GeneratorUUID       = "uuid"
+	GeneratorSuffix     = "suffix"
+	GeneratorInstanceId = "instance_id"
+)
+
+var charsets = map[string]string{
+	"alphanumeric": "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789",
+	"alpha":        "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+	"lower":        "abcdefghijklmnopqrstuvwxyz0123456789",
+	"numeric":      "0123456789",
+	"hex":          "0123456789abcdef",
+	"symbol":       "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789!#%+-.:=@^_~",
+}
+
+type Generator struct {
+	Type    string
+	Length  int
+	Charset string
+	Prefix  string
+}
+
+// ParseGenerators reads the generator expressions declared on a (cluster)template
+func ParseGenerators(annotations map[string]string) (map[string]*Generator, error) {
+	generators := make(map[string]*Generator)
+	raw, ok := annotations[GenerateAnnotation]
+	if !ok || len(strings.TrimSpace(raw)) == 0 {
+		return generators, nil
+	}
+
+	expressions := make(map[string]string)
+	if err := json.Unmarshal([]byte(raw), &expressions); err != nil {
+		return nil, fmt.Errorf("annotation %s is not a valid JSON object: %s", GenerateAnnotation, err.Error())
+	}
+	for name, expression := range expressions {
+		generator, err := ParseGenerator(expression)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %s: %s", name, err.Error())
+		}
+		generators[name] = generator
+	}
+	return generators, nil
+}
+
+// ParseGenerator parses an expression of the form "type[:key=value,...]".
+// The chars option takes the rest of the expression so that it may contain commas.
+func ParseGenerator(expression string) (*Generator, error) {
+	kind, options := expression, ""
+	if idx := strings.Index(expression, ":"); idx >= 0 {
+		kind, options = expression[:idx], expression[idx+1:]
+	}
+
+	generator := &Generator{Type: strings.TrimSpace(kind)}
+	switch generator.Type {
+	case GeneratorPassword:
+		generator.Length = 16
+		generator.Charset = charsets["alphanumeric"]
+	case GeneratorSuffix:
+		generator.Length = 5
+		generator.Charset = charsets["lower"]
+	case GeneratorUUID, GeneratorInstanceId:
+	default:
+		return nil, fmt.Errorf("unknown generator type %q", generator.Type)
+	}
+
+	for len(options) > 0 {
+		option := options
+		if strings.HasPrefix(options, "chars=") {
+			options = ""
+		} else if idx := strings.Index(options, ","); idx >= 0 {
+			option, options = options[:idx], options[idx+1:]
+		} else {
+			options = ""
+		}
+
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid generator option %q", option)
+		}
+		key, val := strings.TrimSpace(kv[0]), kv[1]
+		switch key {
+		case "length":
+			length, err := strconv.Atoi(val)
+			if err != nil || length <= 0 || length > 256 {
+				return nil, fmt.Errorf("invalid length %q", val)
+			}
+			generator.Length = length
+		case "charset":
+			charset, ok := charsets[val]
+			if !ok {
+				return nil, fmt.Errorf("unknown charset %q", val)
+			}
+			generator.Charset = charset
+		case "chars":
+			if len(val) == 0 {
+				return nil, fmt.Errorf("chars must not be empty")
+			}
+			generator.Charset = val
+		case "prefix":
+			generator.Prefix = val
+		default:
+			return nil, fmt.Errorf("unknown generator option %q", key)
+		}
+	}
+
+	if generator.Type == GeneratorSuffix {
+		for _, ch := range generator.Charset {
+			if !strings.ContainsRune(charsets["lower"], ch) {
+				return nil, fmt.Errorf("suffix must be DNS-safe, %q is not allowed", ch)
+			}
+		}
+	}
+	return generator, nil
+}
+
+func (g *Generator) Generate(instanceId string) (string, error) {
+	var value string
+	switch g.Type {
+	case GeneratorPassword, GeneratorSuffix:
+		random, err := randomString(g.Length, g.Charset)
+		if err != nil {
+			return "", err
+		}
+		value = random
+	case GeneratorUUID:
+		value = string(uuid.NewUUID())
+	case GeneratorInstanceId:
+		if len(instanceId) == 0 {
+			return "", fmt.Errorf("instance_id is empty")
+		}
+		value = instanceId
+		if g.Length > 0 && g.Length < len(value) {
+			value = value[:g.Length]
+		}
+	}
+	return g.Prefix + value, nil
+}
+
+func randomString(length int, charset string) (string, error) {
+	chars := []rune(charset)
+	max := big.NewInt(int64(len(chars)))
+	result := make([]rune, length)
+	for i := range result {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		result[i] = chars[n.Int64()]
+	}
+	return string(result), nil
+}
+
+// GeneratedParameters returns the generated parameter values recorded on the template instance
+func GeneratedParameters(templateInstance *tmaxv1.TemplateInstance) map[string]string {
+	generated := make(map[string]string)
+	names := generatedParameterNames(templateInstance)
+	if len(names) == 0 {
+		return generated
+	}
+
+	for _, param := range instanceParameters(templateInstance) {
+		if names[param.Name] {
+			generated[param.Name] = param.Value.String()
+		}
+	}
+	return generated
+}
+
+// InstanceParameters returns the parameter values of the template instance by name
+func InstanceParameters(templateInstance *tmaxv1.TemplateInstance) map[string]string {
+	values := make(map[string]string)
+	for _, param := range instanceParameters(templateInstance) {
+		values[param.Name] = param.Value.String()
+	}
+	return values
+}
+
+func generatedParameterNames(templateInstance *tmaxv1.TemplateInstance) map[string]bool {
+	names := make(map[string]bool)
+	for _, name := range strings.Split(templateInstance.Annotations[GeneratedParametersAnnotation], ",") {
+		if len(name) != 0 {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// InstanceObjects returns the objects the template operator rendered into the template instance
+func InstanceObjects(templateInstance *tmaxv1.TemplateInstance) []runtime.RawExtension {
+	if templateInstance.Spec.Template != nil {
+		return templateInstance.Spec.Template.Objects
+	}
+	if templateInstance.Spec.ClusterTemplate != nil {
+		return templateInstance.Spec.ClusterTemplate.Objects
+	}
+	return nil
+}
+
+func instanceParameters(templateInstance *tmaxv1.TemplateInstance) []tmaxv1.ParamSpec {
+	if templateInstance.Spec.Template != nil {
+		return templateInstance.Spec.Template.Parameters
+	}
+	if templateInstance.Spec.ClusterTemplate != nil {
+		return templateInstance.Spec.ClusterTemplate.Parameters
+	}
+	return nil
+}
+
+func setGeneratedParameterNames(templateInstance *tmaxv1.TemplateInstance, names []string) {
+	if templateInstance.Annotations == nil {
+		templateInstance.Annotations = make(map[string]string)
+	}
+	if len(names) == 0 {
+		delete(templateInstance.Annotations, GeneratedParametersAnnotation)
+		return
+	}
+	sort.Strings(names)
+	templateInstance.Annotations[GeneratedParametersAnnotation] = strings.Join(names, ",")
+}
+
+func isEmptyValue(val intstr.IntOrString) bool {
+	return val.Type == intstr.String && len(val.StrVal) == 0
+}
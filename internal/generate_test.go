@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestParseGenerator(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       Generator
+		err        bool
+	}{
+		{expression: "password", want: Generator{Type: GeneratorPassword, Length: 16, Charset: charsets["alphanumeric"]}},
+		{expression: "password:length=20,charset=hex", want: Generator{Type: GeneratorPassword, Length: 20, Charset: charsets["hex"]}},
+		{expression: "password:length=8,chars=a,b", want: Generator{Type: GeneratorPassword, Length: 8, Charset: "a,b"}},
+		{expression: "suffix:prefix=db-", want: Generator{Type: GeneratorSuffix, Length: 5, Charset: charsets["lower"], Prefix: "db-"}},
+		{expression: "uuid", want: Generator{Type: GeneratorUUID}},
+		{expression: "instance_id:length=8", want: Generator{Type: GeneratorInstanceId, Length: 8}},
+		{expression: "random", err: true},
+		{expression: "password:length=0", err: true},
+		{expression: "password:length=257", err: true},
+		{expression: "password:charset=emoji", err: true},
+		{expression: "password:chars=", err: true},
+		{expression: "password:size=3", err: true},
+		{expression: "password:length", err: true},
+		{expression: "suffix:charset=alpha", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			generator, err := ParseGenerator(test.expression)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", generator)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if *generator != test.want {
+				t.Errorf("got %+v, want %+v", *generator, test.want)
+			}
+		})
+	}
+}
+
+func TestParseGenerators(t *testing.T) {
+	tests := []struct {
+		name       string
+		annotation string
+		want       []string
+		err        bool
+	}{
+		{name: "none"},
+		{name: "blank", annotation: " "},
+		{name: "two", annotation: `{"PASSWORD": "password", "SUFFIX": "suffix"}`, want: []string{"PASSWORD", "SUFFIX"}},
+		{name: "not json", annotation: "password", err: true},
+		{name: "invalid expression", annotation: `{"PASSWORD": "random"}`, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			annotations := map[string]string{}
+			if len(test.annotation) != 0 {
+				annotations[GenerateAnnotation] = test.annotation
+			}
+			generators, err := ParseGenerators(annotations)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			}
+			if len(generators) != len(test.want) {
+				t.Fatalf("got %d generators, want %d", len(generators), len(test.want))
+			}
+			for _, name := range test.want {
+				if _, ok := generators[name]; !ok {
+					t.Errorf("no generator for %s", name)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	tests := []struct {
+		name       string
+		generator  Generator
+		instanceId string
+		check      func(value string) bool
+		err        bool
+	}{
+		{
+			name:      "password",
+			generator: Generator{Type: GeneratorPassword, Length: 12, Charset: charsets["numeric"]},
+			check: func(value string) bool {
+				return len(value) == 12 && strings.Trim(value, charsets["numeric"]) == ""
+			},
+		},
+		{
+			name:      "suffix with prefix",
+			generator: Generator{Type: GeneratorSuffix, Length: 5, Charset: charsets["lower"], Prefix: "db-"},
+			check: func(value string) bool {
+				return strings.HasPrefix(value, "db-") && len(value) == 8
+			},
+		},
+		{
+			name:      "uuid",
+			generator: Generator{Type: GeneratorUUID},
+			check:     func(value string) bool { return len(value) == 36 },
+		},
+		{
+			name:       "instance_id",
+			generator:  Generator{Type: GeneratorInstanceId},
+			instanceId: "6c1e2f38-9a4b-4f4e-8d1c-2b7f8e9a0c11",
+			check:      func(value string) bool { return value == "6c1e2f38-9a4b-4f4e-8d1c-2b7f8e9a0c11" },
+		},
+		{
+			name:       "truncated instance_id",
+			generator:  Generator{Type: GeneratorInstanceId, Length: 8},
+			instanceId: "6c1e2f38-9a4b-4f4e-8d1c-2b7f8e9a0c11",
+			check:      func(value string) bool { return value == "6c1e2f38" },
+		},
+		{
+			name:      "empty instance_id",
+			generator: Generator{Type: GeneratorInstanceId},
+			err:       true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := test.generator.Generate(test.instanceId)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !test.check(value) {
+				t.Errorf("unexpected value %q", value)
+			}
+		})
+	}
+}
+
+func TestUpdateTemplateInstanceMetadataGenerates(t *testing.T) {
+	newTemplate := func() *tmaxv1.Template {
+		template := &tmaxv1.Template{ObjectMeta: metav1.ObjectMeta{
+			Name:        "mysql",
+			Annotations: map[string]string{GenerateAnnotation: `{"PASSWORD": "password:length=10", "NAME": "suffix"}`},
+		}}
+		template.Parameters = []tmaxv1.ParamSpec{
+			{Name: "PASSWORD", Required: true},
+			{Name: "NAME"},
+			{Name: "STORAGE"},
+		}
+		return template
+	}
+	existing := func(password string) *tmaxv1.TemplateInstance {
+		templateInstance := &tmaxv1.TemplateInstance{ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{"instance_id": "i-1", GeneratedParametersAnnotation: "PASSWORD"},
+		}}
+		templateInstance.Spec.Template = &tmaxv1.ObjectInfo{Parameters: []tmaxv1.ParamSpec{
+			{Name: "PASSWORD", Value: intstr.FromString(password)},
+		}}
+		return templateInstance
+	}
+
+	tests := []struct {
+		name      string
+		instance  *tmaxv1.TemplateInstance
+		params    map[string]intstr.IntOrString
+		generated string
+		check     func(values map[string]string) bool
+	}{
+		{
+			name:      "missing parameters are generated",
+			instance:  &tmaxv1.TemplateInstance{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"instance_id": "i-1"}}},
+			generated: "NAME,PASSWORD",
+			check: func(values map[string]string) bool {
+				return len(values["PASSWORD"]) == 10 && len(values["NAME"]) == 5
+			},
+		},
+		{
+			name:      "given values are kept",
+			instance:  &tmaxv1.TemplateInstance{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"instance_id": "i-1"}}},
+			params:    map[string]intstr.IntOrString{"PASSWORD": intstr.FromString("secret"), "NAME": intstr.FromString("db")},
+			generated: "",
+			check: func(values map[string]string) bool {
+				return values["PASSWORD"] == "secret" && values["NAME"] == "db"
+			},
+		},
+		{
+			name:      "empty values are generated",
+			instance:  &tmaxv1.TemplateInstance{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"instance_id": "i-1"}}},
+			params:    map[string]intstr.IntOrString{"PASSWORD": intstr.FromString("")},
+			generated: "NAME,PASSWORD",
+			check:     func(values map[string]string) bool { return len(values["PASSWORD"]) == 10 },
+		},
+		{
+			name:      "updates keep generated values",
+			instance:  existing("generated1"),
+			generated: "NAME,PASSWORD",
+			check:     func(values map[string]string) bool { return values["PASSWORD"] == "generated1" },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := schemas.ServiceInstanceProvisionRequest{Parameters: test.params}
+			templateInstance, err := UpdateTemplateInstanceMetadata(newTemplate(), test.instance, request)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if got := templateInstance.Annotations[GeneratedParametersAnnotation]; got != test.generated {
+				t.Errorf("generated parameters %q, want %q", got, test.generated)
+			}
+			if values := InstanceParameters(templateInstance); !test.check(values) {
+				t.Errorf("unexpected parameters %v", values)
+			}
+		})
+	}
+}
+
+func TestGeneratedParameters(t *testing.T) {
+	templateInstance := &tmaxv1.TemplateInstance{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{GeneratedParametersAnnotation: "PASSWORD"},
+	}}
+	templateInstance.Spec.ClusterTemplate = &tmaxv1.ObjectInfo{Parameters: []tmaxv1.ParamSpec{
+		{Name: "PASSWORD", Value: intstr.FromString("secret")},
+		{Name: "STORAGE", Value: intstr.FromString("1Gi")},
+	}}
+
+	generated := GeneratedParameters(templateInstance)
+	if len(generated) != 1 || generated["PASSWORD"] != "secret" {
+		t.Errorf("unexpected generated parameters %v", generated)
+	}
+	if values := InstanceParameters(templateInstance); len(values) != 2 || values["STORAGE"] != "1Gi" {
+		t.Errorf("unexpected parameters %v", values)
+	}
+}
@@ -5,163 +5,346 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
 	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 var log = logf.Log.WithName("k8s api")
 
-func GetTemplate(c client.Client, name types.NamespacedName) (*tmaxv1.Template, error) {
+const (
+	InstanceIdLabel    = "tsb.tmax.io/instance-id"
+	BindingLabelPrefix = "binding.tsb.tmax.io/"
+	// TemplateLabel and PlanLabel name the (cluster)template and catalog plan an instance is provisioned from
+	TemplateLabel = "tsb.tmax.io/template"
+	PlanLabel     = "tsb.tmax.io/plan"
+	// MaintenanceVersionAnnotation is the maintenance_info version of the plan the instance was last rendered from
+	MaintenanceVersionAnnotation = "tsb.tmax.io/maintenance-info-version"
+)
+
+// abandonTimeout bounds deleting what a failed provision created
+const abandonTimeout = 5 * time.Second
+
+func GetTemplate(ctx context.Context, c client.Client, name types.NamespacedName) (*tmaxv1.Template, error) {
 	template := &tmaxv1.Template{}
-	if err := c.Get(context.TODO(), name, template); err != nil {
+	if err := c.Get(ctx, name, template); err != nil {
 		return nil, err
 	}
 
 	return template, nil
 }
 
-func GetTemplateList(c client.Client, namespace string) (*tmaxv1.TemplateList, error) {
+// GetTemplateList lists the templates of the namespace matching the selector, but for the snapshots instances are pinned to
+func GetTemplateList(ctx context.Context, c client.Client, namespace string, selector labels.Selector) (*tmaxv1.TemplateList, error) {
+	if selector == nil {
+		selector = labels.Everything()
+	}
+	notSnapshot, err := labels.NewRequirement(SnapshotLabel, selection.DoesNotExist, nil)
+	if err != nil {
+		return nil, err
+	}
+	selector = selector.Add(*notSnapshot)
 	templates := &tmaxv1.TemplateList{}
-	if err := c.List(context.TODO(), templates, client.InNamespace(namespace)); err != nil {
+	if err := c.List(ctx, templates, &client.ListOptions{Namespace: namespace, LabelSelector: selector}); err != nil {
 		return nil, err
 	}
 
 	return templates, nil
 }
 
-func GetTemplateInstance(c client.Client, name types.NamespacedName) (*tmaxv1.TemplateInstance, error) {
+func GetTemplateInstance(ctx context.Context, c client.Client, name types.NamespacedName) (*tmaxv1.TemplateInstance, error) {
 	templateInstance := &tmaxv1.TemplateInstance{}
-	if err := c.Get(context.TODO(), name, templateInstance); err != nil {
+	if err := c.Get(ctx, name, templateInstance); err != nil {
 		return nil, err
 	}
 
 	return templateInstance, nil
 }
 
-func GetTemplateInstanceForDeprovision(c client.Client, ns string, instanceId string) (*tmaxv1.TemplateInstance, error) {
-	templateInstanceList, _ := GetTemplateInstanceList(c, ns)
-	var templateInstance *tmaxv1.TemplateInstance
+func GetTemplateInstanceByInstanceId(ctx context.Context, c client.Client, ns string, instanceId string) (*tmaxv1.TemplateInstance, error) {
+	templateInstances := &tmaxv1.TemplateInstanceList{}
+	if err := c.List(ctx, templateInstances, client.InNamespace(ns), client.MatchingLabels{InstanceIdLabel: instanceId}); err != nil {
+		return nil, err
+	}
+	// an instance being deleted is deprovisioned, it is only kept until its usage is accrued
+	templateInstances.Items = withoutDeleted(templateInstances.Items)
+	if len(templateInstances.Items) > 1 {
+		return nil, fmt.Errorf("%d templateinstances are labeled with instance_id %s", len(templateInstances.Items), instanceId)
+	}
+	if len(templateInstances.Items) == 1 {
+		return &templateInstances.Items[0], nil
+	}
 
-	for _, ti := range templateInstanceList.Items {
-		if ti.ObjectMeta.Annotations["instance_id"] == instanceId {
-			templateInstance = &ti
-			break
+	// template instances created before the label was introduced only have the annotation
+	unlabeled, err := labels.NewRequirement(InstanceIdLabel, selection.DoesNotExist, nil)
+	if err != nil {
+		return nil, err
+	}
+	templateInstanceList := &tmaxv1.TemplateInstanceList{}
+	if err := c.List(ctx, templateInstanceList, &client.ListOptions{
+		Namespace:     ns,
+		LabelSelector: labels.NewSelector().Add(*unlabeled),
+	}); err != nil {
+		return nil, err
+	}
+	for idx, ti := range templateInstanceList.Items {
+		if ti.ObjectMeta.Annotations["instance_id"] == instanceId && ti.DeletionTimestamp == nil {
+			return &templateInstanceList.Items[idx], nil
 		}
 	}
 
-	return templateInstance, nil
+	return nil, nil
+}
+
+func withoutDeleted(templateInstances []tmaxv1.TemplateInstance) []tmaxv1.TemplateInstance {
+	var kept []tmaxv1.TemplateInstance
+	for _, templateInstance := range templateInstances {
+		if templateInstance.DeletionTimestamp == nil {
+			kept = append(kept, templateInstance)
+		}
+	}
+	return kept
 }
 
-func GetTemplateInstanceList(c client.Client, namespace string) (*tmaxv1.TemplateInstanceList, error) {
+func GetTemplateInstanceList(ctx context.Context, c client.Client, namespace string) (*tmaxv1.TemplateInstanceList, error) {
 	templateInstances := &tmaxv1.TemplateInstanceList{}
-	if err := c.List(context.TODO(), templateInstances, client.InNamespace(namespace)); err != nil {
+	if err := c.List(ctx, templateInstances, client.InNamespace(namespace)); err != nil {
 		return nil, err
 	}
 
 	return templateInstances, nil
 }
 
-func CreateTemplateInstance(c client.Client, obj interface{}, namespace string,
-	request schemas.ServiceInstanceProvisionRequest, instanceId string) (*tmaxv1.TemplateInstance, error) {
+// CreateTemplateInstance creates the template instance of a provision request with the finalizers, e.g. UsageFinalizer
+func CreateTemplateInstance(ctx context.Context, c client.Client, obj interface{}, namespace string, name string,
+	request schemas.ServiceInstanceProvisionRequest, instanceId string, planName string, finalizers ...string) (*tmaxv1.TemplateInstance, error) {
 
 	var err error
 
-	name := request.Context.InstanceName
 	log.Info(fmt.Sprintf("service instance name: %s", name))
 	log.Info(fmt.Sprintf("service instance namespace: %s", namespace))
 
-	labels := make(map[string]string)
-	labels["serviceInstanceRef"] = request.Context.InstanceName
+	instanceLabels := make(map[string]string)
+	instanceLabels["serviceInstanceRef"] = request.Context.InstanceName
+	if len(validation.IsValidLabelValue(instanceId)) == 0 {
+		instanceLabels[InstanceIdLabel] = instanceId
+	}
 
 	annotations := make(map[string]string)
 	// annotations["uid"] = request.ServiceId + "." + request.PlanId // Deprecated from TSB 0.1.4
 	annotations["instance_id"] = instanceId
+	annotations["service_id"] = request.ServiceId
+	annotations["plan_id"] = request.PlanId
 
 	// form template instance
 	templateInstance := &tmaxv1.TemplateInstance{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:        name,
 			Namespace:   namespace,
-			Labels:      labels,
+			Labels:      instanceLabels,
 			Annotations: annotations,
+			Finalizers:  finalizers,
 		},
 	}
 
-	if templateInstance, err = UpdateTemplateInstanceMetadata(obj, templateInstance, request); err != nil {
+	// the instance is pinned to the revision of the template it is provisioned from. Its snapshot is stored once the instance
+	// renders, and deleted again if this provision created it but the instance cannot be created or cannot own it.
+	snapshot, err := NewSnapshot(obj, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("cannot pin the revision of the template: %s", err.Error())
+	}
+	if templateInstance, err = UpdateTemplateInstanceMetadata(snapshot.DeepCopy(), templateInstance, request); err != nil {
 		return nil, err
 	}
+	setOfferingLabel(templateInstance, PlanLabel, planName)
+	snapshot, created, err := pinSnapshot(ctx, c, snapshot, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot pin the revision of the template: %s", err.Error())
+	}
+	if !created {
+		snapshot = nil
+	}
 
 	// create template instance
-	err = c.Create(context.TODO(), templateInstance)
+	err = c.Create(ctx, templateInstance)
 	if err == nil { // if no error occurs
 		log.Info(fmt.Sprintf("template instance name: %s is created in %s namespace", templateInstance.Name, templateInstance.Namespace))
-		return templateInstance, err
+		if err := SyncSnapshotOwners(ctx, c, templateInstance); err != nil {
+			// the snapshot would outlive an instance not owning it
+			abandonProvision(c, templateInstance, snapshot)
+			return nil, fmt.Errorf("cannot own the template snapshot: %s", err.Error())
+		}
+		return templateInstance, nil
 	}
+	abandonProvision(c, nil, snapshot)
 	if !kerrors.IsAlreadyExists(err) { // if the error is not "AlreadyExists" type
-		return nil, err
+		// the API server may echo parameter values in its error
+		return nil, InstanceRedactor(obj, templateInstance).Error(err)
 	}
 
 	// if exists, return the nil
-	log.Info("The same name of template instance is already existing. Please change service instance name")
+	log.Info(fmt.Sprintf("template instance name: %s is already existing in %s namespace", name, namespace))
 	return nil, err
 }
 
-func UpdateTemplateInstance(c client.Client, obj interface{}, namespace string,
-	request schemas.ServiceInstanceProvisionRequest) (*tmaxv1.TemplateInstance, error) {
+// abandonProvision deletes the template instance and the snapshot a failed provision created, each unless nil. It runs
+// after the request context may have expired.
+func abandonProvision(c client.Client, templateInstance *tmaxv1.TemplateInstance, snapshot *tmaxv1.Template) {
+	ctx, cancel := context.WithTimeout(context.Background(), abandonTimeout)
+	defer cancel()
+	if templateInstance != nil {
+		precondition := client.Preconditions{UID: &templateInstance.UID}
+		if err := c.Delete(ctx, templateInstance, precondition); err != nil && !kerrors.IsNotFound(err) {
+			log.Error(err, "cannot delete the template instance", "templateinstance", templateInstance.Name, "namespace", templateInstance.Namespace)
+		}
+	}
+	if snapshot != nil {
+		if err := releaseSnapshot(ctx, c, snapshot); err != nil {
+			log.Error(err, "cannot release the template snapshot", "snapshot", snapshot.Name, "namespace", snapshot.Namespace)
+		}
+	}
+}
+
+// UpdateTemplateInstance applies an update request, planName is empty unless the plan changes. An upgrade pins the instance
+// to the current revision of the template, other updates render it from the revision it is pinned to.
+func UpdateTemplateInstance(ctx context.Context, c client.Client, obj interface{}, namespace string,
+	request schemas.ServiceInstanceProvisionRequest, instanceId string, planName string, upgrade bool) (*tmaxv1.TemplateInstance, error) {
 
-	instanceName := request.Context.InstanceName
-	log.Info(fmt.Sprintf("service instance name: %s", instanceName))
+	log.Info(fmt.Sprintf("service instance id: %s", instanceId))
 	log.Info(fmt.Sprintf("service instance namespace: %s", namespace))
 
-	templateInstance, err := GetTemplateInstance(c, types.NamespacedName{Name: instanceName, Namespace: namespace})
+	templateInstance, err := GetTemplateInstanceByInstanceId(ctx, c, namespace, instanceId)
 	if err != nil {
 		log.Info(fmt.Sprintf("template instance update fail: %s", err.Error()))
 		return nil, err
 	}
+	if templateInstance == nil {
+		err = kerrors.NewNotFound(SchemeGroupVersion.WithResource("templateinstances").GroupResource(), instanceId)
+		log.Info(fmt.Sprintf("template instance update fail: %s", err.Error()))
+		return nil, err
+	}
+
+	var snapshot *tmaxv1.Template
+	if upgrade {
+		snapshot, err = PinTemplate(ctx, c, obj, namespace, templateInstance)
+	} else {
+		snapshot, err = InstanceSnapshot(ctx, c, templateInstance)
+	}
+	if err != nil {
+		err = fmt.Errorf("cannot get the template snapshot of the instance: %s", err.Error())
+		log.Info(fmt.Sprintf("template instance update fail: %s", err.Error()))
+		return nil, err
+	}
+	if snapshot != nil {
+		obj = snapshot
+	}
 
 	updatedTemplateInstance, err := UpdateTemplateInstanceMetadata(obj, templateInstance, request)
 	if err != nil {
 		log.Info(fmt.Sprintf("template instance update fail: %s", err.Error()))
 		return nil, err
 	}
+	if len(planName) != 0 {
+		setOfferingLabel(updatedTemplateInstance, PlanLabel, planName)
+	}
 
 	// Update template instance
-	err = c.Update(context.TODO(), updatedTemplateInstance)
+	err = c.Update(ctx, updatedTemplateInstance)
 	if err == nil { // if no error occurs
 		log.Info(fmt.Sprintf("template instance name: %s is updated in %s namespace", updatedTemplateInstance.Name, updatedTemplateInstance.Namespace))
-		return updatedTemplateInstance, err
+		if err := SyncSnapshotOwners(ctx, c, updatedTemplateInstance); err != nil {
+			log.Error(err, "cannot release the previous template snapshot", "templateinstance", updatedTemplateInstance.Name,
+				"namespace", namespace)
+		}
+		return updatedTemplateInstance, nil
 	}
 
+	err = InstanceRedactor(obj, updatedTemplateInstance).Error(err)
 	log.Info(fmt.Sprintf("template instance update fail: %s", err.Error()))
 	return nil, err
 }
 
-func DeleteTemplateInstance(c client.Client, templateInstance *tmaxv1.TemplateInstance) error {
-	if err := c.Delete(context.TODO(), templateInstance); err != nil {
+func AddBindingLabel(ctx context.Context, c client.Client, templateInstance *tmaxv1.TemplateInstance, bindingId string) (bool, error) {
+	key, err := BindingLabel(bindingId)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := templateInstance.Labels[key]; ok {
+		return false, nil
+	}
+
+	patch := client.MergeFrom(templateInstance.DeepCopy())
+	if templateInstance.Labels == nil {
+		templateInstance.Labels = make(map[string]string)
+	}
+	templateInstance.Labels[key] = "true"
+	if err := c.Patch(ctx, templateInstance, patch); err != nil {
+		return false, err
+	}
+	log.Info(fmt.Sprintf("binding %s is added to template instance %s in %s namespace", bindingId, templateInstance.Name, templateInstance.Namespace))
+	return true, nil
+}
+
+func RemoveBindingLabel(ctx context.Context, c client.Client, templateInstance *tmaxv1.TemplateInstance, bindingId string) (bool, error) {
+	key, err := BindingLabel(bindingId)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := templateInstance.Labels[key]; !ok {
+		return false, nil
+	}
+
+	patch := client.MergeFrom(templateInstance.DeepCopy())
+	delete(templateInstance.Labels, key)
+	if err := c.Patch(ctx, templateInstance, patch); err != nil {
+		return false, err
+	}
+	log.Info(fmt.Sprintf("binding %s is removed from template instance %s in %s namespace", bindingId, templateInstance.Name, templateInstance.Namespace))
+	return true, nil
+}
+
+func BindingLabel(bindingId string) (string, error) {
+	key := BindingLabelPrefix + bindingId
+	if errs := validation.IsQualifiedName(key); len(errs) != 0 {
+		return "", parameterErrorf("binding_id", "binding_id %s cannot be used as a label: %s", bindingId, strings.Join(errs, ", "))
+	}
+	return key, nil
+}
+
+func DeleteTemplateInstance(ctx context.Context, c client.Client, templateInstance *tmaxv1.TemplateInstance) error {
+	if err := c.Delete(ctx, templateInstance); err != nil {
 		return err
 	}
 	log.Info(fmt.Sprintf("template instance name: %s is deleted in %s namespace", templateInstance.Name, templateInstance.Namespace))
 	return nil
 }
 
-func GetClusterTemplate(c client.Client, name types.NamespacedName) (*tmaxv1.ClusterTemplate, error) {
+func GetClusterTemplate(ctx context.Context, c client.Client, name types.NamespacedName) (*tmaxv1.ClusterTemplate, error) {
 	clusterTemplate := &tmaxv1.ClusterTemplate{}
-	if err := c.Get(context.TODO(), name, clusterTemplate); err != nil {
+	if err := c.Get(ctx, name, clusterTemplate); err != nil {
 		return nil, err
 	}
 
 	return clusterTemplate, nil
 }
 
-func GetClusterTemplateList(c client.Client) (*tmaxv1.ClusterTemplateList, error) {
+func GetClusterTemplateList(ctx context.Context, c client.Client, selector labels.Selector) (*tmaxv1.ClusterTemplateList, error) {
+	if selector == nil {
+		selector = labels.Everything()
+	}
 	clusterTemplates := &tmaxv1.ClusterTemplateList{}
-	if err := c.List(context.TODO(), clusterTemplates); err != nil {
+	if err := c.List(ctx, clusterTemplates, &client.ListOptions{LabelSelector: selector}); err != nil {
 		return nil, err
 	}
 
@@ -187,45 +370,77 @@ func Namespace() (string, error) {
 	}
 }
 
+// UpdateTemplateInstanceMetadata renders the template instance of a request from a template. Rendered from a snapshot, the
+// instance is pinned to the revision of the snapshot.
 func UpdateTemplateInstanceMetadata(obj interface{}, templateInstance *tmaxv1.TemplateInstance,
 	request schemas.ServiceInstanceProvisionRequest) (*tmaxv1.TemplateInstance, error) {
 
 	var parameters []tmaxv1.ParamSpec
+	var generators map[string]*Generator
+	var templateName string
+	var err error
 	template := &tmaxv1.Template{}
 	clusterTemplate := &tmaxv1.ClusterTemplate{}
 	template.Parameters = []tmaxv1.ParamSpec{}
 	clusterTemplate.Parameters = []tmaxv1.ParamSpec{}
 
+	// keep the generated values of an existing instance so that updates do not regenerate them
+	previous := make(map[string]intstr.IntOrString)
+	previouslyGenerated := generatedParameterNames(templateInstance)
+	for _, param := range instanceParameters(templateInstance) {
+		previous[param.Name] = param.Value
+	}
+
 	switch obj.(type) {
 	case *tmaxv1.Template:
 		template = obj.(*tmaxv1.Template)
+		if generators, err = ParseGenerators(template.Annotations); err != nil {
+			return nil, err
+		}
 		templateInstance.Spec.Template = &tmaxv1.ObjectInfo{}
 		templateInstance.Spec.Template.Metadata.Name = template.ObjectMeta.Name
 		templateInstance.Spec.Template.Parameters = template.Parameters
+		templateInstance.Spec.ClusterTemplate = nil
+		templateName = template.Name
+		if source, _, ok := TemplateSource(template.Annotations); ok && IsSnapshot(template) {
+			templateName = source
+		}
 		//		templateInstance.Spec.Template.Objects = template.Objects  // Deprecated since template operator 0.2.0
 		parameters = templateInstance.Spec.Template.Parameters
 	case *tmaxv1.ClusterTemplate:
 		clusterTemplate = obj.(*tmaxv1.ClusterTemplate)
+		if generators, err = ParseGenerators(clusterTemplate.Annotations); err != nil {
+			return nil, err
+		}
 		templateInstance.Spec.ClusterTemplate = &tmaxv1.ObjectInfo{}
 		templateInstance.Spec.ClusterTemplate.Metadata.Name = clusterTemplate.ObjectMeta.Name
 		templateInstance.Spec.ClusterTemplate.Parameters = clusterTemplate.Parameters
+		templateInstance.Spec.Template = nil
+		templateName = clusterTemplate.Name
 		//		templateInstance.Spec.ClusterTemplate.Objects = clusterTemplate.Objects // Deprecated since template operator 0.2.0
 		parameters = templateInstance.Spec.ClusterTemplate.Parameters
 	}
 
 	// check if serviceInstance has required parameters or not
+	var generated []string
 	for idx, param := range parameters {
+		val, ok := request.Parameters[param.Name]
+		generator, generatable := generators[param.Name]
+		if ok && generatable && isEmptyValue(val) { // an empty value is generated instead
+			ok = false
+		}
+
 		// if param in serviceInstance
-		if val, ok := request.Parameters[param.Name]; ok { // if a param was given
+		if ok { // if a param was given
 			if param.Required {
 				if val.Type == 1 && len(val.StrVal) == 0 {
 					// All parameter types filled in UI console have val.Type 1 (string type)
-					return nil, fmt.Errorf("parameter %s must be included", param.Name)
+					return nil, parameterErrorf(param.Name, "parameter %s required by template %s must not be empty", param.Name, templateName)
 				}
 				//[TODO]: int type일 경우 UI에서 공란을 어떻게 받는지 확인 필요
 				if val.Type == 0 && val.IntVal == 0 {
 					// [TODO] : Check if it has problems
-					return nil, fmt.Errorf("parameter %s must be included", param.Name)
+					return nil, parameterErrorf(param.Name, "parameter %s required by template %s must not be empty", param.Name, templateName)
 				}
 				parameters[idx].Value = val
 
@@ -233,10 +448,78 @@ func UpdateTemplateInstanceMetadata(obj interface{}, templateInstance *tmaxv1.Te
 				parameters[idx].Value = val
 			}
 
+		} else if generatable { // if not found && the param can be generated
+			if prev, exists := previous[param.Name]; exists && previouslyGenerated[param.Name] && !isEmptyValue(prev) {
+				parameters[idx].Value = prev
+			} else {
+				value, err := generator.Generate(templateInstance.Annotations["instance_id"])
+				if err != nil {
+					return nil, fmt.Errorf("cannot generate parameter %s: %s", param.Name, err.Error())
+				}
+				parameters[idx].Value = intstr.FromString(value)
+			}
+			generated = append(generated, param.Name)
+
 		} else if param.Required { // if not found && the param was required
-			return nil, fmt.Errorf("parameter %s must be included", param.Name)
+			return nil, parameterErrorf(param.Name, "parameter %s required by template %s must be included", param.Name, templateName)
 		}
 	}
+	setGeneratedParameterNames(templateInstance, generated)
+	setOfferingLabel(templateInstance, TemplateLabel, templateName)
+	if object, ok := obj.(metav1.Object); ok {
+		// the instance keeps what it needs of the template to answer fetches without it
+		copyAnnotations(templateInstance, object.GetAnnotations(), DashboardAnnotation, SensitiveAnnotation)
+	}
+	if request.MaintenanceInfo != nil && len(request.MaintenanceInfo.Version) != 0 {
+		templateInstance.Annotations[MaintenanceVersionAnnotation] = request.MaintenanceInfo.Version
+	}
+	setTemplateRevision(templateInstance, obj)
 
 	return templateInstance, nil
 }
+
+// MaintenanceVersion returns the maintenance_info version the template instance was rendered with, "" if none
+func MaintenanceVersion(templateInstance *tmaxv1.TemplateInstance) string {
+	return templateInstance.Annotations[MaintenanceVersionAnnotation]
+}
+
+// KeepParameters adds the parameter values of the template instance the request leaves out, so that re-rendering it from
+// a newer template revision keeps them. Generated values are kept by the update itself.
+func KeepParameters(request *schemas.ServiceInstanceProvisionRequest, templateInstance *tmaxv1.TemplateInstance) {
+	if request.Parameters == nil {
+		request.Parameters = make(map[string]intstr.IntOrString)
+	}
+	generated := generatedParameterNames(templateInstance)
+	for _, param := range instanceParameters(templateInstance) {
+		if _, ok := request.Parameters[param.Name]; !ok && !generated[param.Name] {
+			request.Parameters[param.Name] = param.Value
+		}
+	}
+}
+
+// copyAnnotations sets the keys of the template instance to their values in annotations, removing those not set there
+func copyAnnotations(templateInstance *tmaxv1.TemplateInstance, annotations map[string]string, keys ...string) {
+	if templateInstance.Annotations == nil {
+		templateInstance.Annotations = make(map[string]string)
+	}
+	for _, key := range keys {
+		if val, ok := annotations[key]; ok {
+			templateInstance.Annotations[key] = val
+		} else {
+			delete(templateInstance.Annotations, key)
+		}
+	}
+}
+
+// setOfferingLabel sets the template or plan label of the template instance. A name that is no valid label value
+// removes the label, so the instance is not counted under a stale one.
+func setOfferingLabel(templateInstance *tmaxv1.TemplateInstance, key string, name string) {
+	if len(validation.IsValidLabelValue(name)) != 0 || len(name) == 0 {
+		delete(templateInstance.Labels, key)
+		return
+	}
+	if templateInstance.Labels == nil {
+		templateInstance.Labels = make(map[string]string)
+	}
+	templateInstance.Labels[key] = name
+}
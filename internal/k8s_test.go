@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1beta1 "k8s.io/api/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// newFakeClient returns a client of an API server holding the objects
+func newFakeClient(t *testing.T, objs ...runtime.Object) client.Client {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := coordinationv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := networkingv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmaxv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return fake.NewFakeClientWithScheme(scheme, objs...)
+}
+
+func newTemplateInstance(namespace string, name string, instanceId string, labels map[string]string) *tmaxv1.TemplateInstance {
+	return &tmaxv1.TemplateInstance{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   namespace,
+		Name:        name,
+		Labels:      labels,
+		Annotations: map[string]string{"instance_id": instanceId},
+	}}
+}
+
+func TestGetTemplateInstanceByInstanceId(t *testing.T) {
+	// deleting is kept by a finalizer after it is deprovisioned
+	deleting := func(name string, instanceId string, labels map[string]string) *tmaxv1.TemplateInstance {
+		templateInstance := newTemplateInstance("ns", name, instanceId, labels)
+		templateInstance.Finalizers = []string{UsageFinalizer}
+		templateInstance.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+		return templateInstance
+	}
+	c := newFakeClient(t,
+		newTemplateInstance("ns", "labeled", "i-1", map[string]string{InstanceIdLabel: "i-1"}),
+		newTemplateInstance("ns", "unlabeled", "i-2", nil),
+		newTemplateInstance("other", "elsewhere", "i-3", map[string]string{InstanceIdLabel: "i-3"}),
+		newTemplateInstance("ns", "twice-a", "i-4", map[string]string{InstanceIdLabel: "i-4"}),
+		newTemplateInstance("ns", "twice-b", "i-4", map[string]string{InstanceIdLabel: "i-4"}),
+		deleting("deprovisioned", "i-6", map[string]string{InstanceIdLabel: "i-6"}),
+		deleting("deprovisioned-unlabeled", "i-7", nil),
+		deleting("replaced-old", "i-8", map[string]string{InstanceIdLabel: "i-8"}),
+		newTemplateInstance("ns", "replaced-new", "i-8", map[string]string{InstanceIdLabel: "i-8"}),
+	)
+
+	tests := []struct {
+		instanceId string
+		want       string
+		err        bool
+	}{
+		{instanceId: "i-1", want: "labeled"},
+		{instanceId: "i-2", want: "unlabeled"},
+		{instanceId: "i-3"},
+		{instanceId: "i-4", err: true},
+		{instanceId: "i-5"},
+		{instanceId: "i-6"},
+		{instanceId: "i-7"},
+		{instanceId: "i-8", want: "replaced-new"},
+	}
+	for _, test := range tests {
+		t.Run(test.instanceId, func(t *testing.T) {
+			templateInstance, err := GetTemplateInstanceByInstanceId(context.Background(), c, "ns", test.instanceId)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			}
+			name := ""
+			if templateInstance != nil {
+				name = templateInstance.Name
+			}
+			if name != test.want {
+				t.Errorf("got %q, want %q", name, test.want)
+			}
+		})
+	}
+}
+
+func TestBindingLabel(t *testing.T) {
+	tests := []struct {
+		bindingId string
+		want      string
+		err       bool
+	}{
+		{bindingId: "6c1e2f38-9a4b-4f4e-8d1c-2b7f8e9a0c11", want: BindingLabelPrefix + "6c1e2f38-9a4b-4f4e-8d1c-2b7f8e9a0c11"},
+		{bindingId: "not/valid", err: true},
+		{bindingId: "", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.bindingId, func(t *testing.T) {
+			key, err := BindingLabel(test.bindingId)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			}
+			if key != test.want {
+				t.Errorf("got %q, want %q", key, test.want)
+			}
+		})
+	}
+}
+
+func TestBindingLabels(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeClient(t, newTemplateInstance("ns", "db", "i-1", nil))
+	get := func() *tmaxv1.TemplateInstance {
+		templateInstance, err := GetTemplateInstance(ctx, c, types.NamespacedName{Namespace: "ns", Name: "db"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return templateInstance
+	}
+
+	steps := []struct {
+		name    string
+		add     bool
+		changed bool
+	}{
+		{name: "add", add: true, changed: true},
+		{name: "add again", add: true, changed: false},
+		{name: "remove", add: false, changed: true},
+		{name: "remove again", add: false, changed: false},
+	}
+	for _, step := range steps {
+		var changed bool
+		var err error
+		if step.add {
+			changed, err = AddBindingLabel(ctx, c, get(), "b-1")
+		} else {
+			changed, err = RemoveBindingLabel(ctx, c, get(), "b-1")
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", step.name, err.Error())
+		}
+		if changed != step.changed {
+			t.Errorf("%s: changed %v, want %v", step.name, changed, step.changed)
+		}
+		if _, labeled := get().Labels[BindingLabelPrefix+"b-1"]; labeled != step.add {
+			t.Errorf("%s: labeled %v, want %v", step.name, labeled, step.add)
+		}
+	}
+}
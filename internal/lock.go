@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// OperationLeaseAnnotation marks the template instance as busy with an operation of one broker replica, e.g.
+// {"holder": "tsb-7d9f-1a2b", "operation": "update", "expires": "2020-10-19T10:00:00Z"}
+const OperationLeaseAnnotation = "tsb.tmax.io/operation-lease"
+
+// Operations recorded in the lease
+const (
+	OperationProvision   = "provision"
+	OperationUpdate      = "update"
+	OperationDeprovision = "deprovision"
+	OperationBind        = "bind"
+	OperationUnbind      = "unbind"
+	// OperationOrphanSweep is the deletion of an orphaned instance by the sweeper
+	OperationOrphanSweep = "orphan-sweep"
+	// OperationRollout is the upgrade or rollback of an instance by a rollout
+	OperationRollout = "rollout"
+)
+
+type OperationLease struct {
+	Holder    string      `json:"holder"`
+	Operation string      `json:"operation"`
+	Expires   metav1.Time `json:"expires"`
+}
+
+// LeaseHeldError is returned when another operation is in progress on the instance
+type LeaseHeldError struct {
+	InstanceId string
+	Operation  string
+}
+
+func (e *LeaseHeldError) Error() string {
+	return fmt.Sprintf("operation %s is in progress on instance %s", e.Operation, e.InstanceId)
+}
+
+// InstanceLocks serializes the operations of one broker process per instance_id
+type InstanceLocks struct {
+	mu   sync.Mutex
+	held map[string]string
+}
+
+func NewInstanceLocks() *InstanceLocks {
+	return &InstanceLocks{held: make(map[string]string)}
+}
+
+// TryLock locks the instance for the operation, or returns a LeaseHeldError naming the running operation
+func (l *InstanceLocks) TryLock(instanceId, operation string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if running, ok := l.held[instanceId]; ok {
+		return &LeaseHeldError{InstanceId: instanceId, Operation: running}
+	}
+	l.held[instanceId] = operation
+	return nil
+}
+
+func (l *InstanceLocks) Unlock(instanceId string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.held, instanceId)
+}
+
+// LeaseHolder returns a name identifying this broker process among the replicas
+func LeaseHolder() string {
+	host, err := os.Hostname()
+	if err != nil || len(host) == 0 {
+		host = "tsb"
+	}
+	return host + "-" + string(uuid.NewUUID())[:8]
+}
+
+// ActiveLease returns the unexpired operation lease of the template instance, if any
+func ActiveLease(templateInstance *tmaxv1.TemplateInstance, now time.Time) *OperationLease {
+	raw, ok := templateInstance.Annotations[OperationLeaseAnnotation]
+	if !ok {
+		return nil
+	}
+	lease := &OperationLease{}
+	if err := json.Unmarshal([]byte(raw), lease); err != nil {
+		return nil
+	}
+	if !lease.Expires.Time.After(now) {
+		return nil
+	}
+	return lease
+}
+
+// AcquireLease records the operation lease on the template instance. The update fails with a conflict
+// if another replica changed the instance in the meantime.
+func AcquireLease(ctx context.Context, c client.Client, templateInstance *tmaxv1.TemplateInstance, holder string,
+	operation string, duration time.Duration) error {
+
+	now := time.Now()
+	if lease := ActiveLease(templateInstance, now); lease != nil && lease.Holder != holder {
+		return &LeaseHeldError{InstanceId: templateInstance.Annotations["instance_id"], Operation: lease.Operation}
+	}
+
+	raw, err := json.Marshal(OperationLease{Holder: holder, Operation: operation, Expires: metav1.NewTime(now.Add(duration))})
+	if err != nil {
+		return err
+	}
+	if templateInstance.Annotations == nil {
+		templateInstance.Annotations = make(map[string]string)
+	}
+	templateInstance.Annotations[OperationLeaseAnnotation] = string(raw)
+	return c.Update(ctx, templateInstance)
+}
+
+// ReleaseLease removes the operation lease of the holder from the template instance
+func ReleaseLease(ctx context.Context, c client.Client, templateInstance *tmaxv1.TemplateInstance, holder string) error {
+	lease := ActiveLease(templateInstance, time.Now())
+	if lease == nil || lease.Holder != holder {
+		return nil
+	}
+
+	patch := client.MergeFrom(templateInstance.DeepCopy())
+	delete(templateInstance.Annotations, OperationLeaseAnnotation)
+	return c.Patch(ctx, templateInstance, patch)
+}
+
+// provisionLeasePrefix names the coordination.k8s.io Lease taken while provisioning an instance,
+// tsb-provision-<hash of instance_id>
+const provisionLeasePrefix = "tsb-provision-"
+
+// ProvisionLeaseName is the name of the provision lease of the instance. Template instance names may be random,
+// so replicas provisioning the same instance_id meet at this lease before creating the instance.
+func ProvisionLeaseName(instanceId string) string {
+	hash := sha256.Sum256([]byte(instanceId))
+	return provisionLeasePrefix + hex.EncodeToString(hash[:])[:hashLength]
+}
+
+// AcquireProvisionLease takes the provision lease of the instance in the namespace, taking over an expired lease.
+// It returns a LeaseHeldError if another replica holds the lease, and a conflict if another replica took it meanwhile.
+func AcquireProvisionLease(ctx context.Context, c client.Client, namespace string, instanceId string, holder string,
+	duration time.Duration) (*coordinationv1.Lease, error) {
+
+	now := metav1.NewMicroTime(time.Now())
+	seconds := int32(duration / time.Second)
+	lease := &coordinationv1.Lease{}
+	err := c.Get(ctx, types.NamespacedName{Name: ProvisionLeaseName(instanceId), Namespace: namespace}, lease)
+	if kerrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        ProvisionLeaseName(instanceId),
+				Namespace:   namespace,
+				Annotations: map[string]string{"instance_id": instanceId},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &holder,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		return lease, c.Create(ctx, lease)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if provisionLeaseActive(lease, now.Time) && (lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != holder) {
+		return nil, &LeaseHeldError{InstanceId: instanceId, Operation: OperationProvision}
+	}
+	lease.Spec.HolderIdentity = &holder
+	lease.Spec.LeaseDurationSeconds = &seconds
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	return lease, c.Update(ctx, lease)
+}
+
+// ReleaseProvisionLease deletes the provision lease, unless another replica took it over in the meantime
+func ReleaseProvisionLease(ctx context.Context, c client.Client, lease *coordinationv1.Lease) error {
+	err := c.Delete(ctx, lease, client.Preconditions{ResourceVersion: &lease.ResourceVersion})
+	if kerrors.IsNotFound(err) || kerrors.IsConflict(err) {
+		return nil
+	}
+	return err
+}
+
+func provisionLeaseActive(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return false
+	}
+	expires := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return expires.After(now)
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newProvisionLease(holder string, renewed time.Time) *coordinationv1.Lease {
+	seconds := int32(60)
+	renewTime := metav1.NewMicroTime(renewed)
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: ProvisionLeaseName("i-1")},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &seconds,
+			RenewTime:            &renewTime,
+		},
+	}
+}
+
+func TestInstanceLocks(t *testing.T) {
+	locks := NewInstanceLocks()
+	if err := locks.TryLock("i-1", OperationUpdate); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	err := locks.TryLock("i-1", OperationBind)
+	if held, ok := err.(*LeaseHeldError); !ok || held.Operation != OperationUpdate {
+		t.Fatalf("got %v, want the update to hold the lock", err)
+	}
+	if err := locks.TryLock("i-2", OperationBind); err != nil {
+		t.Errorf("other instances are locked: %s", err.Error())
+	}
+	locks.Unlock("i-1")
+	if err := locks.TryLock("i-1", OperationBind); err != nil {
+		t.Errorf("the lock is not released: %s", err.Error())
+	}
+}
+
+func TestProvisionLeaseName(t *testing.T) {
+	if ProvisionLeaseName("i-1") != ProvisionLeaseName("i-1") {
+		t.Error("the lease name is not deterministic")
+	}
+	if ProvisionLeaseName("i-1") == ProvisionLeaseName("i-2") {
+		t.Error("instances share a lease")
+	}
+}
+
+func TestAcquireProvisionLease(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		existing []runtime.Object
+		held     bool
+	}{
+		{name: "no lease"},
+		{name: "own lease", existing: []runtime.Object{newProvisionLease("tsb-a", now)}},
+		{name: "expired lease", existing: []runtime.Object{newProvisionLease("tsb-b", now.Add(-2*time.Minute))}},
+		{name: "lease of another replica", existing: []runtime.Object{newProvisionLease("tsb-b", now)}, held: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newFakeClient(t, test.existing...)
+			lease, err := AcquireProvisionLease(context.Background(), c, "ns", "i-1", "tsb-a", time.Minute)
+			if test.held {
+				if _, ok := err.(*LeaseHeldError); !ok {
+					t.Fatalf("got %v, want a LeaseHeldError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			stored := &coordinationv1.Lease{}
+			if err := c.Get(context.Background(), types.NamespacedName{Namespace: "ns", Name: ProvisionLeaseName("i-1")}, stored); err != nil {
+				t.Fatalf("cannot get the lease: %s", err.Error())
+			}
+			if *stored.Spec.HolderIdentity != "tsb-a" || !provisionLeaseActive(stored, time.Now()) {
+				t.Errorf("the lease is not held: %+v", stored.Spec)
+			}
+
+			if err := ReleaseProvisionLease(context.Background(), c, lease); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			err = c.Get(context.Background(), types.NamespacedName{Namespace: "ns", Name: ProvisionLeaseName("i-1")}, stored)
+			if !kerrors.IsNotFound(err) {
+				t.Errorf("the lease is not released: %v", err)
+			}
+		})
+	}
+}
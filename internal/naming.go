@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// NamingInstanceName names the template instance after context.instance_name (falls back to instance_id)
+	NamingInstanceName = "instance-name"
+	// NamingInstanceId names the template instance after the OSB instance_id
+	NamingInstanceId = "instance-id"
+	// NamingPrefixed names the template instance <prefix><context.instance_name>
+	NamingPrefixed = "prefixed"
+	// NamingHashed names the template instance <prefix><context.instance_name>-<hash of instance_id>
+	NamingHashed = "hashed"
+)
+
+const hashLength = 10
+
+var (
+	invalidNameChars = regexp.MustCompile("[^a-z0-9.-]+")
+	validPrefix      = regexp.MustCompile("^[a-z0-9][a-z0-9.-]*$")
+)
+
+type NamingStrategy struct {
+	Type   string
+	Prefix string
+}
+
+func (n NamingStrategy) Validate() error {
+	switch n.Type {
+	case NamingInstanceName, NamingInstanceId, NamingPrefixed, NamingHashed:
+	default:
+		return fmt.Errorf("unknown instance naming strategy %q", n.Type)
+	}
+	if len(n.Prefix) != 0 && !validPrefix.MatchString(n.Prefix) {
+		return fmt.Errorf("instance name prefix %q must consist of lower case alphanumeric characters, '-' or '.'", n.Prefix)
+	}
+	if n.Type == NamingPrefixed && len(n.Prefix) == 0 {
+		return fmt.Errorf("instance naming strategy %q requires a prefix", n.Type)
+	}
+	return nil
+}
+
+// Name returns the template instance name for a provision request
+func (n NamingStrategy) Name(request schemas.ServiceInstanceProvisionRequest, instanceId string) (string, error) {
+	instanceName := request.Context.InstanceName
+	if len(instanceName) == 0 {
+		instanceName = instanceId
+	}
+
+	var name string
+	switch n.Type {
+	case NamingInstanceId:
+		name = n.Prefix + instanceId
+	case NamingPrefixed:
+		name = n.Prefix + instanceName
+	case NamingHashed:
+		hash := sha256.Sum256([]byte(instanceId))
+		suffix := "-" + hex.EncodeToString(hash[:])[:hashLength]
+		base := sanitizeName(n.Prefix + instanceName)
+		if max := validation.DNS1123SubdomainMaxLength - len(suffix); len(base) > max {
+			base = base[:max]
+		}
+		name = strings.TrimRight(base, "-.") + suffix
+	default:
+		name = instanceName
+	}
+
+	name = sanitizeName(name)
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) != 0 {
+		return "", fmt.Errorf("cannot make a valid templateinstance name from %q: %s", name, strings.Join(errs, ", "))
+	}
+	return name, nil
+}
+
+func sanitizeName(name string) string {
+	name = invalidNameChars.ReplaceAllString(strings.ToLower(name), "-")
+	if len(name) > validation.DNS1123SubdomainMaxLength {
+		name = name[:validation.DNS1123SubdomainMaxLength]
+	}
+	return strings.Trim(name, "-.")
+}
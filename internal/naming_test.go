@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
+)
+
+func TestNamingStrategyValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy NamingStrategy
+		err      bool
+	}{
+		{name: "instance-name", strategy: NamingStrategy{Type: NamingInstanceName}},
+		{name: "hashed with prefix", strategy: NamingStrategy{Type: NamingHashed, Prefix: "tsb-"}},
+		{name: "prefixed", strategy: NamingStrategy{Type: NamingPrefixed, Prefix: "tsb-"}},
+		{name: "prefixed without prefix", strategy: NamingStrategy{Type: NamingPrefixed}, err: true},
+		{name: "invalid prefix", strategy: NamingStrategy{Type: NamingInstanceId, Prefix: "TSB_"}, err: true},
+		{name: "unknown", strategy: NamingStrategy{Type: "random"}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.strategy.Validate(); (err != nil) != test.err {
+				t.Errorf("got error %v, want error %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestNamingStrategyName(t *testing.T) {
+	const instanceId = "6c1e2f38-9a4b-4f4e-8d1c-2b7f8e9a0c11"
+	tests := []struct {
+		name         string
+		strategy     NamingStrategy
+		instanceName string
+		want         string
+		err          bool
+	}{
+		{name: "instance-name", strategy: NamingStrategy{Type: NamingInstanceName}, instanceName: "My_DB", want: "my-db"},
+		{name: "instance-name falls back to instance_id", strategy: NamingStrategy{Type: NamingInstanceName}, want: instanceId},
+		{name: "instance-id", strategy: NamingStrategy{Type: NamingInstanceId, Prefix: "tsb-"}, instanceName: "db", want: "tsb-" + instanceId},
+		{name: "prefixed", strategy: NamingStrategy{Type: NamingPrefixed, Prefix: "tsb-"}, instanceName: "db", want: "tsb-db"},
+		{name: "hashed", strategy: NamingStrategy{Type: NamingHashed}, instanceName: "db", want: "db-" + hashOf(instanceId)},
+		{name: "hashed long name", strategy: NamingStrategy{Type: NamingHashed}, instanceName: strings.Repeat("a", 300),
+			want: strings.Repeat("a", 242) + "-" + hashOf(instanceId)},
+		{name: "nothing valid", strategy: NamingStrategy{Type: NamingInstanceName}, instanceName: "___", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := schemas.ServiceInstanceProvisionRequest{Context: schemas.Context{InstanceName: test.instanceName}}
+			name, err := test.strategy.Name(request, instanceId)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if name != test.want {
+				t.Errorf("got %q, want %q", name, test.want)
+			}
+		})
+	}
+}
+
+func hashOf(instanceId string) string {
+	hash := sha256.Sum256([]byte(instanceId))
+	return hex.EncodeToString(hash[:])[:hashLength]
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Reasons a template instance is orphaned
+const (
+	OrphanUnknownInstance = "UnknownInstance"
+	OrphanFailed          = "Failed"
+)
+
+// serviceInstanceListGVK is the ServiceInstance list of the Kubernetes service catalog, read as unstructured
+// so that the broker does not depend on the service catalog being installed
+var serviceInstanceListGVK = schema.GroupVersionKind{Group: "servicecatalog.k8s.io", Version: "v1beta1", Kind: "ServiceInstanceList"}
+
+// Orphan is a template instance no service instance of the platform owns anymore
+type Orphan struct {
+	Namespace  string      `json:"namespace"`
+	Name       string      `json:"name"`
+	InstanceId string      `json:"instance_id"`
+	Reason     string      `json:"reason"`
+	Since      metav1.Time `json:"since"`
+	Deleted    bool        `json:"deleted,omitempty"`
+}
+
+// PlatformInstanceIds returns the instance ids (spec.externalID) of the service catalog's ServiceInstances in the namespaces.
+// found is false if the service catalog is not installed, in which case no instance can be told unknown.
+func PlatformInstanceIds(ctx context.Context, c client.Client, namespaces []string) (ids map[string]bool, found bool, err error) {
+	ids = make(map[string]bool)
+	for _, ns := range namespaces {
+		serviceInstances := &unstructured.UnstructuredList{}
+		serviceInstances.SetGroupVersionKind(serviceInstanceListGVK)
+		if err := c.List(ctx, serviceInstances, client.InNamespace(ns)); err != nil {
+			if meta.IsNoMatchError(err) || kerrors.IsNotFound(err) {
+				return nil, false, nil
+			}
+			return nil, false, err
+		}
+		for _, item := range serviceInstances.Items {
+			if id, ok, _ := unstructured.NestedString(item.Object, "spec", "externalID"); ok && len(id) != 0 {
+				ids[id] = true
+			}
+		}
+	}
+	return ids, true, nil
+}
+
+// FindOrphans returns the template instances created by the broker that have been orphaned for longer than the grace period:
+// their instance_id is not in known (unless known is nil), or they failed and were not retried since
+func FindOrphans(templateInstances []tmaxv1.TemplateInstance, known map[string]bool, gracePeriod time.Duration, now time.Time) []Orphan {
+	var orphans []Orphan
+	for i := range templateInstances {
+		templateInstance := &templateInstances[i]
+		instanceId, ok := templateInstance.Annotations["instance_id"]
+		if !ok || templateInstance.DeletionTimestamp != nil {
+			continue
+		}
+
+		orphan := Orphan{Namespace: templateInstance.Namespace, Name: templateInstance.Name, InstanceId: instanceId}
+		if known != nil && !known[instanceId] {
+			orphan.Reason = OrphanUnknownInstance
+			orphan.Since = templateInstance.CreationTimestamp
+		} else if state, _ := InstanceState(templateInstance); state == StateFailed {
+			orphan.Reason = OrphanFailed
+			orphan.Since = failedSince(templateInstance)
+		} else {
+			continue
+		}
+
+		if now.Sub(orphan.Since.Time) >= gracePeriod {
+			orphans = append(orphans, orphan)
+		}
+	}
+	return orphans
+}
+
+// failedSince returns when the Ready condition of the template instance last changed, so a retried instance starts over
+func failedSince(templateInstance *tmaxv1.TemplateInstance) metav1.Time {
+	since := templateInstance.CreationTimestamp
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(templateInstance)
+	if err != nil {
+		return since
+	}
+	conditions, _, _ := unstructured.NestedSlice(obj, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok || condition["type"] != ConditionReady {
+			continue
+		}
+		transition, _ := condition["lastTransitionTime"].(string)
+		if t, err := time.Parse(time.RFC3339, strings.TrimSpace(transition)); err == nil && t.After(since.Time) {
+			since = metav1.NewTime(t)
+		}
+	}
+	return since
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestFindOrphans(t *testing.T) {
+	now := time.Date(2020, 10, 19, 12, 0, 0, 0, time.UTC)
+	created := metav1.NewTime(now.Add(-2 * time.Hour))
+
+	// orphanCandidate returns a template instance of the broker created two hours ago in the given status
+	orphanCandidate := func(name string, instanceId string, status string) tmaxv1.TemplateInstance {
+		templateInstance := templateInstanceWithStatus(t, status)
+		templateInstance.Namespace = "ns"
+		templateInstance.Name = name
+		templateInstance.CreationTimestamp = created
+		if len(instanceId) != 0 {
+			templateInstance.Annotations = map[string]string{"instance_id": instanceId}
+		}
+		return *templateInstance
+	}
+	failed := func(transition time.Time) string {
+		return `{"conditions": [{"type": "Ready", "status": "False", "lastTransitionTime": "` + transition.Format(time.RFC3339) + `"}]}`
+	}
+	deleting := orphanCandidate("deleting", "i-1", `{}`)
+	deleting.DeletionTimestamp = &metav1.Time{Time: now}
+
+	tests := []struct {
+		name             string
+		templateInstance tmaxv1.TemplateInstance
+		known            map[string]bool
+		gracePeriod      time.Duration
+		reason           string
+		since            time.Time
+	}{
+		{name: "known", templateInstance: orphanCandidate("db", "i-1", `{}`), known: map[string]bool{"i-1": true}},
+		{name: "not created by the broker", templateInstance: orphanCandidate("db", "", `{}`), known: map[string]bool{}},
+		{name: "being deleted", templateInstance: deleting, known: map[string]bool{}},
+		{
+			name:             "unknown",
+			templateInstance: orphanCandidate("db", "i-1", `{}`),
+			known:            map[string]bool{"i-2": true},
+			gracePeriod:      time.Hour,
+			reason:           OrphanUnknownInstance,
+			since:            created.Time,
+		},
+		{
+			name:             "unknown within the grace period",
+			templateInstance: orphanCandidate("db", "i-1", `{}`),
+			known:            map[string]bool{},
+			gracePeriod:      3 * time.Hour,
+		},
+		{name: "no platform", templateInstance: orphanCandidate("db", "i-1", `{}`), gracePeriod: time.Hour},
+		{
+			name:             "failed",
+			templateInstance: orphanCandidate("db", "i-1", failed(now.Add(-90*time.Minute))),
+			gracePeriod:      time.Hour,
+			reason:           OrphanFailed,
+			since:            now.Add(-90 * time.Minute),
+		},
+		{
+			name:             "failed again after a retry",
+			templateInstance: orphanCandidate("db", "i-1", failed(now.Add(-30*time.Minute))),
+			known:            map[string]bool{"i-1": true},
+			gracePeriod:      time.Hour,
+		},
+		{
+			name:             "failed without transition time",
+			templateInstance: orphanCandidate("db", "i-1", `{"conditions": [{"type": "Ready", "status": "False"}]}`),
+			gracePeriod:      time.Hour,
+			reason:           OrphanFailed,
+			since:            created.Time,
+		},
+		{
+			name:             "succeeded",
+			templateInstance: orphanCandidate("db", "i-1", `{"conditions": [{"type": "Ready", "status": "True"}]}`),
+			gracePeriod:      time.Hour,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			orphans := FindOrphans([]tmaxv1.TemplateInstance{test.templateInstance}, test.known, test.gracePeriod, now)
+			if len(test.reason) == 0 {
+				if len(orphans) != 0 {
+					t.Fatalf("unexpected orphans %+v", orphans)
+				}
+				return
+			}
+			if len(orphans) != 1 {
+				t.Fatalf("got %d orphans, want 1", len(orphans))
+			}
+			orphan := orphans[0]
+			if orphan.Reason != test.reason || !orphan.Since.Time.Equal(test.since) {
+				t.Errorf("got reason %s since %s, want %s since %s", orphan.Reason, orphan.Since, test.reason, test.since)
+			}
+			if orphan.Namespace != "ns" || orphan.Name != "db" || orphan.InstanceId != "i-1" {
+				t.Errorf("unexpected orphan %+v", orphan)
+			}
+		})
+	}
+}
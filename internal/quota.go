@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// QuotaReservationsName is the ConfigMap in the instance namespace that holds the instances being provisioned under a quota.
+// Replicas update it with optimistic concurrency, so of two provisions taking the last slot only one succeeds.
+const QuotaReservationsName = "tsb-quota-reservations"
+
+// quotaReservationsKey is the key of the reservations in the data of their ConfigMap
+const quotaReservationsKey = "reservations.json"
+
+// QuotaReservation counts an instance against the quotas of its template and plan until its template instance exists
+type QuotaReservation struct {
+	InstanceId string `json:"instance_id"`
+	Template   string `json:"template"`
+	Plan       string `json:"plan,omitempty"`
+	// Expires releases the reservation of a replica that stopped while provisioning
+	Expires metav1.Time `json:"expires"`
+}
+
+// GetQuotaReservations reads the reservations of the namespace. A missing ConfigMap has none, it is created on save.
+func GetQuotaReservations(ctx context.Context, c client.Client, namespace string) ([]QuotaReservation, *corev1.ConfigMap, error) {
+	name := types.NamespacedName{Name: QuotaReservationsName, Namespace: namespace}
+	configMap := &corev1.ConfigMap{}
+	if err := c.Get(ctx, name, configMap); err != nil {
+		if !kerrors.IsNotFound(err) {
+			return nil, nil, err
+		}
+		configMap = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace}}
+		return nil, configMap, nil
+	}
+
+	var reservations []QuotaReservation
+	if data, ok := configMap.Data[quotaReservationsKey]; ok {
+		if err := json.Unmarshal([]byte(data), &reservations); err != nil {
+			return nil, nil, fmt.Errorf("cannot read quota reservations %s: %s", name, err.Error())
+		}
+	}
+	return reservations, configMap, nil
+}
+
+// SaveQuotaReservations writes the reservations to the ConfigMap they were read from, failing with a conflict
+// if it changed since, or it was created by another replica
+func SaveQuotaReservations(ctx context.Context, c client.Client, reservations []QuotaReservation, configMap *corev1.ConfigMap) error {
+	data, err := json.Marshal(reservations)
+	if err != nil {
+		return err
+	}
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	configMap.Data[quotaReservationsKey] = string(data)
+
+	if len(configMap.ResourceVersion) == 0 {
+		if err := c.Create(ctx, configMap); kerrors.IsAlreadyExists(err) {
+			return kerrors.NewConflict(corev1.Resource("configmaps"), configMap.Name, err)
+		} else if err != nil {
+			return err
+		}
+		return nil
+	}
+	return c.Update(ctx, configMap)
+}
+
+// ActiveReservations drops the expired reservations and those of instances whose template instance exists
+func ActiveReservations(reservations []QuotaReservation, templateInstances []tmaxv1.TemplateInstance, now time.Time) []QuotaReservation {
+	existing := make(map[string]bool)
+	for i := range templateInstances {
+		if instanceId, ok := templateInstances[i].Annotations["instance_id"]; ok {
+			existing[instanceId] = true
+		}
+	}
+	var active []QuotaReservation
+	for _, reservation := range reservations {
+		if reservation.Expires.Time.After(now) && !existing[reservation.InstanceId] {
+			active = append(active, reservation)
+		}
+	}
+	return active
+}
+
+// CountQuotaInstances counts the instances of the template, of one plan unless planName is empty: the active reservations and
+// the template instances created by the broker, i.e. having an instance_id annotation, that are not being deleted. Template
+// instances are matched by the template in their spec. Their plan is only known from the plan label, which instances of old
+// broker versions lack.
+func CountQuotaInstances(templateInstances []tmaxv1.TemplateInstance, reservations []QuotaReservation, templateName string,
+	planName string) int {
+
+	instances := make(map[string]bool)
+	for i := range templateInstances {
+		templateInstance := &templateInstances[i]
+		instanceId, ok := templateInstance.Annotations["instance_id"]
+		if !ok || templateInstance.DeletionTimestamp != nil {
+			continue
+		}
+		if name, _ := InstanceTemplateName(templateInstance); name != templateName {
+			continue
+		}
+		if len(planName) != 0 && templateInstance.Labels[PlanLabel] != planName {
+			continue
+		}
+		instances[instanceId] = true
+	}
+	for _, reservation := range reservations {
+		if reservation.Template == templateName && (len(planName) == 0 || reservation.Plan == planName) {
+			instances[reservation.InstanceId] = true
+		}
+	}
+	return len(instances)
+}
+
+// InstanceTemplateName returns the name of the template or cluster template of the template instance, the one it is taken
+// from if it is pinned to a snapshot
+func InstanceTemplateName(templateInstance *tmaxv1.TemplateInstance) (name string, cluster bool) {
+	if name, cluster, ok := TemplateSource(templateInstance.Annotations); ok {
+		return name, cluster
+	}
+	if templateInstance.Spec.ClusterTemplate != nil {
+		return templateInstance.Spec.ClusterTemplate.Metadata.Name, true
+	}
+	if templateInstance.Spec.Template != nil {
+		return templateInstance.Spec.Template.Metadata.Name, false
+	}
+	return "", false
+}
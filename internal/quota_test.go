@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// quotaInstance returns a template instance of the template, labeled with the plan unless it is empty
+func quotaInstance(instanceId string, template string, plan string) tmaxv1.TemplateInstance {
+	labels := map[string]string{}
+	if len(plan) != 0 {
+		labels[PlanLabel] = plan
+	}
+	templateInstance := newTemplateInstance("ns", "ti-"+instanceId, instanceId, labels)
+	if len(instanceId) == 0 {
+		templateInstance.Annotations = nil
+	}
+	templateInstance.Spec.Template = &tmaxv1.ObjectInfo{}
+	templateInstance.Spec.Template.Metadata.Name = template
+	return *templateInstance
+}
+
+func TestCountQuotaInstances(t *testing.T) {
+	templateInstances := []tmaxv1.TemplateInstance{
+		quotaInstance("i-1", "mysql", "small"),
+		quotaInstance("i-2", "mysql", "large"),
+		quotaInstance("i-3", "mysql", ""),
+		quotaInstance("", "mysql", "small"),
+		quotaInstance("i-4", "redis", "small"),
+	}
+	reservations := []QuotaReservation{
+		{InstanceId: "i-5", Template: "mysql", Plan: "small"},
+		{InstanceId: "i-1", Template: "mysql", Plan: "small"},
+		{InstanceId: "i-6", Template: "redis", Plan: "small"},
+	}
+
+	tests := []struct {
+		name         string
+		template     string
+		plan         string
+		reservations []QuotaReservation
+		want         int
+	}{
+		{name: "template", template: "mysql", want: 3},
+		{name: "plan", template: "mysql", plan: "small", want: 1},
+		{name: "template with reservations", template: "mysql", reservations: reservations, want: 4},
+		{name: "plan with reservations", template: "mysql", plan: "small", reservations: reservations, want: 2},
+		{name: "other template", template: "redis", reservations: reservations, want: 2},
+		{name: "no instances", template: "postgres", reservations: reservations, want: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := CountQuotaInstances(templateInstances, test.reservations, test.template, test.plan); got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestActiveReservations(t *testing.T) {
+	now := time.Now()
+	later, earlier := metav1.NewTime(now.Add(time.Minute)), metav1.NewTime(now.Add(-time.Minute))
+	reservations := []QuotaReservation{
+		{InstanceId: "i-1", Template: "mysql", Expires: later},
+		{InstanceId: "i-2", Template: "mysql", Expires: earlier},
+		{InstanceId: "i-3", Template: "mysql", Expires: later},
+	}
+	active := ActiveReservations(reservations, []tmaxv1.TemplateInstance{quotaInstance("i-3", "mysql", "")}, now)
+	if want := reservations[:1]; !reflect.DeepEqual(active, want) {
+		t.Errorf("got %+v, want %+v", active, want)
+	}
+}
+
+func TestSaveQuotaReservations(t *testing.T) {
+	c := newFakeClient(t)
+	ctx := context.Background()
+	reservations := []QuotaReservation{{InstanceId: "i-1", Template: "mysql", Expires: metav1.NewTime(time.Now().Truncate(time.Second))}}
+
+	_, first, err := GetQuotaReservations(ctx, c, "ns")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	_, second, _ := GetQuotaReservations(ctx, c, "ns")
+	if err := SaveQuotaReservations(ctx, c, reservations, first); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	// a replica that read the reservations before they were saved must read them again
+	if err := SaveQuotaReservations(ctx, c, nil, second); !kerrors.IsConflict(err) {
+		t.Errorf("got %v, want a conflict", err)
+	}
+
+	saved, _, err := GetQuotaReservations(ctx, c, "ns")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(saved) != 1 || saved[0].InstanceId != "i-1" || !saved[0].Expires.Equal(&reservations[0].Expires) {
+		t.Errorf("got %+v, want %+v", saved, reservations)
+	}
+}
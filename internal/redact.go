@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"sort"
+	"strings"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SensitiveAnnotation lists the parameters of a (cluster)template whose values are secret, e.g.
+// tsb.tmax.io/sensitive-parameters: "DB_PASSWORD,API_TOKEN"
+const SensitiveAnnotation = "tsb.tmax.io/sensitive-parameters"
+
+// Redacted replaces the value of a sensitive parameter
+const Redacted = "<redacted>"
+
+// minRedactedLength is the length a value needs to be searched for in messages,
+// shorter ones would garble messages without hiding anything worth a secret
+const minRedactedLength = 4
+
+// sensitiveNames are name fragments of parameters treated as sensitive without being declared
+var sensitiveNames = []string{
+	"password", "passwd", "secret", "token", "credential",
+	"apikey", "api_key", "privatekey", "private_key", "accesskey", "access_key",
+}
+
+// IsSensitiveName reports whether the parameter name looks like it holds a secret
+func IsSensitiveName(name string) bool {
+	name = strings.ToLower(name)
+	for _, fragment := range sensitiveNames {
+		if strings.Contains(name, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redactor hides the values of sensitive parameters in messages and echoed parameters
+type Redactor struct {
+	declared map[string]bool
+	values   map[string]bool
+}
+
+// NewRedactor returns a redactor of the parameters declared sensitive by the annotations of a template
+func NewRedactor(annotations map[string]string) *Redactor {
+	r := &Redactor{declared: make(map[string]bool), values: make(map[string]bool)}
+	for _, name := range strings.Split(annotations[SensitiveAnnotation], ",") {
+		if name = strings.TrimSpace(name); len(name) != 0 {
+			r.declared[name] = true
+		}
+	}
+	return r
+}
+
+// InstanceRedactor returns the redactor of a template instance created from obj, a Template or ClusterTemplate.
+// Generated parameters are always sensitive.
+func InstanceRedactor(obj interface{}, templateInstance *tmaxv1.TemplateInstance) *Redactor {
+	var annotations map[string]string
+	if object, ok := obj.(metav1.Object); ok {
+		annotations = object.GetAnnotations()
+	}
+	r := NewRedactor(annotations)
+	generated := generatedParameterNames(templateInstance)
+	for _, param := range instanceParameters(templateInstance) {
+		if generated[param.Name] {
+			r.AddSecret(param.Value.String())
+			continue
+		}
+		r.Add(param.Name, param.Value.String())
+	}
+	return r
+}
+
+func (r *Redactor) IsSensitive(name string) bool {
+	return r.declared[name] || IsSensitiveName(name)
+}
+
+// Add remembers the value of the parameter if it is sensitive
+func (r *Redactor) Add(name, value string) {
+	if r.IsSensitive(name) {
+		r.AddSecret(value)
+	}
+}
+
+// AddSecret remembers a value to hide regardless of its parameter
+func (r *Redactor) AddSecret(value string) {
+	if len(value) >= minRedactedLength {
+		r.values[value] = true
+	}
+}
+
+// String replaces the remembered values in s, longest first so that no part of a longer value is left
+func (r *Redactor) String(s string) string {
+	if len(r.values) == 0 {
+		return s
+	}
+	values := make([]string, 0, len(r.values))
+	for value := range r.values {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, value := range values {
+		s = strings.Replace(s, value, Redacted, -1)
+	}
+	return s
+}
+
+// Error redacts the message of err. API status and parameter errors keep their type, so they are answered the same.
+func (r *Redactor) Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	message := err.Error()
+	redacted := r.String(message)
+	if redacted == message {
+		return err
+	}
+
+	switch e := err.(type) {
+	case *kerrors.StatusError:
+		status := e.ErrStatus
+		status.Message = r.String(status.Message)
+		if status.Details != nil {
+			details := *status.Details
+			details.Causes = make([]metav1.StatusCause, len(status.Details.Causes))
+			for i, cause := range status.Details.Causes {
+				cause.Message = r.String(cause.Message)
+				details.Causes[i] = cause
+			}
+			status.Details = &details
+		}
+		return &kerrors.StatusError{ErrStatus: status}
+	case *ParameterError:
+		return &ParameterError{Name: e.Name, Message: r.String(e.Message)}
+	}
+	return &redactedError{message: redacted, err: err}
+}
+
+// Parameters returns a copy of the parameters with the sensitive values redacted, for echoing them back
+func (r *Redactor) Parameters(params map[string]string) map[string]string {
+	redacted := make(map[string]string, len(params))
+	for name, value := range params {
+		if r.IsSensitive(name) || r.values[value] {
+			value = Redacted
+		}
+		redacted[name] = value
+	}
+	return redacted
+}
+
+// redactedError keeps the cause of a redacted error reachable by errors.Is, e.g. for deadlines
+type redactedError struct {
+	message string
+	err     error
+}
+
+func (e *redactedError) Error() string {
+	return e.message
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestIsSensitiveName(t *testing.T) {
+	tests := map[string]bool{
+		"DB_PASSWORD":  true,
+		"passwd":       true,
+		"ClientSecret": true,
+		"API_TOKEN":    true,
+		"aws_apikey":   true,
+		"PRIVATE_KEY":  true,
+		"AccessKey":    true,
+		"DB_NAME":      false,
+		"STORAGE":      false,
+		"KEYCLOAK_URL": false,
+	}
+	for name, want := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := IsSensitiveName(name); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func newTestRedactor() *Redactor {
+	r := NewRedactor(map[string]string{SensitiveAnnotation: "LICENSE, ,DSN"})
+	r.Add("LICENSE", "lic-1234")
+	r.Add("DSN", "mysql://root:hunter22@db")
+	r.Add("DB_PASSWORD", "hunter22")
+	r.Add("DB_NAME", "orders")
+	r.Add("API_TOKEN", "abc")
+	return r
+}
+
+func TestRedactorString(t *testing.T) {
+	r := newTestRedactor()
+	tests := []struct {
+		name string
+		s    string
+		want string
+	}{
+		{name: "no secret", s: "database orders is ready", want: "database orders is ready"},
+		{name: "declared", s: "invalid license lic-1234", want: "invalid license " + Redacted},
+		{name: "by name", s: "password hunter22 is too weak", want: "password " + Redacted + " is too weak"},
+		{name: "longest first", s: "cannot reach mysql://root:hunter22@db", want: "cannot reach " + Redacted},
+		{name: "too short", s: "token abc", want: "token abc"},
+		{name: "repeated", s: "hunter22/hunter22", want: Redacted + "/" + Redacted},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := r.String(test.s); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRedactorError(t *testing.T) {
+	r := newTestRedactor()
+	gr := schema.GroupResource{Group: "tmax.io", Resource: "templateinstances"}
+	deadline := fmt.Errorf("password hunter22: %w", context.DeadlineExceeded)
+
+	tests := []struct {
+		name    string
+		err     error
+		message string
+		check   func(err error) bool
+	}{
+		{name: "nil", check: func(err error) bool { return err == nil }},
+		{
+			name:    "unchanged",
+			err:     kerrors.NewNotFound(gr, "db"),
+			message: `templateinstances.tmax.io "db" not found`,
+			check:   kerrors.IsNotFound,
+		},
+		{
+			name: "status error",
+			err: kerrors.NewInvalid(schema.GroupKind{Group: "tmax.io", Kind: "TemplateInstance"}, "db",
+				field.ErrorList{field.Invalid(field.NewPath("spec"), "hunter22", "bad value")}),
+			message: `TemplateInstance.tmax.io "db" is invalid: spec: Invalid value: "` + Redacted + `": bad value`,
+			check: func(err error) bool {
+				status, ok := err.(*kerrors.StatusError)
+				return ok && kerrors.IsInvalid(err) && status.ErrStatus.Details.Causes[0].Message == `Invalid value: "`+Redacted+`": bad value`
+			},
+		},
+		{
+			name:    "parameter error",
+			err:     &ParameterError{Name: "DB_PASSWORD", Message: "hunter22 is too short"},
+			message: Redacted + " is too short",
+			check: func(err error) bool {
+				e, ok := err.(*ParameterError)
+				return ok && e.Name == "DB_PASSWORD"
+			},
+		},
+		{
+			name:    "wrapped deadline",
+			err:     deadline,
+			message: "password " + Redacted + ": context deadline exceeded",
+			check:   func(err error) bool { return errors.Is(err, context.DeadlineExceeded) },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := r.Error(test.err)
+			if err != nil && err.Error() != test.message {
+				t.Errorf("got message %q, want %q", err.Error(), test.message)
+			}
+			if !test.check(err) {
+				t.Errorf("unexpected error %#v", err)
+			}
+		})
+	}
+}
+
+func TestRedactorParameters(t *testing.T) {
+	r := newTestRedactor()
+	params := map[string]string{"DB_NAME": "orders", "DB_PASSWORD": "hunter22", "LICENSE": "x", "COPY": "lic-1234", "API_TOKEN": "abc"}
+	want := map[string]string{"DB_NAME": "orders", "DB_PASSWORD": Redacted, "LICENSE": Redacted, "COPY": Redacted, "API_TOKEN": Redacted}
+	if got := r.Parameters(params); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if params["DB_PASSWORD"] != "hunter22" {
+		t.Error("the parameters are modified")
+	}
+}
+
+func TestInstanceRedactor(t *testing.T) {
+	template := &tmaxv1.Template{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{SensitiveAnnotation: "LICENSE"}}}
+	templateInstance := &tmaxv1.TemplateInstance{ObjectMeta: metav1.ObjectMeta{
+		Annotations: map[string]string{GeneratedParametersAnnotation: "SUFFIX"},
+	}}
+	templateInstance.Spec.Template = &tmaxv1.ObjectInfo{Parameters: []tmaxv1.ParamSpec{
+		{Name: "LICENSE", Value: intstr.FromString("lic-1234")},
+		{Name: "SUFFIX", Value: intstr.FromString("x7k2q")},
+		{Name: "ADMIN_PASSWORD", Value: intstr.FromString("hunter22")},
+		{Name: "DB_NAME", Value: intstr.FromString("orders")},
+	}}
+
+	r := InstanceRedactor(template, templateInstance)
+	got := r.String("lic-1234 x7k2q hunter22 orders")
+	want := Redacted + " " + Redacted + " " + Redacted + " orders"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
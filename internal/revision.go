@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Annotations of the template revision a template instance is pinned to, and of the snapshot of the revision. The revision
+// is a hash of the template spec, so only content changes make a new one, the resourceVersion tells the exact object.
+const (
+	TemplateRevisionAnnotation        = "tsb.tmax.io/template-revision"
+	TemplateResourceVersionAnnotation = "tsb.tmax.io/template-resource-version"
+)
+
+// revisionLength is the number of hex digits of the spec hash kept as revision
+const revisionLength = 16
+
+// TemplateRevision is the content revision of a Template or ClusterTemplate
+type TemplateRevision struct {
+	Revision        string `json:"revision"`
+	ResourceVersion string `json:"resource_version"`
+}
+
+// RevisionOf hashes the spec of a Template or ClusterTemplate
+func RevisionOf(obj interface{}) (TemplateRevision, error) {
+	var spec tmaxv1.TemplateSpec
+	switch template := obj.(type) {
+	case *tmaxv1.Template:
+		spec = template.TemplateSpec
+	case *tmaxv1.ClusterTemplate:
+		spec = template.TemplateSpec
+	default:
+		return TemplateRevision{}, fmt.Errorf("%T is no template", obj)
+	}
+
+	// maps are marshalled with sorted keys, so equal specs hash equally
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return TemplateRevision{}, err
+	}
+	sum := sha256.Sum256(data)
+	revision := TemplateRevision{Revision: hex.EncodeToString(sum[:])[:revisionLength]}
+	if object, ok := obj.(metav1.Object); ok {
+		revision.ResourceVersion = object.GetResourceVersion()
+	}
+	return revision, nil
+}
+
+// InstanceRevision returns the template revision the template instance was last rendered from, empty for instances
+// provisioned before revisions were recorded
+func InstanceRevision(templateInstance *tmaxv1.TemplateInstance) TemplateRevision {
+	return TemplateRevision{
+		Revision:        templateInstance.Annotations[TemplateRevisionAnnotation],
+		ResourceVersion: templateInstance.Annotations[TemplateResourceVersionAnnotation],
+	}
+}
+
+// setTemplateRevision pins the template instance rendered from a snapshot to its revision. An instance rendered from a
+// template as it is keeps the revision it was pinned to, if any.
+func setTemplateRevision(templateInstance *tmaxv1.TemplateInstance, obj interface{}) {
+	snapshot, ok := obj.(*tmaxv1.Template)
+	if !ok || !IsSnapshot(snapshot) {
+		return
+	}
+	if templateInstance.Annotations == nil {
+		templateInstance.Annotations = make(map[string]string)
+	}
+	copyAnnotations(templateInstance, snapshot.Annotations, TemplateSourceAnnotation, TemplateRevisionAnnotation,
+		TemplateResourceVersionAnnotation)
+}
+
+// ObjectChange is an object of a template a revision adds, removes or changes. Objects are told by kind and name, which
+// may be parameters of the template.
+type ObjectChange struct {
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	Change string `json:"change"`
+}
+
+// ObjectChanges compares the objects of two revisions of a template
+func ObjectChanges(from, to []runtime.RawExtension) ([]ObjectChange, error) {
+	before, err := templateObjects(from)
+	if err != nil {
+		return nil, err
+	}
+	after, err := templateObjects(to)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []ObjectChange{}
+	for key, object := range after {
+		previous, ok := before[key]
+		switch {
+		case !ok:
+			changes = append(changes, ObjectChange{Kind: key.kind, Name: key.name, Change: "added"})
+		case !bytes.Equal(previous, object):
+			changes = append(changes, ObjectChange{Kind: key.kind, Name: key.name, Change: "changed"})
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			changes = append(changes, ObjectChange{Kind: key.kind, Name: key.name, Change: "removed"})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Kind != changes[j].Kind {
+			return changes[i].Kind < changes[j].Kind
+		}
+		return changes[i].Name < changes[j].Name
+	})
+	return changes, nil
+}
+
+type objectKey struct{ kind, name string }
+
+// templateObjects indexes the objects of a template by kind and name, in compact JSON so that formatting is no change.
+// An object of the same kind and name as an earlier one is told by its position among them.
+func templateObjects(objects []runtime.RawExtension) (map[objectKey][]byte, error) {
+	indexed := make(map[objectKey][]byte)
+	for i, object := range objects {
+		raw := object.Raw
+		if raw == nil && object.Object != nil {
+			var err error
+			if raw, err = json.Marshal(object.Object); err != nil {
+				return nil, err
+			}
+		}
+		var meta struct {
+			Kind     string `json:"kind"`
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return nil, fmt.Errorf("cannot read object %d of the template: %s", i, err.Error())
+		}
+		compact := &bytes.Buffer{}
+		if err := json.Compact(compact, raw); err != nil {
+			return nil, err
+		}
+
+		key := objectKey{kind: meta.Kind, name: meta.Metadata.Name}
+		for n := 2; indexed[key] != nil; n++ {
+			key.name = fmt.Sprintf("%s (%d)", meta.Metadata.Name, n)
+		}
+		indexed[key] = compact.Bytes()
+	}
+	return indexed, nil
+}
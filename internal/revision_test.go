@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestObjectChanges(t *testing.T) {
+	raw := func(objects ...string) []runtime.RawExtension {
+		var extensions []runtime.RawExtension
+		for _, object := range objects {
+			extensions = append(extensions, runtime.RawExtension{Raw: []byte(object)})
+		}
+		return extensions
+	}
+	service := `{"kind": "Service", "metadata": {"name": "${APP_NAME}"}, "spec": {"ports": [{"port": 80}]}}`
+	deployment := `{"kind": "Deployment", "metadata": {"name": "${APP_NAME}"}, "spec": {"replicas": 1}}`
+
+	tests := []struct {
+		name string
+		from []runtime.RawExtension
+		to   []runtime.RawExtension
+		want []ObjectChange
+		err  bool
+	}{
+		{name: "same", from: raw(service, deployment), to: raw(service, deployment), want: []ObjectChange{}},
+		{name: "reordered and reformatted", from: raw(service, deployment),
+			to: raw(`{"kind":"Deployment","metadata":{"name":"${APP_NAME}"},"spec":{"replicas":1}}`, service), want: []ObjectChange{}},
+		{name: "changed", from: raw(service, deployment),
+			to:   raw(service, `{"kind": "Deployment", "metadata": {"name": "${APP_NAME}"}, "spec": {"replicas": 3}}`),
+			want: []ObjectChange{{Kind: "Deployment", Name: "${APP_NAME}", Change: "changed"}}},
+		{name: "added and removed", from: raw(service),
+			to: raw(deployment),
+			want: []ObjectChange{
+				{Kind: "Deployment", Name: "${APP_NAME}", Change: "added"},
+				{Kind: "Service", Name: "${APP_NAME}", Change: "removed"},
+			}},
+		{name: "same kind and name", from: raw(service),
+			to:   raw(service, `{"kind": "Service", "metadata": {"name": "${APP_NAME}"}, "spec": {"ports": [{"port": 443}]}}`),
+			want: []ObjectChange{{Kind: "Service", Name: "${APP_NAME} (2)", Change: "added"}}},
+		{name: "no objects", want: []ObjectChange{}},
+		{name: "invalid object", from: raw(service), to: raw(`{"kind": `), err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ObjectChanges(test.from, test.to)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			}
+			if !test.err && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// RolloutLabel marks the ConfigMaps rollouts are kept in with the name of the broker running them
+const RolloutLabel = "tsb.tmax.io/rollout"
+
+// PreviousSpecAnnotation keeps the spec of a template instance from before a rollout upgraded it, for rolling it back
+const PreviousSpecAnnotation = "tsb.tmax.io/previous-spec"
+
+// rolloutKey is the key of the rollout in the data of its ConfigMap
+const rolloutKey = "rollout.json"
+
+// Rollout states
+const (
+	RolloutRunning     = "Running"
+	RolloutPaused      = "Paused"
+	RolloutSucceeded   = "Succeeded"
+	RolloutRollingBack = "RollingBack"
+	RolloutRolledBack  = "RolledBack"
+	// RolloutRollbackFailed is a rollout rolled back but for instances that cannot be
+	RolloutRollbackFailed = "RollbackFailed"
+)
+
+// States of the instances of a rollout
+const (
+	RolloutInstancePending    = "Pending"
+	RolloutInstanceUpgrading  = "Upgrading"
+	RolloutInstanceUpgraded   = "Upgraded"
+	RolloutInstanceFailed     = "Failed"
+	RolloutInstanceSkipped    = "Skipped"
+	RolloutInstanceRolledBack = "RolledBack"
+	// RolloutInstanceRollbackFailed is an instance left upgraded, the revision it had cannot be restored
+	RolloutInstanceRollbackFailed = "RollbackFailed"
+)
+
+// Rollout upgrades the instances of a template to its current revision, a batch at a time
+type Rollout struct {
+	// Id is the name of the ConfigMap of the rollout
+	Id       string `json:"id"`
+	Template string `json:"template"`
+	// Namespace limits the rollout to the instances of one namespace
+	Namespace string            `json:"namespace,omitempty"`
+	BatchSize int               `json:"batch_size"`
+	State     string            `json:"state"`
+	Message   string            `json:"message,omitempty"`
+	Created   metav1.Time       `json:"created"`
+	Updated   metav1.Time       `json:"updated"`
+	Instances []RolloutInstance `json:"instances"`
+}
+
+// RolloutInstance is an instance of a rollout and the revisions it is upgraded from and to
+type RolloutInstance struct {
+	Namespace  string           `json:"namespace"`
+	Name       string           `json:"name"`
+	InstanceId string           `json:"instance_id"`
+	From       TemplateRevision `json:"from"`
+	To         TemplateRevision `json:"to"`
+	State      string           `json:"state"`
+	Message    string           `json:"message,omitempty"`
+	// Started is when the instance was upgraded
+	Started *metav1.Time `json:"started,omitempty"`
+}
+
+// Active reports whether the rollout still upgrades or rolls back instances
+func (r *Rollout) Active() bool {
+	return r.State == RolloutRunning || r.State == RolloutPaused || r.State == RolloutRollingBack
+}
+
+// Count returns the number of instances of the rollout in the state
+func (r *Rollout) Count(state string) int {
+	count := 0
+	for _, instance := range r.Instances {
+		if instance.State == state {
+			count++
+		}
+	}
+	return count
+}
+
+// NewRolloutConfigMap returns the ConfigMap a new rollout of the broker is created in, named by the API server
+func NewRolloutConfigMap(namespace string, broker string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		GenerateName: broker + "-rollout-",
+		Namespace:    namespace,
+		Labels:       map[string]string{RolloutLabel: broker},
+	}}
+}
+
+// GetRollout reads the rollout of the broker from its ConfigMap. Other ConfigMaps are not found.
+func GetRollout(ctx context.Context, c client.Client, name types.NamespacedName, broker string) (*Rollout, *corev1.ConfigMap, error) {
+	configMap := &corev1.ConfigMap{}
+	if err := c.Get(ctx, name, configMap); err != nil {
+		return nil, nil, err
+	}
+	if configMap.Labels[RolloutLabel] != broker {
+		return nil, nil, kerrors.NewNotFound(corev1.Resource("rollouts"), name.Name)
+	}
+	rollout, err := DecodeRollout(configMap)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rollout, configMap, nil
+}
+
+// ListRollouts lists the ConfigMaps of the rollouts of the broker in the namespace
+func ListRollouts(ctx context.Context, c client.Client, namespace string, broker string) (*corev1.ConfigMapList, error) {
+	configMaps := &corev1.ConfigMapList{}
+	if err := c.List(ctx, configMaps, client.InNamespace(namespace), client.MatchingLabels{RolloutLabel: broker}); err != nil {
+		return nil, err
+	}
+	return configMaps, nil
+}
+
+// DecodeRollout reads the rollout kept in the ConfigMap
+func DecodeRollout(configMap *corev1.ConfigMap) (*Rollout, error) {
+	rollout := &Rollout{}
+	if err := json.Unmarshal([]byte(configMap.Data[rolloutKey]), rollout); err != nil {
+		return nil, fmt.Errorf("cannot read rollout %s/%s: %s", configMap.Namespace, configMap.Name, err.Error())
+	}
+	rollout.Id = configMap.Name
+	return rollout, nil
+}
+
+// SaveRollout writes the rollout to the ConfigMap it was read from, failing with a conflict if it changed since. A new
+// ConfigMap is created, and the rollout takes its generated name as id.
+func SaveRollout(ctx context.Context, c client.Client, rollout *Rollout, configMap *corev1.ConfigMap) error {
+	rollout.Updated = metav1.Now()
+	data, err := json.Marshal(rollout)
+	if err != nil {
+		return err
+	}
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	configMap.Data[rolloutKey] = string(data)
+
+	if len(configMap.ResourceVersion) != 0 {
+		return c.Update(ctx, configMap)
+	}
+	if err := c.Create(ctx, configMap); err != nil {
+		return err
+	}
+	rollout.Id = configMap.Name
+	return nil
+}
+
+// previousSpec is what a rollout keeps of a template instance before upgrading it: the template it references, a snapshot
+// unless it was provisioned before pinning, its parameters and the rendering annotations. The objects are not kept, they
+// come back from the snapshot, so the annotation stays small whatever the size of the template.
+type previousSpec struct {
+	Rollout string `json:"rollout"`
+	// Template is the name of the template, a ClusterTemplate if ClusterTemplate is set
+	Template        string             `json:"template"`
+	ClusterTemplate bool               `json:"cluster_template,omitempty"`
+	Parameters      []tmaxv1.ParamSpec `json:"parameters,omitempty"`
+	Annotations     map[string]string  `json:"annotations,omitempty"`
+}
+
+// spec returns the template instance spec of the template and parameters kept
+func (p *previousSpec) spec() tmaxv1.TemplateInstanceSpec {
+	info := &tmaxv1.ObjectInfo{Parameters: p.Parameters}
+	info.Metadata.Name = p.Template
+	if p.ClusterTemplate {
+		return tmaxv1.TemplateInstanceSpec{ClusterTemplate: info}
+	}
+	return tmaxv1.TemplateInstanceSpec{Template: info}
+}
+
+// renderedAnnotations are the annotations UpdateTemplateInstanceMetadata sets along with the spec
+var renderedAnnotations = []string{GeneratedParametersAnnotation, DashboardAnnotation, SensitiveAnnotation,
+	MaintenanceVersionAnnotation, TemplateSourceAnnotation, TemplateRevisionAnnotation, TemplateResourceVersionAnnotation}
+
+// SavePreviousSpec keeps the spec of the template instance in an annotation before the rollout upgrades it, replacing the
+// one of an earlier rollout
+func SavePreviousSpec(templateInstance *tmaxv1.TemplateInstance, rolloutId string) error {
+	previous := previousSpec{Rollout: rolloutId, Annotations: make(map[string]string)}
+	switch spec := templateInstance.Spec; {
+	case spec.Template != nil:
+		previous.Template, previous.Parameters = spec.Template.Metadata.Name, spec.Template.Parameters
+	case spec.ClusterTemplate != nil:
+		previous.Template, previous.Parameters = spec.ClusterTemplate.Metadata.Name, spec.ClusterTemplate.Parameters
+		previous.ClusterTemplate = true
+	default:
+		return fmt.Errorf("templateinstance %s references no template", templateInstance.Name)
+	}
+	for _, key := range renderedAnnotations {
+		if val, ok := templateInstance.Annotations[key]; ok {
+			previous.Annotations[key] = val
+		}
+	}
+	data, err := json.Marshal(previous)
+	if err != nil {
+		return err
+	}
+	if templateInstance.Annotations == nil {
+		templateInstance.Annotations = make(map[string]string)
+	}
+	templateInstance.Annotations[PreviousSpecAnnotation] = string(data)
+	return nil
+}
+
+// UpgradedBy reports whether the template instance keeps the previous spec of the rollout, i.e. was upgraded by it
+func UpgradedBy(templateInstance *tmaxv1.TemplateInstance, rolloutId string) bool {
+	previous, err := getPreviousSpec(templateInstance)
+	return err == nil && previous != nil && previous.Rollout == rolloutId
+}
+
+// RestorePreviousSpec puts back the spec the rollout kept by SavePreviousSpec, which is pinned to the snapshot of the
+// previous revision the objects are rendered from. An instance provisioned before instances were pinned referenced its template as it is, so only its
+// parameters are restored and it is left without revision. It reports false if the template instance keeps none of the
+// rollout.
+func RestorePreviousSpec(templateInstance *tmaxv1.TemplateInstance, rolloutId string) (bool, error) {
+	previous, err := getPreviousSpec(templateInstance)
+	if err != nil || previous == nil || previous.Rollout != rolloutId {
+		return false, err
+	}
+	templateInstance.Spec = previous.spec()
+	copyAnnotations(templateInstance, previous.Annotations, renderedAnnotations...)
+	if _, _, pinned := TemplateSource(previous.Annotations); !pinned {
+		delete(templateInstance.Annotations, TemplateRevisionAnnotation)
+		delete(templateInstance.Annotations, TemplateResourceVersionAnnotation)
+	}
+	delete(templateInstance.Annotations, PreviousSpecAnnotation)
+	return true, nil
+}
+
+func getPreviousSpec(templateInstance *tmaxv1.TemplateInstance) (*previousSpec, error) {
+	raw, ok := templateInstance.Annotations[PreviousSpecAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	previous := &previousSpec{}
+	if err := json.Unmarshal([]byte(raw), previous); err != nil {
+		return nil, fmt.Errorf("cannot read the previous spec of templateinstance %s: %s", templateInstance.Name, err.Error())
+	}
+	return previous, nil
+}
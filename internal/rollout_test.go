@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestRestorePreviousSpec(t *testing.T) {
+	previous := newSnapshotTemplate("ns", "mysql", "5.7")
+	current := newSnapshotTemplate("ns", "mysql", "8.0")
+	previousRevision, err := RevisionOf(previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rendered returns the template instance db rendered from the template, or its snapshot if pinned
+	rendered := func(template *tmaxv1.Template, pinned bool, version string) *tmaxv1.TemplateInstance {
+		var obj interface{} = template
+		if pinned {
+			snapshot, err := NewSnapshot(template, "ns")
+			if err != nil {
+				t.Fatal(err)
+			}
+			obj = snapshot
+		}
+		templateInstance, err := UpdateTemplateInstanceMetadata(obj, newTemplateInstance("ns", "db", "i-1", nil),
+			schemas.ServiceInstanceProvisionRequest{Parameters: map[string]intstr.IntOrString{"VERSION": intstr.FromString(version)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return templateInstance
+	}
+	// upgraded returns the template instance upgraded by rollout-1 from before to the snapshot of the current revision
+	upgraded := func(before *tmaxv1.TemplateInstance) *tmaxv1.TemplateInstance {
+		after := rendered(current, true, "8.0")
+		// the objects of the template instance are not kept, they are rendered from the snapshot
+		before.Spec.Template.Objects = []runtime.RawExtension{{Raw: []byte(`{"kind": "Deployment"}`)}}
+		if err := SavePreviousSpec(before, "rollout-1"); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(before.Annotations[PreviousSpecAnnotation], "Deployment") {
+			t.Fatalf("got the objects kept in the previous spec")
+		}
+		after.Annotations[PreviousSpecAnnotation] = before.Annotations[PreviousSpecAnnotation]
+		return after
+	}
+	legacy := rendered(previous, false, "5.7")
+	legacy.Annotations[TemplateRevisionAnnotation] = previousRevision.Revision
+
+	tests := []struct {
+		name         string
+		instance     *tmaxv1.TemplateInstance
+		rollout      string
+		restored     bool
+		wantTemplate string
+		wantValue    string
+		wantRevision string
+	}{
+		{name: "pinned", instance: upgraded(rendered(previous, true, "5.7")), rollout: "rollout-1", restored: true,
+			wantTemplate: SnapshotName("mysql", previousRevision.Revision), wantValue: "5.7", wantRevision: previousRevision.Revision},
+		{name: "provisioned before pinning", instance: upgraded(legacy), rollout: "rollout-1", restored: true,
+			wantTemplate: "mysql", wantValue: "5.7"},
+		{name: "upgraded by another rollout", instance: upgraded(rendered(previous, true, "5.7")), rollout: "rollout-2"},
+		{name: "not upgraded", instance: rendered(current, true, "8.0"), rollout: "rollout-1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			templateInstance := test.instance.DeepCopy()
+			before := test.instance.DeepCopy()
+			restored, err := RestorePreviousSpec(templateInstance, test.rollout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if restored != test.restored {
+				t.Fatalf("got restored %v, want %v", restored, test.restored)
+			}
+			if !restored {
+				if templateInstance.Spec.Template.Metadata.Name != before.Spec.Template.Metadata.Name {
+					t.Errorf("the template instance is changed")
+				}
+				return
+			}
+
+			if name := templateInstance.Spec.Template.Metadata.Name; name != test.wantTemplate {
+				t.Errorf("got template %s, want %s", name, test.wantTemplate)
+			}
+			if value := InstanceParameters(templateInstance)["VERSION"]; value != test.wantValue {
+				t.Errorf("got VERSION %s, want %s", value, test.wantValue)
+			}
+			if revision := InstanceRevision(templateInstance).Revision; revision != test.wantRevision {
+				t.Errorf("got revision %q, want %q", revision, test.wantRevision)
+			}
+			if UpgradedBy(templateInstance, test.rollout) {
+				t.Errorf("the previous spec is kept after it is restored")
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// A template instance is pinned to the revision it is rendered from by referencing a snapshot: a Template in its namespace
+// with a copy of the spec of the template at that revision. Edits of the template do not change the snapshot, so the
+// template operator keeps rendering the instance as provisioned until it is upgraded to a snapshot of a newer revision.
+const (
+	// SnapshotLabel marks snapshots with their revision. They are no templates of the catalog.
+	SnapshotLabel = "tsb.tmax.io/snapshot"
+	// TemplateSourceAnnotation names the template a snapshot and the template instances pinned to it are taken from, as
+	// Template/<name> or ClusterTemplate/<name>
+	TemplateSourceAnnotation = "tsb.tmax.io/template-source"
+)
+
+const (
+	templateSourceKind        = "Template"
+	clusterTemplateSourceKind = "ClusterTemplate"
+	// maxSnapshotNameLength is the maximum length of a Template name, a DNS subdomain
+	maxSnapshotNameLength = 253
+)
+
+// lastAppliedAnnotation is not copied to snapshots, kubectl would take them for the template it was applied to
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+// SnapshotName is the name of the snapshot of a revision of the template
+func SnapshotName(templateName string, revision string) string {
+	if max := maxSnapshotNameLength - len(revision) - 1; len(templateName) > max {
+		templateName = strings.TrimRight(templateName[:max], "-.")
+	}
+	return templateName + "-" + revision
+}
+
+// IsSnapshot reports whether the template is a snapshot
+func IsSnapshot(template metav1.Object) bool {
+	_, ok := template.GetLabels()[SnapshotLabel]
+	return ok
+}
+
+// NewSnapshot returns the snapshot of the current revision of a Template or ClusterTemplate in the namespace, without
+// creating it. A snapshot is its own snapshot.
+func NewSnapshot(obj interface{}, namespace string) (*tmaxv1.Template, error) {
+	var source string
+	var template metav1.Object
+	var spec tmaxv1.TemplateSpec
+	switch t := obj.(type) {
+	case *tmaxv1.Template:
+		if IsSnapshot(t) {
+			return t, nil
+		}
+		source, template, spec = templateSourceKind+"/"+t.Name, t, t.DeepCopy().TemplateSpec
+	case *tmaxv1.ClusterTemplate:
+		source, template, spec = clusterTemplateSourceKind+"/"+t.Name, t, t.DeepCopy().TemplateSpec
+	default:
+		return nil, fmt.Errorf("%T is no template", obj)
+	}
+	revision, err := RevisionOf(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	// the annotations are kept for what is read from the template along with the spec, e.g. generators and the dashboard url
+	annotations := make(map[string]string)
+	for key, val := range template.GetAnnotations() {
+		if key != lastAppliedAnnotation {
+			annotations[key] = val
+		}
+	}
+	annotations[TemplateSourceAnnotation] = source
+	annotations[TemplateRevisionAnnotation] = revision.Revision
+	annotations[TemplateResourceVersionAnnotation] = revision.ResourceVersion
+
+	snapshot := &tmaxv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        SnapshotName(template.GetName(), revision.Revision),
+			Namespace:   namespace,
+			Labels:      map[string]string{SnapshotLabel: revision.Revision},
+			Annotations: annotations,
+		},
+		TemplateSpec: spec,
+	}
+	return snapshot, nil
+}
+
+// PinTemplate returns the snapshot of the current revision of the template in the namespace, creating it if there is none
+// yet. The template instance, unless nil, is added to its owners, for template instances being created it is added by
+// SyncSnapshotOwners once they are.
+func PinTemplate(ctx context.Context, c client.Client, obj interface{}, namespace string, owner *tmaxv1.TemplateInstance) (*tmaxv1.Template, error) {
+	snapshot, err := NewSnapshot(obj, namespace)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, _, err = pinSnapshot(ctx, c, snapshot, owner)
+	return snapshot, err
+}
+
+// pinSnapshot creates the snapshot unless its revision is pinned already and returns it as stored, created reports whether
+// this call created it
+func pinSnapshot(ctx context.Context, c client.Client, snapshot *tmaxv1.Template, owner *tmaxv1.TemplateInstance) (*tmaxv1.Template, bool, error) {
+	if len(snapshot.ResourceVersion) == 0 {
+		if owner != nil {
+			snapshot.OwnerReferences = []metav1.OwnerReference{snapshotOwnerReference(owner)}
+		}
+		err := c.Create(ctx, snapshot)
+		if err == nil {
+			log.Info(fmt.Sprintf("template snapshot %s is created in %s namespace", snapshot.Name, snapshot.Namespace))
+			return snapshot, true, nil
+		}
+		if !kerrors.IsAlreadyExists(err) {
+			return nil, false, err
+		}
+	}
+
+	// the revision is pinned already, by another instance or an earlier attempt
+	source := snapshot.Annotations[TemplateSourceAnnotation]
+	key := types.NamespacedName{Namespace: snapshot.Namespace, Name: snapshot.Name}
+	snapshot, err := GetTemplate(ctx, c, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if snapshot.Annotations[TemplateSourceAnnotation] != source || !IsSnapshot(snapshot) {
+		return nil, false, fmt.Errorf("cannot pin %s: template %s is no snapshot of it", source, key)
+	}
+	if owner != nil && addSnapshotOwner(snapshot, owner) {
+		if err := c.Update(ctx, snapshot); err != nil {
+			return nil, false, err
+		}
+	}
+	return snapshot, false, nil
+}
+
+// releaseSnapshot deletes a snapshot without owners. An instance pinning it in the meantime changed its resourceVersion,
+// the snapshot is kept then.
+func releaseSnapshot(ctx context.Context, c client.Client, snapshot *tmaxv1.Template) error {
+	precondition := client.Preconditions{UID: &snapshot.UID, ResourceVersion: &snapshot.ResourceVersion}
+	if err := c.Delete(ctx, snapshot, precondition); err != nil && !kerrors.IsNotFound(err) && !kerrors.IsConflict(err) {
+		return err
+	}
+	log.Info(fmt.Sprintf("template snapshot %s is released in %s namespace", snapshot.Name, snapshot.Namespace))
+	return nil
+}
+
+// InstanceSnapshot returns the snapshot the template instance is pinned to, nil for instances provisioned before
+// instances were pinned, which are rendered from their template as it is
+func InstanceSnapshot(ctx context.Context, c client.Client, templateInstance *tmaxv1.TemplateInstance) (*tmaxv1.Template, error) {
+	name := pinnedSnapshotName(templateInstance.Annotations, &templateInstance.Spec)
+	if len(name) == 0 {
+		return nil, nil
+	}
+	return GetTemplate(ctx, c, types.NamespacedName{Namespace: templateInstance.Namespace, Name: name})
+}
+
+// SyncSnapshotOwners makes the template instance an owner of the snapshots it is pinned to, and releases those it is not
+// pinned to anymore. A snapshot is deleted with its last owner, by the API server once the last template instance pinned to
+// it is deleted. The snapshot of the spec a rollout keeps for rolling the instance back stays pinned.
+func SyncSnapshotOwners(ctx context.Context, c client.Client, templateInstance *tmaxv1.TemplateInstance) error {
+	pinned := make(map[string]bool)
+	if name := pinnedSnapshotName(templateInstance.Annotations, &templateInstance.Spec); len(name) != 0 {
+		pinned[name] = true
+	}
+	if previous, err := getPreviousSpec(templateInstance); err == nil && previous != nil {
+		spec := previous.spec()
+		if name := pinnedSnapshotName(previous.Annotations, &spec); len(name) != 0 {
+			pinned[name] = true
+		}
+	}
+
+	snapshots, err := snapshotList(ctx, c, templateInstance.Namespace)
+	if err != nil {
+		return err
+	}
+	for i := range snapshots.Items {
+		snapshot := &snapshots.Items[i]
+		if pinned[snapshot.Name] {
+			delete(pinned, snapshot.Name)
+			if addSnapshotOwner(snapshot, templateInstance) {
+				if err := c.Update(ctx, snapshot); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !removeSnapshotOwner(snapshot, templateInstance) {
+			continue
+		}
+		if len(snapshot.OwnerReferences) != 0 {
+			if err := c.Update(ctx, snapshot); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := releaseSnapshot(ctx, c, snapshot); err != nil {
+			return err
+		}
+	}
+	for name := range pinned {
+		return fmt.Errorf("template snapshot %s of templateinstance %s does not exist", name, templateInstance.Name)
+	}
+	return nil
+}
+
+// TemplateSource returns the template a snapshot or pinned template instance is taken from, ok is false for others
+func TemplateSource(annotations map[string]string) (name string, cluster bool, ok bool) {
+	source, exists := annotations[TemplateSourceAnnotation]
+	if !exists {
+		return "", false, false
+	}
+	kind := source[:strings.Index(source+"/", "/")]
+	name = strings.TrimPrefix(source[len(kind):], "/")
+	switch kind {
+	case templateSourceKind:
+		return name, false, len(name) != 0
+	case clusterTemplateSourceKind:
+		return name, true, len(name) != 0
+	}
+	return "", false, false
+}
+
+// pinnedSnapshotName returns the snapshot a template instance spec with the annotations references, "" if it is not pinned
+func pinnedSnapshotName(annotations map[string]string, spec *tmaxv1.TemplateInstanceSpec) string {
+	if _, _, ok := TemplateSource(annotations); !ok || spec.Template == nil {
+		return ""
+	}
+	return spec.Template.Metadata.Name
+}
+
+func snapshotList(ctx context.Context, c client.Client, namespace string) (*tmaxv1.TemplateList, error) {
+	snapshot, err := labels.NewRequirement(SnapshotLabel, selection.Exists, nil)
+	if err != nil {
+		return nil, err
+	}
+	templates := &tmaxv1.TemplateList{}
+	if err := c.List(ctx, templates, &client.ListOptions{Namespace: namespace, LabelSelector: labels.NewSelector().Add(*snapshot)}); err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+func snapshotOwnerReference(templateInstance *tmaxv1.TemplateInstance) metav1.OwnerReference {
+	return metav1.OwnerReference{
+		APIVersion: SchemeGroupVersion.String(),
+		Kind:       "TemplateInstance",
+		Name:       templateInstance.Name,
+		UID:        templateInstance.UID,
+	}
+}
+
+// addSnapshotOwner adds the template instance to the owners of the snapshot, reporting whether it was not one yet
+func addSnapshotOwner(snapshot *tmaxv1.Template, templateInstance *tmaxv1.TemplateInstance) bool {
+	ref := snapshotOwnerReference(templateInstance)
+	for _, owner := range snapshot.OwnerReferences {
+		if owner.Kind == ref.Kind && owner.Name == ref.Name && owner.UID == ref.UID {
+			return false
+		}
+	}
+	snapshot.OwnerReferences = append(snapshot.OwnerReferences, ref)
+	return true
+}
+
+// removeSnapshotOwner removes the template instance from the owners of the snapshot, reporting whether it was one
+func removeSnapshotOwner(snapshot *tmaxv1.Template, templateInstance *tmaxv1.TemplateInstance) bool {
+	ref := snapshotOwnerReference(templateInstance)
+	var kept []metav1.OwnerReference
+	for _, owner := range snapshot.OwnerReferences {
+		if owner.Kind != ref.Kind || owner.Name != ref.Name || owner.UID != ref.UID {
+			kept = append(kept, owner)
+		}
+	}
+	removed := len(kept) != len(snapshot.OwnerReferences)
+	snapshot.OwnerReferences = kept
+	return removed
+}
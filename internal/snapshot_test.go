@@ -0,0 +1,349 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestSnapshotName(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{name: "short", template: "mysql", want: "mysql-0123456789abcdef"},
+		{name: "long", template: strings.Repeat("a", 300), want: strings.Repeat("a", 236) + "-0123456789abcdef"},
+		{name: "cut at a dash", template: strings.Repeat("a", 235) + "-b", want: strings.Repeat("a", 235) + "-0123456789abcdef"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := SnapshotName(test.template, "0123456789abcdef")
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+			if len(got) > maxSnapshotNameLength {
+				t.Errorf("got %d characters, want at most %d", len(got), maxSnapshotNameLength)
+			}
+		})
+	}
+}
+
+func TestTemplateSource(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        string
+		cluster     bool
+		ok          bool
+	}{
+		{name: "none"},
+		{name: "template", annotations: map[string]string{TemplateSourceAnnotation: "Template/mysql"}, want: "mysql", ok: true},
+		{name: "cluster template", annotations: map[string]string{TemplateSourceAnnotation: "ClusterTemplate/mysql"}, want: "mysql",
+			cluster: true, ok: true},
+		{name: "no name", annotations: map[string]string{TemplateSourceAnnotation: "Template/"}},
+		{name: "no kind", annotations: map[string]string{TemplateSourceAnnotation: "mysql"}},
+		{name: "other kind", annotations: map[string]string{TemplateSourceAnnotation: "Deployment/mysql"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, cluster, ok := TemplateSource(test.annotations)
+			if name != test.want || cluster != test.cluster || ok != test.ok {
+				t.Errorf("got %q, %v, %v, want %q, %v, %v", name, cluster, ok, test.want, test.cluster, test.ok)
+			}
+		})
+	}
+}
+
+// newSnapshotTemplate returns a template of the namespace with a parameter of the default value
+func newSnapshotTemplate(namespace string, name string, value string) *tmaxv1.Template {
+	template := &tmaxv1.Template{ObjectMeta: metav1.ObjectMeta{
+		Namespace:       namespace,
+		Name:            name,
+		ResourceVersion: "7",
+		Labels:          map[string]string{"catalog": "true"},
+		Annotations:     map[string]string{DashboardAnnotation: "https://example.com", lastAppliedAnnotation: "{}"},
+	}}
+	template.Parameters = []tmaxv1.ParamSpec{{Name: "VERSION", Value: intstr.FromString(value)}}
+	return template
+}
+
+func TestNewSnapshot(t *testing.T) {
+	template := newSnapshotTemplate("ns", "mysql", "5.7")
+	clusterTemplate := &tmaxv1.ClusterTemplate{ObjectMeta: template.ObjectMeta, TemplateSpec: template.TemplateSpec}
+	clusterTemplate.Namespace = ""
+	revision, err := RevisionOf(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := NewSnapshot(template, "ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		obj    interface{}
+		source string
+	}{
+		{name: "template", obj: template, source: "Template/mysql"},
+		{name: "cluster template", obj: clusterTemplate, source: "ClusterTemplate/mysql"},
+		{name: "snapshot", obj: snapshot, source: "Template/mysql"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := NewSnapshot(test.obj, "ns")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := SnapshotName("mysql", revision.Revision); got.Name != want || got.Namespace != "ns" {
+				t.Errorf("got snapshot %s/%s, want ns/%s", got.Namespace, got.Name, want)
+			}
+			if !IsSnapshot(got) || got.Labels["catalog"] != "" {
+				t.Errorf("got labels %v, want only the snapshot label", got.Labels)
+			}
+			wantAnnotations := map[string]string{
+				DashboardAnnotation:               "https://example.com",
+				TemplateSourceAnnotation:          test.source,
+				TemplateRevisionAnnotation:        revision.Revision,
+				TemplateResourceVersionAnnotation: "7",
+			}
+			if !reflect.DeepEqual(got.Annotations, wantAnnotations) {
+				t.Errorf("got annotations %v, want %v", got.Annotations, wantAnnotations)
+			}
+			// the snapshot is of the same revision as its template
+			if gotRevision, err := RevisionOf(got); err != nil || gotRevision.Revision != revision.Revision {
+				t.Errorf("got revision %v (%v), want %s", gotRevision, err, revision.Revision)
+			}
+		})
+	}
+
+	if _, err := NewSnapshot(&tmaxv1.TemplateInstance{}, "ns"); err == nil {
+		t.Errorf("got a snapshot of a template instance")
+	}
+}
+
+func TestPinTemplate(t *testing.T) {
+	template := newSnapshotTemplate("ns", "mysql", "5.7")
+	owner := newTemplateInstance("ns", "db", "i-1", nil)
+	other := newTemplateInstance("ns", "other", "i-2", nil)
+	existing := func(owners ...*tmaxv1.TemplateInstance) runtime.Object {
+		snapshot, err := NewSnapshot(template, "ns")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, owner := range owners {
+			addSnapshotOwner(snapshot, owner)
+		}
+		return snapshot
+	}
+	taken := func() runtime.Object {
+		snapshot := existing().(*tmaxv1.Template)
+		snapshot.Annotations[TemplateSourceAnnotation] = "ClusterTemplate/mysql"
+		return snapshot
+	}
+
+	tests := []struct {
+		name     string
+		existing []runtime.Object
+		owner    *tmaxv1.TemplateInstance
+		want     []string
+		err      bool
+	}{
+		{name: "new", want: []string{}},
+		{name: "new with owner", owner: owner, want: []string{"db"}},
+		{name: "existing", existing: []runtime.Object{existing(other)}, owner: owner, want: []string{"db", "other"}},
+		{name: "existing of the owner", existing: []runtime.Object{existing(owner)}, owner: owner, want: []string{"db"}},
+		{name: "name taken by another source", existing: []runtime.Object{taken()}, owner: owner, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newFakeClient(t, test.existing...)
+			snapshot, err := PinTemplate(context.Background(), c, template, "ns", test.owner)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			}
+			if test.err {
+				return
+			}
+
+			stored, err := GetTemplate(context.Background(), c, types.NamespacedName{Namespace: "ns", Name: snapshot.Name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ownerNames(stored); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got owners %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCreateTemplateInstanceSnapshot(t *testing.T) {
+	template := newSnapshotTemplate("ns", "mysql", "5.7")
+	template.Parameters[0].Required = true
+	snapshot, err := NewSnapshot(template, "ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned := snapshot.DeepCopy()
+	addSnapshotOwner(pinned, newTemplateInstance("ns", "other", "i-2", nil))
+	existing := newTemplateInstance("ns", "db", "i-0", nil)
+
+	tests := []struct {
+		name     string
+		existing []runtime.Object
+		version  string
+		want     map[string][]string
+		err      bool
+	}{
+		{name: "created", version: "8.0", want: map[string][]string{snapshot.Name: {"db"}}},
+		{name: "missing parameter", version: "", want: map[string][]string{}, err: true},
+		{name: "instance exists", existing: []runtime.Object{existing}, version: "8.0", want: map[string][]string{}, err: true},
+		{name: "snapshot of another instance", existing: []runtime.Object{pinned, existing}, version: "8.0",
+			want: map[string][]string{snapshot.Name: {"other"}}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newFakeClient(t, test.existing...)
+			request := schemas.ServiceInstanceProvisionRequest{Parameters: map[string]intstr.IntOrString{"VERSION": intstr.FromString(test.version)}}
+			_, err := CreateTemplateInstance(context.Background(), c, template.DeepCopy(), "ns", "db", request, "i-1", "default")
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			}
+
+			// a failed provision leaves no snapshot behind but for those pinned by other instances
+			snapshots, err := snapshotList(context.Background(), c, "ns")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string][]string)
+			for i := range snapshots.Items {
+				got[snapshots.Items[i].Name] = ownerNames(&snapshots.Items[i])
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got snapshots %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSyncSnapshotOwners(t *testing.T) {
+	current := newSnapshotTemplate("ns", "mysql", "8.0")
+	previous := newSnapshotTemplate("ns", "mysql", "5.7")
+	other := newTemplateInstance("ns", "other", "i-2", nil)
+
+	// pinned returns the template instance db rendered from the snapshot of the template
+	pinned := func(template *tmaxv1.Template) *tmaxv1.TemplateInstance {
+		snapshot, err := NewSnapshot(template, "ns")
+		if err != nil {
+			t.Fatal(err)
+		}
+		templateInstance, err := UpdateTemplateInstanceMetadata(snapshot, newTemplateInstance("ns", "db", "i-1", nil),
+			schemas.ServiceInstanceProvisionRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return templateInstance
+	}
+	snapshot := func(template *tmaxv1.Template, owners ...*tmaxv1.TemplateInstance) *tmaxv1.Template {
+		snapshot, err := NewSnapshot(template, "ns")
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshot.UID = types.UID(snapshot.Name)
+		for _, owner := range owners {
+			addSnapshotOwner(snapshot, owner)
+		}
+		return snapshot
+	}
+	db := pinned(current)
+	rolledOut := pinned(previous)
+	if err := SavePreviousSpec(rolledOut, "rollout-1"); err != nil {
+		t.Fatal(err)
+	}
+	rolledOut.Spec = db.Spec
+	copyAnnotations(rolledOut, db.Annotations, renderedAnnotations...)
+	unpinned := newTemplateInstance("ns", "db", "i-1", nil)
+	unpinned.Spec.Template = &tmaxv1.ObjectInfo{Metadata: tmaxv1.MetadataSpec{Name: "mysql"}}
+
+	currentName := snapshot(current).Name
+	previousName := snapshot(previous).Name
+	tests := []struct {
+		name      string
+		instance  *tmaxv1.TemplateInstance
+		snapshots []runtime.Object
+		want      map[string][]string
+		err       bool
+	}{
+		{name: "owns the pinned snapshot", instance: db, snapshots: []runtime.Object{snapshot(current)},
+			want: map[string][]string{currentName: {"db"}}},
+		{name: "releases the previous snapshot", instance: db, snapshots: []runtime.Object{snapshot(current, db), snapshot(previous, db)},
+			want: map[string][]string{currentName: {"db"}}},
+		{name: "keeps the previous snapshot of other instances", instance: db,
+			snapshots: []runtime.Object{snapshot(current, db), snapshot(previous, db, other)},
+			want:      map[string][]string{currentName: {"db"}, previousName: {"other"}}},
+		{name: "keeps the snapshot of the previous spec of a rollout", instance: rolledOut,
+			snapshots: []runtime.Object{snapshot(current), snapshot(previous, rolledOut)},
+			want:      map[string][]string{currentName: {"db"}, previousName: {"db"}}},
+		{name: "unpinned", instance: unpinned, snapshots: []runtime.Object{snapshot(previous, db)},
+			want: map[string][]string{}},
+		{name: "pinned snapshot deleted", instance: db, snapshots: []runtime.Object{snapshot(previous, db)},
+			want: map[string][]string{}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newFakeClient(t, test.snapshots...)
+			err := SyncSnapshotOwners(context.Background(), c, test.instance.DeepCopy())
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			}
+
+			snapshots, err := snapshotList(context.Background(), c, "ns")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string][]string)
+			for i := range snapshots.Items {
+				got[snapshots.Items[i].Name] = ownerNames(&snapshots.Items[i])
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got snapshots %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetTemplateListSkipsSnapshots(t *testing.T) {
+	template := newSnapshotTemplate("ns", "mysql", "5.7")
+	snapshot, err := NewSnapshot(template, "ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newFakeClient(t, template, snapshot)
+
+	templates, err := GetTemplateList(context.Background(), c, "ns", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(templates.Items) != 1 || templates.Items[0].Name != "mysql" {
+		t.Errorf("got %d templates, want mysql only", len(templates.Items))
+	}
+}
+
+func ownerNames(template *tmaxv1.Template) []string {
+	names := []string{}
+	for _, owner := range template.OwnerReferences {
+		names = append(names, owner.Name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"time"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	StateInProgress = "in progress"
+	StateSucceeded  = "succeeded"
+	StateFailed     = "failed"
+)
+
+// ConditionReady is the type of the condition the template operator reports the outcome of rendering a template
+// instance with: True once its objects are created, False if they cannot be
+const ConditionReady = "Ready"
+
+// InstanceState derives the OSB operation state from the Ready condition reported by the template operator. An instance
+// without the condition, or with its status Unknown, is in progress.
+func InstanceState(templateInstance *tmaxv1.TemplateInstance) (string, string) {
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(templateInstance)
+	if err != nil {
+		return StateInProgress, ""
+	}
+	conditions, _, _ := unstructured.NestedSlice(obj, "status", "conditions")
+
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if !ok || condition["type"] != ConditionReady {
+			continue
+		}
+		message, _ := condition["message"].(string)
+		if len(message) == 0 {
+			message, _ = condition["reason"].(string)
+		}
+		switch condition["status"] {
+		case string(metav1.ConditionTrue):
+			return StateSucceeded, message
+		case string(metav1.ConditionFalse):
+			return StateFailed, message
+		}
+	}
+	return StateInProgress, ""
+}
+
+// UpdatedInstanceState is the state of a template instance updated at the given time. A condition the template operator
+// reported for an older generation, or, if it reports no observed generation, within settle of the update, is still
+// in progress, so the state of the instance before the update is not taken for the result of the update.
+func UpdatedInstanceState(templateInstance *tmaxv1.TemplateInstance, updated time.Time, settle time.Duration, now time.Time) (string, string) {
+	state, message := InstanceState(templateInstance)
+	if state == StateInProgress {
+		return state, message
+	}
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(templateInstance)
+	if err != nil {
+		return StateInProgress, ""
+	}
+	if observed, found, err := unstructured.NestedInt64(obj, "status", "observedGeneration"); err == nil && found {
+		if observed < templateInstance.Generation {
+			return StateInProgress, ""
+		}
+		return state, message
+	}
+	if now.Sub(updated) < settle {
+		return StateInProgress, ""
+	}
+	return state, message
+}
+
+// IsSameProvision reports whether the template instance was provisioned with the same attributes as the request
+func IsSameProvision(templateInstance *tmaxv1.TemplateInstance, request schemas.ServiceInstanceProvisionRequest, instanceId string) bool {
+	annotations := templateInstance.Annotations
+	if annotations["instance_id"] != instanceId || annotations["service_id"] != request.ServiceId || annotations["plan_id"] != request.PlanId {
+		return false
+	}
+
+	values := make(map[string]intstr.IntOrString)
+	for _, param := range instanceParameters(templateInstance) {
+		values[param.Name] = param.Value
+	}
+	generated := generatedParameterNames(templateInstance)
+	// parameters unknown to the template are ignored on creation, so they are ignored here as well
+	for name, val := range request.Parameters {
+		if generated[name] && isEmptyValue(val) { // an empty value was generated
+			continue
+		}
+		if current, ok := values[name]; ok && current.String() != val.String() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// templateInstanceWithStatus decodes the status as the template operator reports it
+func templateInstanceWithStatus(t *testing.T, status string) *tmaxv1.TemplateInstance {
+	templateInstance := &tmaxv1.TemplateInstance{}
+	if err := json.Unmarshal([]byte(`{"status": `+status+`}`), templateInstance); err != nil {
+		t.Fatalf("cannot decode status: %s", err.Error())
+	}
+	return templateInstance
+}
+
+func TestInstanceState(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  string
+		state   string
+		message string
+	}{
+		{name: "no status", status: `{}`, state: StateInProgress},
+		{name: "ready", status: `{"conditions": [{"type": "Ready", "status": "True"}]}`, state: StateSucceeded},
+		{
+			name:    "not ready",
+			status:  `{"conditions": [{"type": "Ready", "status": "False", "reason": "CreateFailed", "message": "quota exceeded"}]}`,
+			state:   StateFailed,
+			message: "quota exceeded",
+		},
+		{
+			name:    "reason without message",
+			status:  `{"conditions": [{"type": "Ready", "status": "False", "reason": "CreateFailed"}]}`,
+			state:   StateFailed,
+			message: "CreateFailed",
+		},
+		{name: "unknown", status: `{"conditions": [{"type": "Ready", "status": "Unknown"}]}`, state: StateInProgress},
+		{
+			name:   "other conditions are not taken for failures",
+			status: `{"conditions": [{"type": "ErrorBudget", "status": "True", "reason": "failover"}]}`,
+			state:  StateInProgress,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state, message := InstanceState(templateInstanceWithStatus(t, test.status))
+			if state != test.state || message != test.message {
+				t.Errorf("got (%q, %q), want (%q, %q)", state, message, test.state, test.message)
+			}
+		})
+	}
+}
+
+func TestUpdatedInstanceState(t *testing.T) {
+	updated := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		status     string
+		generation int64
+		now        time.Time
+		state      string
+	}{
+		{
+			name:   "settling without observed generation",
+			status: `{"conditions": [{"type": "Ready", "status": "True"}]}`,
+			now:    updated.Add(10 * time.Second),
+			state:  StateInProgress,
+		},
+		{
+			name:   "settled without observed generation",
+			status: `{"conditions": [{"type": "Ready", "status": "True"}]}`,
+			now:    updated.Add(time.Minute),
+			state:  StateSucceeded,
+		},
+		{
+			name:       "older generation",
+			status:     `{"observedGeneration": 1, "conditions": [{"type": "Ready", "status": "False"}]}`,
+			generation: 2,
+			now:        updated.Add(time.Minute),
+			state:      StateInProgress,
+		},
+		{
+			name:       "observed generation",
+			status:     `{"observedGeneration": 2, "conditions": [{"type": "Ready", "status": "False"}]}`,
+			generation: 2,
+			now:        updated,
+			state:      StateFailed,
+		},
+		{
+			name:   "in progress",
+			status: `{}`,
+			now:    updated.Add(time.Hour),
+			state:  StateInProgress,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			templateInstance := templateInstanceWithStatus(t, test.status)
+			templateInstance.Generation = test.generation
+			if state, _ := UpdatedInstanceState(templateInstance, updated, 30*time.Second, test.now); state != test.state {
+				t.Errorf("got %q, want %q", state, test.state)
+			}
+		})
+	}
+}
+
+func TestIsSameProvision(t *testing.T) {
+	templateInstance := &tmaxv1.TemplateInstance{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		"instance_id":                 "i-1",
+		"service_id":                  "s-1",
+		"plan_id":                     "s-1-0",
+		GeneratedParametersAnnotation: "PASSWORD",
+	}}}
+	templateInstance.Spec.Template = &tmaxv1.ObjectInfo{Parameters: []tmaxv1.ParamSpec{
+		{Name: "PASSWORD", Value: intstr.FromString("generated")},
+		{Name: "STORAGE", Value: intstr.FromString("1Gi")},
+		{Name: "REPLICAS", Value: intstr.FromInt(2)},
+	}}
+
+	tests := []struct {
+		name       string
+		instanceId string
+		planId     string
+		params     map[string]intstr.IntOrString
+		want       bool
+	}{
+		{name: "same", instanceId: "i-1", planId: "s-1-0", params: map[string]intstr.IntOrString{"STORAGE": intstr.FromString("1Gi")}, want: true},
+		{name: "other instance", instanceId: "i-2", planId: "s-1-0", want: false},
+		{name: "other plan", instanceId: "i-1", planId: "s-1-1", want: false},
+		{name: "other value", instanceId: "i-1", planId: "s-1-0", params: map[string]intstr.IntOrString{"STORAGE": intstr.FromString("2Gi")}, want: false},
+		{name: "int as string", instanceId: "i-1", planId: "s-1-0", params: map[string]intstr.IntOrString{"REPLICAS": intstr.FromString("2")}, want: true},
+		{name: "unknown parameter", instanceId: "i-1", planId: "s-1-0", params: map[string]intstr.IntOrString{"DEBUG": intstr.FromString("true")}, want: true},
+		{name: "generated left empty", instanceId: "i-1", planId: "s-1-0", params: map[string]intstr.IntOrString{"PASSWORD": intstr.FromString("")}, want: true},
+		{name: "generated given", instanceId: "i-1", planId: "s-1-0", params: map[string]intstr.IntOrString{"PASSWORD": intstr.FromString("other")}, want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := schemas.ServiceInstanceProvisionRequest{ServiceId: "s-1", PlanId: test.planId, Parameters: test.params}
+			if got := IsSameProvision(templateInstance, request, test.instanceId); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
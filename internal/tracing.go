@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// tracerName is the instrumentation name of the spans of API server calls
+const tracerName = "github.com/tmax-cloud/template-service-broker-go/internal"
+
+// tracedClient starts a span for every API server call, as a child of the span of the OSB request in ctx
+type tracedClient struct {
+	client.Client
+}
+
+// TracedClient instruments the calls of c with spans
+func TracedClient(c client.Client) client.Client {
+	return &tracedClient{Client: c}
+}
+
+func (t *tracedClient) Get(ctx context.Context, key client.ObjectKey, obj runtime.Object) error {
+	ctx, span := startSpan(ctx, "Get", obj, attribute.String("k8s.namespace.name", key.Namespace), attribute.String("k8s.object.name", key.Name))
+	return endSpan(span, t.Client.Get(ctx, key, obj))
+}
+
+func (t *tracedClient) List(ctx context.Context, list runtime.Object, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	attrs := []attribute.KeyValue{attribute.String("k8s.namespace.name", listOpts.Namespace)}
+	if listOpts.LabelSelector != nil {
+		attrs = append(attrs, attribute.String("k8s.label_selector", listOpts.LabelSelector.String()))
+	}
+	ctx, span := startSpan(ctx, "List", list, attrs...)
+	err := t.Client.List(ctx, list, opts...)
+	if err == nil {
+		if items, itemsErr := meta.ExtractList(list); itemsErr == nil {
+			span.SetAttributes(attribute.Int("k8s.items", len(items)))
+		}
+	}
+	return endSpan(span, err)
+}
+
+func (t *tracedClient) Create(ctx context.Context, obj runtime.Object, opts ...client.CreateOption) error {
+	ctx, span := startSpan(ctx, "Create", obj, objectAttributes(obj)...)
+	return endSpan(span, t.Client.Create(ctx, obj, opts...))
+}
+
+func (t *tracedClient) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	ctx, span := startSpan(ctx, "Update", obj, objectAttributes(obj)...)
+	return endSpan(span, t.Client.Update(ctx, obj, opts...))
+}
+
+func (t *tracedClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	ctx, span := startSpan(ctx, "Patch", obj, objectAttributes(obj)...)
+	return endSpan(span, t.Client.Patch(ctx, obj, patch, opts...))
+}
+
+func (t *tracedClient) Delete(ctx context.Context, obj runtime.Object, opts ...client.DeleteOption) error {
+	ctx, span := startSpan(ctx, "Delete", obj, objectAttributes(obj)...)
+	return endSpan(span, t.Client.Delete(ctx, obj, opts...))
+}
+
+// startSpan names the span after the verb and kind, e.g. "k8s Get TemplateInstance"
+func startSpan(ctx context.Context, verb string, obj runtime.Object, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	kind := kindOf(obj)
+	attrs = append(attrs, attribute.String("k8s.verb", verb), attribute.String("k8s.kind", kind))
+	return otel.Tracer(tracerName).Start(ctx, "k8s "+verb+" "+kind,
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// endSpan records only the reason of an API status error, whose message may echo parameter values
+func endSpan(span trace.Span, err error) error {
+	if reason := kerrors.ReasonForError(err); len(reason) != 0 {
+		span.SetStatus(codes.Error, string(reason))
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	return err
+}
+
+func objectAttributes(obj runtime.Object) []attribute.KeyValue {
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil
+	}
+	return []attribute.KeyValue{
+		attribute.String("k8s.namespace.name", accessor.GetNamespace()),
+		attribute.String("k8s.object.name", accessor.GetName()),
+	}
+}
+
+// kindOf prefers the kind set on the object, which unstructured objects always have, over the Go type name
+func kindOf(obj runtime.Object) string {
+	if kind := obj.GetObjectKind().GroupVersionKind().Kind; len(kind) != 0 {
+		return kind
+	}
+	t := reflect.TypeOf(obj)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
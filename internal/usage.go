@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// usageLedgerKey is the key of the ledger in the data of its ConfigMap
+const usageLedgerKey = "ledger.json"
+
+// UsageFinalizer keeps a deleted template instance until an accrual has charged it up to its deletion
+const UsageFinalizer = "tsb.tmax.io/usage"
+
+// PlanCost is the cost amount of a plan per cost period, e.g. 100 KRW
+type PlanCost struct {
+	Amount int    `json:"amount"`
+	Unit   string `json:"unit,omitempty"`
+}
+
+// ChargedPlan is the template, plan and cost an instance is charged as
+type ChargedPlan struct {
+	Template string
+	Plan     string
+	Cost     PlanCost
+}
+
+// Usage is the accrued usage of the instances of one plan in a namespace
+type Usage struct {
+	Namespace string `json:"namespace"`
+	Template  string `json:"template"`
+	Plan      string `json:"plan"`
+	// Instances is the number of instances running at the last accrual
+	Instances     int     `json:"instances"`
+	InstanceHours float64 `json:"instance_hours"`
+	Cost          float64 `json:"cost"`
+	CostUnit      string  `json:"cost_unit,omitempty"`
+}
+
+// UsageLedger is the usage accrued since the ledger was created. Its first accrual charges the running instances
+// from their creation.
+type UsageLedger struct {
+	Since        metav1.Time `json:"since"`
+	AccruedUntil metav1.Time `json:"accrued_until"`
+	Usage        []Usage     `json:"usage"`
+}
+
+// GetUsageLedger reads the ledger from its ConfigMap. A missing ConfigMap is an empty ledger, created on save.
+func GetUsageLedger(ctx context.Context, c client.Client, name types.NamespacedName) (*UsageLedger, *corev1.ConfigMap, error) {
+	configMap := &corev1.ConfigMap{}
+	if err := c.Get(ctx, name, configMap); err != nil {
+		if !kerrors.IsNotFound(err) {
+			return nil, nil, err
+		}
+		configMap = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace}}
+		return &UsageLedger{}, configMap, nil
+	}
+
+	ledger := &UsageLedger{}
+	if data, ok := configMap.Data[usageLedgerKey]; ok {
+		if err := json.Unmarshal([]byte(data), ledger); err != nil {
+			return nil, nil, fmt.Errorf("cannot read usage ledger %s: %s", name, err.Error())
+		}
+	}
+	return ledger, configMap, nil
+}
+
+// SaveUsageLedger writes the ledger to the ConfigMap it was read from, failing with a conflict if it changed since
+func SaveUsageLedger(ctx context.Context, c client.Client, ledger *UsageLedger, configMap *corev1.ConfigMap) error {
+	data, err := json.Marshal(ledger)
+	if err != nil {
+		return err
+	}
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+	configMap.Data[usageLedgerKey] = string(data)
+
+	if len(configMap.ResourceVersion) == 0 {
+		return c.Create(ctx, configMap)
+	}
+	return c.Update(ctx, configMap)
+}
+
+// Accrue charges each instance created by the broker from its creation or the last accrual, whichever is later, until now
+// or its deletion. Deleted instances are only seen while UsageFinalizer keeps them. It returns the usage added by this accrual.
+func (l *UsageLedger) Accrue(templateInstances []tmaxv1.TemplateInstance, planOf func(*tmaxv1.TemplateInstance) ChargedPlan,
+	costPeriod time.Duration, now time.Time) []Usage {
+
+	type key struct{ namespace, template, plan, unit string }
+	index := make(map[key]int)
+	for i := range l.Usage {
+		u := &l.Usage[i]
+		u.Instances = 0
+		index[key{u.Namespace, u.Template, u.Plan, u.CostUnit}] = i
+	}
+
+	var keys []key
+	added := make(map[key]*Usage)
+	for i := range templateInstances {
+		templateInstance := &templateInstances[i]
+		if _, ok := templateInstance.Annotations["instance_id"]; !ok {
+			continue
+		}
+		start := templateInstance.CreationTimestamp.Time
+		if start.Before(l.AccruedUntil.Time) {
+			start = l.AccruedUntil.Time
+		}
+		end := now
+		if templateInstance.DeletionTimestamp != nil && templateInstance.DeletionTimestamp.Time.Before(end) {
+			end = templateInstance.DeletionTimestamp.Time
+		}
+
+		plan := planOf(templateInstance)
+		k := key{templateInstance.Namespace, plan.Template, plan.Plan, plan.Cost.Unit}
+		delta, ok := added[k]
+		if !ok {
+			delta = &Usage{Namespace: k.namespace, Template: k.template, Plan: k.plan, CostUnit: k.unit}
+			added[k] = delta
+			keys = append(keys, k)
+		}
+		if templateInstance.DeletionTimestamp == nil {
+			delta.Instances++
+		}
+		if end.After(start) {
+			hours := end.Sub(start).Hours()
+			delta.InstanceHours += hours
+			delta.Cost += float64(plan.Cost.Amount) * hours / costPeriod.Hours()
+		}
+	}
+
+	deltas := make([]Usage, 0, len(keys))
+	for _, k := range keys {
+		delta := added[k]
+		i, ok := index[k]
+		if !ok {
+			l.Usage = append(l.Usage, Usage{Namespace: k.namespace, Template: k.template, Plan: k.plan, CostUnit: k.unit})
+			i = len(l.Usage) - 1
+		}
+		l.Usage[i].Instances = delta.Instances
+		l.Usage[i].InstanceHours += delta.InstanceHours
+		l.Usage[i].Cost += delta.Cost
+		deltas = append(deltas, *delta)
+	}
+
+	sort.Slice(l.Usage, func(i, j int) bool {
+		a, b := l.Usage[i], l.Usage[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Template != b.Template {
+			return a.Template < b.Template
+		}
+		if a.Plan != b.Plan {
+			return a.Plan < b.Plan
+		}
+		return a.CostUnit < b.CostUnit
+	})
+	if l.Since.IsZero() {
+		l.Since = metav1.NewTime(now)
+	}
+	l.AccruedUntil = metav1.NewTime(now)
+	return deltas
+}
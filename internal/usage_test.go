@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUsageLedgerAccrue(t *testing.T) {
+	now := time.Date(2020, 10, 19, 12, 0, 0, 0, time.UTC)
+	hoursAgo := func(hours int) time.Time { return now.Add(-time.Duration(hours) * time.Hour) }
+
+	// usageInstance returns an instance of the broker in namespace ns created and, unless deleted is zero, deleted hours ago
+	usageInstance := func(name string, plan string, created int, deleted int) tmaxv1.TemplateInstance {
+		templateInstance := newTemplateInstance("ns", name, name, map[string]string{PlanLabel: plan})
+		templateInstance.CreationTimestamp = metav1.NewTime(hoursAgo(created))
+		if deleted != 0 {
+			deletion := metav1.NewTime(hoursAgo(deleted))
+			templateInstance.DeletionTimestamp = &deletion
+		}
+		return *templateInstance
+	}
+	unmanaged := usageInstance("unmanaged", "small", 10, 0)
+	unmanaged.Annotations = nil
+
+	costs := map[string]PlanCost{"small": {Amount: 10, Unit: "$"}, "large": {Amount: 100, Unit: "$"}, "free": {}}
+	planOf := func(templateInstance *tmaxv1.TemplateInstance) ChargedPlan {
+		plan := templateInstance.Labels[PlanLabel]
+		return ChargedPlan{Template: "mysql", Plan: plan, Cost: costs[plan]}
+	}
+
+	tests := []struct {
+		name      string
+		ledger    UsageLedger
+		instances []tmaxv1.TemplateInstance
+		// want is the usage of each plan as {instances, instance-hours, cost}
+		want map[string][3]float64
+	}{
+		{
+			name:      "first accrual from creation",
+			instances: []tmaxv1.TemplateInstance{usageInstance("a", "small", 10, 0), usageInstance("b", "large", 2, 0)},
+			want:      map[string][3]float64{"small": {1, 10, 10}, "large": {1, 2, 20}},
+		},
+		{
+			name:      "since the last accrual",
+			ledger:    UsageLedger{AccruedUntil: metav1.NewTime(hoursAgo(1))},
+			instances: []tmaxv1.TemplateInstance{usageInstance("a", "small", 10, 0), usageInstance("b", "small", 2, 0)},
+			want:      map[string][3]float64{"small": {2, 2, 2}},
+		},
+		{
+			name:      "deleted since the last accrual",
+			ledger:    UsageLedger{AccruedUntil: metav1.NewTime(hoursAgo(3))},
+			instances: []tmaxv1.TemplateInstance{usageInstance("a", "small", 10, 1)},
+			want:      map[string][3]float64{"small": {0, 2, 2}},
+		},
+		{
+			name:      "deleted before the last accrual",
+			ledger:    UsageLedger{AccruedUntil: metav1.NewTime(hoursAgo(1))},
+			instances: []tmaxv1.TemplateInstance{usageInstance("a", "small", 10, 3)},
+			want:      map[string][3]float64{"small": {0, 0, 0}},
+		},
+		{
+			name:      "free plan",
+			instances: []tmaxv1.TemplateInstance{usageInstance("a", "free", 4, 0)},
+			want:      map[string][3]float64{"free": {1, 4, 0}},
+		},
+		{
+			name:      "not created by the broker",
+			instances: []tmaxv1.TemplateInstance{unmanaged},
+			want:      map[string][3]float64{},
+		},
+		{
+			name: "adds to the ledger",
+			ledger: UsageLedger{
+				AccruedUntil: metav1.NewTime(hoursAgo(1)),
+				Usage:        []Usage{{Namespace: "ns", Template: "mysql", Plan: "small", Instances: 3, InstanceHours: 5, Cost: 50, CostUnit: "$"}},
+			},
+			instances: []tmaxv1.TemplateInstance{usageInstance("a", "small", 10, 0)},
+			want:      map[string][3]float64{"small": {1, 6, 51}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ledger := test.ledger
+			// plan costs are per 10 hours
+			ledger.Accrue(test.instances, planOf, 10*time.Hour, now)
+
+			if !ledger.AccruedUntil.Time.Equal(now) {
+				t.Errorf("accrued until %s, want %s", ledger.AccruedUntil.Time, now)
+			}
+			if len(ledger.Usage) != len(test.want) {
+				t.Fatalf("got usage %+v, want %v", ledger.Usage, test.want)
+			}
+			for _, usage := range ledger.Usage {
+				want, ok := test.want[usage.Plan]
+				got := [3]float64{float64(usage.Instances), usage.InstanceHours, usage.Cost}
+				if !ok || math.Abs(got[1]-want[1]) > 1e-9 || math.Abs(got[2]-want[2]) > 1e-9 || got[0] != want[0] {
+					t.Errorf("got %v for plan %s, want %v", got, usage.Plan, want)
+				}
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package internal
 
 import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
 	"os"
 )
 
@@ -11,3 +14,14 @@ func FileExists(path string) bool {
 	}
 	return !info.IsDir()
 }
+
+// PeekBody reads the request body and puts it back so that the handler can still decode it
+func PeekBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, err
+}
@@ -6,19 +6,28 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
 	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/metrics"
 	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type Binding struct {
 	client.Client
-	Log logr.Logger
+	Log      logr.Logger
+	Config   *config.Store
+	Recorder record.EventRecorder
+	Locker   *Locker
 }
 
 // [TODO]: instance.status.(cluster)template 으로 변경해야 하는지 확인필요
@@ -29,55 +38,73 @@ func (b *Binding) BindingServiceInstance(w http.ResponseWriter, r *http.Request)
 	//get request body
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
 		b.Log.Error(err, "error occurs while decoding service binding body")
-		respond(w, http.StatusBadRequest, &schemas.Error{
-			Error:            "Bad Request",
-			Description:      "Cannot decode service binding request body",
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, b.Log)
+		respondError(w, r, badRequest("cannot decode service binding request body: %s", err.Error()).Usable(), b.Log)
 		return
 	}
 
-	//get templateinstance name & namespace
-	instanceName := m.Context.InstanceName
-	instanceNameSpace, err := internal.Namespace()
+	//get templateinstance id & namespace
+	instanceId := mux.Vars(r)["instance_id"]
+	namespaces, err := instanceNamespaces(b.Client, b.Config.Get(), r, m.Context.Namespace)
 	if err != nil {
-		b.Log.Error(err, "cannot get namespace")
-		respond(w, http.StatusInternalServerError, &schemas.Error{
-			Error:            "InternalServerError",
-			Description:      "cannot get namespace. Check it is operated on cluster.",
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, b.Log)
+		b.Log.Error(err, "cannot resolve the namespace of the request")
+		respondError(w, r, err, b.Log)
+		return
 	}
 
 	// get templateinstance info
-	templateInstance, err := internal.GetTemplateInstance(b.Client, types.NamespacedName{Name: instanceName, Namespace: instanceNameSpace})
+	templateInstance, err := findTemplateInstance(r.Context(), b.Client, namespaces, instanceId)
 	if err != nil {
 		b.Log.Error(err, "cannot get templateinstance info")
-		respond(w, http.StatusBadRequest, &schemas.Error{
-			Error:            "BadRequest",
-			Description:      fmt.Sprintf("cannot find templateinstance on the %s namespace", instanceNameSpace),
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, b.Log)
+		respondError(w, r, internalError("cannot get the templateinstance of instance %s", instanceId), b.Log)
+		return
+	}
+	if templateInstance == nil {
+		b.Log.Info(fmt.Sprintf("templateinstance of instance %s does not exist", instanceId))
+		respondError(w, r, notFound("instance %s does not exist in namespace %s", instanceId, strings.Join(namespaces, ", ")), b.Log)
+		return
+	}
+	instanceNameSpace := templateInstance.Namespace
+
+	// validate binding parameters against the plan, of the template the plan ids of the catalog are of
+	templateName, _ := internal.InstanceTemplateName(templateInstance)
+	template, err := internal.GetTemplate(r.Context(), b.Client, types.NamespacedName{Name: templateName, Namespace: instanceNameSpace})
+	if err != nil {
+		b.Log.Error(err, "cannot get template info")
+		respondError(w, r, internalError("cannot get template %s of instance %s in namespace %s: %s",
+			templateName, instanceId, instanceNameSpace, err.Error()).Usable(), b.Log)
+		return
+	}
+	params, err := b.bindingParameters(template.Annotations, &template.TemplateSpec, string(template.UID), m)
+	if err != nil {
+		b.Log.Error(err, "invalid binding request")
+		internal.RecordEvent(b.Recorder, corev1.EventTypeWarning, internal.ReasonInvalidParameters,
+			fmt.Sprintf("cannot bind %s: %s", mux.Vars(r)["binding_id"], err.Error()), templateInstance, template)
+		respondError(w, r, brokerError(err).Usable(), b.Log)
 		return
 	}
 
+	unlock, err := b.Locker.LockInstance(r.Context(), templateInstance, internal.OperationBind)
+	if err != nil {
+		b.Log.Info(fmt.Sprintf("cannot bind instance %s: %s", instanceId, err.Error()))
+		respondError(w, r, brokerError(err).Usable(), b.Log)
+		return
+	}
+	defer unlock()
+
 	//set reponse
 	response := &schemas.ServiceBindingResponse{}
-	if err := b.getBindingInfo(templateInstance.Spec.Template.Objects, instanceNameSpace, response); err != nil {
+	if err := b.getBindingInfo(r.Context(), internal.InstanceObjects(templateInstance), instanceNameSpace, params, response); err != nil {
 		b.Log.Error(err, "Error occurs while get binding info")
-		respond(w, http.StatusBadRequest, &schemas.Error{
-			Error:            "BadRequest",
-			Description:      "Error occurs while get binding info",
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, b.Log)
+		internal.RecordEvent(b.Recorder, corev1.EventTypeWarning, internal.ReasonBindFailed,
+			fmt.Sprintf("cannot bind %s: %s", mux.Vars(r)["binding_id"], err.Error()), templateInstance)
+		respondError(w, r, internalError("cannot collect the credentials of instance %s: %s", instanceId, err.Error()).Usable(), b.Log)
 		return
 	}
+	for key, val := range internal.GeneratedParameters(templateInstance) {
+		response.Credentials[key] = val
+	}
 
-	respond(w, http.StatusOK, response, b.Log)
+	b.respondBound(w, r, templateInstance, response)
 }
 
 func (b *Binding) ClusterBindingServiceInstance(w http.ResponseWriter, r *http.Request) {
@@ -87,44 +114,114 @@ func (b *Binding) ClusterBindingServiceInstance(w http.ResponseWriter, r *http.R
 	//get request body
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
 		b.Log.Error(err, "error occurs while decoding service binding body")
-		w.WriteHeader(http.StatusBadRequest)
+		respondError(w, r, badRequest("cannot decode service binding request body: %s", err.Error()).Usable(), b.Log)
 		return
 	}
 
-	//get templateinstance name & namespace
-	instanceName := m.Context.InstanceName
+	//get templateinstance id & namespace
+	instanceId := mux.Vars(r)["instance_id"]
 	instanceNameSpace := m.Context.Namespace
 
 	// get templateinstance info
-	templateInstance, err := internal.GetTemplateInstance(b.Client, types.NamespacedName{Name: instanceName, Namespace: instanceNameSpace})
+	templateInstance, err := internal.GetTemplateInstanceByInstanceId(r.Context(), b.Client, instanceNameSpace, instanceId)
+	if templateInstance != nil {
+		metrics.SetOffering(r.Context(), templateInstance.Annotations["service_id"], templateInstance.Annotations["plan_id"])
+	}
 	if err != nil {
 		b.Log.Error(err, "cannot get templateinstance info")
-		respond(w, http.StatusBadRequest, &schemas.Error{
-			Error:            "BadRequest",
-			Description:      fmt.Sprintf("cannot find templateinstance on the %s namespace", instanceNameSpace),
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, b.Log)
+		respondError(w, r, internalError("cannot get the templateinstance of instance %s", instanceId), b.Log)
 		return
 	}
+	if templateInstance == nil {
+		b.Log.Info(fmt.Sprintf("templateinstance of instance %s does not exist", instanceId))
+		respondError(w, r, notFound("instance %s does not exist", instanceId), b.Log)
+		return
+	}
+	instanceNameSpace = templateInstance.Namespace
+
+	// validate binding parameters against the plan, of the cluster template the plan ids of the catalog are of
+	templateName, _ := internal.InstanceTemplateName(templateInstance)
+	template, err := internal.GetClusterTemplate(r.Context(), b.Client, types.NamespacedName{Name: templateName})
+	if err != nil {
+		b.Log.Error(err, "cannot get clustertemplate info")
+		respondError(w, r, internalError("cannot get clustertemplate %s of instance %s: %s",
+			templateName, instanceId, err.Error()).Usable(), b.Log)
+		return
+	}
+	params, err := b.bindingParameters(template.Annotations, &template.TemplateSpec, string(template.UID), m)
+	if err != nil {
+		b.Log.Error(err, "invalid binding request")
+		internal.RecordEvent(b.Recorder, corev1.EventTypeWarning, internal.ReasonInvalidParameters,
+			fmt.Sprintf("cannot bind %s: %s", mux.Vars(r)["binding_id"], err.Error()), templateInstance, template)
+		respondError(w, r, brokerError(err).Usable(), b.Log)
+		return
+	}
+
+	unlock, err := b.Locker.LockInstance(r.Context(), templateInstance, internal.OperationBind)
+	if err != nil {
+		b.Log.Info(fmt.Sprintf("cannot bind instance %s: %s", instanceId, err.Error()))
+		respondError(w, r, brokerError(err).Usable(), b.Log)
+		return
+	}
+	defer unlock()
 
 	//set reponse
 	response := &schemas.ServiceBindingResponse{}
-	if err := b.getBindingInfo(templateInstance.Spec.ClusterTemplate.Objects, instanceNameSpace, response); err != nil {
+	if err := b.getBindingInfo(r.Context(), internal.InstanceObjects(templateInstance), instanceNameSpace, params, response); err != nil {
 		b.Log.Error(err, "Error occurs while get binding info")
-		respond(w, http.StatusBadRequest, &schemas.Error{
-			Error:            "BadRequest",
-			Description:      "Error occurs while get binding info",
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, b.Log)
+		internal.RecordEvent(b.Recorder, corev1.EventTypeWarning, internal.ReasonBindFailed,
+			fmt.Sprintf("cannot bind %s: %s", mux.Vars(r)["binding_id"], err.Error()), templateInstance)
+		respondError(w, r, internalError("cannot collect the credentials of instance %s: %s", instanceId, err.Error()).Usable(), b.Log)
 		return
 	}
+	for key, val := range internal.GeneratedParameters(templateInstance) {
+		response.Credentials[key] = val
+	}
 
-	respond(w, http.StatusOK, response, b.Log)
+	b.respondBound(w, r, templateInstance, response)
 }
 
-func (b *Binding) getBindingInfo(objects []runtime.RawExtension, ns string, response *schemas.ServiceBindingResponse) error {
+// bindingParameters checks that the requested plan is bindable and validates the binding parameters declared for it
+func (b *Binding) bindingParameters(annotations map[string]string, templateSpec *tmaxv1.TemplateSpec, templateUid string,
+	request schemas.ServiceBindingRequest) (map[string]string, error) {
+
+	bindingConfig, err := internal.ParseBindingConfig(annotations)
+	if err != nil {
+		return nil, internalError("binding configuration of service %s is invalid: %s", templateUid, err.Error())
+	}
+
+	plan, err := findPlan(*templateSpec, templateUid, request.PlanId)
+	if err != nil {
+		return nil, err
+	}
+
+	planName := ""
+	bindable := serviceBindable(bindingConfig, templateSpec, b.Log)
+	if plan != nil {
+		planName = plan.Name
+		if planBindable := planBindable(bindingConfig, *plan); planBindable != nil {
+			bindable = *planBindable
+		}
+	}
+	if !bindable {
+		return nil, badRequest("plan %s is not bindable", request.PlanId)
+	}
+	if bindingConfig.RequiresApp && len(request.BindResource.AppGuid) == 0 {
+		return nil, requiresApp("bindings of plan %s require bind_resource.app_guid", request.PlanId)
+	}
+
+	params, err := internal.ValidateBindingParameters(bindingConfig.PlanParameters(planName), request.Parameters)
+	if err != nil {
+		redactor := internal.NewRedactor(annotations)
+		for name, value := range request.Parameters {
+			redactor.Add(name, value)
+		}
+		return nil, redactor.Error(err)
+	}
+	return params, nil
+}
+
+func (b *Binding) getBindingInfo(ctx context.Context, objects []runtime.RawExtension, ns string, params map[string]string, response *schemas.ServiceBindingResponse) error {
 	response.Credentials = make(map[string]interface{})
 
 	for _, object := range objects {
@@ -136,13 +233,24 @@ func (b *Binding) getBindingInfo(objects []runtime.RawExtension, ns string, resp
 
 		//get kind, namespace, name of object
 		kind := unmarshaledObject["kind"].(string)
-		name := unmarshaledObject["metadata"].(map[string]interface{})["name"].(string)
+		metadata := unmarshaledObject["metadata"].(map[string]interface{})
+		name := metadata["name"].(string)
+
+		//skip objects excluded from binding or not matching the binding parameters
+		if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+			if bind, ok := annotations[internal.BindAnnotation].(string); ok && bind == "false" {
+				continue
+			}
+			if condition, ok := annotations[internal.BindIfAnnotation].(string); ok && !internal.MatchBindCondition(condition, params) {
+				continue
+			}
+		}
 		if kind == "Service" {
 			//set endpoint in case of service
 			service := &corev1.Service{}
-			if err := b.Client.Get(context.TODO(), types.NamespacedName{Namespace: ns, Name: name}, service); err != nil {
+			if err := b.Client.Get(ctx, types.NamespacedName{Namespace: ns, Name: name}, service); err != nil {
 				b.Log.Error(err, "error occurs while get service info")
-				return err
+				return fmt.Errorf("cannot get service %s/%s: %s", ns, name, err.Error())
 			}
 			if service.Spec.Type == corev1.ServiceTypeLoadBalancer {
 				ports := []string{}
@@ -161,9 +269,9 @@ func (b *Binding) getBindingInfo(objects []runtime.RawExtension, ns string, resp
 		if kind == "Secret" {
 			//set credentials in case of secret
 			secret := &corev1.Secret{}
-			if err := b.Client.Get(context.TODO(), types.NamespacedName{Namespace: ns, Name: name}, secret); err != nil {
+			if err := b.Client.Get(ctx, types.NamespacedName{Namespace: ns, Name: name}, secret); err != nil {
 				b.Log.Error(err, "error occurs while get secret info")
-				return err
+				return fmt.Errorf("cannot get secret %s/%s: %s", ns, name, err.Error())
 			}
 			for key, val := range secret.Data {
 				response.Credentials[key] = string(val)
@@ -179,6 +287,83 @@ func (b *Binding) getBindingInfo(objects []runtime.RawExtension, ns string, resp
 	return nil
 }
 
+// respondBound records the binding on the template instance and replies 201 for a new binding, 200 for an existing one
+func (b *Binding) respondBound(w http.ResponseWriter, r *http.Request, templateInstance *tmaxv1.TemplateInstance, response *schemas.ServiceBindingResponse) {
+	bindingId := mux.Vars(r)["binding_id"]
+	added, err := internal.AddBindingLabel(r.Context(), b.Client, templateInstance, bindingId)
+	if err != nil {
+		b.Log.Error(err, "error occurs while recording binding")
+		internal.RecordEvent(b.Recorder, corev1.EventTypeWarning, internal.ReasonBindFailed,
+			fmt.Sprintf("cannot bind %s: %s", bindingId, err.Error()), templateInstance)
+		respondError(w, r, brokerError(err).Usable(), b.Log)
+		return
+	}
+	if added {
+		internal.RecordEvent(b.Recorder, corev1.EventTypeNormal, internal.ReasonBound,
+			fmt.Sprintf("binding %s is created", bindingId), templateInstance)
+		respond(w, http.StatusCreated, response, b.Log)
+		return
+	}
+	respond(w, http.StatusOK, response, b.Log)
+}
+
 func (b *Binding) UnBindingServiceInstance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	namespaces, err := candidateNamespaces(b.Client, b.Config.Get(), r)
+	if err != nil {
+		b.Log.Error(err, "cannot resolve the namespace of the request")
+		respondError(w, r, err, b.Log)
+		return
+	}
+	b.unbind(w, r, namespaces)
+}
+
+func (b *Binding) ClusterUnBindingServiceInstance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	b.unbind(w, r, []string{""})
+}
+
+func (b *Binding) unbind(w http.ResponseWriter, r *http.Request, namespaces []string) {
+	vars := mux.Vars(r)
+	instanceId := vars["instance_id"]
+	bindingId := vars["binding_id"]
+
+	templateInstance, err := findTemplateInstance(r.Context(), b.Client, namespaces, instanceId)
+	if err != nil {
+		b.Log.Error(err, "cannot get templateinstance info")
+		respondError(w, r, internalError("cannot get the templateinstance of instance %s", instanceId).Usable(), b.Log)
+		return
+	}
+	if templateInstance == nil {
+		b.Log.Info(fmt.Sprintf("templateinstance of instance %s does not exist", instanceId))
+		respond(w, http.StatusGone, schemas.ServiceInstanceProvisionResponse{}, b.Log)
+		return
+	}
+
+	unlock, err := b.Locker.LockInstance(r.Context(), templateInstance, internal.OperationUnbind)
+	if err != nil {
+		b.Log.Info(fmt.Sprintf("cannot unbind instance %s: %s", instanceId, err.Error()))
+		respondError(w, r, brokerError(err).Usable(), b.Log)
+		return
+	}
+	defer unlock()
+
+	removed, err := internal.RemoveBindingLabel(r.Context(), b.Client, templateInstance, bindingId)
+	if err != nil {
+		b.Log.Error(err, "error occurs while removing binding")
+		internal.RecordEvent(b.Recorder, corev1.EventTypeWarning, internal.ReasonUnbindFailed,
+			fmt.Sprintf("cannot unbind %s: %s", bindingId, err.Error()), templateInstance)
+		respondError(w, r, brokerError(err).Usable(), b.Log)
+		return
+	}
+	if !removed {
+		b.Log.Info(fmt.Sprintf("binding %s does not exist", bindingId))
+		respond(w, http.StatusGone, schemas.ServiceInstanceProvisionResponse{}, b.Log)
+		return
+	}
+
+	internal.RecordEvent(b.Recorder, corev1.EventTypeNormal, internal.ReasonUnbound,
+		fmt.Sprintf("binding %s is deleted", bindingId), templateInstance)
 	respond(w, http.StatusOK, schemas.ServiceInstanceProvisionResponse{}, b.Log)
 }
@@ -9,17 +9,21 @@ import (
 
 	"github.com/go-logr/logr"
 	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/kubernetes-sigs/service-catalog/pkg/controller"
 	"github.com/kubernetes-sigs/service-catalog/pkg/util"
 	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/metrics"
 	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
 )
 
 type Catalog struct {
 	client.Client
-	Log logr.Logger
+	Log    logr.Logger
+	Config *config.Store
 }
 
 func (c *Catalog) GetCatalog(w http.ResponseWriter, r *http.Request) {
@@ -27,36 +31,30 @@ func (c *Catalog) GetCatalog(w http.ResponseWriter, r *http.Request) {
 	response := &schemas.Catalog{}
 	w.Header().Set("Content-Type", "application/json")
 
-	namespace, err := internal.Namespace()
+	namespace, err := targetNamespace(c.Client, c.Config.Get(), r, "")
 	if err != nil {
-		c.Log.Error(err, "cannot get namespace")
-		respond(w, http.StatusInternalServerError, &schemas.Error{
-			Error:            "InternalServerError",
-			Description:      "cannot get namespace. Check it is operated on cluster.",
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, c.Log)
+		c.Log.Error(err, "cannot resolve the namespace of the request")
+		respondError(w, r, err, c.Log)
 		return
 	}
 
 	// get templatelist
-	templateList, err := internal.GetTemplateList(c.Client, namespace)
+	templateList, err := internal.GetTemplateList(r.Context(), c.Client, namespace, c.Config.Get().Catalog.Selector())
 	if err != nil {
 		c.Log.Error(err, "error occurs while getting templateList")
-		respond(w, http.StatusInternalServerError, &schemas.Error{
-			Error:            "InternalServerError",
-			Description:      fmt.Sprintf("cannot find templateList on the %s namespace", namespace),
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, c.Log)
+		respondError(w, r, internalError("cannot list templates in namespace %s", namespace), c.Log)
 		return
 	}
 
 	for _, template := range templateList.Items {
+		if !c.Config.Get().Catalog.Matches(template.Tags) {
+			continue
+		}
 		//make service
-		service := c.MakeService(template.Name, &template.TemplateSpec, string(template.UID))
+		service := c.MakeService(template.Name, template.Annotations, &template.TemplateSpec, string(template.UID))
 		response.Services = append(response.Services, service)
 	}
+	metrics.CatalogServices.Set(float64(len(response.Services)))
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
@@ -67,34 +65,35 @@ func (c *Catalog) GetClusterCatalog(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	// get templatelist
-	clusterTemplateList, err := internal.GetClusterTemplateList(c.Client)
+	clusterTemplateList, err := internal.GetClusterTemplateList(r.Context(), c.Client, c.Config.Get().Catalog.Selector())
 	if err != nil {
 		c.Log.Error(err, "error occurs while getting templateList")
-		respond(w, http.StatusInternalServerError, &schemas.Error{
-			Error:            "InternalServerError",
-			Description:      "cannot find cluster-templateList",
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, c.Log)
+		respondError(w, r, internalError("cannot list clustertemplates"), c.Log)
+		return
 	}
 
 	for _, template := range clusterTemplateList.Items {
+		if !c.Config.Get().Catalog.Matches(template.Tags) {
+			continue
+		}
 		//make service
-		service := c.MakeService(template.Name, &template.TemplateSpec, string(template.UID))
+		service := c.MakeService(template.Name, template.Annotations, &template.TemplateSpec, string(template.UID))
 		response.Services = append(response.Services, service)
 	}
+	metrics.CatalogServices.Set(float64(len(response.Services)))
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
 
-func (c *Catalog) MakeService(templateName string, templateSpec *tmaxv1.TemplateSpec, uid string) schemas.Service {
+func (c *Catalog) MakeService(templateName string, annotations map[string]string, templateSpec *tmaxv1.TemplateSpec, uid string) schemas.Service {
 	//create service struct
 	service := schemas.Service{
-		Name:        templateName,
-		Id:          uid,
-		Description: templateSpec.ShortDescription,
-		Tags:        templateSpec.Tags,
-		Bindable:    false,
+		Name:                 templateName,
+		Id:                   uid,
+		Description:          templateSpec.ShortDescription,
+		Tags:                 templateSpec.Tags,
+		Bindable:             false,
+		InstancesRetrievable: true,
 		Metadata: map[string]interface{}{
 			"serviceClassRefName": util.GenerateSHA(controller.GenerateEscapedName(uid)),
 			"imageUrl":            templateSpec.ImageUrl,
@@ -107,17 +106,33 @@ func (c *Catalog) MakeService(templateName string, templateSpec *tmaxv1.Template
 		},
 		PlanUpdateable: false,
 	}
+	//binding configuration declared on the template
+	bindingConfig, err := internal.ParseBindingConfig(annotations)
+	if err != nil {
+		c.Log.Error(err, "cannot parse binding configuration", "template", templateName)
+		bindingConfig = &internal.BindingConfig{}
+	}
+
+	//generated parameters are optional because the broker fills them in
+	generators, err := internal.ParseGenerators(annotations)
+	if err != nil {
+		c.Log.Error(err, "cannot parse parameter generators", "template", templateName)
+		generators = map[string]*internal.Generator{}
+	}
+
 	//default parameter setting
 	properties := make(map[string]schemas.PropertiesSpec)
 	var requiredParamters []string
 	for _, parameter := range templateSpec.Parameters {
 		property := schemas.PropertiesSpec{
-			Default:     parameter.Value,
+			Default:     defaultValue(parameter.Value),
 			Description: parameter.Description,
 			Type:        parameter.ValueType,
 			Regex:       parameter.Regex,
 		}
-		if parameter.Required {
+		if generator, ok := generators[parameter.Name]; ok {
+			property.Description = strings.TrimSpace(fmt.Sprintf("%s (generated as %s if omitted)", parameter.Description, generator.Type))
+		} else if parameter.Required {
 			requiredParamters = append(requiredParamters, parameter.Name)
 		}
 		properties[parameter.Name] = property
@@ -131,7 +146,7 @@ func (c *Catalog) MakeService(templateName string, templateSpec *tmaxv1.Template
 		for key := range properties {
 			property := properties[key]
 			if paramVal, ok := planParameters[key]; ok {
-				property.Default = paramVal
+				property.Default = &paramVal
 				property.Fixed = true
 			} else {
 				property.Fixed = false
@@ -151,7 +166,7 @@ func (c *Catalog) MakeService(templateName string, templateSpec *tmaxv1.Template
 				DisplayName: templatePlan.Metadata.DisplayName,
 			},
 			Free:                   templatePlan.Free,
-			Bindable:               templatePlan.Bindable,
+			Bindable:               planBindable(bindingConfig, templatePlan),
 			PlanUpdateable:         templatePlan.PlanUpdateable,
 			MaximumPollingDuration: templatePlan.MaximumPollingDuration,
 			MaintenanceInfo: schemas.MaintenanceInfo{
@@ -167,6 +182,7 @@ func (c *Catalog) MakeService(templateName string, templateSpec *tmaxv1.Template
 						},
 					},
 				},
+				ServiceBinding: bindingSchema(bindingConfig.PlanParameters(templatePlan.Name)),
 			},
 		}
 		if len(plan.Name) == 0 {
@@ -194,30 +210,86 @@ func (c *Catalog) MakeService(templateName string, templateSpec *tmaxv1.Template
 						},
 					},
 				},
+				ServiceBinding: bindingSchema(bindingConfig.Parameters),
 			},
 		}
 		service.Plans = append(service.Plans, plan)
 	}
 
 	//Bindable check
+	service.Bindable = serviceBindable(bindingConfig, templateSpec, c.Log)
+	return service
+}
+
+func serviceBindable(bindingConfig *internal.BindingConfig, templateSpec *tmaxv1.TemplateSpec, log logr.Logger) bool {
+	if bindingConfig.Bindable != nil {
+		return *bindingConfig.Bindable
+	}
 	for _, object := range templateSpec.Objects {
 		var raw map[string]interface{}
 		if err := json.Unmarshal(object.Raw, &raw); err != nil {
-			c.Log.Error(err, "cannot get object info")
+			log.Error(err, "cannot get object info")
 		}
 		//get kind, namespace, name of object
 		kind, ok := raw["kind"].(string)
 		if !ok {
-			c.Log.Info("Checking bindablity is failed")
+			log.Info("Checking bindablity is failed")
 			break
 		}
 
-		if strings.Contains(kind, "Service") || strings.Contains(kind, "Secret") {
-			service.Bindable = true
-			break
+		if kind == "Service" || kind == "Secret" {
+			return true
 		}
 	}
-	return service
+	return false
+}
+
+func planBindable(bindingConfig *internal.BindingConfig, templatePlan tmaxv1.PlanSpec) *bool {
+	if bindable := bindingConfig.PlanBindable(templatePlan.Name); bindable != nil {
+		return bindable
+	}
+	if templatePlan.Bindable {
+		bindable := true
+		return &bindable
+	}
+	return nil
+}
+
+func bindingSchema(parameters []internal.BindingParamSpec) schemas.ServiceBindingSchema {
+	if len(parameters) == 0 {
+		return schemas.ServiceBindingSchema{}
+	}
+
+	properties := make(map[string]schemas.PropertiesSpec)
+	var required []string
+	for _, parameter := range parameters {
+		properties[parameter.Name] = schemas.PropertiesSpec{
+			Default:     defaultValue(intstr.FromString(parameter.Default)),
+			Description: parameter.Description,
+			Type:        "string",
+			Enum:        parameter.Enum,
+		}
+		if parameter.Required {
+			required = append(required, parameter.Name)
+		}
+	}
+	return schemas.ServiceBindingSchema{
+		Create: schemas.SchemaParameters{
+			Parameters: schemas.SchemaParameterSpec{
+				Properties: properties,
+				Required:   required,
+			},
+		},
+	}
+}
+
+// defaultValue returns the value as the default of a property, nil for a parameter without a value so that no
+// default is declared
+func defaultValue(val intstr.IntOrString) *intstr.IntOrString {
+	if val == (intstr.IntOrString{}) || (val.Type == intstr.String && len(val.StrVal) == 0) {
+		return nil
+	}
+	return &val
 }
 
 func respond(w http.ResponseWriter, statusCode int, body interface{}, log logr.Logger) {
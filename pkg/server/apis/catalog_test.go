@@ -0,0 +1,93 @@
+package apis
+
+import (
+	"reflect"
+	"testing"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestBindingSchema(t *testing.T) {
+	readOnly := intstr.FromString("read-only")
+	tests := []struct {
+		name       string
+		parameters []internal.BindingParamSpec
+		properties map[string]schemas.PropertiesSpec
+		required   []string
+	}{
+		{name: "no parameters"},
+		{
+			name: "default only when given",
+			parameters: []internal.BindingParamSpec{
+				{Name: "role", Description: "access", Default: "read-only", Enum: []string{"read-only", "read-write"}},
+				{Name: "user", Required: true},
+			},
+			properties: map[string]schemas.PropertiesSpec{
+				"role": {Default: &readOnly, Description: "access", Type: "string", Enum: []string{"read-only", "read-write"}},
+				"user": {Type: "string"},
+			},
+			required: []string{"user"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schema := bindingSchema(test.parameters)
+			parameters := schema.Create.Parameters
+			if !reflect.DeepEqual(parameters.Properties, test.properties) {
+				t.Errorf("properties %+v, want %+v", parameters.Properties, test.properties)
+			}
+			if !reflect.DeepEqual(parameters.Required, test.required) {
+				t.Errorf("required %v, want %v", parameters.Required, test.required)
+			}
+		})
+	}
+}
+
+func TestDefaultValue(t *testing.T) {
+	tests := []struct {
+		name string
+		val  intstr.IntOrString
+		want *intstr.IntOrString
+	}{
+		{name: "unset", val: intstr.IntOrString{}},
+		{name: "empty string", val: intstr.FromString("")},
+		{name: "string", val: intstr.FromString("1Gi"), want: &intstr.IntOrString{Type: intstr.String, StrVal: "1Gi"}},
+		{name: "int", val: intstr.FromInt(3), want: &intstr.IntOrString{Type: intstr.Int, IntVal: 3}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := defaultValue(test.val); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPlanBindable(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name     string
+		config   *internal.BindingConfig
+		plan     tmaxv1.PlanSpec
+		bindable *bool
+	}{
+		{name: "inherited", config: &internal.BindingConfig{}, plan: tmaxv1.PlanSpec{Name: "small"}},
+		{name: "plan spec", config: &internal.BindingConfig{}, plan: tmaxv1.PlanSpec{Name: "small", Bindable: true}, bindable: &yes},
+		{
+			name:     "annotation overrides plan spec",
+			config:   &internal.BindingConfig{Plans: map[string]internal.PlanBindingConfig{"small": {Bindable: &no}}},
+			plan:     tmaxv1.PlanSpec{Name: "small", Bindable: true},
+			bindable: &no,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := planBindable(test.config, test.plan); !reflect.DeepEqual(got, test.bindable) {
+				t.Errorf("got %v, want %v", got, test.bindable)
+			}
+		})
+	}
+}
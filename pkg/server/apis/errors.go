@@ -0,0 +1,150 @@
+package apis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// OSB error codes
+const (
+	ErrorAsyncRequired           = "AsyncRequired"
+	ErrorConcurrency             = "ConcurrencyError"
+	ErrorRequiresApp             = "RequiresApp"
+	ErrorMaintenanceInfoConflict = "MaintenanceInfoConflict"
+	// ErrorQuotaExceeded and ErrorTooManyRequests are not defined by OSB, platforms show them with the description
+	ErrorQuotaExceeded   = "QuotaExceeded"
+	ErrorTooManyRequests = "TooManyRequests"
+
+	errorBadRequest     = "BadRequest"
+	errorNotFound       = "NotFound"
+	errorConflict       = "Conflict"
+	errorInternalServer = "InternalServerError"
+	errorTimeout        = "Timeout"
+)
+
+// BrokerError is a failed broker operation together with the HTTP status and OSB error body it is answered with
+type BrokerError struct {
+	Status           int
+	Code             string
+	Description      string
+	InstanceUsable   bool
+	UpdateRepeatable bool
+}
+
+func (e *BrokerError) Error() string {
+	return fmt.Sprintf("%s (%d): %s", e.Code, e.Status, e.Description)
+}
+
+// Usable marks the instance as still usable after the failed operation
+func (e *BrokerError) Usable() *BrokerError {
+	e.InstanceUsable = true
+	return e
+}
+
+// Repeatable marks the failed update as repeatable
+func (e *BrokerError) Repeatable() *BrokerError {
+	e.UpdateRepeatable = true
+	return e
+}
+
+func newBrokerError(status int, code string, format string, args ...interface{}) *BrokerError {
+	return &BrokerError{Status: status, Code: code, Description: fmt.Sprintf(format, args...)}
+}
+
+func badRequest(format string, args ...interface{}) *BrokerError {
+	return newBrokerError(http.StatusBadRequest, errorBadRequest, format, args...)
+}
+
+func notFound(format string, args ...interface{}) *BrokerError {
+	return newBrokerError(http.StatusNotFound, errorNotFound, format, args...)
+}
+
+func conflict(format string, args ...interface{}) *BrokerError {
+	return newBrokerError(http.StatusConflict, errorConflict, format, args...)
+}
+
+func internalError(format string, args ...interface{}) *BrokerError {
+	return newBrokerError(http.StatusInternalServerError, errorInternalServer, format, args...)
+}
+
+func asyncRequired(format string, args ...interface{}) *BrokerError {
+	return newBrokerError(http.StatusUnprocessableEntity, ErrorAsyncRequired, format, args...)
+}
+
+func concurrencyError(format string, args ...interface{}) *BrokerError {
+	return newBrokerError(http.StatusUnprocessableEntity, ErrorConcurrency, format, args...)
+}
+
+func requiresApp(format string, args ...interface{}) *BrokerError {
+	return newBrokerError(http.StatusUnprocessableEntity, ErrorRequiresApp, format, args...)
+}
+
+func maintenanceInfoConflict(format string, args ...interface{}) *BrokerError {
+	return newBrokerError(http.StatusUnprocessableEntity, ErrorMaintenanceInfoConflict, format, args...)
+}
+
+// brokerError maps a failure of an internal function to the broker error it is answered with
+func brokerError(err error) *BrokerError {
+	switch e := err.(type) {
+	case *BrokerError:
+		return e
+	case *internal.ParameterError:
+		return badRequest("%s", e.Error())
+	case *internal.LeaseHeldError:
+		return concurrencyError("%s, retry after it completes", e.Error())
+	case *notServedError:
+		return notFound("%s", e.Error())
+	}
+
+	switch {
+	case kerrors.IsNotFound(err):
+		return notFound("%s", err.Error())
+	case kerrors.IsAlreadyExists(err):
+		return conflict("%s", err.Error())
+	case kerrors.IsConflict(err):
+		return concurrencyError("%s was modified concurrently, retry the request", conflictingObject(err))
+	}
+	return internalError("%s", err.Error())
+}
+
+func conflictingObject(err error) string {
+	if status, ok := err.(kerrors.APIStatus); ok && status.Status().Details != nil {
+		details := status.Status().Details
+		return fmt.Sprintf("%s %s", details.Kind, details.Name)
+	}
+	return "the object"
+}
+
+func quotaExceeded(format string, args ...interface{}) *BrokerError {
+	return newBrokerError(http.StatusUnprocessableEntity, ErrorQuotaExceeded, format, args...)
+}
+
+func timeout(format string, args ...interface{}) *BrokerError {
+	return newBrokerError(http.StatusGatewayTimeout, errorTimeout, format, args...)
+}
+
+// isTimeout reports whether err comes from an expired deadline of the request or the API server
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || kerrors.IsTimeout(err) || kerrors.IsServerTimeout(err)
+}
+
+// respondError writes the OSB error body of err. Any failure after the deadline of the request is answered as a timeout.
+func respondError(w http.ResponseWriter, r *http.Request, err error, log logr.Logger) {
+	e := brokerError(err)
+	if r.Context().Err() == context.DeadlineExceeded || isTimeout(err) {
+		e = timeout("the operation did not complete in time, retry the request")
+	}
+	respond(w, e.Status, &schemas.Error{
+		Error:            e.Code,
+		Description:      e.Description,
+		InstanceUsable:   e.InstanceUsable,
+		UpdateRepeatable: e.UpdateRepeatable,
+	}, log)
+}
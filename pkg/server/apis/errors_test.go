@@ -0,0 +1,94 @@
+package apis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestBrokerError(t *testing.T) {
+	resource := schema.GroupResource{Group: "tmax.io", Resource: "templateinstances"}
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{name: "broker error", err: maintenanceInfoConflict("outdated"), status: http.StatusUnprocessableEntity, code: ErrorMaintenanceInfoConflict},
+		{name: "parameter", err: &internal.ParameterError{Name: "PASSWORD", Message: "required"}, status: http.StatusBadRequest, code: errorBadRequest},
+		{name: "lease", err: &internal.LeaseHeldError{InstanceId: "i-1", Operation: "update"}, status: http.StatusUnprocessableEntity, code: ErrorConcurrency},
+		{name: "not served", err: &notServedError{namespace: "team-c"}, status: http.StatusNotFound, code: errorNotFound},
+		{name: "not found", err: kerrors.NewNotFound(resource, "db"), status: http.StatusNotFound, code: errorNotFound},
+		{name: "already exists", err: kerrors.NewAlreadyExists(resource, "db"), status: http.StatusConflict, code: errorConflict},
+		{name: "conflict", err: kerrors.NewConflict(resource, "db", fmt.Errorf("modified")), status: http.StatusUnprocessableEntity, code: ErrorConcurrency},
+		{name: "other", err: fmt.Errorf("connection refused"), status: http.StatusInternalServerError, code: errorInternalServer},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := brokerError(test.err)
+			if e.Status != test.status || e.Code != test.code {
+				t.Errorf("got %d %s, want %d %s", e.Status, e.Code, test.status, test.code)
+			}
+		})
+	}
+}
+
+func TestRespondError(t *testing.T) {
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		err    error
+		status int
+		body   schemas.Error
+	}{
+		{
+			name:   "usable",
+			ctx:    context.Background(),
+			err:    badRequest("plan p-1 does not exist").Usable(),
+			status: http.StatusBadRequest,
+			body:   schemas.Error{Error: errorBadRequest, Description: "plan p-1 does not exist", InstanceUsable: true},
+		},
+		{
+			name:   "deadline of the request",
+			ctx:    expired,
+			err:    internalError("cannot list templates"),
+			status: http.StatusGatewayTimeout,
+			body:   schemas.Error{Error: errorTimeout, Description: "the operation did not complete in time, retry the request"},
+		},
+		{
+			name:   "API server timeout",
+			ctx:    context.Background(),
+			err:    kerrors.NewServerTimeout(schema.GroupResource{Resource: "templates"}, "list", 1),
+			status: http.StatusGatewayTimeout,
+			body:   schemas.Error{Error: errorTimeout, Description: "the operation did not complete in time, retry the request"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			respondError(w, httptest.NewRequest("PUT", "/", nil).WithContext(test.ctx), test.err, testLog)
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d", w.Code, test.status)
+			}
+			body := schemas.Error{}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body != test.body {
+				t.Errorf("got %+v, want %+v", body, test.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package apis
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type Health struct {
+	client.Client
+	Log logr.Logger
+	// Namespace to check Templates in, ignored if ClusterScope is set
+	Namespace    string
+	ClusterScope bool
+	// Checks are additional named readiness checks, e.g. informer cache sync
+	Checks map[string]func() error
+}
+
+// Healthz reports that the process is alive and serving
+func (h *Health) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "ok")
+}
+
+// Readyz reports whether the broker can reach the API server with its credentials
+func (h *Health) Readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+
+	if err := h.checkTemplates(r.Context()); err != nil {
+		h.Log.Error(err, "readiness check failed", "check", "templates")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "templates: %s", err.Error())
+		return
+	}
+	for name, check := range h.Checks {
+		if err := check(); err != nil {
+			h.Log.Error(err, "readiness check failed", "check", name)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "%s: %s", name, err.Error())
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "ok")
+}
+
+func (h *Health) checkTemplates(ctx context.Context) error {
+	var list runtime.Object = &tmaxv1.TemplateList{}
+	opts := []client.ListOption{client.Limit(1)}
+	if h.ClusterScope {
+		list = &tmaxv1.ClusterTemplateList{}
+	} else {
+		opts = append(opts, client.InNamespace(h.Namespace))
+	}
+	return h.Client.List(ctx, list, opts...)
+}
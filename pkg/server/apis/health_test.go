@@ -0,0 +1,62 @@
+package apis
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestHealthz(t *testing.T) {
+	health := &Health{Log: testLog}
+	w := httptest.NewRecorder()
+	health.Healthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name         string
+		client       client.Client
+		clusterScope bool
+		checks       map[string]func() error
+		status       int
+	}{
+		{name: "namespaced", client: newFakeClient(t), status: http.StatusOK},
+		{name: "cluster", client: newFakeClient(t), clusterScope: true, status: http.StatusOK},
+		{
+			name: "templates cannot be listed",
+			// the scheme has no template types, as if the CRDs were not installed
+			client: fake.NewFakeClientWithScheme(runtime.NewScheme()),
+			status: http.StatusServiceUnavailable,
+		},
+		{
+			name:   "check passes",
+			client: newFakeClient(t),
+			checks: map[string]func() error{"cache": func() error { return nil }},
+			status: http.StatusOK,
+		},
+		{
+			name:   "check fails",
+			client: newFakeClient(t),
+			checks: map[string]func() error{"cache": func() error { return fmt.Errorf("not synced") }},
+			status: http.StatusServiceUnavailable,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			health := &Health{Client: test.client, Log: testLog, Namespace: "tsb", ClusterScope: test.clusterScope, Checks: test.checks}
+			w := httptest.NewRecorder()
+			health.Readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+			if w.Code != test.status {
+				t.Errorf("got status %d (%s), want %d", w.Code, w.Body.String(), test.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package apis
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// releaseTimeout bounds releasing a lease, which happens after the request context may have expired
+	releaseTimeout = 5 * time.Second
+	// defaultLeaseDuration is the duration of operation leases without an operation deadline
+	defaultLeaseDuration = time.Minute
+)
+
+// Locker rejects concurrent operations on one instance, within this replica by an in-memory lock
+// and across replicas by an operation lease annotated on the template instance, or a provision lease
+// while the template instance does not exist yet
+type Locker struct {
+	client.Client
+	Log    logr.Logger
+	Config *config.Store
+	Holder string
+
+	locks *internal.InstanceLocks
+}
+
+func NewLocker(c client.Client, log logr.Logger, store *config.Store) *Locker {
+	return &Locker{
+		Client: c,
+		Log:    log,
+		Config: store,
+		Holder: internal.LeaseHolder(),
+		locks:  internal.NewInstanceLocks(),
+	}
+}
+
+// LeaseDuration is the duration of the operation leases taken now. A lease outlives the operation deadline, so it only
+// expires once its replica is gone.
+func (l *Locker) LeaseDuration() time.Duration {
+	return leaseDuration(l.Config.Get())
+}
+
+func leaseDuration(cfg *config.Config) time.Duration {
+	if timeout := cfg.Server.OperationTimeout.Duration; timeout > 0 {
+		return 2 * timeout
+	}
+	return defaultLeaseDuration
+}
+
+// Lock takes the in-memory lock of the instance. The returned func releases it.
+func (l *Locker) Lock(instanceId, operation string) (func(), error) {
+	if err := l.locks.TryLock(instanceId, operation); err != nil {
+		return nil, err
+	}
+	return func() { l.locks.Unlock(instanceId) }, nil
+}
+
+// Check fails if another replica holds an operation lease on the template instance
+func (l *Locker) Check(templateInstance *tmaxv1.TemplateInstance) error {
+	if lease := internal.ActiveLease(templateInstance, time.Now()); lease != nil && lease.Holder != l.Holder {
+		return &internal.LeaseHeldError{InstanceId: templateInstance.Annotations["instance_id"], Operation: lease.Operation}
+	}
+	return nil
+}
+
+// Lease takes the operation lease of the template instance. The returned func releases it.
+func (l *Locker) Lease(ctx context.Context, templateInstance *tmaxv1.TemplateInstance, operation string) (func(), error) {
+	if err := internal.AcquireLease(ctx, l.Client, templateInstance, l.Holder, operation, l.LeaseDuration()); err != nil {
+		return nil, err
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+		defer cancel()
+		if err := internal.ReleaseLease(ctx, l.Client, templateInstance, l.Holder); err != nil && !kerrors.IsNotFound(err) {
+			l.Log.Error(err, "cannot release the operation lease", "templateinstance", templateInstance.Name)
+		}
+	}, nil
+}
+
+// LeaseProvision takes the provision lease of an instance that has no template instance yet. The returned func releases it.
+func (l *Locker) LeaseProvision(ctx context.Context, namespace string, instanceId string) (func(), error) {
+	lease, err := internal.AcquireProvisionLease(ctx, l.Client, namespace, instanceId, l.Holder, l.LeaseDuration())
+	if err != nil {
+		if kerrors.IsAlreadyExists(err) || kerrors.IsConflict(err) {
+			return nil, &internal.LeaseHeldError{InstanceId: instanceId, Operation: internal.OperationProvision}
+		}
+		return nil, err
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+		defer cancel()
+		if err := internal.ReleaseProvisionLease(ctx, l.Client, lease); err != nil {
+			l.Log.Error(err, "cannot release the provision lease", "lease", lease.Name, "namespace", lease.Namespace)
+		}
+	}, nil
+}
+
+// LockInstance takes both the in-memory lock and the operation lease of an existing instance
+func (l *Locker) LockInstance(ctx context.Context, templateInstance *tmaxv1.TemplateInstance, operation string) (func(), error) {
+	instanceId := templateInstance.Annotations["instance_id"]
+	unlock, err := l.Lock(instanceId, operation)
+	if err != nil {
+		return nil, err
+	}
+	release, err := l.Lease(ctx, templateInstance, operation)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return func() {
+		release()
+		unlock()
+	}, nil
+}
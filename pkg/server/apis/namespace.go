@@ -0,0 +1,146 @@
+package apis
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/metrics"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// NamespaceVar is the route variable of the /ns/{namespace}/v2/ routes of a namespaced broker
+const NamespaceVar = "namespace"
+
+// notServedError is returned for a namespace the broker does not serve
+type notServedError struct {
+	namespace string
+}
+
+func (e *notServedError) Error() string {
+	return fmt.Sprintf("namespace %s is not served by this broker", e.namespace)
+}
+
+// targetNamespace resolves the namespace a request of a namespaced broker works in.
+// The /ns/{namespace} route wins, then context.namespace of the request body, then the broker's own namespace.
+func targetNamespace(c client.Client, cfg *config.Config, r *http.Request, contextNamespace string) (string, error) {
+	ns := mux.Vars(r)[NamespaceVar]
+	switch {
+	case len(ns) != 0:
+		if len(contextNamespace) != 0 && contextNamespace != ns {
+			return "", fmt.Errorf("context.namespace %s does not match the namespace %s of the request path", contextNamespace, ns)
+		}
+	case len(contextNamespace) != 0:
+		ns = contextNamespace
+	default:
+		ns = cfg.Namespace
+	}
+
+	served, err := isServed(r.Context(), c, cfg, ns)
+	if err != nil {
+		return "", err
+	}
+	if !served {
+		return "", &notServedError{namespace: ns}
+	}
+	return ns, nil
+}
+
+// candidateNamespaces returns the namespaces the instance of a request without context may live in
+func candidateNamespaces(c client.Client, cfg *config.Config, r *http.Request) ([]string, error) {
+	if ns := mux.Vars(r)[NamespaceVar]; len(ns) != 0 {
+		served, err := isServed(r.Context(), c, cfg, ns)
+		if err != nil {
+			return nil, err
+		}
+		if !served {
+			return nil, &notServedError{namespace: ns}
+		}
+		return []string{ns}, nil
+	}
+	return ServedNamespaces(r.Context(), c, cfg)
+}
+
+// instanceNamespaces returns the namespaces the instance of a request may live in,
+// which is the target namespace if the request has a context.namespace
+func instanceNamespaces(c client.Client, cfg *config.Config, r *http.Request, contextNamespace string) ([]string, error) {
+	if len(contextNamespace) == 0 {
+		return candidateNamespaces(c, cfg, r)
+	}
+	ns, err := targetNamespace(c, cfg, r, contextNamespace)
+	if err != nil {
+		return nil, err
+	}
+	return []string{ns}, nil
+}
+
+// ServedNamespaces lists the broker's own namespace and the watched namespaces
+func ServedNamespaces(ctx context.Context, c client.Client, cfg *config.Config) ([]string, error) {
+	set := map[string]bool{cfg.Namespace: true}
+	for _, name := range cfg.WatchNamespaces.Names {
+		set[name] = true
+	}
+	if selector := cfg.WatchNamespaces.NamespaceSelector(); selector != nil {
+		namespaces := &corev1.NamespaceList{}
+		if err := c.List(ctx, namespaces, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			return nil, err
+		}
+		for _, ns := range namespaces.Items {
+			set[ns.Name] = true
+		}
+	}
+
+	var names []string
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func isServed(ctx context.Context, c client.Client, cfg *config.Config, ns string) (bool, error) {
+	if ns == cfg.Namespace {
+		return true, nil
+	}
+	for _, name := range cfg.WatchNamespaces.Names {
+		if ns == name {
+			return true, nil
+		}
+	}
+
+	selector := cfg.WatchNamespaces.NamespaceSelector()
+	if selector == nil {
+		return false, nil
+	}
+	namespace := &corev1.Namespace{}
+	if err := c.Get(ctx, types.NamespacedName{Name: ns}, namespace); err != nil {
+		if kerrors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return selector.Matches(labels.Set(namespace.Labels)), nil
+}
+
+// findTemplateInstance looks an instance up in each of the namespaces
+func findTemplateInstance(ctx context.Context, c client.Client, namespaces []string, instanceId string) (*tmaxv1.TemplateInstance, error) {
+	for _, ns := range namespaces {
+		templateInstance, err := internal.GetTemplateInstanceByInstanceId(ctx, c, ns, instanceId)
+		if templateInstance != nil {
+			metrics.SetOffering(ctx, templateInstance.Annotations["service_id"], templateInstance.Annotations["plan_id"])
+		}
+		if err != nil || templateInstance != nil {
+			return templateInstance, err
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,93 @@
+package apis
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func namespacedConfig() *config.Config {
+	cfg := config.Default(config.ScopeNamespaced)
+	cfg.Namespace = "tsb"
+	cfg.WatchNamespaces.Names = []string{"team-a"}
+	cfg.WatchNamespaces.Selector = "tsb.tmax.io/enabled=true"
+	return cfg
+}
+
+func watchedNamespaces() []*corev1.Namespace {
+	return []*corev1.Namespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: "team-b", Labels: map[string]string{"tsb.tmax.io/enabled": "true"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "team-c"}},
+	}
+}
+
+func TestTargetNamespace(t *testing.T) {
+	namespaces := watchedNamespaces()
+	c := newFakeClient(t, namespaces[0], namespaces[1])
+	cfg := namespacedConfig()
+
+	tests := []struct {
+		name             string
+		pathNamespace    string
+		contextNamespace string
+		want             string
+		err              bool
+	}{
+		{name: "own namespace", want: "tsb"},
+		{name: "context", contextNamespace: "team-a", want: "team-a"},
+		{name: "path", pathNamespace: "team-b", want: "team-b"},
+		{name: "path and context", pathNamespace: "team-a", contextNamespace: "team-a", want: "team-a"},
+		{name: "path and other context", pathNamespace: "team-a", contextNamespace: "team-b", err: true},
+		{name: "not selected", contextNamespace: "team-c", err: true},
+		{name: "not existing", pathNamespace: "team-d", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "/", nil)
+			if len(test.pathNamespace) != 0 {
+				r = mux.SetURLVars(r, map[string]string{NamespaceVar: test.pathNamespace})
+			}
+			ns, err := targetNamespace(c, cfg, r, test.contextNamespace)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			}
+			if ns != test.want {
+				t.Errorf("got %q, want %q", ns, test.want)
+			}
+		})
+	}
+}
+
+func TestServedNamespaces(t *testing.T) {
+	namespaces := watchedNamespaces()
+	c := newFakeClient(t, namespaces[0], namespaces[1])
+
+	tests := []struct {
+		name   string
+		modify func(cfg *config.Config)
+		want   []string
+	}{
+		{name: "own, names and selector", modify: func(cfg *config.Config) {}, want: []string{"team-a", "team-b", "tsb"}},
+		{name: "own only", modify: func(cfg *config.Config) { cfg.WatchNamespaces = config.WatchNamespacesConfig{} }, want: []string{"tsb"}},
+		{name: "duplicates", modify: func(cfg *config.Config) { cfg.WatchNamespaces.Names = []string{"tsb", "team-b"} }, want: []string{"team-b", "tsb"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := namespacedConfig()
+			test.modify(cfg)
+			names, err := ServedNamespaces(context.Background(), c, cfg)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Errorf("got %v, want %v", names, test.want)
+			}
+		})
+	}
+}
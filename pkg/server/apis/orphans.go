@@ -0,0 +1,149 @@
+package apis
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// sweepTimeout bounds the API calls of one sweep
+const sweepTimeout = 5 * time.Minute
+
+// Orphans finds the template instances left behind by failed or lost provisions and, in delete mode, deletes them
+type Orphans struct {
+	client.Client
+	Log      logr.Logger
+	Config   *config.Store
+	Recorder record.EventRecorder
+	Locker   *Locker
+	// Namespaces returns the namespaces to sweep ("" for all namespaces)
+	Namespaces func(ctx context.Context) ([]string, error)
+}
+
+type OrphanReport struct {
+	Mode        string            `json:"mode"`
+	GracePeriod string            `json:"grace_period"`
+	Platform    bool              `json:"platform_instances_checked"`
+	Orphans     []internal.Orphan `json:"orphans"`
+}
+
+// Report answers the orphans the sweeper would act on, without deleting them
+func (o *Orphans) Report(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	cfg := o.Config.Get().OrphanMitigation
+	report, _, err := o.find(r.Context(), cfg)
+	if err != nil {
+		o.Log.Error(err, "cannot find orphaned template instances")
+		respondError(w, r, err, o.Log)
+		return
+	}
+	respond(w, http.StatusOK, report, o.Log)
+}
+
+// Sweep reports or deletes orphans every interval until ctx is cancelled. It runs on the leader only.
+func (o *Orphans) Sweep(ctx context.Context) {
+	for {
+		cfg := o.Config.Get().OrphanMitigation
+		if cfg.Mode != config.OrphansOff {
+			o.sweep(ctx, cfg)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.Interval.Duration):
+		}
+	}
+}
+
+func (o *Orphans) sweep(ctx context.Context, cfg config.OrphanMitigationConfig) {
+	ctx, cancel := context.WithTimeout(ctx, sweepTimeout)
+	defer cancel()
+
+	report, templateInstances, err := o.find(ctx, cfg)
+	if err != nil {
+		o.Log.Error(err, "cannot find orphaned template instances")
+		return
+	}
+
+	counts := map[string]int{internal.OrphanUnknownInstance: 0, internal.OrphanFailed: 0}
+	for i := range report.Orphans {
+		orphan := &report.Orphans[i]
+		counts[orphan.Reason]++
+		templateInstance := templateInstances[orphan.Namespace+"/"+orphan.Name]
+		message := fmt.Sprintf("instance %s is orphaned (%s) since %s", orphan.InstanceId, orphan.Reason, orphan.Since.UTC().Format(time.RFC3339))
+
+		if cfg.Mode != config.OrphansDelete {
+			o.Log.Info(message, "templateinstance", orphan.Name, "namespace", orphan.Namespace)
+			internal.RecordEvent(o.Recorder, corev1.EventTypeWarning, internal.ReasonOrphaned, message, templateInstance)
+			continue
+		}
+		if err := o.delete(ctx, templateInstance); err != nil {
+			o.Log.Error(err, "cannot delete orphaned template instance", "templateinstance", orphan.Name, "namespace", orphan.Namespace)
+			continue
+		}
+		orphan.Deleted = true
+		metrics.OrphansDeleted.WithLabelValues(orphan.Reason).Inc()
+		o.Log.Info(message+", deleted", "templateinstance", orphan.Name, "namespace", orphan.Namespace)
+		internal.RecordEvent(o.Recorder, corev1.EventTypeNormal, internal.ReasonOrphanDeleted, message+", deleted", templateInstance)
+	}
+	for reason, count := range counts {
+		metrics.Orphans.WithLabelValues(reason).Set(float64(count))
+	}
+}
+
+// delete takes the operation lease first, so an instance changed since it was found orphaned is left alone
+func (o *Orphans) delete(ctx context.Context, templateInstance *tmaxv1.TemplateInstance) error {
+	unlock, err := o.Locker.LockInstance(ctx, templateInstance, internal.OperationOrphanSweep)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return internal.DeleteTemplateInstance(ctx, o.Client, templateInstance)
+}
+
+// find lists the orphans of the served namespaces along with their template instances by namespace/name
+func (o *Orphans) find(ctx context.Context, cfg config.OrphanMitigationConfig) (*OrphanReport, map[string]*tmaxv1.TemplateInstance, error) {
+	namespaces, err := o.Namespaces(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	known, found, err := internal.PlatformInstanceIds(ctx, o.Client, namespaces)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		o.Log.V(1).Info("service catalog is not installed, only failed instances are orphans")
+	}
+
+	items, err := listTemplateInstances(ctx, o.Client, namespaces)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byName := make(map[string]*tmaxv1.TemplateInstance)
+	for i := range items {
+		byName[items[i].Namespace+"/"+items[i].Name] = &items[i]
+	}
+	orphans := internal.FindOrphans(items, known, cfg.GracePeriod.Duration, time.Now())
+	if orphans == nil {
+		orphans = []internal.Orphan{}
+	}
+	return &OrphanReport{
+		Mode:        cfg.Mode,
+		GracePeriod: cfg.GracePeriod.Duration.String(),
+		Platform:    found,
+		Orphans:     orphans,
+	}, byName, nil
+}
@@ -1,6 +1,7 @@
 package apis
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -11,14 +12,26 @@ import (
 	"github.com/gorilla/mux"
 	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
 	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/metrics"
 	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type Provision struct {
 	client.Client
-	Log logr.Logger
+	Log      logr.Logger
+	Config   *config.Store
+	Recorder record.EventRecorder
+	Locker   *Locker
+	Quotas   *Quotas
 }
 
 func (p *Provision) ProvisionServiceInstance(w http.ResponseWriter, r *http.Request) {
@@ -28,87 +41,55 @@ func (p *Provision) ProvisionServiceInstance(w http.ResponseWriter, r *http.Requ
 	// get body
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
 		p.Log.Error(err, "error occurs while decoding service instance body")
-		respond(w, http.StatusBadRequest, &schemas.Error{
-			Error:            "Bad Request",
-			Description:      "Cannot decode service instance request body",
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, p.Log)
+		respondError(w, r, badRequest("cannot decode service instance request body: %s", err.Error()), p.Log)
 		return
 	}
 
 	vars := mux.Vars(r)
 	instanceId := vars["instance_id"]
 
-	ns, err := internal.Namespace()
+	ns, err := targetNamespace(p.Client, p.Config.Get(), r, m.Context.Namespace)
 	if err != nil {
-		p.Log.Error(err, "error occurs while getting namespace")
-		respond(w, http.StatusInternalServerError, &schemas.Error{
-			Error:            "InternalServerError",
-			Description:      "cannot get namespace. Check it is operated on cluster.",
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, p.Log)
+		p.Log.Error(err, "cannot resolve the namespace of the request")
+		respondError(w, r, err, p.Log)
 		return
 	}
 
 	// get template to verify service class and plans exist
-	templateList, err := internal.GetTemplateList(p.Client, ns)
+	templateList, err := internal.GetTemplateList(r.Context(), p.Client, ns, p.Config.Get().Catalog.Selector())
 	if err != nil {
 		p.Log.Error(err, "error occurs while getting templateList")
-		respond(w, http.StatusInternalServerError, &schemas.Error{
-			Error:            "InternalServerError",
-			Description:      fmt.Sprintf("cannot find templateList on the %s namespace", ns),
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, p.Log)
+		respondError(w, r, internalError("cannot list templates in namespace %s", ns), p.Log)
 		return
 	}
 
 	var template *tmaxv1.Template
 	for _, tp := range templateList.Items {
-		if m.ServiceId == string(tp.UID) {
+		if m.ServiceId == string(tp.UID) && p.Config.Get().Catalog.Matches(tp.Tags) {
 			template = &tp
 			break
 		}
 	}
 
 	if template == nil {
-		p.Log.Error(err, "error occurs while getting template")
-		respond(w, http.StatusBadRequest, &schemas.Error{
-			Error:            "BadRequest",
-			Description:      fmt.Sprintf("cannot find template %s on the %s namespace", m.ServiceId, ns),
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, p.Log)
+		p.Log.Info(fmt.Sprintf("template of service %s is not found", m.ServiceId))
+		respondError(w, r, badRequest("service %s is not offered in namespace %s", m.ServiceId, ns), p.Log)
 		return
 	}
 
 	// update template parameters using plan
-	if err := updatePlanParams(&m, template.TemplateSpec, string(template.UID)); err != nil {
+	plan, err := updatePlanParams(&m, template.TemplateSpec, string(template.UID))
+	if err != nil {
 		p.Log.Error(err, "error occurs while reflecting plan parameter")
-		respond(w, http.StatusInternalServerError, &schemas.Error{
-			Error:            "InternalServerError",
-			Description:      "plan is invalid",
-			InstanceUsable:   false,
-			UpdateRepeatable: true,
-		}, p.Log)
+		internal.RecordEvent(p.Recorder, corev1.EventTypeWarning, internal.ReasonInvalidParameters,
+			fmt.Sprintf("plan %s of instance %s is invalid: %s", m.PlanId, instanceId, err.Error()), template)
+		respondError(w, r, err, p.Log)
 		return
 	}
+	metrics.SetOffering(r.Context(), m.ServiceId, m.PlanId)
 
 	// create template instance
-	if _, err = internal.CreateTemplateInstance(p.Client, template, ns, m, instanceId); err != nil {
-		p.Log.Error(err, "error occurs while creating template instance")
-		respond(w, http.StatusBadRequest, &schemas.Error{
-			Error:            "Cannot create template instance",
-			Description:      "Required parameters may be ommited or templateinstance with same name already exists",
-			InstanceUsable:   false,
-			UpdateRepeatable: true,
-		}, p.Log)
-		return
-	}
-
-	respond(w, http.StatusOK, schemas.ServiceInstanceProvisionResponse{}, p.Log)
+	p.createTemplateInstance(w, r, template, ns, m, instanceId, planName(template.Name, m.PlanId, plan))
 }
 
 func (p *Provision) DeprovisionServiceInstance(w http.ResponseWriter, r *http.Request) {
@@ -123,38 +104,70 @@ func (p *Provision) DeprovisionServiceInstance(w http.ResponseWriter, r *http.Re
 	vars := mux.Vars(r)
 	instanceId := vars["instance_id"]
 
-	ns, err := internal.Namespace()
+	namespaces, err := candidateNamespaces(p.Client, p.Config.Get(), r)
 	if err != nil {
-		p.Log.Error(err, "error occurs while getting namespace")
-		respond(w, http.StatusInternalServerError, &schemas.Error{
-			Error:            "InternalServerError",
-			Description:      "cannot get namespace. Check it is operated on cluster.",
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, p.Log)
+		p.Log.Error(err, "cannot resolve the namespace of the request")
+		respondError(w, r, err, p.Log)
 		return
 	}
 
-	templateInstance, err := internal.GetTemplateInstanceForDeprovision(p.Client, ns, instanceId)
-	// If there is no templateinstance, deprovision is complete because there is no instance to delete.
+	templateInstance, err := findTemplateInstance(r.Context(), p.Client, namespaces, instanceId)
 	if err != nil {
+		p.Log.Error(err, "error occurs while getting templateInstance")
+		respondError(w, r, internalError("cannot get the templateinstance of instance %s", instanceId), p.Log)
+		return
+	}
+
+	// If there is no templateinstance, the instance is already gone.
+	if templateInstance == nil {
 		p.Log.Info("TemplateInstance does not exist")
-		respond(w, http.StatusOK, schemas.ServiceInstanceProvisionResponse{}, p.Log)
+		respond(w, http.StatusGone, schemas.ServiceInstanceProvisionResponse{}, p.Log)
 		return
 	}
 
-	if err := internal.DeleteTemplateInstance(p.Client, templateInstance); err != nil {
-		p.Log.Error(err, "error occurs while deleting templateInstance")
-		respond(w, http.StatusInternalServerError, &schemas.Error{
-			Error:            "InternalServerError",
-			Description:      "Error occurs while delete templateInstance",
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, p.Log)
+	p.deleteTemplateInstance(w, r, templateInstance, instanceId)
+}
+
+func (p *Provision) UpdateProvisionServiceInstance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var m schemas.ServiceInstanceProvisionRequest
+
+	// get body
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		p.Log.Error(err, "error occurs while decoding service instance body")
+		respondError(w, r, badRequest("cannot decode service instance request body: %s", err.Error()).Usable(), p.Log)
 		return
 	}
 
-	respond(w, http.StatusOK, schemas.ServiceInstanceProvisionResponse{}, p.Log)
+	ns, err := targetNamespace(p.Client, p.Config.Get(), r, m.Context.Namespace)
+	if err != nil {
+		p.Log.Error(err, "cannot resolve the namespace of the request")
+		respondError(w, r, err, p.Log)
+		return
+	}
+
+	templateList, err := internal.GetTemplateList(r.Context(), p.Client, ns, p.Config.Get().Catalog.Selector())
+	if err != nil {
+		p.Log.Error(err, "error occurs while getting templateList")
+		respondError(w, r, internalError("cannot list templates in namespace %s", ns).Usable(), p.Log)
+		return
+	}
+
+	var template *tmaxv1.Template
+	for _, tp := range templateList.Items {
+		if m.ServiceId == string(tp.UID) && p.Config.Get().Catalog.Matches(tp.Tags) {
+			template = &tp
+			break
+		}
+	}
+
+	if template == nil {
+		p.Log.Info(fmt.Sprintf("template of service %s is not found", m.ServiceId))
+		respondError(w, r, badRequest("service %s is not offered in namespace %s", m.ServiceId, ns).Usable(), p.Log)
+		return
+	}
+
+	p.updateTemplateInstance(w, r, template, template.TemplateSpec, string(template.UID), ns, m)
 }
 
 func (p *Provision) UpdateClusterProvisionServiceInstance(w http.ResponseWriter, r *http.Request) {
@@ -164,53 +177,114 @@ func (p *Provision) UpdateClusterProvisionServiceInstance(w http.ResponseWriter,
 	// get body
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
 		p.Log.Error(err, "error occurs while decoding service instance body")
+		respondError(w, r, badRequest("cannot decode service instance request body: %s", err.Error()).Usable(), p.Log)
 		return
 	}
 
-	templates, err := internal.GetClusterTemplateList(p.Client)
+	templates, err := internal.GetClusterTemplateList(r.Context(), p.Client, p.Config.Get().Catalog.Selector())
 	if err != nil {
 		p.Log.Error(err, "error occurs while getting templateList")
-		respond(w, http.StatusInternalServerError, &schemas.Error{
-			Error:            "InternalServerError",
-			Description:      "cannot find ClusterTemplateList",
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, p.Log)
+		respondError(w, r, internalError("cannot list clustertemplates").Usable(), p.Log)
 		return
 	}
 
 	var template *tmaxv1.ClusterTemplate
 	for _, tp := range templates.Items {
-		if m.ServiceId == string(tp.UID) {
+		if m.ServiceId == string(tp.UID) && p.Config.Get().Catalog.Matches(tp.Tags) {
 			template = &tp
 			break
 		}
 	}
 
 	if template == nil {
-		p.Log.Error(err, "error occurs while getting template")
-		respond(w, http.StatusBadRequest, &schemas.Error{
-			Error:            "BadRequest",
-			Description:      fmt.Sprintf("cannot find ClusterTemplate %s", m.ServiceId),
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, p.Log)
+		p.Log.Info(fmt.Sprintf("clustertemplate of service %s is not found", m.ServiceId))
+		respondError(w, r, badRequest("service %s is not offered", m.ServiceId).Usable(), p.Log)
+		return
+	}
+
+	p.updateTemplateInstance(w, r, template, template.TemplateSpec, string(template.UID), m.Context.Namespace, m)
+}
+
+// updateTemplateInstance applies an update request to the template instance of the instance
+func (p *Provision) updateTemplateInstance(w http.ResponseWriter, r *http.Request, obj runtime.Object, templateSpec tmaxv1.TemplateSpec,
+	templateUid string, namespace string, request schemas.ServiceInstanceProvisionRequest) {
+
+	instanceId := mux.Vars(r)["instance_id"]
+	metrics.SetOffering(r.Context(), templateUid, "")
+	existing, err := internal.GetTemplateInstanceByInstanceId(r.Context(), p.Client, namespace, instanceId)
+	if err != nil {
+		p.Log.Error(err, "error occurs while getting template instance")
+		respondError(w, r, internalError("cannot get the templateinstance of instance %s", instanceId).Usable(), p.Log)
 		return
 	}
 
+	// a maintenance_info without plan_id is checked against the current plan of the instance
+	planRequest := request
+	if len(planRequest.PlanId) == 0 && request.MaintenanceInfo != nil && existing != nil {
+		planRequest.PlanId = existing.Annotations["plan_id"]
+	}
+	newPlanName := ""
+	upgrade := false
+	if len(planRequest.PlanId) != 0 {
+		plan, err := planFor(planRequest, templateSpec, templateUid)
+		if err != nil {
+			p.Log.Error(err, "invalid plan of update request")
+			internal.RecordEvent(p.Recorder, corev1.EventTypeWarning, internal.ReasonInvalidParameters,
+				fmt.Sprintf("plan %s of instance %s is invalid: %s", planRequest.PlanId, instanceId, err.Error()), obj)
+			respondError(w, r, brokerError(err).Usable(), p.Log)
+			return
+		}
+		metrics.SetOffering(r.Context(), "", planRequest.PlanId)
+		if template, ok := obj.(metav1.Object); ok && len(request.PlanId) != 0 {
+			newPlanName = planName(template.GetName(), request.PlanId, plan)
+		}
+
+		// only a maintenance_info.version other than the one of the instance upgrades it. planFor made sure it is the one of
+		// the plan; without one, e.g. a parameter or plan change, the instance keeps its version.
+		upgrade = existing != nil && request.MaintenanceInfo != nil && len(request.MaintenanceInfo.Version) != 0 &&
+			internal.MaintenanceVersion(existing) != request.MaintenanceInfo.Version
+		if upgrade && plan != nil {
+			// re-render from the current template with the values the instance has, and the fixed values of the plan
+			internal.KeepParameters(&request, existing)
+			for key, val := range plan.Schemas.ServiceInstance.Create.Parameters {
+				request.Parameters[key] = val
+			}
+		}
+	}
+
+	if existing != nil {
+		unlock, err := p.Locker.LockInstance(r.Context(), existing, internal.OperationUpdate)
+		if err != nil {
+			p.Log.Info(fmt.Sprintf("cannot update instance %s: %s", instanceId, err.Error()))
+			respondError(w, r, brokerError(err).Usable(), p.Log)
+			return
+		}
+		defer unlock()
+	}
+
 	// Update template instance
-	if _, err = internal.UpdateTemplateInstance(p.Client, template, m.Context.Namespace, m); err != nil {
+	templateInstance, err := internal.UpdateTemplateInstance(r.Context(), p.Client, obj, namespace, request, instanceId, newPlanName, upgrade)
+	if err != nil {
 		p.Log.Error(err, "error occurs while updating template instance")
-		respond(w, http.StatusBadRequest, &schemas.Error{
-			Error:            "Cannot update template instance",
-			Description:      "Required parameters may be ommited or templateinstance is not exist",
-			InstanceUsable:   false,
-			UpdateRepeatable: true,
-		}, p.Log)
+		internal.RecordEvent(p.Recorder, corev1.EventTypeWarning, internal.ReasonUpdateFailed,
+			fmt.Sprintf("cannot update instance %s: %s", instanceId, err.Error()), obj)
+		e := brokerError(err).Usable()
+		if e.Status == http.StatusBadRequest {
+			e.Repeatable()
+		}
+		respondError(w, r, e, p.Log)
 		return
 	}
 
-	respond(w, http.StatusOK, schemas.ServiceInstanceProvisionResponse{}, p.Log)
+	if upgrade {
+		internal.RecordEvent(p.Recorder, corev1.EventTypeNormal, internal.ReasonUpgraded,
+			fmt.Sprintf("instance %s is upgraded from maintenance_info version %q to %s", instanceId,
+				internal.MaintenanceVersion(existing), request.MaintenanceInfo.Version), templateInstance)
+	} else {
+		internal.RecordEvent(p.Recorder, corev1.EventTypeNormal, internal.ReasonUpdated,
+			fmt.Sprintf("instance %s is updated", instanceId), templateInstance)
+	}
+	respond(w, http.StatusOK, schemas.ServiceInstanceProvisionResponse{DashboardUrl: p.dashboardURL(r.Context(), templateInstance)}, p.Log)
 }
 
 func (p *Provision) ClusterProvisionServiceInstance(w http.ResponseWriter, r *http.Request) {
@@ -223,56 +297,44 @@ func (p *Provision) ClusterProvisionServiceInstance(w http.ResponseWriter, r *ht
 	// get body
 	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
 		p.Log.Error(err, "error occurs while decoding service instance body")
+		respondError(w, r, badRequest("cannot decode service instance request body: %s", err.Error()), p.Log)
 		return
 	}
 
-	templates, err := internal.GetClusterTemplateList(p.Client)
+	templates, err := internal.GetClusterTemplateList(r.Context(), p.Client, p.Config.Get().Catalog.Selector())
 	if err != nil {
 		p.Log.Error(err, "error occurs while getting templateList")
-		respond(w, http.StatusInternalServerError, &schemas.Error{
-			Error:            "InternalServerError",
-			Description:      "cannot find ClusterTemplateList",
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, p.Log)
+		respondError(w, r, internalError("cannot list clustertemplates"), p.Log)
 		return
 	}
 
 	var template *tmaxv1.ClusterTemplate
 	for _, tp := range templates.Items {
-		if m.ServiceId == string(tp.UID) {
+		if m.ServiceId == string(tp.UID) && p.Config.Get().Catalog.Matches(tp.Tags) {
 			template = &tp
 			break
 		}
 	}
 
 	if template == nil {
-		p.Log.Error(err, "error occurs while getting template")
-		respond(w, http.StatusBadRequest, &schemas.Error{
-			Error:            "BadRequest",
-			Description:      fmt.Sprintf("cannot find ClusterTemplate %s", m.ServiceId),
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, p.Log)
+		p.Log.Info(fmt.Sprintf("clustertemplate of service %s is not found", m.ServiceId))
+		respondError(w, r, badRequest("service %s is not offered", m.ServiceId), p.Log)
 		return
 	}
 
 	// update template parameters using plan
-	updatePlanParams(&m, template.TemplateSpec, string(template.UID))
-
-	// create template instance
-	if _, err = internal.CreateTemplateInstance(p.Client, template, m.Context.Namespace, m, instanceId); err != nil {
-		p.Log.Error(err, "error occurs while creating template instance")
-		respond(w, http.StatusBadRequest, &schemas.Error{
-			Error:            "Cannot create template instance",
-			Description:      "Required parameters may be ommited or templateinstance with same name already exists",
-			InstanceUsable:   false,
-			UpdateRepeatable: true,
-		}, p.Log)
+	plan, err := updatePlanParams(&m, template.TemplateSpec, string(template.UID))
+	if err != nil {
+		p.Log.Error(err, "error occurs while reflecting plan parameter")
+		internal.RecordEvent(p.Recorder, corev1.EventTypeWarning, internal.ReasonInvalidParameters,
+			fmt.Sprintf("plan %s of instance %s is invalid: %s", m.PlanId, instanceId, err.Error()), template)
+		respondError(w, r, err, p.Log)
 		return
 	}
+	metrics.SetOffering(r.Context(), m.ServiceId, m.PlanId)
 
-	respond(w, http.StatusOK, schemas.ServiceInstanceProvisionResponse{}, p.Log)
+	// create template instance
+	p.createTemplateInstance(w, r, template, m.Context.Namespace, m, instanceId, planName(template.Name, m.PlanId, plan))
 }
 
 func (p *Provision) ClusterDeprovisionServiceInstance(w http.ResponseWriter, r *http.Request) {
@@ -287,72 +349,361 @@ func (p *Provision) ClusterDeprovisionServiceInstance(w http.ResponseWriter, r *
 	instanceId := vars["instance_id"]
 
 	// get templateinstance in all namespace
-	templateInstanceList, err := internal.GetTemplateInstanceList(p.Client, "")
+	templateInstance, err := internal.GetTemplateInstanceByInstanceId(r.Context(), p.Client, "", instanceId)
+	if templateInstance != nil {
+		metrics.SetOffering(r.Context(), templateInstance.Annotations["service_id"], templateInstance.Annotations["plan_id"])
+	}
 	if err != nil {
-		p.Log.Error(err, "error occurs while getting templateinstanceList")
-		respond(w, http.StatusInternalServerError, &schemas.Error{
-			Error:            "InternalServerError",
-			Description:      "cannot find templateInstanceList",
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, p.Log)
+		p.Log.Error(err, "error occurs while getting templateinstance")
+		respondError(w, r, internalError("cannot get the templateinstance of instance %s", instanceId), p.Log)
 		return
 	}
 
-	var templateInstance *tmaxv1.TemplateInstance
-	for _, ti := range templateInstanceList.Items {
-		if ti.ObjectMeta.Annotations["instance_id"] == instanceId {
-			templateInstance = &ti
-			break
-		}
-	}
-
-	// If there is no templateinstance, deprovision is complete because there is no instance to delete.
+	// If there is no templateinstance, the instance is already gone.
 	if templateInstance == nil {
 		p.Log.Info("TemplateInstance does not exist")
-		respond(w, http.StatusOK, schemas.ServiceInstanceProvisionResponse{}, p.Log)
+		respond(w, http.StatusGone, schemas.ServiceInstanceProvisionResponse{}, p.Log)
 		return
 	}
 
-	if err := internal.DeleteTemplateInstance(p.Client, templateInstance); err != nil {
+	p.deleteTemplateInstance(w, r, templateInstance, instanceId)
+}
+
+func (p *Provision) deleteTemplateInstance(w http.ResponseWriter, r *http.Request, templateInstance *tmaxv1.TemplateInstance, instanceId string) {
+	unlock, err := p.Locker.LockInstance(r.Context(), templateInstance, internal.OperationDeprovision)
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			respond(w, http.StatusGone, schemas.ServiceInstanceProvisionResponse{}, p.Log)
+			return
+		}
+		p.Log.Info(fmt.Sprintf("cannot deprovision instance %s: %s", instanceId, err.Error()))
+		respondError(w, r, brokerError(err).Usable(), p.Log)
+		return
+	}
+	defer unlock()
+
+	if err := internal.DeleteTemplateInstance(r.Context(), p.Client, templateInstance); err != nil {
 		p.Log.Error(err, "error occurs while deleting templateInstance")
-		respond(w, http.StatusBadRequest, &schemas.Error{
-			Error:            "BadRequest",
-			Description:      "cannot delete templateInstance on the namespace",
-			InstanceUsable:   false,
-			UpdateRepeatable: false,
-		}, p.Log)
+		internal.RecordEvent(p.Recorder, corev1.EventTypeWarning, internal.ReasonDeprovisionFailed,
+			fmt.Sprintf("cannot deprovision instance %s: %s", instanceId, err.Error()), templateInstance)
+		if kerrors.IsNotFound(err) {
+			respond(w, http.StatusGone, schemas.ServiceInstanceProvisionResponse{}, p.Log)
+			return
+		}
+		respondError(w, r, internalError("cannot delete templateinstance %s in namespace %s: %s",
+			templateInstance.Name, templateInstance.Namespace, err.Error()).Usable(), p.Log)
 		return
 	}
 
+	internal.RecordEvent(p.Recorder, corev1.EventTypeNormal, internal.ReasonDeprovisioned,
+		fmt.Sprintf("instance %s is deprovisioned", instanceId), templateInstance)
 	respond(w, http.StatusOK, schemas.ServiceInstanceProvisionResponse{}, p.Log)
 }
 
-func updatePlanParams(request *schemas.ServiceInstanceProvisionRequest, templateSpec tmaxv1.TemplateSpec, templateUid string) error {
-	// check if plan valid
-	tokIdx := strings.LastIndex(request.PlanId, "-")
-	planUid := request.PlanId[:tokIdx]
-	planIdx := request.PlanId[tokIdx+1:]
+// createTemplateInstance names and creates the template instance of a provision request,
+// unless an instance with the same instance_id or name already exists
+func (p *Provision) createTemplateInstance(w http.ResponseWriter, r *http.Request, obj interface{}, namespace string,
+	request schemas.ServiceInstanceProvisionRequest, instanceId string, planName string) {
 
-	if planUid != templateUid {
-		return fmt.Errorf("plan has invalid uid")
+	template, _ := obj.(runtime.Object)
+	unlock, err := p.Locker.Lock(instanceId, internal.OperationProvision)
+	if err != nil {
+		p.Log.Info(fmt.Sprintf("cannot provision instance %s: %s", instanceId, err.Error()))
+		respondError(w, r, err, p.Log)
+		return
+	}
+	defer unlock()
+
+	existing, err := internal.GetTemplateInstanceByInstanceId(r.Context(), p.Client, namespace, instanceId)
+	if err != nil {
+		p.Log.Error(err, "error occurs while getting existing template instance")
+		respondError(w, r, internalError("cannot get the templateinstance of instance %s", instanceId), p.Log)
+		return
+	}
+	if existing == nil {
+		// another replica may be creating the instance under a different name, so take the provision lease
+		// and look again once it is ours
+		release, err := p.Locker.LeaseProvision(r.Context(), namespace, instanceId)
+		if err != nil {
+			p.Log.Info(fmt.Sprintf("cannot provision instance %s: %s", instanceId, err.Error()))
+			respondError(w, r, err, p.Log)
+			return
+		}
+		defer release()
+
+		if existing, err = internal.GetTemplateInstanceByInstanceId(r.Context(), p.Client, namespace, instanceId); err != nil {
+			p.Log.Error(err, "error occurs while getting existing template instance")
+			respondError(w, r, internalError("cannot get the templateinstance of instance %s", instanceId), p.Log)
+			return
+		}
+	}
+	if existing != nil {
+		if err := p.Locker.Check(existing); err != nil {
+			p.Log.Info(fmt.Sprintf("cannot provision instance %s: %s", instanceId, err.Error()))
+			respondError(w, r, err, p.Log)
+			return
+		}
+		p.respondExisting(w, r, existing, request, instanceId)
+		return
+	}
+
+	name, err := p.Config.Get().Naming.NamingStrategy().Name(request, instanceId)
+	if err != nil {
+		p.Log.Error(err, "error occurs while naming template instance")
+		internal.RecordEvent(p.Recorder, corev1.EventTypeWarning, internal.ReasonProvisionFailed,
+			fmt.Sprintf("cannot provision instance %s: %s", instanceId, err.Error()), template)
+		respondError(w, r, badRequest("%s", err.Error()), p.Log)
+		return
 	}
 
-	plan := tmaxv1.PlanSpec{}
-	if len(templateSpec.Plans) != 0 {
-		idx, _ := strconv.Atoi(planIdx)
-		if idx >= len(templateSpec.Plans) {
-			return fmt.Errorf("plan has invalid index")
+	if templateMeta, ok := obj.(metav1.Object); ok {
+		release, err := p.Quotas.Reserve(r.Context(), namespace, templateMeta.GetName(), planName, instanceId)
+		if err != nil {
+			p.Log.Info(fmt.Sprintf("cannot provision instance %s: %s", instanceId, err.Error()))
+			reason := internal.ReasonProvisionFailed
+			if brokerErr, ok := err.(*BrokerError); ok && brokerErr.Code == ErrorQuotaExceeded {
+				reason = internal.ReasonQuotaExceeded
+				metrics.RejectedRequests.WithLabelValues("quota").Inc()
+			}
+			internal.RecordEvent(p.Recorder, corev1.EventTypeWarning, reason,
+				fmt.Sprintf("cannot provision instance %s: %s", instanceId, err.Error()), template)
+			respondError(w, r, err, p.Log)
+			return
+		}
+		defer release()
+	}
+
+	var finalizers []string
+	if p.Config.Get().Accounting.Enabled {
+		finalizers = append(finalizers, internal.UsageFinalizer)
+	}
+	created, err := internal.CreateTemplateInstance(r.Context(), p.Client, obj, namespace, name, request, instanceId, planName, finalizers...)
+	if err != nil {
+		if kerrors.IsAlreadyExists(err) {
+			if existing, err = internal.GetTemplateInstance(r.Context(), p.Client, types.NamespacedName{Name: name, Namespace: namespace}); err == nil {
+				p.respondExisting(w, r, existing, request, instanceId)
+				return
+			}
 		}
-		plan = templateSpec.Plans[idx]
+		p.Log.Error(err, "error occurs while creating template instance")
+		internal.RecordEvent(p.Recorder, corev1.EventTypeWarning, internal.ReasonProvisionFailed,
+			fmt.Sprintf("cannot provision instance %s: %s", instanceId, err.Error()), template)
+		respondError(w, r, err, p.Log)
+		return
+	}
+
+	internal.RecordEvent(p.Recorder, corev1.EventTypeNormal, internal.ReasonProvisioned,
+		fmt.Sprintf("instance %s is provisioned as templateinstance %s/%s", instanceId, created.Namespace, created.Name), created, template)
+	respondProvisioned(w, r, http.StatusCreated, p.dashboardURL(r.Context(), created), p.Log)
+}
+
+// respondExisting answers a provision request whose template instance already exists:
+// 200 (or 202 while in progress) for an identical request, 409 otherwise
+func (p *Provision) respondExisting(w http.ResponseWriter, r *http.Request, templateInstance *tmaxv1.TemplateInstance,
+	request schemas.ServiceInstanceProvisionRequest, instanceId string) {
+
+	if !internal.IsSameProvision(templateInstance, request, instanceId) {
+		p.Log.Info(fmt.Sprintf("template instance %s already exists with different attributes", templateInstance.Name))
+		internal.RecordEvent(p.Recorder, corev1.EventTypeWarning, internal.ReasonProvisionConflicted,
+			fmt.Sprintf("instance %s is requested again with different attributes", instanceId), templateInstance)
+		respondError(w, r, conflict("templateinstance %s already exists in namespace %s with different attributes",
+			templateInstance.Name, templateInstance.Namespace), p.Log)
+		return
+	}
+
+	if state, _ := internal.InstanceState(templateInstance); state == internal.StateInProgress {
+		if r.URL.Query().Get("accepts_incomplete") != "true" {
+			respondError(w, r, asyncRequired("templateinstance %s is still being provisioned, retry with accepts_incomplete=true",
+				templateInstance.Name), p.Log)
+			return
+		}
+		respondProvisioned(w, r, http.StatusOK, p.dashboardURL(r.Context(), templateInstance), p.Log)
+		return
+	}
+	respond(w, http.StatusOK, schemas.ServiceInstanceProvisionResponse{DashboardUrl: p.dashboardURL(r.Context(), templateInstance)}, p.Log)
+}
+
+// respondProvisioned replies 202 with an operation if the platform accepts asynchronous provisioning
+func respondProvisioned(w http.ResponseWriter, r *http.Request, syncStatus int, dashboardUrl string, log logr.Logger) {
+	if r.URL.Query().Get("accepts_incomplete") == "true" {
+		respond(w, http.StatusAccepted, schemas.ServiceInstanceProvisionResponse{DashboardUrl: dashboardUrl, Operation: "provision"}, log)
+		return
+	}
+	respond(w, syncStatus, schemas.ServiceInstanceProvisionResponse{DashboardUrl: dashboardUrl}, log)
+}
+
+// dashboardURL resolves the dashboard of the instance, leaving it out of the response if it cannot be resolved
+func (p *Provision) dashboardURL(ctx context.Context, templateInstance *tmaxv1.TemplateInstance) string {
+	dashboardUrl, err := internal.DashboardURL(ctx, p.Client, templateInstance)
+	if err != nil {
+		p.Log.Error(err, "cannot resolve dashboard url", "templateinstance", templateInstance.Name, "namespace", templateInstance.Namespace)
+	}
+	return dashboardUrl
+}
+
+func (p *Provision) GetServiceInstance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	instanceId := mux.Vars(r)["instance_id"]
+
+	namespaces, err := candidateNamespaces(p.Client, p.Config.Get(), r)
+	if err != nil {
+		p.Log.Error(err, "cannot resolve the namespace of the request")
+		respondError(w, r, err, p.Log)
+		return
+	}
+	p.getServiceInstance(w, r, namespaces, instanceId)
+}
+
+func (p *Provision) ClusterGetServiceInstance(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	p.getServiceInstance(w, r, []string{""}, mux.Vars(r)["instance_id"])
+}
+
+// getServiceInstance answers the service, plan, dashboard and parameters of an instance. Sensitive and generated parameter
+// values are redacted.
+func (p *Provision) getServiceInstance(w http.ResponseWriter, r *http.Request, namespaces []string, instanceId string) {
+	templateInstance, err := findTemplateInstance(r.Context(), p.Client, namespaces, instanceId)
+	if err != nil {
+		p.Log.Error(err, "error occurs while getting template instance")
+		respondError(w, r, internalError("cannot get the templateinstance of instance %s", instanceId), p.Log)
+		return
+	}
+	if templateInstance == nil {
+		respondError(w, r, notFound("instance %s does not exist", instanceId), p.Log)
+		return
+	}
+	if state, _ := internal.InstanceState(templateInstance); state == internal.StateInProgress {
+		// the spec of a template instance that was never updated is still at its first generation
+		if templateInstance.Generation <= 1 {
+			respondError(w, r, notFound("instance %s is still being provisioned", instanceId), p.Log)
+			return
+		}
+		respondError(w, r, concurrencyError("instance %s is being updated", instanceId), p.Log)
+		return
+	}
+
+	resource := schemas.ServiceInstanceResource{
+		ServiceId:    templateInstance.Annotations["service_id"],
+		PlanId:       templateInstance.Annotations["plan_id"],
+		DashboardUrl: p.dashboardURL(r.Context(), templateInstance),
+		Parameters:   internal.InstanceRedactor(templateInstance, templateInstance).Parameters(internal.InstanceParameters(templateInstance)),
+	}
+	if version := internal.MaintenanceVersion(templateInstance); len(version) != 0 {
+		resource.MaintenanceInfo = &schemas.MaintenanceInfo{Version: version}
+	}
+	respond(w, http.StatusOK, resource, p.Log)
+}
+
+func (p *Provision) LastOperation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	instanceId := mux.Vars(r)["instance_id"]
+
+	namespaces, err := candidateNamespaces(p.Client, p.Config.Get(), r)
+	if err != nil {
+		p.Log.Error(err, "cannot resolve the namespace of the request")
+		respondError(w, r, err, p.Log)
+		return
+	}
+	p.lastOperation(w, r, namespaces, instanceId)
+}
+
+func (p *Provision) ClusterLastOperation(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	p.lastOperation(w, r, []string{""}, mux.Vars(r)["instance_id"])
+}
+
+func (p *Provision) lastOperation(w http.ResponseWriter, r *http.Request, namespaces []string, instanceId string) {
+	templateInstance, err := findTemplateInstance(r.Context(), p.Client, namespaces, instanceId)
+	if err != nil {
+		p.Log.Error(err, "error occurs while getting template instance")
+		respondError(w, r, internalError("cannot get the templateinstance of instance %s", instanceId), p.Log)
+		return
+	}
+	if templateInstance == nil {
+		// the instance is gone, which is the expected result of a deprovision
+		respond(w, http.StatusGone, schemas.LastOperationResponse{State: internal.StateSucceeded}, p.Log)
+		return
+	}
+
+	state, description := internal.InstanceState(templateInstance)
+	respond(w, http.StatusOK, schemas.LastOperationResponse{State: state, Description: description}, p.Log)
+}
+
+// updatePlanParams reflects the parameters of the requested plan into the request and returns the plan
+func updatePlanParams(request *schemas.ServiceInstanceProvisionRequest, templateSpec tmaxv1.TemplateSpec, templateUid string) (*tmaxv1.PlanSpec, error) {
+	// check if plan valid
+	plan, err := planFor(*request, templateSpec, templateUid)
+	if err != nil {
+		return nil, err
 	}
 
 	// reflect plan parameter
 	if len(request.Parameters) == 0 {
 		request.Parameters = make(map[string]intstr.IntOrString)
 	}
+	if plan == nil {
+		return nil, nil
+	}
+	if len(plan.MaintenanceInfo.Version) != 0 {
+		request.MaintenanceInfo = &schemas.MaintenanceInfo{Version: plan.MaintenanceInfo.Version}
+	}
 	for key, val := range plan.Schemas.ServiceInstance.Create.Parameters {
 		request.Parameters[key] = val
 	}
-	return nil
+	return plan, nil
+}
+
+// planName is the name the plan is offered under in the catalog
+func planName(templateName string, planId string, plan *tmaxv1.PlanSpec) string {
+	if plan == nil {
+		return templateName + "-plan-default"
+	}
+	if len(plan.Name) != 0 {
+		return plan.Name
+	}
+	return templateName + "-plan-" + planId[strings.LastIndex(planId, "-")+1:]
+}
+
+// planFor resolves the plan of a request and checks the maintenance_info the platform expects
+func planFor(request schemas.ServiceInstanceProvisionRequest, templateSpec tmaxv1.TemplateSpec, templateUid string) (*tmaxv1.PlanSpec, error) {
+	plan, err := findPlan(templateSpec, templateUid, request.PlanId)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.MaintenanceInfo != nil && len(request.MaintenanceInfo.Version) != 0 {
+		version := ""
+		if plan != nil {
+			version = plan.MaintenanceInfo.Version
+		}
+		if request.MaintenanceInfo.Version != version {
+			return nil, maintenanceInfoConflict("maintenance_info.version %s does not match the version %q of plan %s",
+				request.MaintenanceInfo.Version, version, request.PlanId)
+		}
+	}
+	return plan, nil
+}
+
+// findPlan resolves a catalog plan id into the template plan. The default plan of a template without plans resolves to nil.
+func findPlan(templateSpec tmaxv1.TemplateSpec, templateUid string, planId string) (*tmaxv1.PlanSpec, error) {
+	if planId == templateUid+"-plan-default" && len(templateSpec.Plans) == 0 {
+		return nil, nil
+	}
+
+	tokIdx := strings.LastIndex(planId, "-")
+	if tokIdx < 0 {
+		return nil, badRequest("plan_id %q is not a plan id of this broker", planId)
+	}
+	planUid := planId[:tokIdx]
+	planIdx := planId[tokIdx+1:]
+
+	if planUid != templateUid {
+		return nil, badRequest("plan %s does not belong to service %s", planId, templateUid)
+	}
+
+	idx, err := strconv.Atoi(planIdx)
+	if err != nil || idx < 0 || idx >= len(templateSpec.Plans) {
+		return nil, badRequest("plan %s does not exist in service %s", planId, templateUid)
+	}
+	return &templateSpec.Plans[idx], nil
 }
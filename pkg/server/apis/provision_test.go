@@ -0,0 +1,248 @@
+package apis
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func TestCreateTemplateInstance(t *testing.T) {
+	cfg := namespacedConfig()
+	template := &tmaxv1.Template{ObjectMeta: metav1.ObjectMeta{Namespace: "tsb", Name: "mysql"}}
+	request := schemas.ServiceInstanceProvisionRequest{
+		ServiceId: "service-1",
+		PlanId:    "plan-1",
+		Context:   schemas.Context{InstanceName: "db", Namespace: "tsb"},
+	}
+	name, err := cfg.Naming.NamingStrategy().Name(request, "i-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// existing returns the template instance of the request under another name, or under its own name for another instance
+	existing := func(name string, instanceId string) runtime.Object {
+		templateInstance, err := internal.UpdateTemplateInstanceMetadata(template, &tmaxv1.TemplateInstance{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "tsb",
+				Name:        name,
+				Annotations: map[string]string{"instance_id": instanceId, "service_id": "service-1", "plan_id": "plan-1"},
+			},
+		}, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return templateInstance
+	}
+	heldLease := func() runtime.Object {
+		holder, seconds, now := "tsb-other", int32(60), metav1.NewMicroTime(time.Now())
+		return &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "tsb", Name: internal.ProvisionLeaseName("i-1")},
+			Spec:       coordinationv1.LeaseSpec{HolderIdentity: &holder, LeaseDurationSeconds: &seconds, RenewTime: &now},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		existing []runtime.Object
+		want     int
+	}{
+		{name: "new instance", want: http.StatusAccepted},
+		{name: "created by another replica", existing: []runtime.Object{existing("db-other", "i-1")}, want: http.StatusAccepted},
+		{name: "being provisioned by another replica", existing: []runtime.Object{heldLease()}, want: http.StatusUnprocessableEntity},
+		{name: "name taken by another instance", existing: []runtime.Object{existing(name, "i-2")}, want: http.StatusConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newFakeClient(t, test.existing...)
+			store := config.NewStore(cfg)
+			p := &Provision{
+				Client:   c,
+				Log:      testLog,
+				Config:   store,
+				Recorder: record.NewFakeRecorder(10),
+				Locker:   NewLocker(c, testLog, store),
+				Quotas:   NewQuotas(c, testLog, store),
+			}
+
+			w := httptest.NewRecorder()
+			p.createTemplateInstance(w, httptest.NewRequest("PUT", "/?accepts_incomplete=true", nil), template, "tsb", request, "i-1", "default")
+			if w.Code != test.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, test.want, w.Body.String())
+			}
+
+			if test.want != http.StatusUnprocessableEntity {
+				lease := &coordinationv1.Lease{}
+				key := client.ObjectKey{Namespace: "tsb", Name: internal.ProvisionLeaseName("i-1")}
+				if err := c.Get(context.Background(), key, lease); err == nil {
+					t.Errorf("the provision lease is not released")
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateTemplateInstance(t *testing.T) {
+	template := &tmaxv1.Template{ObjectMeta: metav1.ObjectMeta{Namespace: "tsb", Name: "mysql", UID: "service-1"}}
+	template.Parameters = []tmaxv1.ParamSpec{{Name: "STORAGE"}, {Name: "VERSION"}}
+	template.Plans = []tmaxv1.PlanSpec{{Name: "small", MaintenanceInfo: tmaxv1.MaintenanceInfo{Version: "2.0.0"}}}
+	template.Plans[0].Schemas.ServiceInstance.Create.Parameters = map[string]intstr.IntOrString{"VERSION": intstr.FromString("8.0")}
+
+	// templateAt returns the template as it was when its plan had the maintenance_info version
+	templateAt := func(version string) *tmaxv1.Template {
+		old := template.DeepCopy()
+		old.Plans[0].MaintenanceInfo.Version = version
+		return old
+	}
+	snapshotName := func(version string) string {
+		snapshot, err := internal.NewSnapshot(templateAt(version), "tsb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return snapshot.Name
+	}
+	// existing creates the template instance of i-1 pinned to the snapshot of the template at the maintenance_info version
+	existing := func(c client.Client, version string) {
+		ctx := context.Background()
+		snapshot, err := internal.PinTemplate(ctx, c, templateAt(version), "tsb", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		templateInstance, err := internal.UpdateTemplateInstanceMetadata(snapshot, &tmaxv1.TemplateInstance{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "tsb",
+				Name:        "db",
+				Annotations: map[string]string{"instance_id": "i-1", "service_id": "service-1", "plan_id": "service-1-0"},
+			},
+		}, schemas.ServiceInstanceProvisionRequest{
+			Parameters:      map[string]intstr.IntOrString{"STORAGE": intstr.FromString("1Gi"), "VERSION": intstr.FromString("5.7")},
+			MaintenanceInfo: &schemas.MaintenanceInfo{Version: version},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Create(ctx, templateInstance); err != nil {
+			t.Fatal(err)
+		}
+		if err := internal.SyncSnapshotOwners(ctx, c, templateInstance); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		version     string
+		planId      string
+		maintenance string
+		want        int
+		wantVersion string
+		wantValue   string
+		wantEvent   string
+	}{
+		{name: "parameters", version: "1.0.0", want: http.StatusOK, wantVersion: "1.0.0", wantValue: "5.7", wantEvent: internal.ReasonUpdated},
+		{name: "parameters with plan_id", version: "1.0.0", planId: "service-1-0", want: http.StatusOK, wantVersion: "1.0.0",
+			wantValue: "5.7", wantEvent: internal.ReasonUpdated},
+		{name: "upgrade", version: "1.0.0", planId: "service-1-0", maintenance: "2.0.0", want: http.StatusOK, wantVersion: "2.0.0",
+			wantValue: "8.0", wantEvent: internal.ReasonUpgraded},
+		{name: "upgrade without plan_id", version: "1.0.0", maintenance: "2.0.0", want: http.StatusOK, wantVersion: "2.0.0",
+			wantValue: "8.0", wantEvent: internal.ReasonUpgraded},
+		{name: "current maintenance_info", version: "2.0.0", planId: "service-1-0", maintenance: "2.0.0", want: http.StatusOK,
+			wantVersion: "2.0.0", wantValue: "5.7", wantEvent: internal.ReasonUpdated},
+		{name: "stale maintenance_info", version: "1.0.0", planId: "service-1-0", maintenance: "1.0.0",
+			want: http.StatusUnprocessableEntity, wantVersion: "1.0.0", wantValue: "5.7"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newFakeClient(t)
+			existing(c, test.version)
+			store := config.NewStore(namespacedConfig())
+			recorder := record.NewFakeRecorder(10)
+			p := &Provision{
+				Client:   c,
+				Log:      testLog,
+				Config:   store,
+				Recorder: recorder,
+				Locker:   NewLocker(c, testLog, store),
+				Quotas:   NewQuotas(c, testLog, store),
+			}
+			request := schemas.ServiceInstanceProvisionRequest{
+				ServiceId:  "service-1",
+				PlanId:     test.planId,
+				Context:    schemas.Context{InstanceName: "db", Namespace: "tsb"},
+				Parameters: map[string]intstr.IntOrString{"STORAGE": intstr.FromString("2Gi"), "VERSION": intstr.FromString("5.7")},
+			}
+			if len(test.maintenance) != 0 {
+				request.MaintenanceInfo = &schemas.MaintenanceInfo{Version: test.maintenance}
+			}
+
+			w := httptest.NewRecorder()
+			r := mux.SetURLVars(httptest.NewRequest("PATCH", "/", nil), map[string]string{"instance_id": "i-1"})
+			p.updateTemplateInstance(w, r, template, template.TemplateSpec, "service-1", "tsb", request)
+			if w.Code != test.want {
+				t.Fatalf("got status %d, want %d: %s", w.Code, test.want, w.Body.String())
+			}
+
+			templateInstance, err := internal.GetTemplateInstanceByInstanceId(context.Background(), c, "tsb", "i-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version := internal.MaintenanceVersion(templateInstance); version != test.wantVersion {
+				t.Errorf("got maintenance_info version %q, want %q", version, test.wantVersion)
+			}
+			// only an upgrade pins the instance to the current revision, releasing the snapshot it was pinned to
+			if name := templateInstance.Spec.Template.Metadata.Name; name != snapshotName(test.wantVersion) {
+				t.Errorf("got template %s, want the snapshot %s", name, snapshotName(test.wantVersion))
+			}
+			if name, _ := internal.InstanceTemplateName(templateInstance); name != "mysql" {
+				t.Errorf("got template name %s, want mysql", name)
+			}
+			snapshots, err := internal.GetTemplateList(context.Background(), c, "tsb", labels.Everything())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(snapshots.Items) != 0 {
+				t.Errorf("got %d templates in the catalog, want no snapshots in it", len(snapshots.Items))
+			}
+			snapshot, err := internal.InstanceSnapshot(context.Background(), c, templateInstance)
+			if err != nil || snapshot == nil || len(snapshot.OwnerReferences) != 1 {
+				t.Errorf("got snapshot %v (%v), want it owned by the instance", snapshot, err)
+			}
+			if test.wantVersion != test.version {
+				if _, err := internal.GetTemplate(context.Background(), c, client.ObjectKey{Namespace: "tsb", Name: snapshotName(test.version)}); err == nil {
+					t.Errorf("the previous snapshot is not released")
+				}
+			}
+			for _, param := range templateInstance.Spec.Template.Parameters {
+				if param.Name == "VERSION" && param.Value.String() != test.wantValue {
+					t.Errorf("got VERSION %q, want %q", param.Value.String(), test.wantValue)
+				}
+			}
+
+			event := ""
+			for len(recorder.Events) != 0 {
+				if e := <-recorder.Events; strings.HasPrefix(e, corev1.EventTypeNormal) {
+					event = strings.Fields(e)[1]
+				}
+			}
+			if event != test.wantEvent {
+				t.Errorf("got event %q, want %q", event, test.wantEvent)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package apis
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Quotas enforces the configured per-namespace limits of instances of a template or plan. The instances being provisioned
+// are reserved in a ConfigMap of the namespace, so the limits hold across replicas.
+type Quotas struct {
+	client.Client
+	Log    logr.Logger
+	Config *config.Store
+}
+
+func NewQuotas(c client.Client, log logr.Logger, store *config.Store) *Quotas {
+	return &Quotas{Client: c, Log: log, Config: store}
+}
+
+// Reserve checks the quotas a new instance of the template and plan counts against, and reserves a slot for the instance.
+// The reservation counts until the returned func is called, which is once its template instance is created or it failed.
+func (q *Quotas) Reserve(ctx context.Context, namespace string, templateName string, planName string, instanceId string) (func(), error) {
+	cfg := q.Config.Get()
+	var quotas []config.QuotaConfig
+	for _, quota := range cfg.Quotas {
+		if quota.Matches(namespace, templateName, planName) {
+			quotas = append(quotas, quota)
+		}
+	}
+	if len(quotas) == 0 {
+		return func() {}, nil
+	}
+
+	reservation := internal.QuotaReservation{InstanceId: instanceId, Template: templateName, Plan: planName}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		templateInstances := &tmaxv1.TemplateInstanceList{}
+		if err := q.List(ctx, templateInstances, client.InNamespace(namespace)); err != nil {
+			return err
+		}
+		reservations, configMap, err := internal.GetQuotaReservations(ctx, q.Client, namespace)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		reservations = withoutReservation(internal.ActiveReservations(reservations, templateInstances.Items, now), instanceId)
+
+		for _, quota := range quotas {
+			count := internal.CountQuotaInstances(templateInstances.Items, reservations, quota.Template, quota.Plan)
+			if count < quota.MaxInstances {
+				continue
+			}
+			if len(quota.Plan) != 0 {
+				return quotaExceeded("namespace %s already has %d instances of plan %s of template %s, the quota is %d",
+					namespace, count, quota.Plan, quota.Template, quota.MaxInstances)
+			}
+			return quotaExceeded("namespace %s already has %d instances of template %s, the quota is %d",
+				namespace, count, quota.Template, quota.MaxInstances)
+		}
+
+		reservation.Expires = metav1.NewTime(now.Add(leaseDuration(cfg)))
+		return internal.SaveQuotaReservations(ctx, q.Client, append(reservations, reservation), configMap)
+	})
+	if err != nil {
+		if brokerErr, ok := err.(*BrokerError); ok {
+			return nil, brokerErr
+		}
+		return nil, internalError("cannot reserve an instance of template %s in namespace %s: %s", templateName, namespace, err.Error())
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+		defer cancel()
+		if err := q.release(ctx, namespace, instanceId); err != nil {
+			q.Log.Error(err, "cannot release the quota reservation, it expires", "namespace", namespace, "instance_id", instanceId)
+		}
+	}, nil
+}
+
+func (q *Quotas) release(ctx context.Context, namespace string, instanceId string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		reservations, configMap, err := internal.GetQuotaReservations(ctx, q.Client, namespace)
+		if err != nil || len(configMap.ResourceVersion) == 0 {
+			return err
+		}
+		kept := withoutReservation(reservations, instanceId)
+		if len(kept) == len(reservations) {
+			return nil
+		}
+		return internal.SaveQuotaReservations(ctx, q.Client, kept, configMap)
+	})
+}
+
+// withoutReservation drops the reservation of the instance, e.g. of an earlier attempt to provision it
+func withoutReservation(reservations []internal.QuotaReservation, instanceId string) []internal.QuotaReservation {
+	var kept []internal.QuotaReservation
+	for _, reservation := range reservations {
+		if reservation.InstanceId != instanceId {
+			kept = append(kept, reservation)
+		}
+	}
+	return kept
+}
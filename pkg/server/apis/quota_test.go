@@ -0,0 +1,77 @@
+package apis
+
+import (
+	"context"
+	"testing"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestQuotasReserve(t *testing.T) {
+	instance := func(instanceId string) runtime.Object {
+		templateInstance := &tmaxv1.TemplateInstance{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "ns",
+			Name:        "ti-" + instanceId,
+			Annotations: map[string]string{"instance_id": instanceId},
+		}}
+		templateInstance.Spec.Template = &tmaxv1.ObjectInfo{}
+		templateInstance.Spec.Template.Metadata.Name = "mysql"
+		return templateInstance
+	}
+
+	tests := []struct {
+		name     string
+		existing []runtime.Object
+		// reserved are the instances reserved before, without being released
+		reserved []string
+		template string
+		exceeded bool
+	}{
+		{name: "no quota", existing: []runtime.Object{instance("i-1"), instance("i-2")}, template: "redis"},
+		{name: "under the quota", existing: []runtime.Object{instance("i-1")}, template: "mysql"},
+		{name: "at the quota", existing: []runtime.Object{instance("i-1"), instance("i-2")}, template: "mysql", exceeded: true},
+		{name: "reserved by another replica", existing: []runtime.Object{instance("i-1")}, reserved: []string{"i-2"}, template: "mysql", exceeded: true},
+		{name: "reserved and created", existing: []runtime.Object{instance("i-1")}, reserved: []string{"i-1"}, template: "mysql"},
+		{name: "reserved by an earlier attempt", existing: []runtime.Object{instance("i-1")}, reserved: []string{"i-3"}, template: "mysql"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := namespacedConfig()
+			cfg.Quotas = []config.QuotaConfig{{Template: "mysql", MaxInstances: 2}}
+			c := newFakeClient(t, test.existing...)
+			q := NewQuotas(c, testLog, config.NewStore(cfg))
+			ctx := context.Background()
+			for _, instanceId := range test.reserved {
+				if _, err := q.Reserve(ctx, "ns", "mysql", "", instanceId); err != nil {
+					t.Fatalf("cannot reserve %s: %s", instanceId, err.Error())
+				}
+			}
+
+			release, err := q.Reserve(ctx, "ns", test.template, "", "i-3")
+			if test.exceeded {
+				if brokerErr, ok := err.(*BrokerError); !ok || brokerErr.Code != ErrorQuotaExceeded {
+					t.Fatalf("got %v, want QuotaExceeded", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			release()
+			reservations, _, err := internal.GetQuotaReservations(ctx, c, "ns")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, reservation := range reservations {
+				if reservation.InstanceId == "i-3" {
+					t.Error("the reservation is not released")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package apis
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/go-logr/logr"
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Revisions tells which instances were rendered from an older revision of their template than the current one
+type Revisions struct {
+	client.Client
+	Log logr.Logger
+	// Namespaces returns the namespaces of the instances ("" for all namespaces)
+	Namespaces func(ctx context.Context) ([]string, error)
+}
+
+// OutdatedInstance is an instance behind the current revision of its template. An instance provisioned before revisions
+// were recorded has an empty revision.
+type OutdatedInstance struct {
+	Namespace       string                    `json:"namespace"`
+	Name            string                    `json:"name"`
+	InstanceId      string                    `json:"instance_id"`
+	Template        string                    `json:"template"`
+	Plan            string                    `json:"plan,omitempty"`
+	Revision        internal.TemplateRevision `json:"revision"`
+	CurrentRevision internal.TemplateRevision `json:"current_revision"`
+}
+
+type OutdatedReport struct {
+	// Instances is the number of instances checked
+	Instances int                `json:"instances"`
+	Outdated  []OutdatedInstance `json:"outdated"`
+}
+
+// Outdated answers the instances behind their template, filtered by the namespace and template query parameters
+func (v *Revisions) Outdated(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	report, err := v.outdated(r.Context(), query.Get("namespace"), query.Get("template"))
+	if err != nil {
+		v.Log.Error(err, "cannot find outdated template instances")
+		respondError(w, r, internalError("cannot find outdated template instances: %s", err.Error()), v.Log)
+		return
+	}
+	respond(w, http.StatusOK, report, v.Log)
+}
+
+func (v *Revisions) outdated(ctx context.Context, namespace string, templateName string) (*OutdatedReport, error) {
+	namespaces, err := v.Namespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	items, err := listTemplateInstances(ctx, v.Client, namespaces)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &OutdatedReport{Outdated: []OutdatedInstance{}}
+	templates := newTemplateCache(v.Client)
+	for i := range items {
+		templateInstance := &items[i]
+		name, _ := internal.InstanceTemplateName(templateInstance)
+		if _, ok := templateInstance.Annotations["instance_id"]; !ok || templateInstance.DeletionTimestamp != nil ||
+			!matchesQuery(namespace, templateInstance.Namespace) || !matchesQuery(templateName, name) {
+			continue
+		}
+		report.Instances++
+
+		outdated, err := outdatedInstance(ctx, templates, templateInstance)
+		if err != nil {
+			return nil, err
+		}
+		if outdated != nil {
+			report.Outdated = append(report.Outdated, *outdated)
+		}
+	}
+	sort.Slice(report.Outdated, func(i, j int) bool {
+		a, b := report.Outdated[i], report.Outdated[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	return report, nil
+}
+
+// outdatedInstance compares the revision of the template instance to the current one of its template. Instances of
+// deleted templates cannot be brought up to date and are never outdated.
+func outdatedInstance(ctx context.Context, templates *templateCache, templateInstance *tmaxv1.TemplateInstance) (*OutdatedInstance, error) {
+	template, err := templates.of(ctx, templateInstance)
+	if err != nil || template == nil {
+		return nil, err
+	}
+	current, err := internal.RevisionOf(template.obj)
+	if err != nil {
+		return nil, err
+	}
+	revision := internal.InstanceRevision(templateInstance)
+	if revision.Revision == current.Revision {
+		return nil, nil
+	}
+
+	name, _ := internal.InstanceTemplateName(templateInstance)
+	return &OutdatedInstance{
+		Namespace:       templateInstance.Namespace,
+		Name:            templateInstance.Name,
+		InstanceId:      templateInstance.Annotations["instance_id"],
+		Template:        name,
+		Plan:            templateInstance.Labels[internal.PlanLabel],
+		Revision:        revision,
+		CurrentRevision: current,
+	}, nil
+}
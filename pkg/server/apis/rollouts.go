@@ -0,0 +1,707 @@
+package apis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// RolloutVar is the route variable of the rollout id
+const RolloutVar = "rollout_id"
+
+const (
+	// rolloutStepTimeout bounds the API calls of one step of the rollouts
+	rolloutStepTimeout = 5 * time.Minute
+	// rolloutSettleTime is how long after its upgrade the state of an instance is taken as the result of the upgrade,
+	// if the template operator does not report the generation it observed
+	rolloutSettleTime = 30 * time.Second
+)
+
+// Rollouts upgrades the outdated instances of a template to its current revision in batches. A batch starts once the
+// instances of the previous one are ready, and an instance that fails or does not become ready in time rolls back all
+// instances the rollout upgraded.
+type Rollouts struct {
+	client.Client
+	Log       logr.Logger
+	Config    *config.Store
+	Recorder  record.EventRecorder
+	Locker    *Locker
+	Revisions *Revisions
+	// Broker names the rollouts of this broker, apart from those of a broker of the other scope in the same namespace
+	Broker string
+}
+
+type RolloutRequest struct {
+	Template string `json:"template"`
+	// Namespace limits the rollout to the instances of one namespace
+	Namespace string `json:"namespace,omitempty"`
+	// BatchSize defaults to rollout.batchSize of the configuration
+	BatchSize int `json:"batch_size,omitempty"`
+	// DryRun answers the upgrades the rollout would make without starting it
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// ParameterChange is a parameter value changed by an upgrade. Sensitive and generated values are redacted.
+type ParameterChange struct {
+	Name   string `json:"name"`
+	Change string `json:"change"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+}
+
+// PlannedUpgrade is the upgrade of an instance by a dry-run rollout, or the reason it would fail. The template changes are
+// unknown for an instance provisioned before instances were pinned, its revision is not kept.
+type PlannedUpgrade struct {
+	OutdatedInstance
+	Changes         []ParameterChange       `json:"changes"`
+	TemplateChanges []internal.ObjectChange `json:"template_changes,omitempty"`
+	Error           string                  `json:"error,omitempty"`
+}
+
+type RolloutPlan struct {
+	Template  string           `json:"template"`
+	Namespace string           `json:"namespace,omitempty"`
+	BatchSize int              `json:"batch_size"`
+	Batches   int              `json:"batches"`
+	Instances []PlannedUpgrade `json:"instances"`
+}
+
+// templateChangedError stops a rollout whose template changed again since the rollout started
+type templateChangedError struct {
+	template string
+	revision string
+}
+
+func (e *templateChangedError) Error() string {
+	return fmt.Sprintf("template %s changed to revision %s since the rollout started, start a new rollout", e.template, e.revision)
+}
+
+// List answers the rollouts, newest first, filtered by the template query parameter
+func (r *Rollouts) List(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rollouts, err := r.list(req.Context())
+	if err != nil {
+		r.Log.Error(err, "cannot list rollouts")
+		respondError(w, req, internalError("cannot list rollouts: %s", err.Error()), r.Log)
+		return
+	}
+	filtered := []*internal.Rollout{}
+	for _, rollout := range rollouts {
+		if matchesQuery(req.URL.Query().Get("template"), rollout.Template) {
+			filtered = append(filtered, rollout)
+		}
+	}
+	respond(w, http.StatusOK, filtered, r.Log)
+}
+
+// Get answers the rollout with its instances
+func (r *Rollouts) Get(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rollout, _, err := r.get(req.Context(), mux.Vars(req)[RolloutVar])
+	if err != nil {
+		respondError(w, req, err, r.Log)
+		return
+	}
+	respond(w, http.StatusOK, rollout, r.Log)
+}
+
+// Create starts a rollout of the outdated instances of a template, or answers its plan for a dry run
+func (r *Rollouts) Create(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var m RolloutRequest
+
+	if err := json.NewDecoder(req.Body).Decode(&m); err != nil {
+		respondError(w, req, badRequest("cannot decode rollout request body: %s", err.Error()), r.Log)
+		return
+	}
+	if len(m.Template) == 0 {
+		respondError(w, req, badRequest("template is required"), r.Log)
+		return
+	}
+	if m.BatchSize == 0 {
+		m.BatchSize = r.Config.Get().Rollout.BatchSize
+	}
+	if m.BatchSize < 0 {
+		respondError(w, req, badRequest("batch_size must be positive, got %d", m.BatchSize), r.Log)
+		return
+	}
+
+	report, err := r.Revisions.outdated(req.Context(), m.Namespace, m.Template)
+	if err != nil {
+		r.Log.Error(err, "cannot find outdated template instances")
+		respondError(w, req, internalError("cannot find outdated template instances: %s", err.Error()), r.Log)
+		return
+	}
+
+	if m.DryRun {
+		plan, err := r.plan(req.Context(), m, report.Outdated)
+		if err != nil {
+			r.Log.Error(err, "cannot plan rollout", "template", m.Template)
+			respondError(w, req, err, r.Log)
+			return
+		}
+		respond(w, http.StatusOK, plan, r.Log)
+		return
+	}
+
+	if len(report.Outdated) == 0 {
+		respondError(w, req, badRequest("no instance of template %s is outdated", m.Template), r.Log)
+		return
+	}
+	rollouts, err := r.list(req.Context())
+	if err != nil {
+		r.Log.Error(err, "cannot list rollouts")
+		respondError(w, req, internalError("cannot list rollouts: %s", err.Error()), r.Log)
+		return
+	}
+	for _, running := range rollouts {
+		if running.Active() && running.Template == m.Template && (len(running.Namespace) == 0 || len(m.Namespace) == 0 ||
+			running.Namespace == m.Namespace) {
+			respondError(w, req, conflict("rollout %s of template %s is %s", running.Id, running.Template, running.State), r.Log)
+			return
+		}
+	}
+
+	rollout := &internal.Rollout{
+		Template:  m.Template,
+		Namespace: m.Namespace,
+		BatchSize: m.BatchSize,
+		State:     internal.RolloutRunning,
+		Created:   metav1.Now(),
+	}
+	for _, outdated := range report.Outdated {
+		rollout.Instances = append(rollout.Instances, internal.RolloutInstance{
+			Namespace:  outdated.Namespace,
+			Name:       outdated.Name,
+			InstanceId: outdated.InstanceId,
+			From:       outdated.Revision,
+			To:         outdated.CurrentRevision,
+			State:      internal.RolloutInstancePending,
+		})
+	}
+	configMap := internal.NewRolloutConfigMap(r.Config.Get().Rollout.Namespace, r.Broker)
+	if err := internal.SaveRollout(req.Context(), r.Client, rollout, configMap); err != nil {
+		r.Log.Error(err, "cannot create rollout", "template", m.Template)
+		respondError(w, req, err, r.Log)
+		return
+	}
+	r.Log.Info(fmt.Sprintf("rollout %s of template %s started for %d instances", rollout.Id, rollout.Template, len(rollout.Instances)))
+	respond(w, http.StatusCreated, rollout, r.Log)
+}
+
+// Pause stops a running rollout from starting further batches, the instances being upgraded are still watched
+func (r *Rollouts) Pause(w http.ResponseWriter, req *http.Request) {
+	r.transition(w, req, internal.RolloutPaused, internal.RolloutRunning)
+}
+
+// Resume continues a paused rollout with its next batch
+func (r *Rollouts) Resume(w http.ResponseWriter, req *http.Request) {
+	r.transition(w, req, internal.RolloutRunning, internal.RolloutPaused)
+}
+
+// Rollback returns the instances a rollout upgraded to their previous revision, also after the rollout succeeded
+func (r *Rollouts) Rollback(w http.ResponseWriter, req *http.Request) {
+	r.transition(w, req, internal.RolloutRollingBack, internal.RolloutRunning, internal.RolloutPaused, internal.RolloutSucceeded)
+}
+
+// transition moves the rollout to the state if it is in one of the states from. A rollout the leader changed in the
+// meantime is answered with a concurrency error.
+func (r *Rollouts) transition(w http.ResponseWriter, req *http.Request, to string, from ...string) {
+	w.Header().Set("Content-Type", "application/json")
+
+	rollout, configMap, err := r.get(req.Context(), mux.Vars(req)[RolloutVar])
+	if err != nil {
+		respondError(w, req, err, r.Log)
+		return
+	}
+	allowed := false
+	for _, state := range from {
+		allowed = allowed || rollout.State == state
+	}
+	if !allowed {
+		respondError(w, req, conflict("rollout %s is %s, it can only be set %s when %v", rollout.Id, rollout.State, to, from), r.Log)
+		return
+	}
+
+	rollout.State = to
+	rollout.Message = fmt.Sprintf("set %s by request", to)
+	if err := internal.SaveRollout(req.Context(), r.Client, rollout, configMap); err != nil {
+		r.Log.Error(err, "cannot save rollout", "rollout", rollout.Id)
+		respondError(w, req, err, r.Log)
+		return
+	}
+	r.Log.Info(fmt.Sprintf("rollout %s of template %s is set %s", rollout.Id, rollout.Template, to))
+	respond(w, http.StatusOK, rollout, r.Log)
+}
+
+func (r *Rollouts) get(ctx context.Context, id string) (*internal.Rollout, *corev1.ConfigMap, error) {
+	name := types.NamespacedName{Namespace: r.Config.Get().Rollout.Namespace, Name: id}
+	rollout, configMap, err := internal.GetRollout(ctx, r.Client, name, r.Broker)
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			return nil, nil, notFound("rollout %s does not exist", id)
+		}
+		r.Log.Error(err, "cannot get rollout", "rollout", id)
+		return nil, nil, internalError("cannot get rollout %s: %s", id, err.Error())
+	}
+	return rollout, configMap, nil
+}
+
+// list returns the rollouts of the broker, newest first
+func (r *Rollouts) list(ctx context.Context) ([]*internal.Rollout, error) {
+	configMaps, err := internal.ListRollouts(ctx, r.Client, r.Config.Get().Rollout.Namespace, r.Broker)
+	if err != nil {
+		return nil, err
+	}
+	var rollouts []*internal.Rollout
+	for i := range configMaps.Items {
+		rollout, err := internal.DecodeRollout(&configMaps.Items[i])
+		if err != nil {
+			r.Log.Error(err, "skipping unreadable rollout")
+			continue
+		}
+		rollouts = append(rollouts, rollout)
+	}
+	sort.Slice(rollouts, func(i, j int) bool {
+		return rollouts[i].Created.After(rollouts[j].Created.Time)
+	})
+	return rollouts, nil
+}
+
+// plan renders each outdated instance from the current revision without saving it, to show the parameter changes, and
+// compares the objects of the revision it is pinned to with the current one
+func (r *Rollouts) plan(ctx context.Context, m RolloutRequest, outdated []OutdatedInstance) (*RolloutPlan, error) {
+	plan := &RolloutPlan{
+		Template:  m.Template,
+		Namespace: m.Namespace,
+		BatchSize: m.BatchSize,
+		Batches:   (len(outdated) + m.BatchSize - 1) / m.BatchSize,
+		Instances: []PlannedUpgrade{},
+	}
+	templates := newTemplateCache(r.Client)
+	for _, instance := range outdated {
+		planned := PlannedUpgrade{OutdatedInstance: instance, Changes: []ParameterChange{}}
+		templateInstance, err := internal.GetTemplateInstance(ctx, r.Client, types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name})
+		if err != nil {
+			if kerrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		template, err := templates.of(ctx, templateInstance)
+		if err != nil {
+			return nil, err
+		}
+		if template == nil {
+			continue
+		}
+
+		// rendered from the snapshot the upgrade would pin the instance to, without creating it
+		snapshot, err := internal.NewSnapshot(template.obj, templateInstance.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		rendered, err := renderUpgrade(templateInstance.DeepCopy(), template, snapshot)
+		if err != nil {
+			planned.Error = internal.InstanceRedactor(template.obj, templateInstance).Error(err).Error()
+		} else {
+			planned.Changes = parameterChanges(templateInstance, rendered, internal.InstanceRedactor(template.obj, rendered))
+		}
+		pinned, err := internal.InstanceSnapshot(ctx, r.Client, templateInstance)
+		if err != nil && !kerrors.IsNotFound(err) {
+			return nil, err
+		}
+		if pinned != nil {
+			if planned.TemplateChanges, err = internal.ObjectChanges(pinned.Objects, snapshot.Objects); err != nil {
+				return nil, err
+			}
+		}
+		plan.Instances = append(plan.Instances, planned)
+	}
+	return plan, nil
+}
+
+// renderUpgrade renders the template instance from the snapshot of the current revision of its template, with the values it
+// has and the fixed values and maintenance_info of its plan
+func renderUpgrade(templateInstance *tmaxv1.TemplateInstance, template *instanceTemplate, snapshot *tmaxv1.Template) (*tmaxv1.TemplateInstance, error) {
+	request := schemas.ServiceInstanceProvisionRequest{
+		ServiceId: templateInstance.Annotations["service_id"],
+		PlanId:    templateInstance.Annotations["plan_id"],
+	}
+	plan, err := findPlan(template.spec, template.uid, request.PlanId)
+	if err != nil {
+		return nil, err
+	}
+	internal.KeepParameters(&request, templateInstance)
+	if plan != nil {
+		if len(plan.MaintenanceInfo.Version) != 0 {
+			request.MaintenanceInfo = &schemas.MaintenanceInfo{Version: plan.MaintenanceInfo.Version}
+		}
+		for key, val := range plan.Schemas.ServiceInstance.Create.Parameters {
+			request.Parameters[key] = val
+		}
+	}
+	return internal.UpdateTemplateInstanceMetadata(snapshot, templateInstance, request)
+}
+
+// parameterChanges compares the parameter values of the template instance before and after rendering, by name
+func parameterChanges(before, after *tmaxv1.TemplateInstance, redactor *internal.Redactor) []ParameterChange {
+	from := internal.InstanceParameters(before)
+	to := internal.InstanceParameters(after)
+	shownFrom := redactor.Parameters(from)
+	shownTo := redactor.Parameters(to)
+
+	changes := []ParameterChange{}
+	for name, value := range to {
+		previous, ok := from[name]
+		switch {
+		case !ok:
+			changes = append(changes, ParameterChange{Name: name, Change: "added", To: shownTo[name]})
+		case previous != value:
+			changes = append(changes, ParameterChange{Name: name, Change: "changed", From: shownFrom[name], To: shownTo[name]})
+		}
+	}
+	for name := range from {
+		if _, ok := to[name]; !ok {
+			changes = append(changes, ParameterChange{Name: name, Change: "removed", From: shownFrom[name]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes
+}
+
+// Run advances the active rollouts every interval until ctx is cancelled. It runs on the leader only, and a new leader
+// continues from the state saved by the previous one.
+func (r *Rollouts) Run(ctx context.Context) {
+	for {
+		cfg := r.Config.Get().Rollout
+		r.step(ctx, cfg)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.Interval.Duration):
+		}
+	}
+}
+
+func (r *Rollouts) step(ctx context.Context, cfg config.RolloutConfig) {
+	ctx, cancel := context.WithTimeout(ctx, rolloutStepTimeout)
+	defer cancel()
+
+	configMaps, err := internal.ListRollouts(ctx, r.Client, cfg.Namespace, r.Broker)
+	if err != nil {
+		r.Log.Error(err, "cannot list rollouts")
+		return
+	}
+	for i := range configMaps.Items {
+		configMap := &configMaps.Items[i]
+		rollout, err := internal.DecodeRollout(configMap)
+		if err != nil {
+			r.Log.Error(err, "skipping unreadable rollout")
+			continue
+		}
+		if !rollout.Active() {
+			continue
+		}
+
+		state := rollout.State
+		before, _ := json.Marshal(rollout)
+		r.advance(ctx, cfg, rollout)
+		if after, _ := json.Marshal(rollout); string(after) == string(before) {
+			continue
+		}
+		// a rollout changed by a request in the meantime is advanced again at the next step. Instances upgraded or rolled
+		// back by this step are recognized by their previous spec annotation then.
+		if err := internal.SaveRollout(ctx, r.Client, rollout, configMap); err != nil {
+			r.Log.Error(err, "cannot save rollout, retrying at the next step", "rollout", rollout.Id)
+			continue
+		}
+		if rollout.State != state {
+			r.Log.Info(fmt.Sprintf("rollout %s of template %s is %s: %s", rollout.Id, rollout.Template, rollout.State, rollout.Message))
+		}
+	}
+}
+
+// advance watches the instances being upgraded, then starts the next batch, or rolls back once an instance failed
+func (r *Rollouts) advance(ctx context.Context, cfg config.RolloutConfig, rollout *internal.Rollout) {
+	if rollout.State == internal.RolloutRollingBack {
+		r.rollBack(ctx, rollout)
+		return
+	}
+
+	r.watch(ctx, cfg, rollout)
+	if failed := rollout.Count(internal.RolloutInstanceFailed); failed != 0 {
+		rollout.State = internal.RolloutRollingBack
+		rollout.Message = fmt.Sprintf("%d instances failed to upgrade, rolling back", failed)
+		r.rollBack(ctx, rollout)
+		return
+	}
+	if rollout.State != internal.RolloutRunning || rollout.Count(internal.RolloutInstanceUpgrading) != 0 {
+		return
+	}
+	if rollout.Count(internal.RolloutInstancePending) == 0 {
+		rollout.State = internal.RolloutSucceeded
+		rollout.Message = fmt.Sprintf("%d instances upgraded", rollout.Count(internal.RolloutInstanceUpgraded))
+		return
+	}
+	r.startBatch(ctx, rollout)
+}
+
+// watch marks the instances being upgraded upgraded once ready, and failed if they fail or are not ready in time
+func (r *Rollouts) watch(ctx context.Context, cfg config.RolloutConfig, rollout *internal.Rollout) {
+	now := time.Now()
+	for i := range rollout.Instances {
+		instance := &rollout.Instances[i]
+		if instance.State != internal.RolloutInstanceUpgrading {
+			continue
+		}
+		templateInstance, err := internal.GetTemplateInstance(ctx, r.Client, types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name})
+		if err != nil {
+			if kerrors.IsNotFound(err) {
+				instance.State = internal.RolloutInstanceSkipped
+				instance.Message = "deleted during its upgrade"
+				continue
+			}
+			r.Log.Error(err, "cannot get template instance", "templateinstance", instance.Name, "namespace", instance.Namespace)
+			continue
+		}
+
+		state, message := internal.UpdatedInstanceState(templateInstance, instance.Started.Time, rolloutSettleTime, now)
+		switch {
+		case state == internal.StateSucceeded:
+			instance.State = internal.RolloutInstanceUpgraded
+			internal.RecordEvent(r.Recorder, corev1.EventTypeNormal, internal.ReasonUpgraded,
+				fmt.Sprintf("instance %s is upgraded to revision %s of template %s by rollout %s", instance.InstanceId,
+					instance.To.Revision, rollout.Template, rollout.Id), templateInstance)
+		case state == internal.StateFailed:
+			instance.State = internal.RolloutInstanceFailed
+			instance.Message = internal.InstanceRedactor(templateInstance, templateInstance).String(message)
+		case now.Sub(instance.Started.Time) > cfg.BatchTimeout.Duration:
+			instance.State = internal.RolloutInstanceFailed
+			instance.Message = fmt.Sprintf("not ready %s after its upgrade", cfg.BatchTimeout.Duration)
+		}
+		if instance.State == internal.RolloutInstanceFailed {
+			internal.RecordEvent(r.Recorder, corev1.EventTypeWarning, internal.ReasonUpgradeFailed,
+				fmt.Sprintf("instance %s failed to upgrade to revision %s of template %s by rollout %s: %s", instance.InstanceId,
+					instance.To.Revision, rollout.Template, rollout.Id, instance.Message), templateInstance)
+		}
+	}
+}
+
+// startBatch upgrades up to a batch of pending instances. Instances busy with another operation are tried again at the
+// next step.
+func (r *Rollouts) startBatch(ctx context.Context, rollout *internal.Rollout) {
+	templates := newTemplateCache(r.Client)
+	started := 0
+	for i := range rollout.Instances {
+		instance := &rollout.Instances[i]
+		if started >= rollout.BatchSize {
+			return
+		}
+		if instance.State != internal.RolloutInstancePending {
+			continue
+		}
+
+		err := r.upgrade(ctx, templates, rollout, instance)
+		switch e := err.(type) {
+		case nil:
+			if instance.State == internal.RolloutInstanceUpgrading {
+				started++
+			}
+		case *internal.LeaseHeldError:
+			r.Log.V(1).Info(fmt.Sprintf("cannot upgrade instance %s yet: %s", instance.InstanceId, e.Error()))
+		case *templateChangedError:
+			rollout.State = internal.RolloutPaused
+			rollout.Message = e.Error()
+			return
+		default:
+			if kerrors.IsConflict(err) {
+				r.Log.V(1).Info(fmt.Sprintf("cannot upgrade instance %s yet: %s", instance.InstanceId, err.Error()))
+				continue
+			}
+			instance.State = internal.RolloutInstanceFailed
+			instance.Message = err.Error()
+			r.Log.Error(err, "cannot upgrade template instance", "templateinstance", instance.Name, "namespace", instance.Namespace)
+			return
+		}
+	}
+}
+
+// upgrade renders the instance from the revision the rollout started with, keeping its previous spec for rolling it back
+func (r *Rollouts) upgrade(ctx context.Context, templates *templateCache, rollout *internal.Rollout, instance *internal.RolloutInstance) error {
+	templateInstance, err := internal.GetTemplateInstance(ctx, r.Client, types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name})
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			instance.State = internal.RolloutInstanceSkipped
+			instance.Message = "deleted before its upgrade"
+			return nil
+		}
+		return err
+	}
+	now := metav1.Now()
+	if internal.UpgradedBy(templateInstance, rollout.Id) {
+		// upgraded by a step whose rollout could not be saved
+		instance.State = internal.RolloutInstanceUpgrading
+		instance.Started = &now
+		return nil
+	}
+
+	template, err := templates.of(ctx, templateInstance)
+	if err != nil {
+		return err
+	}
+	if template == nil {
+		instance.State = internal.RolloutInstanceSkipped
+		instance.Message = "its template was deleted"
+		return nil
+	}
+	current, err := internal.RevisionOf(template.obj)
+	if err != nil {
+		return err
+	}
+	if current.Revision != instance.To.Revision {
+		return &templateChangedError{template: rollout.Template, revision: current.Revision}
+	}
+	if internal.InstanceRevision(templateInstance).Revision == instance.To.Revision {
+		instance.State = internal.RolloutInstanceSkipped
+		instance.Message = "already at the revision, e.g. upgraded by an update"
+		return nil
+	}
+
+	unlock, err := r.Locker.LockInstance(ctx, templateInstance, internal.OperationRollout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	redactor := internal.InstanceRedactor(template.obj, templateInstance)
+	snapshot, err := internal.PinTemplate(ctx, r.Client, template.obj, templateInstance.Namespace, templateInstance)
+	if err != nil {
+		return err
+	}
+	if err := internal.SavePreviousSpec(templateInstance, rollout.Id); err != nil {
+		return err
+	}
+	if _, err := renderUpgrade(templateInstance, template, snapshot); err != nil {
+		return redactor.Error(err)
+	}
+	if err := r.Client.Update(ctx, templateInstance); err != nil {
+		return redactor.Error(err)
+	}
+	if err := internal.SyncSnapshotOwners(ctx, r.Client, templateInstance); err != nil {
+		r.Log.Error(err, "cannot sync the template snapshots", "templateinstance", templateInstance.Name, "namespace", templateInstance.Namespace)
+	}
+	instance.State = internal.RolloutInstanceUpgrading
+	instance.Started = &now
+	instance.Message = ""
+	return nil
+}
+
+// rollBack restores the previous spec of every instance the rollout changed, whatever its state says: an instance upgraded
+// by a step whose rollout could not be saved is still Pending. Instances that cannot be rolled back yet keep their state and
+// are tried again at the next step, the rollout fails once the others are rolled back if some cannot be at all.
+func (r *Rollouts) rollBack(ctx context.Context, rollout *internal.Rollout) {
+	remaining := 0
+	for i := range rollout.Instances {
+		instance := &rollout.Instances[i]
+		switch instance.State {
+		case internal.RolloutInstanceRolledBack, internal.RolloutInstanceSkipped, internal.RolloutInstanceRollbackFailed:
+			continue
+		}
+
+		if err := r.restore(ctx, rollout, instance); err != nil {
+			remaining++
+			r.Log.Error(err, "cannot roll back template instance, retrying at the next step", "templateinstance", instance.Name,
+				"namespace", instance.Namespace)
+		}
+	}
+	if remaining != 0 {
+		return
+	}
+	var failed []string
+	for _, instance := range rollout.Instances {
+		if instance.State == internal.RolloutInstanceRollbackFailed {
+			failed = append(failed, instance.Namespace+"/"+instance.Name)
+		}
+	}
+	rolledBack := rollout.Count(internal.RolloutInstanceRolledBack)
+	if len(failed) != 0 {
+		rollout.State = internal.RolloutRollbackFailed
+		rollout.Message = fmt.Sprintf("%d instances rolled back, cannot roll back %s", rolledBack, strings.Join(failed, ", "))
+		return
+	}
+	rollout.State = internal.RolloutRolledBack
+	rollout.Message = fmt.Sprintf("%d instances rolled back", rolledBack)
+}
+
+// restore puts back the spec the rollout kept in the template instance of the instance, pinning it to the snapshot of the
+// revision it had. An instance the rollout did not upgrade is left as it is.
+func (r *Rollouts) restore(ctx context.Context, rollout *internal.Rollout, instance *internal.RolloutInstance) error {
+	templateInstance, err := internal.GetTemplateInstance(ctx, r.Client, types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name})
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			instance.State = internal.RolloutInstanceSkipped
+			instance.Message = "deleted before its rollback"
+			return nil
+		}
+		return err
+	}
+	if !internal.UpgradedBy(templateInstance, rollout.Id) {
+		if instance.Started != nil {
+			instance.State = internal.RolloutInstanceSkipped
+			instance.Message = "changed by a later rollout or update, not rolled back"
+		}
+		return nil
+	}
+
+	unlock, err := r.Locker.LockInstance(ctx, templateInstance, internal.OperationRollout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	restored, err := internal.RestorePreviousSpec(templateInstance, rollout.Id)
+	if err != nil || !restored {
+		return err
+	}
+	if _, err := internal.InstanceSnapshot(ctx, r.Client, templateInstance); err != nil {
+		if !kerrors.IsNotFound(err) {
+			return err
+		}
+		// the snapshot is kept while the instance keeps the previous spec, unless it was deleted by hand
+		instance.State = internal.RolloutInstanceRollbackFailed
+		instance.Message = fmt.Sprintf("cannot roll back, the snapshot of revision %s was deleted", instance.From.Revision)
+		return nil
+	}
+	if err := r.Client.Update(ctx, templateInstance); err != nil {
+		return err
+	}
+	if err := internal.SyncSnapshotOwners(ctx, r.Client, templateInstance); err != nil {
+		r.Log.Error(err, "cannot sync the template snapshots", "templateinstance", templateInstance.Name, "namespace", templateInstance.Namespace)
+	}
+	instance.State = internal.RolloutInstanceRolledBack
+	internal.RecordEvent(r.Recorder, corev1.EventTypeNormal, internal.ReasonRolledBack,
+		fmt.Sprintf("instance %s is rolled back to revision %s of template %s by rollout %s", instance.InstanceId,
+			instance.From.Revision, rollout.Template, rollout.Id), templateInstance)
+	return nil
+}
@@ -0,0 +1,420 @@
+package apis
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	readyStatus  = `{"conditions": [{"type": "Ready", "status": "True"}]}`
+	failedStatus = `{"conditions": [{"type": "Ready", "status": "False", "message": "quota exceeded"}]}`
+)
+
+// redisTemplate returns the template redis of the tsb namespace with a deployment of the image
+func redisTemplate(image string) *tmaxv1.Template {
+	template := &tmaxv1.Template{ObjectMeta: metav1.ObjectMeta{Namespace: "tsb", Name: "redis", UID: "service-1"}}
+	template.Parameters = []tmaxv1.ParamSpec{{Name: "VERSION"}}
+	template.Plans = []tmaxv1.PlanSpec{{Name: "small"}}
+	template.Objects = []runtime.RawExtension{{
+		Raw: []byte(`{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": {"name": "redis"}, "spec": {"image": "` + image + `"}}`),
+	}}
+	return template
+}
+
+// redisSnapshot returns the name of the snapshot of the template redis with the image
+func redisSnapshot(t *testing.T, image string) string {
+	snapshot, err := internal.NewSnapshot(redisTemplate(image), "tsb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot.Name
+}
+
+// newRolloutsFixture returns the rollouts of a client holding the template redis with the image and its instances db-0 to
+// db-<count-1>, provisioned pinned to it
+func newRolloutsFixture(t *testing.T, image string, count int) (*Rollouts, client.Client) {
+	ctx := context.Background()
+	template := redisTemplate(image)
+	c := newFakeClient(t, template)
+	for i := 0; i < count; i++ {
+		snapshot, err := internal.PinTemplate(ctx, c, template, "tsb", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		templateInstance, err := internal.UpdateTemplateInstanceMetadata(snapshot, &tmaxv1.TemplateInstance{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "tsb",
+				Name:        "db-" + strconv.Itoa(i),
+				UID:         types.UID("uid-" + strconv.Itoa(i)),
+				Annotations: map[string]string{"instance_id": "i-" + strconv.Itoa(i), "service_id": "service-1", "plan_id": "service-1-0"},
+			},
+		}, schemas.ServiceInstanceProvisionRequest{Parameters: map[string]intstr.IntOrString{"VERSION": intstr.FromString("5.0")}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Create(ctx, templateInstance); err != nil {
+			t.Fatal(err)
+		}
+		if err := internal.SyncSnapshotOwners(ctx, c, templateInstance); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := namespacedConfig()
+	cfg.Rollout.Namespace = "tsb"
+	store := config.NewStore(cfg)
+	r := &Rollouts{
+		Client:   c,
+		Log:      testLog,
+		Config:   store,
+		Recorder: record.NewFakeRecorder(100),
+		Locker:   NewLocker(c, testLog, store),
+		Broker:   "tsb",
+	}
+	return r, c
+}
+
+// changeTemplate changes the image of the template redis
+func changeTemplate(t *testing.T, c client.Client, image string) {
+	template, err := internal.GetTemplate(context.Background(), c, types.NamespacedName{Namespace: "tsb", Name: "redis"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.Objects = redisTemplate(image).Objects
+	if err := c.Update(context.Background(), template); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getInstance(t *testing.T, c client.Client, name string) *tmaxv1.TemplateInstance {
+	templateInstance, err := internal.GetTemplateInstance(context.Background(), c, types.NamespacedName{Namespace: "tsb", Name: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return templateInstance
+}
+
+func TestRolloutAdvance(t *testing.T) {
+	type instance struct {
+		state string
+		// upgraded instances are upgraded by the rollout before it advances, and report the status then
+		upgraded bool
+		status   string
+		// started is how long ago the instance was upgraded
+		started time.Duration
+	}
+	tests := []struct {
+		name      string
+		state     string
+		batchSize int
+		instances []instance
+		// changed changes the template again after the rollout started
+		changed bool
+		// deleted deletes the snapshot of the revision the instances are upgraded from by hand
+		deleted bool
+
+		want string
+		// wantMessage is part of the message of the rollout
+		wantMessage   string
+		wantInstances []string
+		// wantImages are the images of the snapshots the instances are pinned to
+		wantImages []string
+		// wantSnapshots are the images of the snapshots kept, the one of the previous spec stays for rolling back
+		wantSnapshots []string
+	}{
+		{
+			name: "starts a batch", state: internal.RolloutRunning, batchSize: 2,
+			instances: []instance{{state: internal.RolloutInstancePending}, {state: internal.RolloutInstancePending},
+				{state: internal.RolloutInstancePending}},
+			want: internal.RolloutRunning,
+			wantInstances: []string{internal.RolloutInstanceUpgrading, internal.RolloutInstanceUpgrading,
+				internal.RolloutInstancePending},
+			wantImages: []string{"redis:6", "redis:6", "redis:5"}, wantSnapshots: []string{"redis:5", "redis:6"},
+		},
+		{
+			name: "waits for the batch", state: internal.RolloutRunning, batchSize: 1,
+			instances: []instance{{state: internal.RolloutInstanceUpgrading, upgraded: true, status: `{}`, started: time.Minute},
+				{state: internal.RolloutInstancePending}},
+			want:          internal.RolloutRunning,
+			wantInstances: []string{internal.RolloutInstanceUpgrading, internal.RolloutInstancePending},
+			wantImages:    []string{"redis:6", "redis:5"}, wantSnapshots: []string{"redis:5", "redis:6"},
+		},
+		{
+			name: "takes no status for the result before it settles", state: internal.RolloutRunning, batchSize: 1,
+			instances: []instance{{state: internal.RolloutInstanceUpgrading, upgraded: true, status: failedStatus},
+				{state: internal.RolloutInstancePending}},
+			want:          internal.RolloutRunning,
+			wantInstances: []string{internal.RolloutInstanceUpgrading, internal.RolloutInstancePending},
+			wantImages:    []string{"redis:6", "redis:5"}, wantSnapshots: []string{"redis:5", "redis:6"},
+		},
+		{
+			name: "starts the next batch once ready", state: internal.RolloutRunning, batchSize: 1,
+			instances: []instance{{state: internal.RolloutInstanceUpgrading, upgraded: true, status: readyStatus, started: time.Minute},
+				{state: internal.RolloutInstancePending}},
+			want:          internal.RolloutRunning,
+			wantInstances: []string{internal.RolloutInstanceUpgraded, internal.RolloutInstanceUpgrading},
+			wantImages:    []string{"redis:6", "redis:6"}, wantSnapshots: []string{"redis:5", "redis:6"},
+		},
+		{
+			name: "succeeds", state: internal.RolloutRunning, batchSize: 1,
+			instances: []instance{{state: internal.RolloutInstanceUpgraded, upgraded: true, status: readyStatus, started: time.Minute},
+				{state: internal.RolloutInstanceUpgrading, upgraded: true, status: readyStatus, started: time.Minute}},
+			want:          internal.RolloutSucceeded,
+			wantInstances: []string{internal.RolloutInstanceUpgraded, internal.RolloutInstanceUpgraded},
+			wantImages:    []string{"redis:6", "redis:6"}, wantSnapshots: []string{"redis:5", "redis:6"},
+		},
+		{
+			name: "rolls back a failed batch", state: internal.RolloutRunning, batchSize: 2,
+			instances: []instance{{state: internal.RolloutInstanceUpgraded, upgraded: true, status: readyStatus, started: time.Minute},
+				{state: internal.RolloutInstanceUpgrading, upgraded: true, status: failedStatus, started: time.Minute},
+				{state: internal.RolloutInstancePending}},
+			want: internal.RolloutRolledBack,
+			wantInstances: []string{internal.RolloutInstanceRolledBack, internal.RolloutInstanceRolledBack,
+				internal.RolloutInstancePending},
+			wantImages: []string{"redis:5", "redis:5", "redis:5"}, wantSnapshots: []string{"redis:5"},
+		},
+		{
+			name: "rolls back an instance not ready in time", state: internal.RolloutRunning, batchSize: 1,
+			instances: []instance{{state: internal.RolloutInstanceUpgrading, upgraded: true, status: `{}`, started: 11 * time.Minute}},
+			want:      internal.RolloutRolledBack, wantInstances: []string{internal.RolloutInstanceRolledBack},
+			wantImages: []string{"redis:5"}, wantSnapshots: []string{"redis:5"},
+		},
+		{
+			name: "rolls back an instance upgraded by a step whose rollout was not saved", state: internal.RolloutRollingBack, batchSize: 1,
+			instances: []instance{{state: internal.RolloutInstancePending, upgraded: true, status: readyStatus}},
+			want:      internal.RolloutRolledBack, wantInstances: []string{internal.RolloutInstanceRolledBack},
+			wantImages: []string{"redis:5"}, wantSnapshots: []string{"redis:5"},
+		},
+		{
+			name: "rolls back an instance whatever its state", state: internal.RolloutRollingBack, batchSize: 1,
+			instances: []instance{{state: internal.RolloutInstanceFailed, upgraded: true, status: failedStatus, started: time.Minute}},
+			want:      internal.RolloutRolledBack, wantInstances: []string{internal.RolloutInstanceRolledBack},
+			wantImages: []string{"redis:5"}, wantSnapshots: []string{"redis:5"},
+		},
+		{
+			name: "fails to roll back an instance whose snapshot was deleted", state: internal.RolloutRunning, batchSize: 2, deleted: true,
+			instances: []instance{{state: internal.RolloutInstanceUpgrading, upgraded: true, status: failedStatus, started: time.Minute},
+				{state: internal.RolloutInstancePending}},
+			want: internal.RolloutRollbackFailed, wantMessage: "cannot roll back tsb/db-0",
+			wantInstances: []string{internal.RolloutInstanceRollbackFailed, internal.RolloutInstancePending},
+			wantImages:    []string{"redis:6"}, wantSnapshots: []string{"redis:6"},
+		},
+		{
+			name: "skips an instance changed since its upgrade", state: internal.RolloutRollingBack, batchSize: 1,
+			instances: []instance{{state: internal.RolloutInstanceUpgraded, started: time.Minute},
+				{state: internal.RolloutInstancePending}},
+			want:          internal.RolloutRolledBack,
+			wantInstances: []string{internal.RolloutInstanceSkipped, internal.RolloutInstancePending},
+			wantImages:    []string{"redis:5", "redis:5"}, wantSnapshots: []string{"redis:5"},
+		},
+		{
+			name: "paused starts no batch", state: internal.RolloutPaused, batchSize: 1,
+			instances: []instance{{state: internal.RolloutInstanceUpgrading, upgraded: true, status: readyStatus, started: time.Minute},
+				{state: internal.RolloutInstancePending}},
+			want:          internal.RolloutPaused,
+			wantInstances: []string{internal.RolloutInstanceUpgraded, internal.RolloutInstancePending},
+			wantImages:    []string{"redis:6", "redis:5"}, wantSnapshots: []string{"redis:5", "redis:6"},
+		},
+		{
+			name: "pauses once the template changed again", state: internal.RolloutRunning, batchSize: 1, changed: true,
+			instances: []instance{{state: internal.RolloutInstancePending}},
+			want:      internal.RolloutPaused, wantInstances: []string{internal.RolloutInstancePending},
+			wantImages: []string{"redis:5"}, wantSnapshots: []string{"redis:5"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			r, c := newRolloutsFixture(t, "redis:5", len(test.instances))
+			from, err := internal.RevisionOf(redisTemplate("redis:5"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			changeTemplate(t, c, "redis:6")
+			to, err := internal.RevisionOf(redisTemplate("redis:6"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rollout := &internal.Rollout{Id: "rollout-1", Template: "redis", BatchSize: test.batchSize, State: test.state}
+			for i, instance := range test.instances {
+				name := "db-" + strconv.Itoa(i)
+				rollout.Instances = append(rollout.Instances, internal.RolloutInstance{Namespace: "tsb", Name: name,
+					InstanceId: "i-" + strconv.Itoa(i), From: from, To: to, State: internal.RolloutInstancePending})
+				if instance.upgraded {
+					if err := r.upgrade(ctx, newTemplateCache(c), rollout, &rollout.Instances[i]); err != nil {
+						t.Fatal(err)
+					}
+					templateInstance := getInstance(t, c, name)
+					if err := json.Unmarshal([]byte(`{"status": `+instance.status+`}`), templateInstance); err != nil {
+						t.Fatal(err)
+					}
+					if err := c.Update(ctx, templateInstance); err != nil {
+						t.Fatal(err)
+					}
+				}
+				rollout.Instances[i].State = instance.state
+				rollout.Instances[i].Started = nil
+				if instance.state != internal.RolloutInstancePending {
+					rollout.Instances[i].Started = &metav1.Time{Time: time.Now().Add(-instance.started)}
+				}
+			}
+			if test.changed {
+				changeTemplate(t, c, "redis:7")
+			}
+			if test.deleted {
+				snapshot := &tmaxv1.Template{ObjectMeta: metav1.ObjectMeta{Namespace: "tsb", Name: redisSnapshot(t, "redis:5")}}
+				if err := c.Delete(ctx, snapshot); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			r.advance(ctx, r.Config.Get().Rollout, rollout)
+			if rollout.State != test.want {
+				t.Errorf("got rollout %s (%s), want %s", rollout.State, rollout.Message, test.want)
+			}
+			if !strings.Contains(rollout.Message, test.wantMessage) {
+				t.Errorf("got message %q, want %q in it", rollout.Message, test.wantMessage)
+			}
+			var states []string
+			for _, instance := range rollout.Instances {
+				states = append(states, instance.State)
+			}
+			if !reflect.DeepEqual(states, test.wantInstances) {
+				t.Errorf("got instances %v, want %v", states, test.wantInstances)
+			}
+			for i, image := range test.wantImages {
+				templateInstance := getInstance(t, c, rollout.Instances[i].Name)
+				if name := templateInstance.Spec.Template.Metadata.Name; name != redisSnapshot(t, image) {
+					t.Errorf("got %s pinned to %s, want the snapshot of %s", templateInstance.Name, name, image)
+				}
+				// an instance rolled back no longer keeps the spec from before the rollout
+				if upgraded := internal.UpgradedBy(templateInstance, rollout.Id); upgraded != (image == "redis:6") {
+					t.Errorf("got %s upgraded by the rollout %v, want %v", templateInstance.Name, upgraded, !upgraded)
+				}
+			}
+			for _, image := range []string{"redis:5", "redis:6"} {
+				_, err := internal.GetTemplate(ctx, c, types.NamespacedName{Namespace: "tsb", Name: redisSnapshot(t, image)})
+				kept := false
+				for _, want := range test.wantSnapshots {
+					kept = kept || want == image
+				}
+				if (err == nil) != kept {
+					t.Errorf("got the snapshot of %s kept %v, want %v", image, err == nil, kept)
+				}
+			}
+		})
+	}
+}
+
+func TestRolloutTransition(t *testing.T) {
+	tests := []struct {
+		name   string
+		state  string
+		action func(r *Rollouts) http.HandlerFunc
+		want   int
+		// wantState is the state of the rollout after the request
+		wantState string
+	}{
+		{name: "pause running", state: internal.RolloutRunning, action: func(r *Rollouts) http.HandlerFunc { return r.Pause },
+			want: http.StatusOK, wantState: internal.RolloutPaused},
+		{name: "pause paused", state: internal.RolloutPaused, action: func(r *Rollouts) http.HandlerFunc { return r.Pause },
+			want: http.StatusConflict, wantState: internal.RolloutPaused},
+		{name: "resume paused", state: internal.RolloutPaused, action: func(r *Rollouts) http.HandlerFunc { return r.Resume },
+			want: http.StatusOK, wantState: internal.RolloutRunning},
+		{name: "resume running", state: internal.RolloutRunning, action: func(r *Rollouts) http.HandlerFunc { return r.Resume },
+			want: http.StatusConflict, wantState: internal.RolloutRunning},
+		{name: "roll back succeeded", state: internal.RolloutSucceeded, action: func(r *Rollouts) http.HandlerFunc { return r.Rollback },
+			want: http.StatusOK, wantState: internal.RolloutRollingBack},
+		{name: "roll back rolled back", state: internal.RolloutRolledBack, action: func(r *Rollouts) http.HandlerFunc { return r.Rollback },
+			want: http.StatusConflict, wantState: internal.RolloutRolledBack},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, c := newRolloutsFixture(t, "redis:5", 0)
+			configMap := internal.NewRolloutConfigMap("tsb", "tsb")
+			configMap.Name = "rollout-1"
+			rollout := &internal.Rollout{Template: "redis", BatchSize: 1, State: test.state, Instances: []internal.RolloutInstance{}}
+			if err := internal.SaveRollout(context.Background(), c, rollout, configMap); err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			req := mux.SetURLVars(httptest.NewRequest("POST", "/", nil), map[string]string{RolloutVar: "rollout-1"})
+			test.action(r)(w, req)
+			if w.Code != test.want {
+				t.Errorf("got status %d, want %d: %s", w.Code, test.want, w.Body.String())
+			}
+
+			saved, _, err := internal.GetRollout(context.Background(), c, types.NamespacedName{Namespace: "tsb", Name: "rollout-1"}, "tsb")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved.State != test.wantState {
+				t.Errorf("got rollout %s, want %s", saved.State, test.wantState)
+			}
+		})
+	}
+}
+
+func TestRolloutPlan(t *testing.T) {
+	tests := []struct {
+		name string
+		// legacy instances were provisioned before instances were pinned to a snapshot
+		legacy bool
+		want   []internal.ObjectChange
+	}{
+		{name: "pinned", want: []internal.ObjectChange{{Kind: "Deployment", Name: "redis", Change: "changed"}}},
+		{name: "provisioned before pinning", legacy: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			r, c := newRolloutsFixture(t, "redis:5", 1)
+			if test.legacy {
+				templateInstance := getInstance(t, c, "db-0")
+				templateInstance.Spec.Template.Metadata.Name = "redis"
+				delete(templateInstance.Annotations, internal.TemplateSourceAnnotation)
+				delete(templateInstance.Annotations, internal.TemplateRevisionAnnotation)
+				if err := c.Update(ctx, templateInstance); err != nil {
+					t.Fatal(err)
+				}
+			}
+			changeTemplate(t, c, "redis:6")
+
+			plan, err := r.plan(ctx, RolloutRequest{Template: "redis", BatchSize: 1}, []OutdatedInstance{{Namespace: "tsb", Name: "db-0"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plan.Instances) != 1 {
+				t.Fatalf("got %d planned upgrades, want 1", len(plan.Instances))
+			}
+			planned := plan.Instances[0]
+			if len(planned.Error) != 0 || len(planned.Changes) != 0 {
+				t.Errorf("got changes %v, error %q, want no parameter changes", planned.Changes, planned.Error)
+			}
+			if !reflect.DeepEqual(planned.TemplateChanges, test.want) {
+				t.Errorf("got template changes %v, want %v", planned.TemplateChanges, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package apis
+
+import (
+	"context"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// instanceTemplate is the template or cluster template a template instance is provisioned from
+type instanceTemplate struct {
+	obj  runtime.Object
+	uid  string
+	spec tmaxv1.TemplateSpec
+}
+
+// templateCache gets the template of each template instance once, for loops over many instances of few templates
+type templateCache struct {
+	client    client.Client
+	templates map[types.NamespacedName]*instanceTemplate
+}
+
+func newTemplateCache(c client.Client) *templateCache {
+	return &templateCache{client: c, templates: make(map[types.NamespacedName]*instanceTemplate)}
+}
+
+// of returns the template of the template instance, nil if it no longer exists
+func (t *templateCache) of(ctx context.Context, templateInstance *tmaxv1.TemplateInstance) (*instanceTemplate, error) {
+	name, cluster := internal.InstanceTemplateName(templateInstance)
+	key := types.NamespacedName{Namespace: templateInstance.Namespace, Name: name}
+	if cluster {
+		key.Namespace = ""
+	}
+	if template, ok := t.templates[key]; ok {
+		return template, nil
+	}
+
+	var template *instanceTemplate
+	if cluster {
+		clusterTemplate, err := internal.GetClusterTemplate(ctx, t.client, key)
+		if err != nil && !kerrors.IsNotFound(err) {
+			return nil, err
+		}
+		if err == nil {
+			template = &instanceTemplate{obj: clusterTemplate, uid: string(clusterTemplate.UID), spec: clusterTemplate.TemplateSpec}
+		}
+	} else {
+		namespacedTemplate, err := internal.GetTemplate(ctx, t.client, key)
+		if err != nil && !kerrors.IsNotFound(err) {
+			return nil, err
+		}
+		if err == nil {
+			template = &instanceTemplate{obj: namespacedTemplate, uid: string(namespacedTemplate.UID), spec: namespacedTemplate.TemplateSpec}
+		}
+	}
+	t.templates[key] = template
+	return template, nil
+}
+
+// listTemplateInstances lists the template instances of the namespaces ("" for all namespaces)
+func listTemplateInstances(ctx context.Context, c client.Client, namespaces []string) ([]tmaxv1.TemplateInstance, error) {
+	var items []tmaxv1.TemplateInstance
+	for _, ns := range namespaces {
+		templateInstances, err := internal.GetTemplateInstanceList(ctx, c, ns)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, templateInstances.Items...)
+	}
+	return items, nil
+}
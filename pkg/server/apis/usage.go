@@ -0,0 +1,196 @@
+package apis
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/metrics"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// accrueTimeout bounds the API calls of one accrual
+const accrueTimeout = 5 * time.Minute
+
+// Accounting accrues the instance-hours and cost of the instances of each plan in a ledger ConfigMap
+type Accounting struct {
+	client.Client
+	Log    logr.Logger
+	Config *config.Store
+	// Namespaces returns the namespaces to account ("" for all namespaces)
+	Namespaces func(ctx context.Context) ([]string, error)
+}
+
+type UsageReport struct {
+	Enabled      bool             `json:"enabled"`
+	CostPeriod   string           `json:"cost_period"`
+	Since        *time.Time       `json:"since,omitempty"`
+	AccruedUntil *time.Time       `json:"accrued_until,omitempty"`
+	Usage        []internal.Usage `json:"usage"`
+}
+
+// Report answers the accrued usage, filtered by the namespace, template and plan query parameters
+func (a *Accounting) Report(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	cfg := a.Config.Get().Accounting
+	report := &UsageReport{Enabled: cfg.Enabled, CostPeriod: cfg.CostPeriod.Duration.String(), Usage: []internal.Usage{}}
+	if !cfg.Enabled {
+		respond(w, http.StatusOK, report, a.Log)
+		return
+	}
+
+	ledger, _, err := internal.GetUsageLedger(r.Context(), a.Client, types.NamespacedName{Namespace: cfg.LedgerNamespace, Name: cfg.LedgerName})
+	if err != nil {
+		a.Log.Error(err, "cannot get usage ledger")
+		respondError(w, r, internalError("cannot get usage ledger %s/%s", cfg.LedgerNamespace, cfg.LedgerName), a.Log)
+		return
+	}
+	if !ledger.Since.IsZero() {
+		report.Since = &ledger.Since.Time
+		report.AccruedUntil = &ledger.AccruedUntil.Time
+	}
+
+	query := r.URL.Query()
+	for _, usage := range ledger.Usage {
+		if matchesQuery(query.Get("namespace"), usage.Namespace) && matchesQuery(query.Get("template"), usage.Template) &&
+			matchesQuery(query.Get("plan"), usage.Plan) {
+			report.Usage = append(report.Usage, usage)
+		}
+	}
+	respond(w, http.StatusOK, report, a.Log)
+}
+
+func matchesQuery(want string, got string) bool {
+	return len(want) == 0 || want == got
+}
+
+// Accrue adds the usage since the last accrual to the ledger every interval until ctx is cancelled. It runs on the leader only.
+// With accounting disabled it only releases the instances kept for accounting.
+func (a *Accounting) Accrue(ctx context.Context) {
+	for {
+		cfg := a.Config.Get().Accounting
+		if err := a.accrue(ctx, cfg); err != nil {
+			a.Log.Error(err, "cannot accrue usage, retrying at the next interval")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.Interval.Duration):
+		}
+	}
+}
+
+// accrue re-reads the ledger, so a new leader continues from the last accrual of the previous one. Once the ledger is saved,
+// the deleted instances it charged are released and the running ones are kept for the next accrual by UsageFinalizer.
+func (a *Accounting) accrue(ctx context.Context, cfg config.AccountingConfig) error {
+	ctx, cancel := context.WithTimeout(ctx, accrueTimeout)
+	defer cancel()
+
+	namespaces, err := a.Namespaces(ctx)
+	if err != nil {
+		return err
+	}
+	items, err := listTemplateInstances(ctx, a.Client, namespaces)
+	if err != nil {
+		return err
+	}
+	if !cfg.Enabled {
+		return a.updateFinalizers(ctx, items, false)
+	}
+
+	ledger, configMap, err := internal.GetUsageLedger(ctx, a.Client, types.NamespacedName{Namespace: cfg.LedgerNamespace, Name: cfg.LedgerName})
+	if err != nil {
+		return err
+	}
+
+	plans := &chargedPlans{ctx: ctx, log: a.Log, templates: newTemplateCache(a.Client)}
+	deltas := ledger.Accrue(items, plans.of, cfg.CostPeriod.Duration, time.Now())
+	if err := internal.SaveUsageLedger(ctx, a.Client, ledger, configMap); err != nil {
+		// nothing is counted, the next accrual charges the same time again
+		return err
+	}
+
+	for _, delta := range deltas {
+		metrics.InstanceHours.WithLabelValues(delta.Namespace, delta.Template, delta.Plan).Add(delta.InstanceHours)
+		metrics.InstanceCost.WithLabelValues(delta.Namespace, delta.Template, delta.Plan, delta.CostUnit).Add(delta.Cost)
+	}
+	a.Log.V(1).Info("usage accrued", "instances", len(items), "until", ledger.AccruedUntil.Time)
+	return a.updateFinalizers(ctx, items, true)
+}
+
+// updateFinalizers removes UsageFinalizer from the deleted instances, and from all instances unless keep is set, in which
+// case running instances of the broker created before accounting was enabled get it. An instance that fails is updated
+// at the next accrual, a deleted one is charged nothing more meanwhile.
+func (a *Accounting) updateFinalizers(ctx context.Context, items []tmaxv1.TemplateInstance, keep bool) error {
+	failed := 0
+	for i := range items {
+		templateInstance := &items[i]
+		if _, ok := templateInstance.Annotations["instance_id"]; !ok {
+			continue
+		}
+		has := controllerutil.ContainsFinalizer(templateInstance, internal.UsageFinalizer)
+		want := keep && templateInstance.DeletionTimestamp == nil
+		if has == want {
+			continue
+		}
+		if want {
+			controllerutil.AddFinalizer(templateInstance, internal.UsageFinalizer)
+		} else {
+			controllerutil.RemoveFinalizer(templateInstance, internal.UsageFinalizer)
+		}
+		if err := a.Update(ctx, templateInstance); err != nil && !kerrors.IsNotFound(err) {
+			a.Log.Error(err, "cannot update the usage finalizer", "templateinstance", templateInstance.Name,
+				"namespace", templateInstance.Namespace)
+			failed++
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("cannot update the usage finalizer of %d instances", failed)
+	}
+	return nil
+}
+
+// chargedPlans resolves the plans of the instances of one accrual, getting each template once
+type chargedPlans struct {
+	ctx       context.Context
+	log       logr.Logger
+	templates *templateCache
+}
+
+// of charges an instance at the current cost of its plan. Free plans and plans that no longer exist cost nothing.
+func (c *chargedPlans) of(templateInstance *tmaxv1.TemplateInstance) internal.ChargedPlan {
+	templateName, _ := internal.InstanceTemplateName(templateInstance)
+	charged := internal.ChargedPlan{Template: templateName, Plan: templateInstance.Labels[internal.PlanLabel]}
+
+	template, err := c.templates.of(c.ctx, templateInstance)
+	if err != nil {
+		c.log.Error(err, "cannot get the template of an instance, charging it nothing", "templateinstance", templateInstance.Name,
+			"namespace", templateInstance.Namespace)
+		return charged
+	}
+	if template == nil {
+		return charged
+	}
+	planId := templateInstance.Annotations["plan_id"]
+	plan, err := findPlan(template.spec, template.uid, planId)
+	if err != nil {
+		return charged
+	}
+	if len(charged.Plan) == 0 {
+		charged.Plan = planName(templateName, planId, plan)
+	}
+	if plan != nil && !plan.Free {
+		charged.Cost = internal.PlanCost{Amount: plan.Metadata.Costs.Amount, Unit: plan.Metadata.Costs.Unit}
+	}
+	return charged
+}
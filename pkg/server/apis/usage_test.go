@@ -0,0 +1,113 @@
+package apis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+func TestAccountingFinalizers(t *testing.T) {
+	// usageInstance returns an instance of the broker created two hours ago, with the usage finalizer if kept
+	usageInstance := func(name string, kept bool, deleted bool) runtime.Object {
+		templateInstance := &tmaxv1.TemplateInstance{ObjectMeta: metav1.ObjectMeta{
+			Namespace:         "ns",
+			Name:              name,
+			Annotations:       map[string]string{"instance_id": name},
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-2 * time.Hour)),
+		}}
+		templateInstance.Spec.Template = &tmaxv1.ObjectInfo{}
+		templateInstance.Spec.Template.Metadata.Name = "mysql"
+		if kept {
+			templateInstance.Finalizers = []string{internal.UsageFinalizer}
+		}
+		if deleted {
+			deletion := metav1.NewTime(time.Now().Add(-time.Hour))
+			templateInstance.DeletionTimestamp = &deletion
+		}
+		return templateInstance
+	}
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		existing []runtime.Object
+		// want is whether each instance keeps the finalizer after the accrual
+		want  map[string]bool
+		hours float64
+	}{
+		{
+			name:     "running instances are kept",
+			enabled:  true,
+			existing: []runtime.Object{usageInstance("old", false, false), usageInstance("new", true, false)},
+			want:     map[string]bool{"old": true, "new": true},
+			hours:    4,
+		},
+		{
+			name:     "deleted instances are charged and released",
+			enabled:  true,
+			existing: []runtime.Object{usageInstance("deleted", true, true)},
+			want:     map[string]bool{"deleted": false},
+			hours:    1,
+		},
+		{
+			name:     "disabled accounting releases all instances",
+			existing: []runtime.Object{usageInstance("running", true, false), usageInstance("deleted", true, true)},
+			want:     map[string]bool{"running": false, "deleted": false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := namespacedConfig()
+			cfg.Accounting.Enabled = test.enabled
+			cfg.Accounting.LedgerNamespace = "tsb"
+			c := newFakeClient(t, test.existing...)
+			a := &Accounting{
+				Client:     c,
+				Log:        testLog,
+				Config:     config.NewStore(cfg),
+				Namespaces: func(context.Context) ([]string, error) { return []string{"ns"}, nil },
+			}
+			ctx := context.Background()
+			if err := a.accrue(ctx, cfg.Accounting); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			for name, want := range test.want {
+				templateInstance := &tmaxv1.TemplateInstance{}
+				if err := c.Get(ctx, types.NamespacedName{Namespace: "ns", Name: name}, templateInstance); err != nil {
+					t.Fatal(err)
+				}
+				if got := controllerutil.ContainsFinalizer(templateInstance, internal.UsageFinalizer); got != want {
+					t.Errorf("%s has the finalizer %v, want %v", name, got, want)
+				}
+			}
+
+			ledger, configMap, err := internal.GetUsageLedger(ctx, c, types.NamespacedName{Namespace: "tsb", Name: cfg.Accounting.LedgerName})
+			if err != nil && !kerrors.IsNotFound(err) {
+				t.Fatal(err)
+			}
+			if !test.enabled {
+				if len(configMap.ResourceVersion) != 0 {
+					t.Error("the ledger is saved with accounting disabled")
+				}
+				return
+			}
+			hours := 0.0
+			for _, usage := range ledger.Usage {
+				hours += usage.InstanceHours
+			}
+			if hours < test.hours-0.01 || hours > test.hours+0.01 {
+				t.Errorf("accrued %f instance-hours, want %f", hours, test.hours)
+			}
+		})
+	}
+}
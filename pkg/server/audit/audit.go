@@ -0,0 +1,193 @@
+package audit
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/metrics"
+)
+
+// OriginatingIdentityHeader carries the platform user on whose behalf the OSB call is made
+const OriginatingIdentityHeader = "X-Broker-API-Originating-Identity"
+
+const (
+	ResultSucceeded = "succeeded"
+	ResultFailed    = "failed"
+)
+
+// Record is one audited broker call. Parameter values are never recorded, only their names.
+type Record struct {
+	Time       time.Time `json:"time"`
+	Operation  string    `json:"operation"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	RemoteAddr string    `json:"remote_addr"`
+	User       string    `json:"user,omitempty"`
+	Identity   *Identity `json:"originating_identity,omitempty"`
+	Namespace  string    `json:"namespace,omitempty"`
+	InstanceId string    `json:"instance_id,omitempty"`
+	BindingId  string    `json:"binding_id,omitempty"`
+	ServiceId  string    `json:"service_id,omitempty"`
+	PlanId     string    `json:"plan_id,omitempty"`
+	Parameters []string  `json:"parameters,omitempty"`
+	Status     int       `json:"status"`
+	Result     string    `json:"result"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// Identity is the decoded originating identity header
+type Identity struct {
+	Platform string                 `json:"platform"`
+	Value    map[string]interface{} `json:"value,omitempty"`
+}
+
+// Auditor writes a record of every request it wraps to each of its sinks
+type Auditor struct {
+	sinks []Sink
+	log   logr.Logger
+}
+
+// New builds the sinks of the configuration. An auditor without sinks audits nothing.
+func New(cfg config.AuditConfig, log logr.Logger) (*Auditor, error) {
+	a := &Auditor{log: log}
+	if len(cfg.File) != 0 {
+		sink, err := NewFileSink(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		a.sinks = append(a.sinks, sink)
+	}
+	if cfg.Stdout {
+		a.sinks = append(a.sinks, NewStdoutSink())
+	}
+	if len(cfg.Webhook.URL) != 0 {
+		a.sinks = append(a.sinks, NewWebhookSink(cfg.Webhook.URL, cfg.Webhook.Timeout.Duration, log.WithName("webhook")))
+	}
+	return a, nil
+}
+
+// Middleware audits the requests of a router. The operation is the name of the matched route.
+func (a *Auditor) Middleware(next http.Handler) http.Handler {
+	if len(a.sinks) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		record := newRecord(r)
+
+		recorder := &metrics.StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		record.Time = start.UTC()
+		record.Status = recorder.Status
+		record.Result = ResultSucceeded
+		if recorder.Status >= http.StatusBadRequest {
+			record.Result = ResultFailed
+		}
+		record.DurationMs = time.Since(start).Milliseconds()
+		a.write(record)
+	})
+}
+
+func (a *Auditor) write(record *Record) {
+	for _, sink := range a.sinks {
+		if err := sink.Write(record); err != nil {
+			a.log.Error(err, "cannot write audit record", "operation", record.Operation, "instance_id", record.InstanceId)
+		}
+	}
+}
+
+// Close flushes and closes every sink
+func (a *Auditor) Close() error {
+	var errs []string
+	for _, sink := range a.sinks {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		return &closeError{errs}
+	}
+	return nil
+}
+
+type closeError struct {
+	errs []string
+}
+
+func (e *closeError) Error() string {
+	return "cannot close audit sinks: " + strings.Join(e.errs, ", ")
+}
+
+func newRecord(r *http.Request) *Record {
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+	record := &Record{
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		RemoteAddr: r.RemoteAddr,
+		Identity:   OriginatingIdentity(r.Header.Get(OriginatingIdentityHeader)),
+		Namespace:  vars["namespace"],
+		InstanceId: vars["instance_id"],
+		BindingId:  vars["binding_id"],
+		ServiceId:  query.Get("service_id"),
+		PlanId:     query.Get("plan_id"),
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		record.Operation = route.GetName()
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		record.User = user
+	}
+
+	if r.Method == http.MethodPut || r.Method == http.MethodPatch {
+		body := struct {
+			ServiceId  string                     `json:"service_id"`
+			PlanId     string                     `json:"plan_id"`
+			Parameters map[string]json.RawMessage `json:"parameters"`
+		}{}
+		if data, err := internal.PeekBody(r); err == nil && json.Unmarshal(data, &body) == nil {
+			record.ServiceId = body.ServiceId
+			record.PlanId = body.PlanId
+			for name := range body.Parameters {
+				record.Parameters = append(record.Parameters, name)
+			}
+			sort.Strings(record.Parameters)
+		}
+	}
+	return record
+}
+
+// OriginatingIdentity decodes "<platform> <base64 encoded JSON>". An undecodable value keeps only the platform.
+func OriginatingIdentity(header string) *Identity {
+	if len(header) == 0 {
+		return nil
+	}
+	fields := strings.Fields(header)
+	identity := &Identity{Platform: fields[0]}
+	if len(fields) < 2 {
+		return identity
+	}
+	if data, err := base64.StdEncoding.DecodeString(fields[1]); err == nil {
+		json.Unmarshal(data, &identity.Value)
+	}
+	return identity
+}
+
+// User names the platform user, e.g. "kubernetes/alice", or returns "" if the identity carries none
+func (i *Identity) User() string {
+	for _, key := range []string{"username", "user_id"} {
+		if user, ok := i.Value[key].(string); ok && len(user) != 0 {
+			return i.Platform + "/" + user
+		}
+	}
+	return ""
+}
@@ -0,0 +1,259 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// memorySink keeps the records written to it
+type memorySink struct {
+	mu      sync.Mutex
+	records []*Record
+}
+
+func (s *memorySink) Write(record *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, record)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+func TestOriginatingIdentity(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte(`{"username": "alice", "uid": "1"}`))
+	tests := []struct {
+		name   string
+		header string
+		want   *Identity
+		user   string
+	}{
+		{name: "none"},
+		{name: "platform only", header: "kubernetes", want: &Identity{Platform: "kubernetes"}},
+		{
+			name:   "username",
+			header: "kubernetes " + encoded,
+			want:   &Identity{Platform: "kubernetes", Value: map[string]interface{}{"username": "alice", "uid": "1"}},
+			user:   "kubernetes/alice",
+		},
+		{
+			name:   "user_id",
+			header: "cloudfoundry " + base64.StdEncoding.EncodeToString([]byte(`{"user_id": "683ea748"}`)),
+			want:   &Identity{Platform: "cloudfoundry", Value: map[string]interface{}{"user_id": "683ea748"}},
+			user:   "cloudfoundry/683ea748",
+		},
+		{name: "not base64", header: "kubernetes %%%", want: &Identity{Platform: "kubernetes"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			identity := OriginatingIdentity(test.header)
+			if !reflect.DeepEqual(identity, test.want) {
+				t.Fatalf("got %+v, want %+v", identity, test.want)
+			}
+			if identity != nil && identity.User() != test.user {
+				t.Errorf("got user %q, want %q", identity.User(), test.user)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		user   string
+		status int
+		want   Record
+	}{
+		{
+			name:   "provision",
+			method: http.MethodPut,
+			path:   "/v2/service_instances/i-1",
+			body:   `{"service_id": "s-1", "plan_id": "p-1", "parameters": {"PASSWORD": "secret", "DB": "mysql"}}`,
+			user:   "admin",
+			status: http.StatusCreated,
+			want: Record{
+				Operation:  "provision",
+				Method:     http.MethodPut,
+				Path:       "/v2/service_instances/i-1",
+				User:       "admin",
+				InstanceId: "i-1",
+				ServiceId:  "s-1",
+				PlanId:     "p-1",
+				Parameters: []string{"DB", "PASSWORD"},
+				Status:     http.StatusCreated,
+				Result:     ResultSucceeded,
+			},
+		},
+		{
+			name:   "failed deprovision",
+			method: http.MethodDelete,
+			path:   "/v2/service_instances/i-1?service_id=s-1&plan_id=p-1",
+			status: http.StatusGone,
+			want: Record{
+				Operation:  "deprovision",
+				Method:     http.MethodDelete,
+				Path:       "/v2/service_instances/i-1",
+				InstanceId: "i-1",
+				ServiceId:  "s-1",
+				PlanId:     "p-1",
+				Status:     http.StatusGone,
+				Result:     ResultFailed,
+			},
+		},
+		{
+			name:   "unbind",
+			method: http.MethodDelete,
+			path:   "/v2/service_instances/i-1/service_bindings/b-1",
+			status: http.StatusOK,
+			want: Record{
+				Operation:  "unbind",
+				Method:     http.MethodDelete,
+				Path:       "/v2/service_instances/i-1/service_bindings/b-1",
+				InstanceId: "i-1",
+				BindingId:  "b-1",
+				Status:     http.StatusOK,
+				Result:     ResultSucceeded,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sink := &memorySink{}
+			auditor := &Auditor{sinks: []Sink{sink}, log: logf.Log.WithName("test")}
+
+			var body string
+			handler := func(w http.ResponseWriter, r *http.Request) {
+				data, _ := ioutil.ReadAll(r.Body)
+				body = string(data)
+				w.WriteHeader(test.status)
+			}
+			router := mux.NewRouter()
+			router.Use(auditor.Middleware)
+			router.HandleFunc("/v2/service_instances/{instance_id}", handler).Methods("PUT").Name("provision")
+			router.HandleFunc("/v2/service_instances/{instance_id}", handler).Methods("DELETE").Name("deprovision")
+			router.HandleFunc("/v2/service_instances/{instance_id}/service_bindings/{binding_id}", handler).Methods("DELETE").Name("unbind")
+
+			r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			if len(test.user) != 0 {
+				r.SetBasicAuth(test.user, "password")
+			}
+			router.ServeHTTP(httptest.NewRecorder(), r)
+
+			if body != test.body {
+				t.Errorf("the handler read body %q, want %q", body, test.body)
+			}
+			if len(sink.records) != 1 {
+				t.Fatalf("got %d records, want 1", len(sink.records))
+			}
+			record := *sink.records[0]
+			if record.Time.IsZero() || record.DurationMs < 0 {
+				t.Errorf("unexpected time %s and duration %d", record.Time, record.DurationMs)
+			}
+			record.Time, record.DurationMs, record.RemoteAddr = time.Time{}, 0, ""
+			if !reflect.DeepEqual(record, test.want) {
+				t.Errorf("got %+v, want %+v", record, test.want)
+			}
+		})
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	// records are appended across restarts
+	for _, instanceId := range []string{"i-1", "i-2"} {
+		sink, err := NewFileSink(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if err := sink.Write(&Record{Operation: "provision", InstanceId: instanceId}); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var instanceIds []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := &Record{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			t.Fatalf("cannot decode %q: %s", scanner.Text(), err.Error())
+		}
+		instanceIds = append(instanceIds, record.InstanceId)
+	}
+	if !reflect.DeepEqual(instanceIds, []string{"i-1", "i-2"}) {
+		t.Errorf("got records of %v", instanceIds)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{name: "accepted", status: http.StatusOK},
+		{name: "rejected", status: http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var received []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				record := &Record{}
+				if err := json.NewDecoder(r.Body).Decode(record); err != nil {
+					t.Errorf("cannot decode record: %s", err.Error())
+				}
+				mu.Lock()
+				received = append(received, record.InstanceId)
+				mu.Unlock()
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			sink := NewWebhookSink(server.URL, time.Second, logf.Log.WithName("test"))
+			for _, instanceId := range []string{"i-1", "i-2", "i-3"} {
+				if err := sink.Write(&Record{InstanceId: instanceId}); err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+			}
+			// a rejecting receiver does not hold up the remaining records
+			if err := sink.Close(); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !reflect.DeepEqual(received, []string{"i-1", "i-2", "i-3"}) {
+				t.Errorf("delivered %v", received)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Sink stores audit records
+type Sink interface {
+	Write(record *Record) error
+	Close() error
+}
+
+// writerSink writes one JSON object per line
+type writerSink struct {
+	mu     sync.Mutex
+	writer io.Writer
+	closer io.Closer
+}
+
+// NewFileSink appends records to the file as JSON lines. Existing records are never rewritten.
+func NewFileSink(path string) (Sink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log: %s", err.Error())
+	}
+	return &writerSink{writer: file, closer: file}, nil
+}
+
+// NewStdoutSink writes records to the standard output as JSON lines
+func NewStdoutSink() Sink {
+	return &writerSink{writer: os.Stdout}
+}
+
+func (s *writerSink) Write(record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.writer.Write(line)
+	return err
+}
+
+func (s *writerSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// webhookQueueSize is how many records wait for delivery before new ones are dropped
+const webhookQueueSize = 1000
+
+// webhookSink posts each record to a URL. Records are delivered in the background, so a slow receiver
+// does not delay OSB responses.
+type webhookSink struct {
+	url    string
+	client *http.Client
+	log    logr.Logger
+
+	queue chan *Record
+	done  chan struct{}
+}
+
+func NewWebhookSink(url string, timeout time.Duration, log logr.Logger) Sink {
+	s := &webhookSink{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+		log:    log,
+		queue:  make(chan *Record, webhookQueueSize),
+		done:   make(chan struct{}),
+	}
+	go s.deliver()
+	return s
+}
+
+func (s *webhookSink) Write(record *Record) error {
+	select {
+	case s.queue <- record:
+		return nil
+	default:
+		return fmt.Errorf("audit webhook queue is full, record is dropped")
+	}
+}
+
+// Close delivers the queued records before it returns
+func (s *webhookSink) Close() error {
+	close(s.queue)
+	<-s.done
+	return nil
+}
+
+func (s *webhookSink) deliver() {
+	defer close(s.done)
+	for record := range s.queue {
+		if err := s.post(record); err != nil {
+			s.log.Error(err, "cannot deliver audit record", "operation", record.Operation, "instance_id", record.InstanceId)
+		}
+	}
+}
+
+func (s *webhookSink) post(record *Record) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("audit webhook answered %s", resp.Status)
+	}
+	return nil
+}
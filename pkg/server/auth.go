@@ -0,0 +1,56 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
+)
+
+// authenticate checks the credentials of OSB requests against the current auth configuration
+func authenticate(store *config.Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := store.Get().Auth
+			if auth.Type == config.AuthBasic {
+				username, password, ok := r.BasicAuth()
+				if !ok || !equal(username, auth.Username) || !equal(password, auth.Password) {
+					w.Header().Set("WWW-Authenticate", `Basic realm="template-service-broker"`)
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusUnauthorized)
+					json.NewEncoder(w).Encode(&schemas.Error{
+						Error:       "Unauthorized",
+						Description: "invalid broker credentials",
+					})
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireAuth refuses admin requests unless auth is configured, since the admin API changes and reveals instances of all
+// platforms the broker serves. The credentials are checked by authenticate.
+func requireAuth(store *config.Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if store.Get().Auth.Type != config.AuthBasic {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(&schemas.Error{
+					Error:       "Forbidden",
+					Description: "the admin API requires auth.type basic",
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func equal(given, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+)
+
+func TestAdminAuth(t *testing.T) {
+	basic := config.AuthConfig{Type: config.AuthBasic, Username: "broker", Password: "secret"}
+	tests := []struct {
+		name     string
+		auth     config.AuthConfig
+		password string
+		want     int
+	}{
+		{name: "no auth", auth: config.AuthConfig{Type: config.AuthNone}, want: http.StatusForbidden},
+		{name: "no auth with credentials", auth: config.AuthConfig{Type: config.AuthNone}, password: "secret", want: http.StatusForbidden},
+		{name: "basic", auth: basic, password: "secret", want: http.StatusOK},
+		{name: "basic with wrong credentials", auth: basic, password: "wrong", want: http.StatusUnauthorized},
+		{name: "basic without credentials", auth: basic, want: http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := config.Default(config.ScopeNamespaced)
+			cfg.Auth = test.auth
+			store := config.NewStore(cfg)
+			handler := requireAuth(store)(authenticate(store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+			r := httptest.NewRequest("POST", "/admin/rollouts", nil)
+			if len(test.password) != 0 {
+				r.SetBasicAuth("broker", test.password)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.want {
+				t.Errorf("got status %d, want %d", w.Code, test.want)
+			}
+		})
+	}
+}
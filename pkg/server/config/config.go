@@ -0,0 +1,567 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	APIVersion = "tsb.tmax.io/v1alpha1"
+	Kind       = "BrokerConfig"
+
+	ScopeNamespaced = "namespaced"
+	ScopeCluster    = "cluster"
+
+	AuthNone  = "none"
+	AuthBasic = "basic"
+
+	OrphansOff    = "off"
+	OrphansReport = "report"
+	OrphansDelete = "delete"
+)
+
+// Config is the versioned configuration of a broker, read from a YAML file and overridden by env vars and flags
+type Config struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+
+	// Scope is either namespaced (Templates) or cluster (ClusterTemplates)
+	Scope string `json:"scope,omitempty"`
+	// Namespace served by a namespaced broker, defaults to the namespace the broker runs in
+	Namespace string `json:"namespace,omitempty"`
+	// WatchNamespaces are additional namespaces whose Templates a namespaced broker serves
+	WatchNamespaces WatchNamespacesConfig `json:"watchNamespaces,omitempty"`
+
+	Server  ServerConfig  `json:"server,omitempty"`
+	Auth    AuthConfig    `json:"auth,omitempty"`
+	Catalog CatalogConfig `json:"catalog,omitempty"`
+	Naming  NamingConfig  `json:"naming,omitempty"`
+
+	// RateLimit limits the OSB requests of each client
+	RateLimit RateLimitConfig `json:"rateLimit,omitempty"`
+	// Quotas limit the instances of a template or plan per namespace
+	Quotas []QuotaConfig `json:"quotas,omitempty"`
+
+	// Tracing exports spans of OSB requests and API server calls
+	Tracing TracingConfig `json:"tracing,omitempty"`
+
+	// Audit records every OSB call
+	Audit AuditConfig `json:"audit,omitempty"`
+
+	// OrphanMitigation sweeps template instances left behind by failed or lost provisions
+	OrphanMitigation OrphanMitigationConfig `json:"orphanMitigation,omitempty"`
+
+	// Accounting accrues the instance-hours and cost of each plan for chargeback
+	Accounting AccountingConfig `json:"accounting,omitempty"`
+
+	// Rollout upgrades the instances of a changed template to its current revision in batches
+	Rollout RolloutConfig `json:"rollout,omitempty"`
+
+	// LeaderElection elects the replica running background loops, so several replicas can serve requests
+	LeaderElection LeaderElectionConfig `json:"leaderElection,omitempty"`
+
+	// ReloadInterval is how often the configuration file is checked for changes, 0 disables reloading
+	ReloadInterval metav1.Duration `json:"reloadInterval,omitempty"`
+
+	// File is the path the configuration was read from
+	File string `json:"-"`
+}
+
+type WatchNamespacesConfig struct {
+	Names []string `json:"names,omitempty"`
+	// Selector is a label selector of namespaces
+	Selector string `json:"selector,omitempty"`
+}
+
+type ServerConfig struct {
+	Port              int             `json:"port,omitempty"`
+	ReadTimeout       metav1.Duration `json:"readTimeout,omitempty"`
+	ReadHeaderTimeout metav1.Duration `json:"readHeaderTimeout,omitempty"`
+	WriteTimeout      metav1.Duration `json:"writeTimeout,omitempty"`
+	IdleTimeout       metav1.Duration `json:"idleTimeout,omitempty"`
+	ShutdownTimeout   metav1.Duration `json:"shutdownTimeout,omitempty"`
+	OperationTimeout  metav1.Duration `json:"operationTimeout,omitempty"` // deadline of an OSB request's API server calls, 0 disables it
+	MaxHeaderBytes    int             `json:"maxHeaderBytes,omitempty"`
+	MaxBodyBytes      int64           `json:"maxBodyBytes,omitempty"`
+	TLS               TLSConfig       `json:"tls,omitempty"`
+}
+
+type TLSConfig struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+}
+
+type AuthConfig struct {
+	// Type is none or basic
+	Type         string `json:"type,omitempty"`
+	Username     string `json:"username,omitempty"`
+	Password     string `json:"password,omitempty"`
+	UsernameFile string `json:"usernameFile,omitempty"`
+	PasswordFile string `json:"passwordFile,omitempty"`
+}
+
+type CatalogConfig struct {
+	// LabelSelector limits the (cluster)templates served in the catalog
+	LabelSelector string `json:"labelSelector,omitempty"`
+	// Tags limits the catalog to templates having at least one of the tags
+	Tags []string `json:"tags,omitempty"`
+}
+
+type RateLimitConfig struct {
+	// RequestsPerSecond each broker user, or client address without auth, may send on average. 0 disables rate limiting.
+	RequestsPerSecond float64 `json:"requestsPerSecond,omitempty"`
+	Burst             int     `json:"burst,omitempty"`
+}
+
+type QuotaConfig struct {
+	// Template is the name of the (cluster)template whose instances are counted
+	Template string `json:"template"`
+	// Plan limits the quota to one catalog plan of the template
+	Plan string `json:"plan,omitempty"`
+	// Namespace limits the quota to one namespace, otherwise it applies to each namespace
+	Namespace    string `json:"namespace,omitempty"`
+	MaxInstances int    `json:"maxInstances"`
+}
+
+type TracingConfig struct {
+	// Endpoint is the host:port of an OTLP/HTTP collector, no spans are exported if empty
+	Endpoint    string  `json:"endpoint,omitempty"`
+	Insecure    bool    `json:"insecure,omitempty"`
+	ServiceName string  `json:"serviceName,omitempty"`
+	SampleRatio float64 `json:"sampleRatio,omitempty"`
+}
+
+type AuditConfig struct {
+	// File is a JSON lines audit log the records are appended to
+	File   string `json:"file,omitempty"`
+	Stdout bool   `json:"stdout,omitempty"`
+	// Webhook receives each record as a JSON POST
+	Webhook AuditWebhookConfig `json:"webhook,omitempty"`
+}
+
+type AuditWebhookConfig struct {
+	URL     string          `json:"url,omitempty"`
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+}
+
+type OrphanMitigationConfig struct {
+	// Mode is off, report (only log and record events) or delete
+	Mode string `json:"mode,omitempty"`
+	// Interval between sweeps of the leader
+	Interval metav1.Duration `json:"interval,omitempty"`
+	// GracePeriod an instance must stay orphaned before it is reported or deleted
+	GracePeriod metav1.Duration `json:"gracePeriod,omitempty"`
+}
+
+type AccountingConfig struct {
+	Enabled bool `json:"enabled"`
+	// Interval between accruals of the leader. Instances deleted in between are kept by a finalizer until the next accrual.
+	Interval metav1.Duration `json:"interval,omitempty"`
+	// CostPeriod is the running time the cost amount of a plan is charged for, e.g. 730h for a monthly price
+	CostPeriod metav1.Duration `json:"costPeriod,omitempty"`
+	// LedgerName and LedgerNamespace of the ConfigMap the usage is accrued in, the namespace defaults to the one the broker runs in
+	LedgerName      string `json:"ledgerName,omitempty"`
+	LedgerNamespace string `json:"ledgerNamespace,omitempty"`
+}
+
+type RolloutConfig struct {
+	// BatchSize is the number of instances a rollout upgrades at once unless it sets its own
+	BatchSize int `json:"batchSize,omitempty"`
+	// BatchTimeout is how long an upgraded instance may take to become ready before the rollout is rolled back
+	BatchTimeout metav1.Duration `json:"batchTimeout,omitempty"`
+	// Interval between the steps of the running rollouts on the leader
+	Interval metav1.Duration `json:"interval,omitempty"`
+	// Namespace of the ConfigMaps the rollouts are kept in, defaults to the one the broker runs in
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type LeaderElectionConfig struct {
+	Enabled bool `json:"enabled"`
+	// LeaseName and LeaseNamespace of the coordination.k8s.io Lease, the namespace defaults to the one the broker runs in
+	LeaseName      string          `json:"leaseName,omitempty"`
+	LeaseNamespace string          `json:"leaseNamespace,omitempty"`
+	LeaseDuration  metav1.Duration `json:"leaseDuration,omitempty"`
+	RenewDeadline  metav1.Duration `json:"renewDeadline,omitempty"`
+	RetryPeriod    metav1.Duration `json:"retryPeriod,omitempty"`
+}
+
+type NamingConfig struct {
+	Strategy string `json:"strategy,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+}
+
+func Default(scope string) *Config {
+	return &Config{
+		APIVersion: APIVersion,
+		Kind:       Kind,
+		Scope:      scope,
+		Server: ServerConfig{
+			Port:              8081,
+			ReadTimeout:       metav1.Duration{Duration: 30 * time.Second},
+			ReadHeaderTimeout: metav1.Duration{Duration: 10 * time.Second},
+			WriteTimeout:      metav1.Duration{Duration: 60 * time.Second},
+			IdleTimeout:       metav1.Duration{Duration: 120 * time.Second},
+			ShutdownTimeout:   metav1.Duration{Duration: 25 * time.Second},
+			OperationTimeout:  metav1.Duration{Duration: 20 * time.Second},
+			MaxHeaderBytes:    1 << 20,
+			MaxBodyBytes:      1 << 20,
+		},
+		Auth: AuthConfig{
+			Type: AuthNone,
+		},
+		Naming: NamingConfig{
+			Strategy: internal.NamingInstanceName,
+		},
+		RateLimit: RateLimitConfig{
+			Burst: 10,
+		},
+		Tracing: TracingConfig{
+			ServiceName: BrokerName(scope),
+			SampleRatio: 1,
+		},
+		Audit: AuditConfig{
+			Webhook: AuditWebhookConfig{Timeout: metav1.Duration{Duration: 5 * time.Second}},
+		},
+		OrphanMitigation: OrphanMitigationConfig{
+			Mode:        OrphansReport,
+			Interval:    metav1.Duration{Duration: 10 * time.Minute},
+			GracePeriod: metav1.Duration{Duration: time.Hour},
+		},
+		Accounting: AccountingConfig{
+			Enabled:    false,
+			Interval:   metav1.Duration{Duration: 5 * time.Minute},
+			CostPeriod: metav1.Duration{Duration: 730 * time.Hour},
+			LedgerName: BrokerName(scope) + "-usage",
+		},
+		Rollout: RolloutConfig{
+			BatchSize:    5,
+			BatchTimeout: metav1.Duration{Duration: 10 * time.Minute},
+			Interval:     metav1.Duration{Duration: 10 * time.Second},
+		},
+		LeaderElection: LeaderElectionConfig{
+			Enabled:       true,
+			LeaseName:     BrokerName(scope) + "-leader",
+			LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+			RenewDeadline: metav1.Duration{Duration: 10 * time.Second},
+			RetryPeriod:   metav1.Duration{Duration: 2 * time.Second},
+		},
+	}
+}
+
+// BrokerName tells a namespaced and a cluster broker apart, e.g. in lease names when both are installed in one namespace
+func BrokerName(scope string) string {
+	if scope == ScopeCluster {
+		return "cluster-template-service-broker"
+	}
+	return "template-service-broker"
+}
+
+// readFile merges the configuration file into the config
+func (c *Config) readFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read configuration file: %s", err.Error())
+	}
+
+	header := struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+	}{}
+	if err := yaml.Unmarshal(data, &header); err != nil {
+		return fmt.Errorf("configuration file %s is not valid YAML: %s", path, err.Error())
+	}
+	if header.APIVersion != APIVersion || header.Kind != Kind {
+		return fmt.Errorf("configuration file %s must have apiVersion %s and kind %s, got %q and %q",
+			path, APIVersion, Kind, header.APIVersion, header.Kind)
+	}
+
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("configuration file %s is invalid: %s", path, err.Error())
+	}
+	return nil
+}
+
+// complete fills in values derived from the environment
+func (c *Config) complete() error {
+	if c.Scope == ScopeNamespaced && len(c.Namespace) == 0 {
+		ns, err := internal.Namespace()
+		if err != nil {
+			return fmt.Errorf("cannot get namespace: %s", err.Error())
+		}
+		c.Namespace = strings.TrimSpace(ns)
+	}
+	if c.LeaderElection.Enabled && len(c.LeaderElection.LeaseNamespace) == 0 {
+		c.LeaderElection.LeaseNamespace = c.Namespace
+		if c.Scope != ScopeNamespaced {
+			ns, err := internal.Namespace()
+			if err != nil {
+				return fmt.Errorf("cannot get namespace of the leader election lease: %s", err.Error())
+			}
+			c.LeaderElection.LeaseNamespace = strings.TrimSpace(ns)
+		}
+	}
+	if c.Accounting.Enabled && len(c.Accounting.LedgerNamespace) == 0 {
+		c.Accounting.LedgerNamespace = c.Namespace
+		if c.Scope != ScopeNamespaced {
+			ns, err := internal.Namespace()
+			if err != nil {
+				return fmt.Errorf("cannot get namespace of the usage ledger: %s", err.Error())
+			}
+			c.Accounting.LedgerNamespace = strings.TrimSpace(ns)
+		}
+	}
+	if len(c.Rollout.Namespace) == 0 {
+		c.Rollout.Namespace = c.Namespace
+		if c.Scope != ScopeNamespaced {
+			ns, err := internal.Namespace()
+			if err != nil {
+				return fmt.Errorf("cannot get namespace of the rollouts: %s", err.Error())
+			}
+			c.Rollout.Namespace = strings.TrimSpace(ns)
+		}
+	}
+
+	if len(c.Auth.UsernameFile) != 0 {
+		username, err := ioutil.ReadFile(c.Auth.UsernameFile)
+		if err != nil {
+			return fmt.Errorf("auth.usernameFile: %s", err.Error())
+		}
+		c.Auth.Username = strings.TrimSpace(string(username))
+	}
+	if len(c.Auth.PasswordFile) != 0 {
+		password, err := ioutil.ReadFile(c.Auth.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("auth.passwordFile: %s", err.Error())
+		}
+		c.Auth.Password = strings.TrimSpace(string(password))
+	}
+	return nil
+}
+
+// Validate reports every invalid field of the configuration at once
+func (c *Config) Validate() error {
+	var errs []string
+	invalid := func(field string, format string, args ...interface{}) {
+		errs = append(errs, field+": "+fmt.Sprintf(format, args...))
+	}
+
+	switch c.Scope {
+	case ScopeNamespaced:
+		if len(c.Namespace) == 0 {
+			invalid("namespace", "must be set for the %s scope", ScopeNamespaced)
+		}
+	case ScopeCluster:
+	default:
+		invalid("scope", "must be %s or %s, got %q", ScopeNamespaced, ScopeCluster, c.Scope)
+	}
+
+	if c.Scope == ScopeCluster && (len(c.WatchNamespaces.Names) != 0 || len(c.WatchNamespaces.Selector) != 0) {
+		invalid("watchNamespaces", "is only supported by the %s scope", ScopeNamespaced)
+	}
+	for _, name := range c.WatchNamespaces.Names {
+		if errs := validation.IsDNS1123Label(name); len(errs) != 0 {
+			invalid("watchNamespaces.names", "%q is not a valid namespace: %s", name, strings.Join(errs, ", "))
+		}
+	}
+	if _, err := labels.Parse(c.WatchNamespaces.Selector); err != nil {
+		invalid("watchNamespaces.selector", "%s", err.Error())
+	}
+
+	if c.Server.Port <= 0 || c.Server.Port > 65535 {
+		invalid("server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	}
+	for field, d := range map[string]metav1.Duration{
+		"server.readTimeout":       c.Server.ReadTimeout,
+		"server.readHeaderTimeout": c.Server.ReadHeaderTimeout,
+		"server.writeTimeout":      c.Server.WriteTimeout,
+		"server.idleTimeout":       c.Server.IdleTimeout,
+		"server.shutdownTimeout":   c.Server.ShutdownTimeout,
+		"server.operationTimeout":  c.Server.OperationTimeout,
+		"reloadInterval":           c.ReloadInterval,
+	} {
+		if d.Duration < 0 {
+			invalid(field, "must not be negative, got %s", d.Duration)
+		}
+	}
+	if write, op := c.Server.WriteTimeout.Duration, c.Server.OperationTimeout.Duration; write > 0 && op >= write {
+		invalid("server.operationTimeout", "must be shorter than server.writeTimeout (%s) to answer timeouts, got %s", write, op)
+	}
+	if c.RateLimit.RequestsPerSecond < 0 {
+		invalid("rateLimit.requestsPerSecond", "must not be negative, got %v", c.RateLimit.RequestsPerSecond)
+	}
+	if c.RateLimit.RequestsPerSecond > 0 && c.RateLimit.Burst <= 0 {
+		invalid("rateLimit.burst", "must be positive, got %d", c.RateLimit.Burst)
+	}
+	for i, quota := range c.Quotas {
+		if len(quota.Template) == 0 {
+			invalid(fmt.Sprintf("quotas[%d].template", i), "must be set")
+		}
+		if quota.MaxInstances < 0 {
+			invalid(fmt.Sprintf("quotas[%d].maxInstances", i), "must not be negative, got %d", quota.MaxInstances)
+		}
+	}
+
+	if strings.Contains(c.Tracing.Endpoint, "://") {
+		invalid("tracing.endpoint", "must be host:port without a scheme, got %q", c.Tracing.Endpoint)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		invalid("tracing.sampleRatio", "must be between 0 and 1, got %v", c.Tracing.SampleRatio)
+	}
+
+	if len(c.Audit.Webhook.URL) != 0 {
+		if u, err := url.Parse(c.Audit.Webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			invalid("audit.webhook.url", "must be an http(s) URL, got %q", c.Audit.Webhook.URL)
+		}
+		if c.Audit.Webhook.Timeout.Duration <= 0 {
+			invalid("audit.webhook.timeout", "must be positive, got %s", c.Audit.Webhook.Timeout.Duration)
+		}
+	}
+
+	switch c.OrphanMitigation.Mode {
+	case OrphansOff, OrphansReport, OrphansDelete:
+	default:
+		invalid("orphanMitigation.mode", "must be %s, %s or %s, got %q", OrphansOff, OrphansReport, OrphansDelete, c.OrphanMitigation.Mode)
+	}
+	if c.OrphanMitigation.Interval.Duration <= 0 {
+		invalid("orphanMitigation.interval", "must be positive, got %s", c.OrphanMitigation.Interval.Duration)
+	}
+	if c.OrphanMitigation.GracePeriod.Duration <= 0 {
+		invalid("orphanMitigation.gracePeriod", "must be positive, got %s", c.OrphanMitigation.GracePeriod.Duration)
+	}
+
+	// the accrual loop also runs with accounting disabled, to release the instances kept for accounting
+	if c.Accounting.Interval.Duration <= 0 {
+		invalid("accounting.interval", "must be positive, got %s", c.Accounting.Interval.Duration)
+	}
+	if a := c.Accounting; a.Enabled {
+		if a.CostPeriod.Duration <= 0 {
+			invalid("accounting.costPeriod", "must be positive, got %s", a.CostPeriod.Duration)
+		}
+		if errs := validation.IsDNS1123Subdomain(a.LedgerName); len(errs) != 0 {
+			invalid("accounting.ledgerName", "%q is not a valid name: %s", a.LedgerName, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsDNS1123Label(a.LedgerNamespace); len(errs) != 0 {
+			invalid("accounting.ledgerNamespace", "%q is not a valid namespace: %s", a.LedgerNamespace, strings.Join(errs, ", "))
+		}
+	}
+
+	if c.Rollout.BatchSize <= 0 {
+		invalid("rollout.batchSize", "must be positive, got %d", c.Rollout.BatchSize)
+	}
+	if c.Rollout.BatchTimeout.Duration <= 0 {
+		invalid("rollout.batchTimeout", "must be positive, got %s", c.Rollout.BatchTimeout.Duration)
+	}
+	if c.Rollout.Interval.Duration <= 0 {
+		invalid("rollout.interval", "must be positive, got %s", c.Rollout.Interval.Duration)
+	}
+	if errs := validation.IsDNS1123Label(c.Rollout.Namespace); len(errs) != 0 {
+		invalid("rollout.namespace", "%q is not a valid namespace: %s", c.Rollout.Namespace, strings.Join(errs, ", "))
+	}
+
+	if le := c.LeaderElection; le.Enabled {
+		if errs := validation.IsDNS1123Subdomain(le.LeaseName); len(errs) != 0 {
+			invalid("leaderElection.leaseName", "%q is not a valid name: %s", le.LeaseName, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsDNS1123Label(le.LeaseNamespace); len(errs) != 0 {
+			invalid("leaderElection.leaseNamespace", "%q is not a valid namespace: %s", le.LeaseNamespace, strings.Join(errs, ", "))
+		}
+		if le.RetryPeriod.Duration <= 0 {
+			invalid("leaderElection.retryPeriod", "must be positive, got %s", le.RetryPeriod.Duration)
+		}
+		if le.RenewDeadline.Duration <= le.RetryPeriod.Duration*6/5 {
+			invalid("leaderElection.renewDeadline", "must be longer than 1.2 * retryPeriod (%s), got %s", le.RetryPeriod.Duration, le.RenewDeadline.Duration)
+		}
+		if le.LeaseDuration.Duration <= le.RenewDeadline.Duration {
+			invalid("leaderElection.leaseDuration", "must be longer than renewDeadline (%s), got %s", le.RenewDeadline.Duration, le.LeaseDuration.Duration)
+		}
+	}
+	if c.Server.MaxHeaderBytes <= 0 {
+		invalid("server.maxHeaderBytes", "must be positive, got %d", c.Server.MaxHeaderBytes)
+	}
+	if c.Server.MaxBodyBytes <= 0 {
+		invalid("server.maxBodyBytes", "must be positive, got %d", c.Server.MaxBodyBytes)
+	}
+	if (len(c.Server.TLS.CertFile) == 0) != (len(c.Server.TLS.KeyFile) == 0) {
+		invalid("server.tls", "certFile and keyFile must be set together")
+	}
+
+	switch c.Auth.Type {
+	case AuthNone:
+	case AuthBasic:
+		if len(c.Auth.Username) == 0 || len(c.Auth.Password) == 0 {
+			invalid("auth", "username and password (or usernameFile and passwordFile) are required for basic auth")
+		}
+	default:
+		invalid("auth.type", "must be %s or %s, got %q", AuthNone, AuthBasic, c.Auth.Type)
+	}
+
+	if _, err := labels.Parse(c.Catalog.LabelSelector); err != nil {
+		invalid("catalog.labelSelector", "%s", err.Error())
+	}
+
+	if err := c.Naming.NamingStrategy().Validate(); err != nil {
+		invalid("naming", "%s", err.Error())
+	}
+
+	if len(errs) != 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("invalid configuration:\n  - %s", strings.Join(errs, "\n  - "))
+	}
+	return nil
+}
+
+func (n NamingConfig) NamingStrategy() internal.NamingStrategy {
+	return internal.NamingStrategy{Type: n.Strategy, Prefix: n.Prefix}
+}
+
+// Selector returns the label selector of the catalog. The config is validated, so the selector parses.
+func (c CatalogConfig) Selector() labels.Selector {
+	selector, err := labels.Parse(c.LabelSelector)
+	if err != nil {
+		return labels.Nothing()
+	}
+	return selector
+}
+
+// Matches reports whether a template with the tags belongs to the catalog
+func (c CatalogConfig) Matches(tags []string) bool {
+	if len(c.Tags) == 0 {
+		return true
+	}
+	for _, tag := range tags {
+		for _, want := range c.Tags {
+			if tag == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NamespaceSelector returns the label selector of watched namespaces, or nil if none is configured
+func (w WatchNamespacesConfig) NamespaceSelector() labels.Selector {
+	if len(w.Selector) == 0 {
+		return nil
+	}
+	selector, err := labels.Parse(w.Selector)
+	if err != nil {
+		return nil
+	}
+	return selector
+}
+
+// Matches reports whether a new instance of the template and plan in the namespace counts against the quota
+func (q QuotaConfig) Matches(namespace string, templateName string, planName string) bool {
+	return q.Template == templateName && (len(q.Plan) == 0 || q.Plan == planName) &&
+		(len(q.Namespace) == 0 || q.Namespace == namespace)
+}
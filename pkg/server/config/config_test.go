@@ -0,0 +1,243 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsb-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	file := `apiVersion: tsb.tmax.io/v1alpha1
+kind: BrokerConfig
+namespace: tsb
+server:
+  port: 9000
+  operationTimeout: 10s
+naming:
+  strategy: prefixed
+  prefix: file-
+`
+	if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		check  func(cfg *Config) bool
+		errMsg string
+	}{
+		{
+			name: "defaults",
+			args: []string{"--namespace", "tsb"},
+			check: func(cfg *Config) bool {
+				return cfg.Server.Port == 8081 && cfg.Naming.Strategy == "instance-name" && !cfg.Accounting.Enabled
+			},
+		},
+		{
+			name:  "accounting opted in",
+			args:  []string{"--namespace", "tsb", "--accounting"},
+			check: func(cfg *Config) bool { return cfg.Accounting.Enabled && cfg.Accounting.LedgerNamespace == "tsb" },
+		},
+		{
+			name: "file",
+			args: []string{"--config", path},
+			check: func(cfg *Config) bool {
+				return cfg.Server.Port == 9000 && cfg.Server.OperationTimeout.Duration == 10*time.Second && cfg.Naming.Prefix == "file-"
+			},
+		},
+		{
+			name:  "env over file",
+			args:  []string{"--config=" + path},
+			env:   map[string]string{"TSB_INSTANCE_NAME_PREFIX": "env-"},
+			check: func(cfg *Config) bool { return cfg.Naming.Prefix == "env-" && cfg.Server.Port == 9000 },
+		},
+		{
+			name:  "flags over env",
+			args:  []string{"--config", path, "--instance-name-prefix", "flag-"},
+			env:   map[string]string{"TSB_INSTANCE_NAME_PREFIX": "env-"},
+			check: func(cfg *Config) bool { return cfg.Naming.Prefix == "flag-" },
+		},
+		{
+			name:  "config path from env",
+			env:   map[string]string{"TSB_CONFIG": path},
+			check: func(cfg *Config) bool { return cfg.Server.Port == 9000 },
+		},
+		{
+			name:   "invalid value",
+			args:   []string{"--namespace", "tsb", "--instance-naming", "random"},
+			errMsg: "naming",
+		},
+		{
+			name:   "missing file",
+			args:   []string{"--config", filepath.Join(dir, "missing.yaml")},
+			errMsg: "cannot read configuration file",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for key, val := range test.env {
+				os.Setenv(key, val)
+				defer os.Unsetenv(key)
+			}
+			cfg, err := Load(test.args, ScopeNamespaced, nil)
+			if len(test.errMsg) != 0 {
+				if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+					t.Fatalf("got error %v, want an error containing %q", err, test.errMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !test.check(cfg) {
+				t.Errorf("unexpected configuration %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestReadFileHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsb-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		file string
+		err  bool
+	}{
+		{name: "valid", file: "apiVersion: tsb.tmax.io/v1alpha1\nkind: BrokerConfig\n"},
+		{name: "other kind", file: "apiVersion: tsb.tmax.io/v1alpha1\nkind: Config\n", err: true},
+		{name: "unknown key", file: "apiVersion: tsb.tmax.io/v1alpha1\nkind: BrokerConfig\nport: 8080\n", err: true},
+		{name: "not yaml", file: "{", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.Replace(test.name, " ", "-", -1)+".yaml")
+			if err := ioutil.WriteFile(path, []byte(test.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := Default(ScopeNamespaced).readFile(path); (err != nil) != test.err {
+				t.Errorf("got error %v, want error %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		field  string
+	}{
+		{name: "default", modify: func(cfg *Config) {}},
+		{name: "unknown scope", modify: func(cfg *Config) { cfg.Scope = "global" }, field: "scope"},
+		{name: "watched namespaces of a cluster broker", modify: func(cfg *Config) {
+			cfg.Scope = ScopeCluster
+			cfg.WatchNamespaces.Names = []string{"team-a"}
+		}, field: "watchNamespaces"},
+		{name: "port", modify: func(cfg *Config) { cfg.Server.Port = 70000 }, field: "server.port"},
+		{name: "operation timeout beyond write timeout", modify: func(cfg *Config) {
+			cfg.Server.OperationTimeout = metav1.Duration{Duration: time.Minute}
+		}, field: "server.operationTimeout"},
+		{name: "burst", modify: func(cfg *Config) {
+			cfg.RateLimit = RateLimitConfig{RequestsPerSecond: 5}
+		}, field: "rateLimit.burst"},
+		{name: "basic auth without credentials", modify: func(cfg *Config) { cfg.Auth.Type = AuthBasic }, field: "auth"},
+		{name: "quota without template", modify: func(cfg *Config) { cfg.Quotas = []QuotaConfig{{MaxInstances: 1}} }, field: "quotas[0].template"},
+		{name: "orphan mode", modify: func(cfg *Config) { cfg.OrphanMitigation.Mode = "purge" }, field: "orphanMitigation.mode"},
+		{name: "accounting interval without accounting", modify: func(cfg *Config) {
+			cfg.Accounting = AccountingConfig{Enabled: false}
+		}, field: "accounting.interval"},
+		{name: "rollout batch size", modify: func(cfg *Config) { cfg.Rollout.BatchSize = 0 }, field: "rollout.batchSize"},
+		{name: "tls", modify: func(cfg *Config) { cfg.Server.TLS.CertFile = "tls.crt" }, field: "server.tls"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := validConfig()
+			test.modify(cfg)
+			err := cfg.Validate()
+			if len(test.field) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err.Error())
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.field+":") {
+				t.Errorf("got error %v, want an error of %s", err, test.field)
+			}
+		})
+	}
+}
+
+func TestKeepRestartOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(cfg *Config)
+		changed []string
+		check   func(next *Config) bool
+	}{
+		{
+			name:   "reloadable",
+			modify: func(cfg *Config) { cfg.Naming.Prefix = "new-"; cfg.RateLimit.RequestsPerSecond = 3 },
+			check:  func(next *Config) bool { return next.Naming.Prefix == "new-" && next.RateLimit.RequestsPerSecond == 3 },
+		},
+		{
+			name:   "operation timeout",
+			modify: func(cfg *Config) { cfg.Server.OperationTimeout = metav1.Duration{Duration: 5 * time.Second} },
+			check:  func(next *Config) bool { return next.Server.OperationTimeout.Duration == 5*time.Second },
+		},
+		{
+			name: "restart only",
+			modify: func(cfg *Config) {
+				cfg.Server.Port = 9000
+				cfg.Server.OperationTimeout = metav1.Duration{Duration: 5 * time.Second}
+				cfg.Namespace = "other"
+				cfg.Audit.Stdout = true
+			},
+			changed: []string{"namespace", "server", "audit"},
+			check: func(next *Config) bool {
+				return next.Server.Port == 8081 && next.Server.OperationTimeout.Duration == 5*time.Second &&
+					next.Namespace == "tsb" && !next.Audit.Stdout
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			current, next := validConfig(), validConfig()
+			test.modify(next)
+			changed := keepRestartOnly(next, current)
+			if !reflect.DeepEqual(changed, test.changed) {
+				t.Errorf("changed %v, want %v", changed, test.changed)
+			}
+			if !test.check(next) {
+				t.Errorf("unexpected configuration %+v", next)
+			}
+		})
+	}
+}
+
+func validConfig() *Config {
+	cfg := Default(ScopeNamespaced)
+	cfg.Namespace = "tsb"
+	cfg.LeaderElection.LeaseNamespace = "tsb"
+	cfg.Accounting.LedgerNamespace = "tsb"
+	cfg.Rollout.Namespace = "tsb"
+	return cfg
+}
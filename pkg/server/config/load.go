@@ -0,0 +1,175 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	configFlag = "config"
+	envPrefix  = "TSB_"
+)
+
+// Load builds the configuration from defaults, the configuration file, TSB_* env vars and flags, in increasing precedence.
+// bindExtra binds flags that are not part of the configuration, e.g. logging flags.
+func Load(args []string, defaultScope string, bindExtra func(*flag.FlagSet)) (*Config, error) {
+	cfg := Default(defaultScope)
+
+	path := configPath(args)
+	if len(path) != 0 {
+		if err := cfg.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.String(configFlag, path, "path of the broker configuration file (env "+envName(configFlag)+")")
+	cfg.BindFlags(fs)
+	if bindExtra != nil {
+		bindExtra(fs)
+	}
+	if err := applyEnv(fs); err != nil {
+		return nil, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg.File = path
+	if err := cfg.complete(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) BindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Scope, "scope", c.Scope, "scope of the broker: namespaced or cluster")
+	fs.StringVar(&c.Namespace, "namespace", c.Namespace, "namespace served by a namespaced broker")
+	fs.Var((*stringList)(&c.WatchNamespaces.Names), "watch-namespaces", "comma separated additional namespaces served by a namespaced broker")
+	fs.StringVar(&c.WatchNamespaces.Selector, "watch-namespace-selector", c.WatchNamespaces.Selector,
+		"label selector of additional namespaces served by a namespaced broker")
+
+	fs.IntVar(&c.Server.Port, "port", c.Server.Port, "port the broker listens on")
+	fs.DurationVar(&c.Server.ReadTimeout.Duration, "read-timeout", c.Server.ReadTimeout.Duration, "maximum duration for reading an entire request")
+	fs.DurationVar(&c.Server.ReadHeaderTimeout.Duration, "read-header-timeout", c.Server.ReadHeaderTimeout.Duration, "maximum duration for reading request headers")
+	fs.DurationVar(&c.Server.WriteTimeout.Duration, "write-timeout", c.Server.WriteTimeout.Duration, "maximum duration before timing out writes of a response")
+	fs.DurationVar(&c.Server.IdleTimeout.Duration, "idle-timeout", c.Server.IdleTimeout.Duration, "maximum time to wait for the next request on a keep-alive connection")
+	fs.DurationVar(&c.Server.ShutdownTimeout.Duration, "shutdown-timeout", c.Server.ShutdownTimeout.Duration, "maximum time to drain in-flight requests on shutdown")
+	fs.DurationVar(&c.Server.OperationTimeout.Duration, "operation-timeout", c.Server.OperationTimeout.Duration,
+		"deadline of the API server calls of an OSB request, 0 disables it")
+	fs.IntVar(&c.Server.MaxHeaderBytes, "max-header-bytes", c.Server.MaxHeaderBytes, "maximum size of request headers in bytes")
+	fs.Int64Var(&c.Server.MaxBodyBytes, "max-body-bytes", c.Server.MaxBodyBytes, "maximum size of a request body in bytes")
+	fs.StringVar(&c.Server.TLS.CertFile, "tls-cert-file", c.Server.TLS.CertFile, "TLS certificate file, serves plain HTTP if empty")
+	fs.StringVar(&c.Server.TLS.KeyFile, "tls-key-file", c.Server.TLS.KeyFile, "TLS private key file")
+
+	fs.StringVar(&c.Auth.Type, "auth-type", c.Auth.Type, "authentication of OSB requests: none or basic")
+	fs.StringVar(&c.Auth.UsernameFile, "auth-username-file", c.Auth.UsernameFile, "file containing the basic auth username")
+	fs.StringVar(&c.Auth.PasswordFile, "auth-password-file", c.Auth.PasswordFile, "file containing the basic auth password")
+
+	fs.StringVar(&c.Catalog.LabelSelector, "catalog-label-selector", c.Catalog.LabelSelector, "label selector of the templates served in the catalog")
+	fs.Var((*stringList)(&c.Catalog.Tags), "catalog-tags", "comma separated tags, serves only templates having one of them")
+
+	fs.StringVar(&c.Naming.Strategy, "instance-naming", c.Naming.Strategy,
+		"how template instances are named: instance-name, instance-id, prefixed or hashed")
+	fs.StringVar(&c.Naming.Prefix, "instance-name-prefix", c.Naming.Prefix, "prefix of template instance names")
+
+	fs.Float64Var(&c.RateLimit.RequestsPerSecond, "rate-limit", c.RateLimit.RequestsPerSecond,
+		"OSB requests per second each broker user or client may send, 0 disables rate limiting")
+	fs.IntVar(&c.RateLimit.Burst, "rate-limit-burst", c.RateLimit.Burst, "OSB requests each broker user or client may send at once")
+
+	fs.StringVar(&c.Tracing.Endpoint, "tracing-endpoint", c.Tracing.Endpoint, "host:port of the OTLP/HTTP collector spans are exported to, disabled if empty")
+	fs.BoolVar(&c.Tracing.Insecure, "tracing-insecure", c.Tracing.Insecure, "export spans over plain HTTP")
+	fs.Float64Var(&c.Tracing.SampleRatio, "tracing-sample-ratio", c.Tracing.SampleRatio, "ratio of traces started by the broker that are sampled")
+
+	fs.StringVar(&c.Audit.File, "audit-file", c.Audit.File, "JSON lines file the audit records of OSB calls are appended to")
+	fs.BoolVar(&c.Audit.Stdout, "audit-stdout", c.Audit.Stdout, "write audit records of OSB calls to the standard output")
+	fs.StringVar(&c.Audit.Webhook.URL, "audit-webhook-url", c.Audit.Webhook.URL, "URL each audit record of OSB calls is posted to")
+
+	fs.StringVar(&c.OrphanMitigation.Mode, "orphan-mitigation", c.OrphanMitigation.Mode,
+		"handling of template instances no service instance owns anymore: off, report or delete")
+	fs.DurationVar(&c.OrphanMitigation.Interval.Duration, "orphan-sweep-interval", c.OrphanMitigation.Interval.Duration, "interval between orphan sweeps")
+	fs.DurationVar(&c.OrphanMitigation.GracePeriod.Duration, "orphan-grace-period", c.OrphanMitigation.GracePeriod.Duration,
+		"how long an instance must stay orphaned before it is reported or deleted")
+
+	fs.BoolVar(&c.Accounting.Enabled, "accounting", c.Accounting.Enabled, "accrue the instance-hours and cost of each plan in the usage ledger")
+	fs.DurationVar(&c.Accounting.Interval.Duration, "accounting-interval", c.Accounting.Interval.Duration, "interval between usage accruals")
+	fs.DurationVar(&c.Accounting.CostPeriod.Duration, "accounting-cost-period", c.Accounting.CostPeriod.Duration,
+		"running time the cost amount of a plan is charged for, e.g. 730h for monthly prices")
+
+	fs.IntVar(&c.Rollout.BatchSize, "rollout-batch-size", c.Rollout.BatchSize, "number of instances a rollout upgrades at once unless it sets its own")
+	fs.DurationVar(&c.Rollout.BatchTimeout.Duration, "rollout-batch-timeout", c.Rollout.BatchTimeout.Duration,
+		"how long an upgraded instance may take to become ready before its rollout is rolled back")
+
+	fs.BoolVar(&c.LeaderElection.Enabled, "leader-elect", c.LeaderElection.Enabled,
+		"elect a leader among the replicas to run background loops, disable only for a single replica")
+	fs.StringVar(&c.LeaderElection.LeaseName, "leader-election-lease-name", c.LeaderElection.LeaseName, "name of the leader election lease")
+	fs.StringVar(&c.LeaderElection.LeaseNamespace, "leader-election-lease-namespace", c.LeaderElection.LeaseNamespace,
+		"namespace of the leader election lease, defaults to the namespace the broker runs in")
+	fs.DurationVar(&c.LeaderElection.LeaseDuration.Duration, "leader-election-lease-duration", c.LeaderElection.LeaseDuration.Duration,
+		"how long a replica waits to take over the lead after the leader stopped renewing it")
+	fs.DurationVar(&c.LeaderElection.RenewDeadline.Duration, "leader-election-renew-deadline", c.LeaderElection.RenewDeadline.Duration,
+		"how long the leader retries renewing the lease before giving up the lead")
+	fs.DurationVar(&c.LeaderElection.RetryPeriod.Duration, "leader-election-retry-period", c.LeaderElection.RetryPeriod.Duration,
+		"how often replicas try to acquire or renew the lease")
+
+	fs.DurationVar(&c.ReloadInterval.Duration, "config-reload-interval", c.ReloadInterval.Duration,
+		"how often the configuration file is checked for changes, 0 disables reloading")
+}
+
+// configPath finds the configuration file before the other flags are parsed
+func configPath(args []string) string {
+	for i, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if name == arg {
+			continue
+		}
+		if name == configFlag && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(name, configFlag+"=") {
+			return strings.TrimPrefix(name, configFlag+"=")
+		}
+	}
+	return os.Getenv(envName(configFlag))
+}
+
+// applyEnv sets every flag that has a matching TSB_* env var, e.g. TSB_INSTANCE_NAMING for --instance-naming
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		if val, ok := os.LookupEnv(envName(f.Name)); ok {
+			if setErr := fs.Set(f.Name, val); setErr != nil {
+				err = fmt.Errorf("env %s: %s", envName(f.Name), setErr.Error())
+			}
+		}
+	})
+	return err
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(flagName))
+}
+
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(val string) error {
+	*s = nil
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); len(item) != 0 {
+			*s = append(*s, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Store holds the current configuration and swaps it when the configuration file is reloaded
+type Store struct {
+	value atomic.Value
+}
+
+func NewStore(cfg *Config) *Store {
+	s := &Store{}
+	s.value.Store(cfg)
+	return s
+}
+
+func (s *Store) Get() *Config {
+	return s.value.Load().(*Config)
+}
+
+// Set replaces the configuration, which later calls of Get return
+func (s *Store) Set(cfg *Config) {
+	s.value.Store(cfg)
+}
+
+// Watch polls the configuration file and applies changes of the reloadable sections (auth, catalog, naming, quotas,
+// orphanMitigation, accounting, rollout, rateLimit, server.operationTimeout). Changes of the other keys are logged and
+// ignored until a restart.
+// load rebuilds the whole configuration, so env vars and flags keep their precedence over the file.
+func (s *Store) Watch(path string, load func() (*Config, error), stop <-chan struct{}, log logr.Logger) {
+	interval := s.Get().ReloadInterval.Duration
+	if len(path) == 0 || interval == 0 {
+		return
+	}
+
+	last := fileHash(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		hash := fileHash(path)
+		if hash == last {
+			continue
+		}
+		last = hash
+
+		next, err := load()
+		if err != nil {
+			log.Error(err, "configuration is not reloaded, keeping the current one")
+			continue
+		}
+
+		if changed := keepRestartOnly(next, s.Get()); len(changed) != 0 {
+			log.Info("WARNING: changes of these keys are ignored until the broker is restarted", "keys", changed)
+		}
+		s.Set(next)
+		log.Info("configuration is reloaded", "path", path)
+	}
+}
+
+// keepRestartOnly sets the keys that only take effect on a restart back to their current values, and returns those that
+// were changed
+func keepRestartOnly(next *Config, current *Config) []string {
+	var changed []string
+	keep := func(key string, differs bool) bool {
+		if differs {
+			changed = append(changed, key)
+		}
+		return differs
+	}
+
+	if keep("scope", next.Scope != current.Scope) {
+		next.Scope = current.Scope
+	}
+	if keep("namespace", next.Namespace != current.Namespace) {
+		next.Namespace = current.Namespace
+	}
+	if keep("watchNamespaces", !reflect.DeepEqual(next.WatchNamespaces, current.WatchNamespaces)) {
+		next.WatchNamespaces = current.WatchNamespaces
+	}
+	// the listener is set up once, only the operation deadline is read per request
+	server := current.Server
+	server.OperationTimeout = next.Server.OperationTimeout
+	if keep("server", !reflect.DeepEqual(next.Server, server)) {
+		next.Server = server
+	}
+	if keep("tracing", next.Tracing != current.Tracing) {
+		next.Tracing = current.Tracing
+	}
+	if keep("audit", next.Audit != current.Audit) {
+		next.Audit = current.Audit
+	}
+	if keep("leaderElection", next.LeaderElection != current.LeaderElection) {
+		next.LeaderElection = current.LeaderElection
+	}
+	if keep("reloadInterval", next.ReloadInterval != current.ReloadInterval) {
+		next.ReloadInterval = current.ReloadInterval
+	}
+	return changed
+}
+
+func fileHash(path string) [sha256.Size]byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}
+	}
+	return sha256.Sum256(data)
+}
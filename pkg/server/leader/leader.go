@@ -0,0 +1,133 @@
+package leader
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-logr/logr"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/metrics"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Loop is a background loop of the broker, it runs until ctx is cancelled
+type Loop func(ctx context.Context)
+
+// Elector runs the background loops on the elected replica only. Requests are served by every replica,
+// so the loops must keep their state in Kubernetes objects.
+type Elector struct {
+	client   kubernetes.Interface
+	config   config.LeaderElectionConfig
+	identity string
+	log      logr.Logger
+
+	mu      sync.Mutex
+	loops   []Loop
+	leading int32
+	running sync.WaitGroup
+}
+
+func NewElector(c kubernetes.Interface, cfg config.LeaderElectionConfig, identity string, log logr.Logger) *Elector {
+	return &Elector{
+		client:   c,
+		config:   cfg,
+		identity: identity,
+		log:      log,
+	}
+}
+
+// Add registers a loop, it must be called before Run
+func (e *Elector) Add(loop Loop) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.loops = append(e.loops, loop)
+}
+
+// IsLeader reports whether this replica currently runs the background loops
+func (e *Elector) IsLeader() bool {
+	return atomic.LoadInt32(&e.leading) == 1
+}
+
+// Run takes part in the election until stop is closed. Without leader election the replica leads right away.
+func (e *Elector) Run(stop <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	if !e.config.Enabled {
+		e.lead(ctx)
+		return nil
+	}
+
+	lock, err := resourcelock.New(resourcelock.LeasesResourceLock, e.config.LeaseNamespace, e.config.LeaseName,
+		e.client.CoreV1(), e.client.CoordinationV1(), resourcelock.ResourceLockConfig{Identity: e.identity})
+	if err != nil {
+		return err
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            e.config.LeaseName,
+		LeaseDuration:   e.config.LeaseDuration.Duration,
+		RenewDeadline:   e.config.RenewDeadline.Duration,
+		RetryPeriod:     e.config.RetryPeriod.Duration,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: e.lead,
+			OnStoppedLeading: func() {
+				e.log.Info("stopped leading", "identity", e.identity)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != e.identity {
+					e.log.Info("another replica leads", "leader", identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// a replica losing the lead keeps serving requests and rejoins the election once its loops have stopped
+	for {
+		elector.Run(ctx)
+		e.running.Wait()
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// lead runs every loop until ctx is cancelled, i.e. the lead is lost or the broker stops
+func (e *Elector) lead(ctx context.Context) {
+	e.running.Add(1)
+	defer e.running.Done()
+
+	e.mu.Lock()
+	loops := append([]Loop(nil), e.loops...)
+	e.mu.Unlock()
+
+	e.log.Info("started leading", "identity", e.identity, "loops", len(loops))
+	atomic.StoreInt32(&e.leading, 1)
+	metrics.Leader.Set(1)
+	defer func() {
+		atomic.StoreInt32(&e.leading, 0)
+		metrics.Leader.Set(0)
+	}()
+
+	var wg sync.WaitGroup
+	for _, loop := range loops {
+		wg.Add(1)
+		go func(loop Loop) {
+			defer wg.Done()
+			loop(ctx)
+		}(loop)
+	}
+	wg.Wait()
+	<-ctx.Done()
+}
@@ -0,0 +1,107 @@
+package leader
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+func electionConfig(enabled bool) config.LeaderElectionConfig {
+	return config.LeaderElectionConfig{
+		Enabled:        enabled,
+		LeaseName:      "tsb-leader",
+		LeaseNamespace: "tsb",
+		LeaseDuration:  metav1.Duration{Duration: 2 * time.Second},
+		RenewDeadline:  metav1.Duration{Duration: time.Second},
+		RetryPeriod:    metav1.Duration{Duration: 100 * time.Millisecond},
+	}
+}
+
+// countingElector returns an elector whose loop counts the replicas running it
+func countingElector(c kubernetes.Interface, cfg config.LeaderElectionConfig, identity string, running *int32) *Elector {
+	e := NewElector(c, cfg, identity, logf.Log.WithName(identity))
+	e.Add(func(ctx context.Context) {
+		atomic.AddInt32(running, 1)
+		<-ctx.Done()
+		atomic.AddInt32(running, -1)
+	})
+	return e
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		replicas int
+	}{
+		{name: "without election", enabled: false, replicas: 1},
+		{name: "single replica", enabled: true, replicas: 1},
+		{name: "several replicas", enabled: true, replicas: 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := fake.NewSimpleClientset()
+			stop := make(chan struct{})
+			done := make(chan struct{}, test.replicas)
+			var running int32
+			var electors []*Elector
+			for i := 0; i < test.replicas; i++ {
+				e := countingElector(c, electionConfig(test.enabled), string(rune('a'+i)), &running)
+				electors = append(electors, e)
+				go func() {
+					if err := e.Run(stop); err != nil {
+						t.Error(err)
+					}
+					done <- struct{}{}
+				}()
+			}
+
+			waitFor(t, func() bool { return atomic.LoadInt32(&running) == 1 })
+			// give the other replicas a chance to wrongly take the lead
+			time.Sleep(300 * time.Millisecond)
+			if n := atomic.LoadInt32(&running); n != 1 {
+				t.Fatalf("%d replicas run the loops", n)
+			}
+			leaders := 0
+			for _, e := range electors {
+				if e.IsLeader() {
+					leaders++
+				}
+			}
+			if leaders != 1 {
+				t.Errorf("%d replicas lead", leaders)
+			}
+
+			close(stop)
+			for i := 0; i < test.replicas; i++ {
+				<-done
+			}
+			if n := atomic.LoadInt32(&running); n != 0 {
+				t.Errorf("%d loops still run after stop", n)
+			}
+			for _, e := range electors {
+				if e.IsLeader() {
+					t.Error("a replica still leads after stop")
+				}
+			}
+		})
+	}
+}
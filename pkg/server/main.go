@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/audit"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/leader"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/tracing"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+)
+
+var log = logf.Log.WithName("TSB-main")
+
+// tracingShutdownTimeout bounds flushing the spans left on shutdown
+const tracingShutdownTimeout = 5 * time.Second
+
+// Main runs a broker serving the default scope unless the configuration chooses another one
+func Main(defaultScope string) {
+	opts := zap.Options{
+		Development: false,
+	}
+	cfg, err := config.Load(os.Args[1:], defaultScope, opts.BindFlags)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+	logf.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	if err := run(cfg, defaultScope); err != nil {
+		log.Error(err, "failed to run a server")
+		os.Exit(1)
+	}
+}
+
+// run serves the broker until it is shut down. It returns its error rather than exiting, so the deferred flushes of the
+// spans and audit records still run.
+func run(cfg *config.Config, defaultScope string) error {
+	log.Info("initializing server....", "scope", cfg.Scope, "namespace", cfg.Namespace)
+
+	shutdownTracing, err := tracing.Setup(cfg.Tracing, log.WithName("tracing"))
+	if err != nil {
+		return fmt.Errorf("cannot set up tracing: %s", err.Error())
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.Error(err, "spans may be lost")
+		}
+	}()
+
+	s := scheme.Scheme
+	if err := tmaxv1.AddToScheme(s); err != nil {
+		return err
+	}
+	c, err := internal.Client(client.Options{Scheme: s})
+	if err != nil {
+		return fmt.Errorf("cannot create a client: %s", err.Error())
+	}
+
+	recorder, err := internal.EventRecorder(s)
+	if err != nil {
+		return fmt.Errorf("cannot create an event recorder: %s", err.Error())
+	}
+
+	clientset, err := internal.Clientset()
+	if err != nil {
+		return fmt.Errorf("cannot create a clientset: %s", err.Error())
+	}
+	elector := leader.NewElector(clientset, cfg.LeaderElection, internal.LeaseHolder(), log.WithName("leader"))
+
+	auditor, err := audit.New(cfg.Audit, log.WithName("audit"))
+	if err != nil {
+		return fmt.Errorf("cannot set up auditing: %s", err.Error())
+	}
+	defer func() {
+		if err := auditor.Close(); err != nil {
+			log.Error(err, "audit records may be lost")
+		}
+	}()
+
+	store := config.NewStore(cfg)
+	router, err := NewRouter(store, c, recorder, elector, auditor)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	elected := make(chan struct{})
+	go func() {
+		defer close(elected)
+		if err := elector.Run(stop); err != nil {
+			log.Error(err, "leader election failed, background loops do not run on this replica")
+		}
+	}()
+	go store.Watch(cfg.File, func() (*config.Config, error) {
+		// logging flags are not reloaded
+		return config.Load(os.Args[1:], defaultScope, (&zap.Options{}).BindFlags)
+	}, stop, log.WithName("config"))
+
+	if err := Run(router, cfg.Server, stop, log); err != nil {
+		return err
+	}
+	// wait for the lease to be released, so another replica takes over right away
+	<-elected
+	return nil
+}
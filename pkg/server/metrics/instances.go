@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	tmaxv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var instancesDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "", "provisioned_instances"),
+	"Number of template instances provisioned by the broker per template",
+	[]string{"namespace", "template"}, nil,
+)
+
+// collectTimeout bounds the API calls of a scrape
+const collectTimeout = 10 * time.Second
+
+// instanceCollector counts the provisioned template instances whenever metrics are scraped
+type instanceCollector struct {
+	client     client.Client
+	namespaces func(ctx context.Context) ([]string, error)
+	log        logr.Logger
+}
+
+// RegisterInstanceCollector exposes the provisioned instances in the namespaces ("" for all namespaces)
+func RegisterInstanceCollector(c client.Client, namespaces func(ctx context.Context) ([]string, error), log logr.Logger) error {
+	return ctrlmetrics.Registry.Register(&instanceCollector{client: c, namespaces: namespaces, log: log})
+}
+
+func (i *instanceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- instancesDesc
+}
+
+func (i *instanceCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+
+	namespaces, err := i.namespaces(ctx)
+	if err != nil {
+		i.log.Error(err, "cannot list namespaces for metrics")
+		return
+	}
+
+	var items []tmaxv1.TemplateInstance
+	for _, ns := range namespaces {
+		templateInstances := &tmaxv1.TemplateInstanceList{}
+		if err := i.client.List(ctx, templateInstances, client.InNamespace(ns)); err != nil {
+			i.log.Error(err, "cannot list template instances for metrics", "namespace", ns)
+			return
+		}
+		items = append(items, templateInstances.Items...)
+	}
+
+	type key struct{ namespace, template string }
+	counts := make(map[key]int)
+	for _, ti := range items {
+		if _, ok := ti.Annotations["instance_id"]; !ok || ti.DeletionTimestamp != nil {
+			continue
+		}
+		k := key{namespace: ti.Namespace}
+		k.template, _ = internal.InstanceTemplateName(&ti)
+		counts[k]++
+	}
+
+	for k, count := range counts {
+		ch <- prometheus.MustNewConstMetric(instancesDesc, prometheus.GaugeValue, float64(count), k.namespace, k.template)
+	}
+}
@@ -0,0 +1,137 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const namespace = "tsb"
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Number of OSB requests by operation, status code, service and plan",
+	}, []string{"operation", "code", "service", "plan"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Latency of OSB requests by operation, status code, service and plan",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"operation", "code", "service", "plan"})
+
+	// CatalogServices is the number of services returned by the last catalog request
+	CatalogServices = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "catalog_services",
+		Help:      "Number of services in the catalog",
+	})
+
+	// Leader is 1 on the replica running the background loops
+	Leader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "leader",
+		Help:      "Whether this replica is the elected leader running background loops",
+	})
+
+	// Orphans is the number of orphaned template instances found by the last sweep
+	Orphans = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "orphan_instances",
+		Help:      "Number of orphaned template instances found by the last sweep by reason",
+	}, []string{"reason"})
+
+	// OrphansDeleted counts the orphaned template instances deleted by the sweeper
+	OrphansDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "orphan_instances_deleted_total",
+		Help:      "Number of orphaned template instances deleted by the sweeper by reason",
+	}, []string{"reason"})
+
+	// InstanceHours and InstanceCost count the usage accrued by the leader, for chargeback
+	InstanceHours = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "instance_hours_total",
+		Help:      "Running hours of template instances accrued by namespace, template and plan",
+	}, []string{"namespace", "template", "plan"})
+
+	InstanceCost = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "instance_cost_total",
+		Help:      "Cost of template instances accrued from the plan costs by namespace, template, plan and cost unit",
+	}, []string{"namespace", "template", "plan", "unit"})
+
+	// RejectedRequests counts the requests refused by the rate limit or the instance quotas
+	RejectedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rejected_requests_total",
+		Help:      "Number of OSB requests rejected by the rate limit or the instance quotas by reason",
+	}, []string{"reason"})
+)
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(requests, requestDuration, CatalogServices, Leader, Orphans, OrphansDeleted, InstanceHours, InstanceCost, RejectedRequests)
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(ctrlmetrics.Registry, promhttp.HandlerOpts{})
+}
+
+// unknownOffering labels the requests of services and plans not resolved to catalog entries
+const unknownOffering = "unknown"
+
+type offeringKey struct{}
+
+// offering is the service and plan the handler of a request resolved it to
+type offering struct {
+	service string
+	plan    string
+}
+
+// Instrument counts and times the requests of an OSB operation. They are labeled with the service and plan set by
+// SetOffering, "unknown" if the handler resolved none, so that ids made up by clients do not grow the label values.
+func Instrument(operation string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		o := &offering{service: unknownOffering, plan: unknownOffering}
+
+		recorder := &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+		next(recorder, r.WithContext(context.WithValue(r.Context(), offeringKey{}, o)))
+
+		code := strconv.Itoa(recorder.Status)
+		requests.WithLabelValues(operation, code, o.service, o.plan).Inc()
+		requestDuration.WithLabelValues(operation, code, o.service, o.plan).Observe(time.Since(start).Seconds())
+	}
+}
+
+// SetOffering labels the metrics of the request with the ids of the service and plan it was resolved to. Handlers only
+// pass ids of catalog entries or of existing instances, an empty id leaves the label as it is.
+func SetOffering(ctx context.Context, serviceId string, planId string) {
+	o, ok := ctx.Value(offeringKey{}).(*offering)
+	if !ok {
+		return
+	}
+	if len(serviceId) != 0 {
+		o.service = serviceId
+	}
+	if len(planId) != 0 {
+		o.plan = planId
+	}
+}
+
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+func (s *StatusRecorder) WriteHeader(status int) {
+	s.Status = status
+	s.ResponseWriter.WriteHeader(status)
+}
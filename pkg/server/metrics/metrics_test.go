@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrument(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation string
+		serviceId string
+		planId    string
+		status    int
+		service   string
+		plan      string
+	}{
+		{name: "unresolved", operation: "test_unresolved", status: http.StatusBadRequest, service: "unknown", plan: "unknown"},
+		{name: "service only", operation: "test_service", serviceId: "s-1", status: http.StatusOK, service: "s-1", plan: "unknown"},
+		{name: "resolved", operation: "test_resolved", serviceId: "s-1", planId: "s-1-0", status: http.StatusCreated, service: "s-1", plan: "s-1-0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := Instrument(test.operation, func(w http.ResponseWriter, r *http.Request) {
+				SetOffering(r.Context(), test.serviceId, test.planId)
+				w.WriteHeader(test.status)
+			})
+			// the ids of the request itself are never used as labels
+			req := httptest.NewRequest("GET", "/v2/service_instances/i-1?service_id=made-up&plan_id=made-up", nil)
+			handler(httptest.NewRecorder(), req)
+
+			code := http.StatusText(test.status)
+			counter := requests.WithLabelValues(test.operation, strconv.Itoa(test.status), test.service, test.plan)
+			if got := testutil.ToFloat64(counter); got != 1 {
+				t.Errorf("%s: counted %v requests with service %s and plan %s, want 1", code, got, test.service, test.plan)
+			}
+			if got := testutil.ToFloat64(requests.WithLabelValues(test.operation, strconv.Itoa(test.status), "made-up", "made-up")); got != 0 {
+				t.Errorf("counted %v requests with the ids of the request", got)
+			}
+		})
+	}
+}
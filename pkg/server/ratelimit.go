@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/apis"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/metrics"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/schemas"
+	"golang.org/x/time/rate"
+)
+
+// limiterIdleTimeout is how long the limiter of a client is kept after its last request
+const limiterIdleTimeout = 10 * time.Minute
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter keeps a token bucket per authenticated broker user, or per client address without authentication.
+// Buckets of clients idle for limiterIdleTimeout are evicted.
+type rateLimiter struct {
+	mu        sync.Mutex
+	cfg       config.RateLimitConfig
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+}
+
+// rateLimit answers 429 to clients exceeding the current rateLimit configuration. The routers using it share its limiters.
+// It must run after authenticate, so that a client cannot pick its bucket by the credentials or headers it sends.
+func rateLimit(store *config.Store) mux.MiddlewareFunc {
+	l := &rateLimiter{clients: make(map[string]*clientLimiter)}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			current := store.Get()
+			cfg := current.RateLimit
+			if cfg.RequestsPerSecond <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key := clientKey(r, current.Auth)
+			reservation := l.reserve(key, cfg)
+			if delay := reservation.Delay(); delay > 0 {
+				reservation.Cancel()
+				metrics.RejectedRequests.WithLabelValues("rate_limit").Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(&schemas.Error{
+					Error:       apis.ErrorTooManyRequests,
+					Description: fmt.Sprintf("%s exceeded %v requests per second, retry after %s", key, cfg.RequestsPerSecond, delay.Round(time.Second)),
+				})
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// reserve takes a token of the client. A changed configuration starts all clients over with full buckets.
+func (l *rateLimiter) reserve(key string, cfg config.RateLimitConfig) *rate.Reservation {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if cfg != l.cfg {
+		l.cfg = cfg
+		l.clients = make(map[string]*clientLimiter)
+	}
+
+	if now.Sub(l.lastSweep) > limiterIdleTimeout {
+		for k, c := range l.clients {
+			if now.Sub(c.lastSeen) > limiterIdleTimeout {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	c, ok := l.clients[key]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(cfg.RequestsPerSecond), cfg.Burst)}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+	return c.limiter.ReserveN(now, 1)
+}
+
+// clientKey names the authenticated broker user of the request, or the client address if the broker requires no credentials.
+// The originating identity header is not used, since any client can send one.
+func clientKey(r *http.Request, auth config.AuthConfig) string {
+	if auth.Type == config.AuthBasic {
+		if user, _, ok := r.BasicAuth(); ok {
+			return "user " + user
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "client " + host
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+)
+
+func TestClientKey(t *testing.T) {
+	basic := config.AuthConfig{Type: config.AuthBasic, Username: "broker", Password: "secret"}
+	tests := []struct {
+		name     string
+		auth     config.AuthConfig
+		user     string
+		identity string
+		want     string
+	}{
+		{name: "authenticated", auth: basic, user: "broker", want: "user broker"},
+		{name: "no auth", auth: config.AuthConfig{Type: config.AuthNone}, user: "broker", want: "client 10.0.0.1"},
+		{name: "originating identity is ignored", auth: config.AuthConfig{Type: config.AuthNone},
+			identity: "kubernetes eyJ1c2VybmFtZSI6ImFsaWNlIn0=", want: "client 10.0.0.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v2/catalog", nil)
+			r.RemoteAddr = "10.0.0.1:41234"
+			if len(test.user) != 0 {
+				r.SetBasicAuth(test.user, "secret")
+			}
+			if len(test.identity) != 0 {
+				r.Header.Set("X-Broker-API-Originating-Identity", test.identity)
+			}
+			if got := clientKey(r, test.auth); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	cfg := config.Default(config.ScopeNamespaced)
+	cfg.Auth = config.AuthConfig{Type: config.AuthBasic, Username: "broker", Password: "secret"}
+	cfg.RateLimit = config.RateLimitConfig{RequestsPerSecond: 0.001, Burst: 2}
+	store := config.NewStore(cfg)
+	handler := authenticate(store)(rateLimit(store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	tests := []struct {
+		name     string
+		password string
+		addr     string
+		want     int
+	}{
+		{name: "unauthenticated requests are not counted", password: "wrong", addr: "10.0.0.1:1", want: http.StatusUnauthorized},
+		{name: "first", password: "secret", addr: "10.0.0.1:1", want: http.StatusOK},
+		{name: "unauthenticated requests are not counted again", password: "wrong", addr: "10.0.0.2:1", want: http.StatusUnauthorized},
+		{name: "same user from another address", password: "secret", addr: "10.0.0.2:1", want: http.StatusOK},
+		{name: "over the burst of the user", password: "secret", addr: "10.0.0.3:1", want: http.StatusTooManyRequests},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v2/catalog", nil)
+			r.RemoteAddr = test.addr
+			r.SetBasicAuth("broker", test.password)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.want {
+				t.Fatalf("got status %d, want %d", w.Code, test.want)
+			}
+			if test.want == http.StatusTooManyRequests && len(w.Header().Get("Retry-After")) == 0 {
+				t.Error("no Retry-After header")
+			}
+		})
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	cfg := config.RateLimitConfig{RequestsPerSecond: 1, Burst: 1}
+	l := &rateLimiter{clients: make(map[string]*clientLimiter)}
+	l.reserve("client 10.0.0.1", cfg)
+	l.reserve("client 10.0.0.2", cfg)
+
+	// the first client goes idle, the sweep on the next request evicts it
+	l.clients["client 10.0.0.1"].lastSeen = time.Now().Add(-2 * limiterIdleTimeout)
+	l.lastSweep = time.Now().Add(-2 * limiterIdleTimeout)
+	l.reserve("client 10.0.0.2", cfg)
+	if _, ok := l.clients["client 10.0.0.1"]; ok {
+		t.Error("the idle client is kept")
+	}
+	if _, ok := l.clients["client 10.0.0.2"]; !ok {
+		t.Error("the active client is evicted")
+	}
+
+	// a changed configuration starts over
+	l.reserve("client 10.0.0.2", config.RateLimitConfig{RequestsPerSecond: 2, Burst: 1})
+	if delay := l.reserve("client 10.0.0.3", cfg).Delay(); delay != 0 {
+		t.Errorf("a new client waits %s", delay)
+	}
+}
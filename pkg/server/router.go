@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/apis"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/audit"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/leader"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/metrics"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/tracing"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	apiPathPrefix         = "/v2/"
+	nsAPIPathPrefix       = "/ns/{" + apis.NamespaceVar + "}/v2/"
+	serviceCatalogPrefix  = "/catalog"
+	serviceInstancePrefix = "/service_instances/{instance_id}"
+	serviceBindingPrefix  = "/service_instances/{instance_id}/service_bindings/{binding_id}"
+	lastOperationPrefix   = "/service_instances/{instance_id}/last_operation"
+	metricsPath           = "/metrics"
+	healthzPath           = "/healthz"
+	readyzPath            = "/readyz"
+	adminPathPrefix       = "/admin"
+	orphansPath           = "/orphans"
+	usagePath             = "/usage"
+	outdatedPath          = "/instances/outdated"
+	rolloutsPath          = "/rollouts"
+	rolloutPath           = "/rollouts/{" + apis.RolloutVar + "}"
+)
+
+// osbHandlers are the OSB operations of a broker scope
+type osbHandlers struct {
+	catalog, provision, update, deprovision, fetch, lastOperation, bind, unbind http.HandlerFunc
+}
+
+// NewRouter serves the audited OSB and admin APIs, and registers the background loops with the elector
+func NewRouter(store *config.Store, c client.Client, recorder record.EventRecorder, elector *leader.Elector,
+	auditor *audit.Auditor) (*mux.Router, error) {
+	cfg := store.Get()
+	router := mux.NewRouter()
+	apiRouters := []*mux.Router{router.PathPrefix(apiPathPrefix).Subrouter()}
+	if cfg.Scope == config.ScopeNamespaced {
+		// a namespaced broker also serves each watched namespace under /ns/{namespace}/v2/
+		apiRouters = append(apiRouters, router.PathPrefix(nsAPIPathPrefix).Subrouter())
+	}
+
+	locker := apis.NewLocker(c, logf.Log.WithName("Locker"), store)
+	limiter := rateLimit(store)
+
+	catalog := &apis.Catalog{
+		Client: c,
+		Log:    logf.Log.WithName("Catalog"),
+		Config: store,
+	}
+	provision := &apis.Provision{
+		Client:   c,
+		Log:      logf.Log.WithName("Provision"),
+		Config:   store,
+		Recorder: recorder,
+		Locker:   locker,
+		Quotas:   apis.NewQuotas(c, logf.Log.WithName("Quotas"), store),
+	}
+	binding := &apis.Binding{
+		Client:   c,
+		Log:      logf.Log.WithName("Binding"),
+		Config:   store,
+		Recorder: recorder,
+		Locker:   locker,
+	}
+	health := &apis.Health{
+		Client:       c,
+		Log:          logf.Log.WithName("Health"),
+		Namespace:    cfg.Namespace,
+		ClusterScope: cfg.Scope == config.ScopeCluster,
+	}
+
+	handlers := osbHandlers{
+		catalog:       catalog.GetCatalog,
+		provision:     provision.ProvisionServiceInstance,
+		update:        provision.UpdateProvisionServiceInstance,
+		deprovision:   provision.DeprovisionServiceInstance,
+		fetch:         provision.GetServiceInstance,
+		lastOperation: provision.LastOperation,
+		bind:          binding.BindingServiceInstance,
+		unbind:        binding.UnBindingServiceInstance,
+	}
+	instanceNamespaces := func(ctx context.Context) ([]string, error) {
+		return apis.ServedNamespaces(ctx, c, store.Get())
+	}
+	if cfg.Scope == config.ScopeCluster {
+		handlers = osbHandlers{
+			catalog:       catalog.GetClusterCatalog,
+			provision:     provision.ClusterProvisionServiceInstance,
+			update:        provision.UpdateClusterProvisionServiceInstance,
+			deprovision:   provision.ClusterDeprovisionServiceInstance,
+			fetch:         provision.ClusterGetServiceInstance,
+			lastOperation: provision.ClusterLastOperation,
+			bind:          binding.ClusterBindingServiceInstance,
+			unbind:        binding.ClusterUnBindingServiceInstance,
+		}
+		instanceNamespaces = func(context.Context) ([]string, error) {
+			return []string{""}, nil
+		}
+	}
+
+	for _, apiRouter := range apiRouters {
+		// routes are named by operation for spans and the audit log, which also records unauthenticated
+		// and rate limited calls
+		apiRouter.Use(tracing.Middleware, auditor.Middleware, authenticate(store), limiter, withDeadline(store))
+
+		//catalog
+		apiRouter.HandleFunc(serviceCatalogPrefix, metrics.Instrument("catalog", handlers.catalog)).Methods("GET").Name("catalog")
+
+		//provision
+		apiRouter.HandleFunc(serviceInstancePrefix, metrics.Instrument("provision", handlers.provision)).Methods("PUT").Name("provision")
+		apiRouter.HandleFunc(serviceInstancePrefix, metrics.Instrument("update", handlers.update)).Methods("PATCH").Name("update")
+		apiRouter.HandleFunc(serviceInstancePrefix, metrics.Instrument("deprovision", handlers.deprovision)).Methods("DELETE").Name("deprovision")
+		apiRouter.HandleFunc(serviceInstancePrefix, metrics.Instrument("fetch", handlers.fetch)).Methods("GET").Name("fetch")
+		apiRouter.HandleFunc(lastOperationPrefix, metrics.Instrument("last_operation", handlers.lastOperation)).Methods("GET").Name("last_operation")
+
+		//binding
+		apiRouter.HandleFunc(serviceBindingPrefix, metrics.Instrument("bind", handlers.bind)).Methods("PUT").Name("bind")
+		apiRouter.HandleFunc(serviceBindingPrefix, metrics.Instrument("unbind", handlers.unbind)).Methods("DELETE").Name("unbind")
+	}
+
+	//admin
+	orphans := &apis.Orphans{
+		Client:     c,
+		Log:        logf.Log.WithName("Orphans"),
+		Config:     store,
+		Recorder:   recorder,
+		Locker:     locker,
+		Namespaces: instanceNamespaces,
+	}
+	elector.Add(orphans.Sweep)
+	accounting := &apis.Accounting{
+		Client:     c,
+		Log:        logf.Log.WithName("Accounting"),
+		Config:     store,
+		Namespaces: instanceNamespaces,
+	}
+	elector.Add(accounting.Accrue)
+	revisions := &apis.Revisions{
+		Client:     c,
+		Log:        logf.Log.WithName("Revisions"),
+		Namespaces: instanceNamespaces,
+	}
+	rollouts := &apis.Rollouts{
+		Client:    c,
+		Log:       logf.Log.WithName("Rollouts"),
+		Config:    store,
+		Recorder:  recorder,
+		Locker:    locker,
+		Revisions: revisions,
+		Broker:    config.BrokerName(cfg.Scope),
+	}
+	elector.Add(rollouts.Run)
+
+	adminRouter := router.PathPrefix(adminPathPrefix).Subrouter()
+	adminRouter.Use(tracing.Middleware, auditor.Middleware, requireAuth(store), authenticate(store), limiter, withDeadline(store))
+	adminRouter.HandleFunc(orphansPath, orphans.Report).Methods("GET").Name("orphans")
+	adminRouter.HandleFunc(usagePath, accounting.Report).Methods("GET").Name("usage")
+	adminRouter.HandleFunc(outdatedPath, revisions.Outdated).Methods("GET").Name("outdated_instances")
+	adminRouter.HandleFunc(rolloutsPath, rollouts.List).Methods("GET").Name("rollouts")
+	adminRouter.HandleFunc(rolloutsPath, rollouts.Create).Methods("POST").Name("create_rollout")
+	adminRouter.HandleFunc(rolloutPath, rollouts.Get).Methods("GET").Name("rollout")
+	adminRouter.HandleFunc(rolloutPath+"/pause", rollouts.Pause).Methods("POST").Name("pause_rollout")
+	adminRouter.HandleFunc(rolloutPath+"/resume", rollouts.Resume).Methods("POST").Name("resume_rollout")
+	adminRouter.HandleFunc(rolloutPath+"/rollback", rollouts.Rollback).Methods("POST").Name("rollback_rollout")
+
+	//metrics
+	if err := metrics.RegisterInstanceCollector(c, instanceNamespaces, logf.Log.WithName("Metrics")); err != nil {
+		return nil, err
+	}
+	router.Handle(metricsPath, metrics.Handler()).Methods("GET")
+
+	//health
+	router.HandleFunc(healthzPath, health.Healthz).Methods("GET")
+	router.HandleFunc(readyzPath, health.Readyz).Methods("GET")
+
+	return router, nil
+}
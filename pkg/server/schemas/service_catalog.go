@@ -7,16 +7,17 @@ type Catalog struct {
 }
 
 type Service struct {
-	Name            string                 `json:"name"`
-	Id              string                 `json:"id"`
-	Description     string                 `json:"description"`
-	Tags            []string               `json:"tags,omitempty"`
-	Requires        []string               `json:"requires,omitempty"`
-	Bindable        bool                   `json:"bindable"`
-	Metadata        map[string]interface{} `json:"metadata,omitempty"`
-	DashboardClient DashBoardClient        `json:"dashboard_client,omitempty"`
-	PlanUpdateable  bool                   `json:"plan_updateable,omitempty"`
-	Plans           []PlanSpec             `json:"plans"`
+	Name                 string                 `json:"name"`
+	Id                   string                 `json:"id"`
+	Description          string                 `json:"description"`
+	Tags                 []string               `json:"tags,omitempty"`
+	Requires             []string               `json:"requires,omitempty"`
+	Bindable             bool                   `json:"bindable"`
+	Metadata             map[string]interface{} `json:"metadata,omitempty"`
+	DashboardClient      DashBoardClient        `json:"dashboard_client,omitempty"`
+	PlanUpdateable       bool                   `json:"plan_updateable,omitempty"`
+	InstancesRetrievable bool                   `json:"instances_retrievable,omitempty"`
+	Plans                []PlanSpec             `json:"plans"`
 }
 
 type DashBoardClient struct {
@@ -31,7 +32,7 @@ type PlanSpec struct {
 	Description            string          `json:"description,omitempty"`
 	Metadata               PlanMetadata    `json:"metadata,omitempty"`
 	Free                   bool            `json:"free,omitempty"`
-	Bindable               bool            `json:"bindable,omitempty"`
+	Bindable               *bool           `json:"bindable,omitempty"`
 	PlanUpdateable         bool            `json:"plan_updateable,omitempty"`
 	Schemas                Schemas         `json:"schemas,omitempty"`
 	MaximumPollingDuration int             `json:"maximum_polling_duration,omitempty"`
@@ -77,12 +78,13 @@ type SchemaParameterSpec struct {
 }
 
 type PropertiesSpec struct {
-	Default     intstr.IntOrString `json:"default,omitempty"`
-	Fixed       bool               `json:"fixed,omitempty"`
-	Title       string             `json:"title,omitempty"`
-	Description string             `json:"description,omitempty"`
-	Type        string             `json:"type,omitempty"`
-	Regex       string             `json:"regex,omitempty"`
+	Default     *intstr.IntOrString `json:"default,omitempty"`
+	Fixed       bool                `json:"fixed,omitempty"`
+	Title       string              `json:"title,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Type        string              `json:"type,omitempty"`
+	Regex       string              `json:"regex,omitempty"`
+	Enum        []string            `json:"enum,omitempty"`
 }
 
 type ParamSpec struct {
@@ -9,6 +9,7 @@ type ServiceInstanceProvisionRequest struct {
 	OrganizationGuid string                        `json:"organization_guid"`
 	SpaceGuid        string                        `json:"space_guid"`
 	Parameters       map[string]intstr.IntOrString `json:"parameters,omitempty"`
+	MaintenanceInfo  *MaintenanceInfo              `json:"maintenance_info,omitempty"`
 }
 
 type ServiceInstanceProvisionResponse struct {
@@ -17,6 +18,20 @@ type ServiceInstanceProvisionResponse struct {
 	Metadata     ServiceInstanceMetadata `json:"metadata,omitempty"`
 }
 
+// ServiceInstanceResource is the answer of fetching an instance
+type ServiceInstanceResource struct {
+	ServiceId       string            `json:"service_id,omitempty"`
+	PlanId          string            `json:"plan_id,omitempty"`
+	DashboardUrl    string            `json:"dashboard_url,omitempty"`
+	Parameters      map[string]string `json:"parameters,omitempty"`
+	MaintenanceInfo *MaintenanceInfo  `json:"maintenance_info,omitempty"`
+}
+
 type ServiceInstanceMetadata struct {
 	Labels map[string]string `json:"labels,omitempty"`
 }
+
+type LastOperationResponse struct {
+	State       string `json:"state"`
+	Description string `json:"description,omitempty"`
+}
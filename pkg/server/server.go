@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/go-logr/logr"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+)
+
+// Run serves the handler until SIGTERM or SIGINT is received, then drains in-flight requests.
+// stop is closed when the server starts shutting down.
+func Run(handler http.Handler, opts config.ServerConfig, stop chan<- struct{}, log logr.Logger) error {
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", opts.Port),
+		Handler:           limitBody(handler, opts.MaxBodyBytes),
+		ReadTimeout:       opts.ReadTimeout.Duration,
+		ReadHeaderTimeout: opts.ReadHeaderTimeout.Duration,
+		WriteTimeout:      opts.WriteTimeout.Duration,
+		IdleTimeout:       opts.IdleTimeout.Duration,
+		MaxHeaderBytes:    opts.MaxHeaderBytes,
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		sig := <-signals
+		log.Info(fmt.Sprintf("received %s, shutting down server", sig))
+		close(stop)
+
+		ctx, cancel := context.WithTimeout(context.Background(), opts.ShutdownTimeout.Duration)
+		defer cancel()
+		stopped <- server.Shutdown(ctx)
+	}()
+
+	var err error
+	if len(opts.TLS.CertFile) != 0 {
+		log.Info(fmt.Sprintf("listening on %s (TLS)", server.Addr))
+		err = server.ListenAndServeTLS(opts.TLS.CertFile, opts.TLS.KeyFile)
+	} else {
+		log.Info(fmt.Sprintf("listening on %s", server.Addr))
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	if err := <-stopped; err != nil {
+		return fmt.Errorf("in-flight requests were not drained: %s", err.Error())
+	}
+	log.Info("server is shut down")
+	return nil
+}
+
+// withDeadline bounds the context of each request by the current server.operationTimeout, so hung API server calls are
+// cancelled and answered as timeouts. The request context is also cancelled when the client goes away.
+func withDeadline(store *config.Store) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			timeout := store.Get().Server.OperationTimeout.Duration
+			if timeout <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func limitBody(next http.Handler, max int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLimitBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		max  int64
+		err  bool
+	}{
+		{name: "under the limit", body: `{"service_id": "s-1"}`, max: 1024},
+		{name: "at the limit", body: "1234", max: 4},
+		{name: "over the limit", body: "12345", max: 4, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var readErr error
+			handler := limitBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, readErr = ioutil.ReadAll(r.Body)
+			}), test.max)
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/", strings.NewReader(test.body)))
+			if (readErr != nil) != test.err {
+				t.Errorf("got error %v, want error %v", readErr, test.err)
+			}
+		})
+	}
+}
+
+func TestWithDeadline(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		deadline bool
+	}{
+		{name: "deadline", timeout: 20 * time.Second, deadline: true},
+		{name: "disabled", timeout: 0, deadline: false},
+	}
+	store := config.NewStore(config.Default(config.ScopeNamespaced))
+	handler := withDeadline(store)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the store is swapped as by a reload, the middleware reads the timeout of each request
+			cfg := *store.Get()
+			cfg.Server.OperationTimeout = metav1.Duration{Duration: test.timeout}
+			store.Set(&cfg)
+
+			var remaining time.Duration
+			var ok bool
+			handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var deadline time.Time
+				deadline, ok = r.Context().Deadline()
+				remaining = time.Until(deadline)
+			})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			if ok != test.deadline {
+				t.Fatalf("got deadline %v, want deadline %v", ok, test.deadline)
+			}
+			if ok && (remaining <= 0 || remaining > test.timeout) {
+				t.Errorf("deadline in %s, want it within %s", remaining, test.timeout)
+			}
+		})
+	}
+}
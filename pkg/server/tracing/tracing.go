@@ -0,0 +1,111 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	"github.com/gorilla/mux"
+	"github.com/tmax-cloud/template-service-broker-go/internal"
+	"github.com/tmax-cloud/template-service-broker-go/pkg/server/config"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Span attributes of OSB requests
+const (
+	AttributeServiceId  = "osb.service_id"
+	AttributePlanId     = "osb.plan_id"
+	AttributeInstanceId = "osb.instance_id"
+	AttributeBindingId  = "osb.binding_id"
+	AttributeNamespace  = "k8s.namespace.name"
+)
+
+// Setup installs the trace context propagator and, if an OTLP endpoint is configured, an exporting tracer provider.
+// Without an endpoint the global no-op provider stays, so spans cost next to nothing.
+// The returned func flushes the spans left on shutdown.
+func Setup(cfg config.TracingConfig, log logr.Logger) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if len(cfg.Endpoint) == 0 {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(cfg.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Error(err, "cannot export spans")
+	}))
+	log.Info("exporting spans", "endpoint", cfg.Endpoint, "sampleRatio", cfg.SampleRatio)
+	return provider.Shutdown, nil
+}
+
+// Middleware continues the trace of the platform and starts a span per request, named after the matched route
+func Middleware(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(withAttributes(next), "osb",
+		otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+			if route := mux.CurrentRoute(r); route != nil && len(route.GetName()) != 0 {
+				return route.GetName()
+			}
+			return operation
+		}))
+}
+
+// withAttributes adds the service, plan, instance and binding of the request to its span
+func withAttributes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := trace.SpanFromContext(r.Context())
+		if !span.IsRecording() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		vars := mux.Vars(r)
+		query := r.URL.Query()
+		ids := struct {
+			ServiceId string `json:"service_id"`
+			PlanId    string `json:"plan_id"`
+		}{
+			ServiceId: query.Get("service_id"),
+			PlanId:    query.Get("plan_id"),
+		}
+		if r.Method == http.MethodPut || r.Method == http.MethodPatch {
+			if body, err := internal.PeekBody(r); err == nil && len(body) != 0 {
+				json.Unmarshal(body, &ids)
+			}
+		}
+
+		for key, val := range map[string]string{
+			AttributeServiceId:  ids.ServiceId,
+			AttributePlanId:     ids.PlanId,
+			AttributeInstanceId: vars["instance_id"],
+			AttributeBindingId:  vars["binding_id"],
+			AttributeNamespace:  vars["namespace"],
+		} {
+			if len(val) != 0 {
+				span.SetAttributes(attribute.String(key, val))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}